@@ -3,6 +3,8 @@
 
 #include <stdint.h>
 
+typedef void (*core_event_callback)(const char* payload);
+
 char* WriteConfigFiles(const char* xrayPath,
                        const char* xrayContent,
                        const char* servicePath,
@@ -21,6 +23,10 @@ char* PerformAction(const char* action, const char* password);
 int32_t IsXrayDownloading(void);
 char* StartXray(const char* config);
 char* StopXray(void);
+char* GetEngineState(void);
+char* GetDesktopRuntimeSnapshot(void);
+char* PollCoreEvents(long long cursor);
+void RegisterCoreEventCallback(core_event_callback cb);
 long long StartXrayTunnel(const char* config);
 long long StartXrayTunnelWithFd(const char* config, int32_t tunFd, const char* interfaceName);
 char* GetLastXrayTunnelError(void);
@@ -32,4 +38,59 @@ char* StopXrayTunnel(long long handle);
 char* FreeXrayTunnel(long long handle);
 void FreeCString(char* str);
 
+// v2 exports return a JSON envelope:
+// {"ok":true,"data":...} or
+// {"ok":false,"error":{"code":"ALREADY_RUNNING","message":"...","retryable":false,"details":{...}}}
+char* WriteConfigFilesV2(const char* xrayPath,
+                         const char* xrayContent,
+                         const char* servicePath,
+                         const char* serviceContent,
+                         const char* vpnPath,
+                         const char* vpnContent,
+                         const char* password);
+char* LoadVpnNodes(const char* path);
+char* StartNodeServiceV2(const char* name);
+char* StopNodeServiceV2(const char* name);
+char* StartXrayV2(const char* config);
+char* StopXrayV2(void);
+char* StartXrayTunnelV2(const char* config);
+char* StartXrayTunnelWithFdV2(const char* config, int32_t tunFd, const char* interfaceName);
+char* StopXrayTunnelV2(long long handle);
+char* SwitchNode(const char* name);
+char* SwitchConfig(const char* config);
+char* ValidateXrayConfig(const char* config);
+char* RenderXrayConfig(const char* options);
+char* CompileDnsPolicy(const char* policy);
+char* StartArtifactDownload(const char* request);
+char* GetDownloadProgress(void);
+char* CancelDownload(const char* id);
+char* MeasureNodes(const char* names, const char* mode);
+char* RunSpeedTest(const char* options);
+char* CancelSpeedTest(void);
+char* RunLeakTest(const char* request);
+char* ListConnections(void);
+char* CloseConnection(const char* id);
+char* ImportShareLink(const char* uri);
+char* ExportNode(const char* name, const char* format);
+char* RefreshSubscription(const char* url);
+char* GetSubscription(const char* url);
+char* StartNodeInstance(const char* name);
+char* StopNodeInstance(const char* name);
+char* GetNodeInstance(const char* name);
+char* ListNodeInstances(void);
+char* ConfigureSupervisor(const char* config);
+char* ConfigureFailover(const char* config);
+char* GetFailoverStatus(void);
+char* SetCoreDataDir(const char* path);
+char* ListNodes(void);
+char* GetNode(const char* name);
+char* UpsertNode(const char* node);
+char* DeleteNode(const char* name);
+char* ConfigureVault(const char* options);
+char* UnlockVault(const char* passphrase);
+char* LockVault(void);
+char* GetVaultStatus(void);
+char* ReadVaultFile(const char* path);
+char* WriteVaultFile(const char* path, const char* content);
+
 #endif // BRIDGE_H
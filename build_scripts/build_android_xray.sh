@@ -93,6 +93,8 @@ if [[ ! -d "$TOOLCHAIN_BIN" ]]; then
   exit 1
 fi
 
+source "$ROOT_DIR/build_scripts/go_ldflags.sh"
+
 build_one() {
   local abi="$1"
   local goarch="$2"
@@ -115,8 +117,9 @@ build_one() {
       unset GOARM || true
     fi
     go build -trimpath -buildmode=c-shared \
+      -ldflags="$XSTREAM_GO_LDFLAGS" \
       -o "$outdir/libgo_native_bridge.so" \
-      ./bridge_android.go
+      .
   )
 }
 
@@ -41,8 +41,10 @@ export GOARCH=arm64
 export CC="$(xcrun --sdk iphoneos --find clang)"
 export CGO_CFLAGS="-isysroot $(xcrun --sdk iphoneos --show-sdk-path)"
 
+source "$DIR/build_scripts/go_ldflags.sh"
+
 "$GO_BIN" mod download
-"$GO_BIN" build -buildmode=c-archive -o "$OUTPUT_ARCHIVE" ./bridge_ios.go
+"$GO_BIN" build -buildmode=c-archive -ldflags="$XSTREAM_GO_LDFLAGS" -o "$OUTPUT_ARCHIVE" .
 
 echo ">>> Output archive: $OUTPUT_ARCHIVE"
 echo ">>> Output header: $OUTPUT_HEADER"
@@ -48,7 +48,10 @@ fi
 export CC
 export CXX
 
+# 链接参数（geodata 清单公钥）
+source "$DIR/build_scripts/go_ldflags.sh"
+
 echo ">>> Building Go shared library"
-CC=$CC GOOS=$GOOS GOARCH=$GOARCH go build -buildmode=c-shared -o "$FLUTTER_LIB_DIR/libgo_native_bridge.so"
+CC=$CC GOOS=$GOOS GOARCH=$GOARCH go build -buildmode=c-shared -ldflags="$XSTREAM_GO_LDFLAGS" -o "$FLUTTER_LIB_DIR/libgo_native_bridge.so"
 
 echo ">>> Build complete: $FLUTTER_LIB_DIR/libgo_native_bridge.so"
@@ -51,6 +51,8 @@ if [[ "${ARCH}" == "x86_64h" ]]; then
   ARCH="x86_64"
 fi
 
+source "${ROOT_DIR}/build_scripts/go_ldflags.sh"
+
 echo "[xray-bridge] building for darwin/${ARCH} -> ${TMP_LIB}"
 (
   cd "${GO_CORE_DIR}"
@@ -60,7 +62,7 @@ echo "[xray-bridge] building for darwin/${ARCH} -> ${TMP_LIB}"
   export CC="$(xcrun --sdk macosx --find clang)"
   export CGO_CFLAGS="-isysroot $(xcrun --sdk macosx --show-sdk-path)"
   export CGO_LDFLAGS="-isysroot $(xcrun --sdk macosx --show-sdk-path)"
-  "$GO_BIN" build -trimpath -buildmode=c-shared -o "${TMP_LIB}" ./bridge_ios.go
+  "$GO_BIN" build -trimpath -buildmode=c-shared -ldflags="${XSTREAM_GO_LDFLAGS}" -o "${TMP_LIB}" .
 )
 
 if [[ ! -f "${TMP_LIB}" ]]; then
@@ -56,7 +56,9 @@ fi
 
 export CC
 
+source "$DIR/build_scripts/go_ldflags.sh"
+
 GOOS=windows GOARCH=amd64 go build -buildmode=c-shared \
-  -ldflags="-linkmode external -extldflags '-static'" \
+  -ldflags="-linkmode external -extldflags '-static' $XSTREAM_GO_LDFLAGS" \
   -o ../bindings/libgo_native_bridge.dll \
-  ./bridge_windows.go
+  .
@@ -0,0 +1,18 @@
+#!/usr/bin/env bash
+# Sourced by the go_core build scripts. Sets XSTREAM_GO_LDFLAGS to the -X
+# flags every go_core build needs.
+#
+# XSTREAM_GEODATA_MANIFEST_PUBLIC_KEY is the base64 ed25519 key that signs the
+# geodata manifest on artifact.svc.plus. Without it the library refuses
+# geodata updates (UpdateGeodata returns UNSUPPORTED).
+
+XSTREAM_GO_LDFLAGS=""
+if [[ -n "${XSTREAM_GEODATA_MANIFEST_PUBLIC_KEY:-}" ]]; then
+  if ! printf '%s' "$XSTREAM_GEODATA_MANIFEST_PUBLIC_KEY" | base64 -d 2>/dev/null | wc -c | grep -qx ' *32'; then
+    echo "XSTREAM_GEODATA_MANIFEST_PUBLIC_KEY is not a base64 ed25519 public key" >&2
+    exit 1
+  fi
+  XSTREAM_GO_LDFLAGS="-X main.geodataManifestPublicKey=${XSTREAM_GEODATA_MANIFEST_PUBLIC_KEY}"
+else
+  echo "warning: XSTREAM_GEODATA_MANIFEST_PUBLIC_KEY is not set; geodata updates will be disabled in this build" >&2
+fi
@@ -0,0 +1,44 @@
+package main
+
+import "context"
+
+// PerformAction names handled by dispatchAction.
+const (
+	actionIsXrayDownloading = "isXrayDownloading"
+	actionDownloadProgress  = "getDownloadProgress"
+	actionUpdateGeodata     = "updateGeodata"
+	actionGeodataStatus     = "getGeodataStatus"
+	actionRollbackGeodata   = "rollbackGeodata"
+	actionRunSpeedTest      = "runSpeedTest"
+	actionCancelSpeedTest   = "cancelSpeedTest"
+	actionSpeedTestStatus   = "getSpeedTestStatus"
+)
+
+// dispatchAction backs PerformAction on every platform. Legacy actions keep
+// their v1 answers ("0"/"1", "error:..."); newer actions return a v2
+// envelope. password is only used by privileged platform actions.
+func dispatchAction(action, password string) string {
+	_ = password
+	switch action {
+	case actionIsXrayDownloading:
+		if downloads.active() {
+			return "1"
+		}
+		return "0"
+	case actionDownloadProgress:
+		return envelopeJSON(downloads.snapshot(), nil)
+	case actionUpdateGeodata:
+		return envelopeJSON(updateGeodata(context.Background()))
+	case actionGeodataStatus:
+		return envelopeJSON(getGeodataStatus())
+	case actionRollbackGeodata:
+		return envelopeJSON(rollbackGeodata())
+	case actionRunSpeedTest:
+		return envelopeJSON(speedTests.start(speedTestOptions{}))
+	case actionCancelSpeedTest:
+		return envelopeJSON(nil, speedTests.cancelRun())
+	case actionSpeedTestStatus:
+		return envelopeJSON(speedTests.snapshot(), nil)
+	}
+	return "error:unsupported"
+}
@@ -2,9 +2,25 @@ package main
 
 /*
 #include <stdlib.h>
+
+typedef void (*core_event_callback)(const char* payload);
+
+static inline void invoke_core_event_callback(core_event_callback cb, const char* payload) {
+    if (cb != NULL) {
+        cb(payload);
+    }
+}
 */
 import "C"
-import "unsafe"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"unsafe"
+)
 
 // FreeCString frees C strings returned from Go.
 //
@@ -13,4 +29,562 @@ func FreeCString(str *C.char) {
 	C.free(unsafe.Pointer(str))
 }
 
+func resultString(err error) *C.char {
+	if err != nil {
+		return C.CString("error:" + err.Error())
+	}
+	return C.CString("success")
+}
+
+func envelopeResult(data interface{}, err error) *C.char {
+	return C.CString(envelopeJSON(data, err))
+}
+
+//export WriteConfigFiles
+func WriteConfigFiles(xrayPathC, xrayContentC, servicePathC, serviceContentC, vpnPathC, vpnContentC, passwordC *C.char) *C.char {
+	_ = passwordC
+	return resultString(writeConfigFilesInternal(
+		C.GoString(xrayPathC), C.GoString(xrayContentC),
+		C.GoString(servicePathC), C.GoString(serviceContentC),
+		C.GoString(vpnPathC), C.GoString(vpnContentC),
+	))
+}
+
+// LoadVpnNodes reads vpn_nodes.json, migrating every record to the current
+// schemaVersion. Records that cannot be loaded are moved to the quarantine
+// sidecar (vpn_nodes.quarantine.json) and listed in data.quarantined; the
+// file is rewritten only when something changed.
+//
+//export LoadVpnNodes
+func LoadVpnNodes(pathC *C.char) *C.char {
+	return envelopeResult(loadVpnNodes(C.GoString(pathC)))
+}
+
+//export StartNodeService
+func StartNodeService(name *C.char) *C.char {
+	return resultString(startNode(C.GoString(name)))
+}
+
+//export StopNodeService
+func StopNodeService(name *C.char) *C.char {
+	return resultString(stopNode(C.GoString(name)))
+}
+
+//export CheckNodeStatus
+func CheckNodeStatus(name *C.char) C.int {
+	node := C.GoString(name)
+	if engine.isActive(node) || instances.running(node) {
+		return 1
+	}
+	return 0
+}
+
+//export StartXray
+func StartXray(configC *C.char) *C.char {
+	instMu.Lock()
+	defer instMu.Unlock()
+
+	cfgData := []byte(C.GoString(configC))
+	return resultString(startXrayInternal("", cfgData))
+}
+
+//export StopXray
+func StopXray() *C.char {
+	instMu.Lock()
+	defer instMu.Unlock()
+
+	return resultString(stopXrayInternal("stop requested"))
+}
+
+// ---- v2 exports: JSON envelope {"ok":bool,"data":...,"error":{code,message,retryable,details}} ----
+
+//export WriteConfigFilesV2
+func WriteConfigFilesV2(xrayPathC, xrayContentC, servicePathC, serviceContentC, vpnPathC, vpnContentC, passwordC *C.char) *C.char {
+	_ = passwordC
+	return envelopeResult(nil, writeConfigFilesInternal(
+		C.GoString(xrayPathC), C.GoString(xrayContentC),
+		C.GoString(servicePathC), C.GoString(serviceContentC),
+		C.GoString(vpnPathC), C.GoString(vpnContentC),
+	))
+}
+
+//export StartNodeServiceV2
+func StartNodeServiceV2(name *C.char) *C.char {
+	node := C.GoString(name)
+	if err := startNode(node); err != nil {
+		return envelopeResult(nil, err)
+	}
+	return envelopeResult(engine.snapshot(), nil)
+}
+
+//export StopNodeServiceV2
+func StopNodeServiceV2(name *C.char) *C.char {
+	if err := stopNode(C.GoString(name)); err != nil {
+		return envelopeResult(nil, err)
+	}
+	return envelopeResult(engine.snapshot(), nil)
+}
+
+//export StartXrayV2
+func StartXrayV2(configC *C.char) *C.char {
+	instMu.Lock()
+	err := startXrayInternal("", []byte(C.GoString(configC)))
+	instMu.Unlock()
+	if err != nil {
+		return envelopeResult(nil, err)
+	}
+	return envelopeResult(engine.snapshot(), nil)
+}
+
+//export StopXrayV2
+func StopXrayV2() *C.char {
+	instMu.Lock()
+	err := stopXrayInternal("stop requested")
+	instMu.Unlock()
+	if err != nil {
+		return envelopeResult(nil, err)
+	}
+	return envelopeResult(engine.snapshot(), nil)
+}
+
+// SwitchNode moves the core to the named node, restarting the previous
+// config if the new one does not come up.
+//
+//export SwitchNode
+func SwitchNode(name *C.char) *C.char {
+	result, err := switchNode(C.GoString(name), defaultSwitchTimeout)
+	return envelopeResult(result, err)
+}
+
+// SwitchConfig is SwitchNode for a raw xray JSON config.
+//
+//export SwitchConfig
+func SwitchConfig(configC *C.char) *C.char {
+	result, err := switchConfig("", []byte(C.GoString(configC)), defaultSwitchTimeout)
+	return envelopeResult(result, err)
+}
+
+// ValidateXrayConfig runs the xray-core loader over a config without
+// starting it and returns {"valid","errors":[{path,message}],"warnings":[...]}.
+//
+//export ValidateXrayConfig
+func ValidateXrayConfig(configC *C.char) *C.char {
+	payload, err := json.Marshal(validateXrayConfig([]byte(C.GoString(configC))))
+	if err != nil {
+		return C.CString(`{"valid":false,"errors":[{"path":"","message":"failed to encode report"}],"warnings":[]}`)
+	}
+	return C.CString(string(payload))
+}
+
+// RenderXrayConfig builds the complete runtime config for a node outbound
+// from {"node"|"outbound","mode","logLevel","inbounds","dns","routing",...}
+// and returns it as data.
+//
+//export RenderXrayConfig
+func RenderXrayConfig(optionsC *C.char) *C.char {
+	var opts renderOptions
+	if err := json.Unmarshal([]byte(C.GoString(optionsC)), &opts); err != nil {
+		return envelopeResult(nil, newCoreError(codeInvalidArgument, "invalid render options: "+err.Error(), false, nil))
+	}
+	return envelopeResult(renderXrayConfig(opts))
+}
+
+// CompileDnsPolicy compiles a DNS control plane (the dnsPolicy object of
+// RenderXrayConfig plus "mode") into the xray dns section, the routing rules
+// that must lead the rule list, fakeDns pools and sniffing destOverride.
+// Policies that would resolve a domain through one path and route it through
+// another fail with CONFIG_INVALID and the offending entries in
+// details.issues.
+//
+//export CompileDnsPolicy
+func CompileDnsPolicy(policyC *C.char) *C.char {
+	var req struct {
+		dnsControlPlane
+		Mode string `json:"mode"`
+	}
+	if err := json.Unmarshal([]byte(C.GoString(policyC)), &req); err != nil {
+		return envelopeResult(nil, newCoreError(codeInvalidArgument, "invalid DNS policy: "+err.Error(), false, nil))
+	}
+	return envelopeResult(compileDNSPolicy(req.dnsControlPlane, strings.EqualFold(req.Mode, renderModeTunnel)))
+}
+
+// IsXrayDownloading reports 1 while any runtime artifact (xray binary, geo
+// files, rule sets) is being downloaded.
+//
+//export IsXrayDownloading
+func IsXrayDownloading() C.int {
+	if downloads.active() {
+		return 1
+	}
+	return 0
+}
+
+// StartArtifactDownload starts fetching {kind, path, sha256, size?, dest?,
+// id?} from the artifact server in the background. Partial files are resumed
+// with HTTP range requests and only moved into dest after the sha256
+// matches. Progress arrives as download_progress events and through
+// GetDownloadProgress.
+//
+//export StartArtifactDownload
+func StartArtifactDownload(requestC *C.char) *C.char {
+	var req downloadRequest
+	if err := json.Unmarshal([]byte(C.GoString(requestC)), &req); err != nil {
+		return envelopeResult(nil, newCoreError(codeInvalidArgument, "invalid download request: "+err.Error(), false, nil))
+	}
+	return envelopeResult(startArtifactDownload(req))
+}
+
+// GetDownloadProgress lists running and recently finished downloads.
+//
+//export GetDownloadProgress
+func GetDownloadProgress() *C.char {
+	return envelopeResult(downloads.snapshot(), nil)
+}
+
+// CancelDownload stops a running download; its partial file is kept so the
+// next attempt resumes.
+//
+//export CancelDownload
+func CancelDownload(idC *C.char) *C.char {
+	return envelopeResult(nil, downloads.cancelDownload(C.GoString(idC)))
+}
+
+// MeasureNodes measures registered nodes concurrently in the background.
+// names is a JSON array (empty or "[]" for every node); mode is "tcp"
+// (connect time to the server), "real" (an HTTP request through a throwaway
+// xray instance built from the node's outbound) or "all". It returns the run
+// id at once; each result arrives as a node_measured event and the full list
+// as measure_finished.
+//
+//export MeasureNodes
+func MeasureNodes(namesC, modeC *C.char) *C.char {
+	var names []string
+	if raw := strings.TrimSpace(C.GoString(namesC)); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &names); err != nil {
+			return envelopeResult(nil, newCoreError(codeInvalidArgument, "names must be a JSON array of node names", false, nil))
+		}
+	}
+	return envelopeResult(startMeasureNodes(names, C.GoString(modeC)))
+}
+
+// RunSpeedTest measures time to first byte and download then upload
+// throughput through the running core's local inbound. options is
+// {"url","uploadUrl","durationMs","uploadBytes","skipUpload"}, all optional;
+// progress and the result arrive as speedtest_progress events.
+//
+//export RunSpeedTest
+func RunSpeedTest(optionsC *C.char) *C.char {
+	var opts speedTestOptions
+	if raw := strings.TrimSpace(C.GoString(optionsC)); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &opts); err != nil {
+			return envelopeResult(nil, newCoreError(codeInvalidArgument, "invalid speed test options: "+err.Error(), false, nil))
+		}
+	}
+	return envelopeResult(speedTests.start(opts))
+}
+
+// CancelSpeedTest stops the running speed test.
+//
+//export CancelSpeedTest
+func CancelSpeedTest() *C.char {
+	return envelopeResult(nil, speedTests.cancelRun())
+}
+
+// RunLeakTest checks, while connected, which egress IPs and resolvers A and
+// AAAA queries use and whether IPv6 bypasses the tunnel, and compares them
+// with the active DNS policy. request is {"probe": {...}, "system": {...}}:
+// the host's probe service and what the host app saw when it made the
+// system path requests itself.
+//
+//export RunLeakTest
+func RunLeakTest(requestC *C.char) *C.char {
+	var req leakTestRequest
+	if err := json.Unmarshal([]byte(C.GoString(requestC)), &req); err != nil {
+		return envelopeResult(nil, newCoreError(codeInvalidArgument, "invalid leak test request: "+err.Error(), false, nil))
+	}
+	return envelopeResult(leakTest(req))
+}
+
+// ListConnections returns the live connection table: source, destination,
+// sniffed domain and protocol, matched rule, outbound, bytes and age of every
+// open flow of the primary core.
+//
+//export ListConnections
+func ListConnections() *C.char {
+	return envelopeResult(connections.list(), nil)
+}
+
+// CloseConnection closes one flow from ListConnections by id.
+//
+//export CloseConnection
+func CloseConnection(idC *C.char) *C.char {
+	return envelopeResult(nil, connections.closeConnection(C.GoString(idC)))
+}
+
+// ImportShareLink parses a vless://, vmess://, trojan://, ss:// or
+// hysteria2:// link into node metadata plus an xray outbound.
+//
+//export ImportShareLink
+func ImportShareLink(uriC *C.char) *C.char {
+	return envelopeResult(parseShareLink(C.GoString(uriC)))
+}
+
+// ExportNode renders a registered node as a share link. format is "uri"
+// (default), "qr-png" or "qr-svg"; the QR formats add the base64 image in
+// data.data.
+//
+//export ExportNode
+func ExportNode(name, formatC *C.char) *C.char {
+	return envelopeResult(exportNode(C.GoString(name), C.GoString(formatC)))
+}
+
+// RefreshSubscription fetches a subscription URL (base64 link list, Clash
+// YAML or sing-box JSON), caches the result under the data dir and returns
+// the imported nodes with quota information.
+//
+//export RefreshSubscription
+func RefreshSubscription(urlC *C.char) *C.char {
+	return envelopeResult(refreshSubscription(context.Background(), C.GoString(urlC)))
+}
+
+// GetSubscription returns the cached result of the last refresh.
+//
+//export GetSubscription
+func GetSubscription(urlC *C.char) *C.char {
+	return envelopeResult(loadSubscription(strings.TrimSpace(C.GoString(urlC))))
+}
+
+// StartNodeInstance runs a registered node as an additional xray instance
+// alongside the primary core. Inbound ports that are already in use are moved
+// to free ports; data.inbounds lists the ports actually bound.
+//
+//export StartNodeInstance
+func StartNodeInstance(name *C.char) *C.char {
+	return envelopeResult(instances.start(C.GoString(name)))
+}
+
+//export StopNodeInstance
+func StopNodeInstance(name *C.char) *C.char {
+	return envelopeResult(nil, instances.stop(C.GoString(name)))
+}
+
+// GetNodeInstance reports the state and bound inbounds of a node, whether it
+// runs as the primary core or as an additional instance.
+//
+//export GetNodeInstance
+func GetNodeInstance(name *C.char) *C.char {
+	return envelopeResult(instances.status(C.GoString(name)))
+}
+
+//export ListNodeInstances
+func ListNodeInstances() *C.char {
+	return envelopeResult(instances.list(), nil)
+}
+
+// ConfigureSupervisor updates the automatic restart policy. Fields missing
+// from the JSON keep their current value; the effective policy is returned.
+//
+//export ConfigureSupervisor
+func ConfigureSupervisor(configC *C.char) *C.char {
+	cfg := coreSupervisor.config()
+	if raw := C.GoString(configC); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
+			return envelopeResult(nil, newCoreError(codeInvalidArgument, "invalid supervisor config: "+err.Error(), false, nil))
+		}
+	}
+	return envelopeResult(coreSupervisor.configure(cfg))
+}
+
+// ConfigureFailover updates the automatic node selection policy and starts or
+// stops its health checks. Fields missing from the JSON keep their current
+// value; the effective policy and last decision are returned.
+//
+//export ConfigureFailover
+func ConfigureFailover(configC *C.char) *C.char {
+	cfg := coreFailover.config()
+	if raw := C.GoString(configC); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
+			return envelopeResult(nil, newCoreError(codeInvalidArgument, "invalid failover config: "+err.Error(), false, nil))
+		}
+	}
+	return envelopeResult(coreFailover.configure(cfg))
+}
+
+// GetFailoverStatus returns the failover policy, its last decision and the
+// measurements behind it.
+//
+//export GetFailoverStatus
+func GetFailoverStatus() *C.char {
+	return envelopeResult(coreFailover.snapshot(), nil)
+}
+
+// SetCoreDataDir overrides the directory the core keeps its node registry and
+// other persistent state in. An empty path restores the platform default.
+//
+//export SetCoreDataDir
+func SetCoreDataDir(pathC *C.char) *C.char {
+	return envelopeResult(nil, setCoreDataDir(C.GoString(pathC)))
+}
+
+// ConfigureVault enables or disables encryption of node configs at rest with
+// {"enabled","keySource":"keyring"|"passphrase","passphrase"}. Enabling seals
+// the existing plaintext files; disabling decrypts them again.
+//
+//export ConfigureVault
+func ConfigureVault(optionsC *C.char) *C.char {
+	var opts vaultOptions
+	if err := json.Unmarshal([]byte(C.GoString(optionsC)), &opts); err != nil {
+		return envelopeResult(nil, newCoreError(codeInvalidArgument, "invalid vault options: "+err.Error(), false, nil))
+	}
+	return envelopeResult(vault.configure(opts))
+}
+
+// UnlockVault derives the key of a passphrase vault. Keyring vaults unlock on
+// first use; an empty passphrase forces that load.
+//
+//export UnlockVault
+func UnlockVault(passphraseC *C.char) *C.char {
+	return envelopeResult(vault.unlock(C.GoString(passphraseC)))
+}
+
+// LockVault forgets the key until the next unlock.
+//
+//export LockVault
+func LockVault() *C.char {
+	vault.lock()
+	return envelopeResult(vault.status())
+}
+
+//export GetVaultStatus
+func GetVaultStatus() *C.char {
+	return envelopeResult(vault.status())
+}
+
+// ReadVaultFile returns the plaintext of a file the vault may have encrypted,
+// such as vpn_nodes.json. Plaintext files are left as they are.
+//
+//export ReadVaultFile
+func ReadVaultFile(pathC *C.char) *C.char {
+	path := C.GoString(pathC)
+	data, _, err := openVaultFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = newCoreError(codeNotFound, "file not found", false, map[string]interface{}{"path": path})
+		}
+		return envelopeResult(nil, err)
+	}
+	return envelopeResult(string(data), nil)
+}
+
+// WriteVaultFile replaces path with content, encrypted when the vault is
+// enabled, for hosts that write vpn_nodes.json themselves.
+//
+//export WriteVaultFile
+func WriteVaultFile(pathC, contentC *C.char) *C.char {
+	return envelopeResult(nil, writeVaultFile(C.GoString(pathC), []byte(C.GoString(contentC)), 0o600))
+}
+
+// ListNodes returns the registered nodes without their configs.
+//
+//export ListNodes
+func ListNodes() *C.char {
+	return envelopeResult(nodes.list())
+}
+
+// GetNode returns a registered node including its xray config.
+//
+//export GetNode
+func GetNode(name *C.char) *C.char {
+	return envelopeResult(nodes.get(C.GoString(name)))
+}
+
+// UpsertNode stores {"name","config",...} in the registry, replacing any node
+// with the same name. The config is validated before it is written.
+//
+//export UpsertNode
+func UpsertNode(nodeC *C.char) *C.char {
+	var rec nodeRecord
+	if err := json.Unmarshal([]byte(C.GoString(nodeC)), &rec); err != nil {
+		return envelopeResult(nil, newCoreError(codeInvalidArgument, "invalid node: "+err.Error(), false, nil))
+	}
+	return envelopeResult(nodes.upsert(rec))
+}
+
+//export DeleteNode
+func DeleteNode(name *C.char) *C.char {
+	return envelopeResult(nil, nodes.remove(C.GoString(name)))
+}
+
+// GetDesktopRuntimeSnapshot reports whether the core runs, traffic rates,
+// process memory/CPU and Go heap statistics as JSON. The name is kept for
+// compatibility; it is available on every platform.
+//
+//export GetDesktopRuntimeSnapshot
+func GetDesktopRuntimeSnapshot() *C.char {
+	payload, err := json.Marshal(collectRuntimeSnapshot())
+	if err != nil {
+		return C.CString("{}")
+	}
+	return C.CString(string(payload))
+}
+
+// GetEngineState returns the core lifecycle state, active node and the
+// recent transition history as JSON.
+//
+//export GetEngineState
+func GetEngineState() *C.char {
+	payload, err := json.Marshal(engine.snapshot())
+	if err != nil {
+		return C.CString("{}")
+	}
+	return C.CString(string(payload))
+}
+
+// PollCoreEvents returns events newer than cursor as JSON. Hosts pass the
+// returned cursor back on the next call; start with 0.
+//
+//export PollCoreEvents
+func PollCoreEvents(cursor C.longlong) *C.char {
+	payload, err := json.Marshal(coreEvents.poll(int64(cursor), 0))
+	if err != nil {
+		return C.CString(`{"cursor":0,"events":[]}`)
+	}
+	return C.CString(string(payload))
+}
+
+var (
+	eventCallbackMu   sync.Mutex
+	eventCallback     C.core_event_callback
+	eventCallbackOnce sync.Once
+)
+
+// RegisterCoreEventCallback installs a C callback that receives every event
+// as JSON. The payload is only valid for the duration of the call. Passing
+// NULL removes the callback.
+//
+//export RegisterCoreEventCallback
+func RegisterCoreEventCallback(cb C.core_event_callback) {
+	eventCallbackMu.Lock()
+	eventCallback = cb
+	eventCallbackMu.Unlock()
+
+	eventCallbackOnce.Do(func() {
+		coreEvents.subscribe(func(event coreEvent) {
+			eventCallbackMu.Lock()
+			cb := eventCallback
+			eventCallbackMu.Unlock()
+			if cb == nil {
+				return
+			}
+			payload, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			cPayload := C.CString(string(payload))
+			C.invoke_core_event_callback(cb, cPayload)
+			C.free(unsafe.Pointer(cPayload))
+		})
+	})
+}
+
 func main() {}
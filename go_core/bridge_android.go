@@ -9,211 +9,106 @@ import "C"
 import (
 	"errors"
 	"os"
-	"path/filepath"
 	"strconv"
 	"sync"
 	"sync/atomic"
-	"unsafe"
 
-	"github.com/xtls/libxray/xray"
 	"github.com/xtls/xray-core/common/platform"
 )
 
-var androidProcMap sync.Map
-var androidInstMu sync.Mutex
 var androidTunnelSeq atomic.Int64
 var androidTunnelSession sync.Map
 
-func androidStartXrayInternal(cfgData []byte) error {
-	if xray.GetXrayState() {
-		return errors.New("already running")
-	}
-	return xray.RunXrayFromJSON("", "", string(cfgData))
+// platformConfigDir is only a fallback; the app passes its files dir through
+// SetCoreDataDir because HOME is not set inside the app process.
+func platformConfigDir() string {
+	return userConfigSubdir("xstream")
 }
 
-func androidStopXrayInternal() error {
-	if !xray.GetXrayState() {
-		return errors.New("not running")
+func startTunnelInternal(cfgData []byte) (int64, error) {
+	instMu.Lock()
+	defer instMu.Unlock()
+
+	if err := startXrayInternal("", cfgData); err != nil {
+		publishEvent(eventTunnelError, "", err.Error(), nil)
+		return -1, err
 	}
-	return xray.StopXray()
-}
 
-func clearAndroidNodeRegistry() {
-	androidProcMap.Range(func(key, value any) bool {
-		androidProcMap.Delete(key)
-		return true
-	})
+	handle := androidTunnelSeq.Add(1)
+	androidTunnelSession.Store(handle, true)
+	return handle, nil
 }
 
-//export WriteConfigFiles
-func WriteConfigFiles(xrayPathC, xrayContentC, servicePathC, serviceContentC, vpnPathC, vpnContentC, passwordC *C.char) *C.char {
-	_ = passwordC
-	xrayPath := C.GoString(xrayPathC)
-	xrayContent := C.GoString(xrayContentC)
-	servicePath := C.GoString(servicePathC)
-	serviceContent := C.GoString(serviceContentC)
-	vpnPath := C.GoString(vpnPathC)
-	vpnContent := C.GoString(vpnContentC)
-
-	if err := os.MkdirAll(filepath.Dir(xrayPath), 0o755); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	if err := os.WriteFile(xrayPath, []byte(xrayContent), 0o644); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	if err := os.MkdirAll(filepath.Dir(servicePath), 0o755); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	if err := os.WriteFile(servicePath, []byte(serviceContent), 0o644); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	if err := os.MkdirAll(filepath.Dir(vpnPath), 0o755); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	if err := os.WriteFile(vpnPath, []byte(vpnContent), 0o644); err != nil {
-		return C.CString("error:" + err.Error())
+func startTunnelWithFdInternal(cfgData []byte, fd int) (int64, error) {
+	if fd <= 0 {
+		err := newCoreError(codeTunFdInvalid, "invalid tun fd", false, map[string]interface{}{"fd": fd})
+		publishEvent(eventTunnelError, "", err.Message, nil)
+		return -1, err
 	}
-	return C.CString("success")
-}
 
-//export StartNodeService
-func StartNodeService(name *C.char) *C.char {
-	androidInstMu.Lock()
-	defer androidInstMu.Unlock()
+	instMu.Lock()
+	defer instMu.Unlock()
 
-	node := C.GoString(name)
-	if _, ok := androidProcMap.Load(node); ok && xray.GetXrayState() {
-		return C.CString("success")
-	}
-	if xray.GetXrayState() {
-		return C.CString("error:already running")
+	if engine.running() {
+		return -1, errAlreadyRunning
 	}
 
-	configPath := filepath.Join(os.TempDir(), node+".json")
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	if err := androidStartXrayInternal(data); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	androidProcMap.Store(node, true)
-	return C.CString("success")
-}
-
-//export StopNodeService
-func StopNodeService(name *C.char) *C.char {
-	androidInstMu.Lock()
-	defer androidInstMu.Unlock()
+	_ = os.Setenv(platform.TunFdKey, strconv.Itoa(fd))
+	_ = os.Setenv(platform.NormalizeEnvName(platform.TunFdKey), strconv.Itoa(fd))
 
-	node := C.GoString(name)
-	if _, ok := androidProcMap.Load(node); ok {
-		if xray.GetXrayState() {
-			if err := androidStopXrayInternal(); err != nil {
-				return C.CString("error:" + err.Error())
-			}
-		}
-		androidProcMap.Delete(node)
-		return C.CString("success")
+	if err := startXrayInternal("", cfgData); err != nil {
+		clearTunFdEnv()
+		publishEvent(eventTunnelError, "", err.Error(), nil)
+		return -1, err
 	}
-	if xray.GetXrayState() {
-		if err := androidStopXrayInternal(); err != nil {
-			return C.CString("error:" + err.Error())
-		}
-	}
-	clearAndroidNodeRegistry()
-	return C.CString("success")
-}
 
-//export CheckNodeStatus
-func CheckNodeStatus(name *C.char) C.int {
-	node := C.GoString(name)
-	if _, ok := androidProcMap.Load(node); ok && xray.GetXrayState() {
-		return 1
-	}
-	return 0
+	handle := androidTunnelSeq.Add(1)
+	androidTunnelSession.Store(handle, fd)
+	return handle, nil
 }
 
-//export StartXray
-func StartXray(configC *C.char) *C.char {
-	androidInstMu.Lock()
-	defer androidInstMu.Unlock()
+func stopTunnelInternal(id int64) error {
+	instMu.Lock()
+	defer instMu.Unlock()
 
-	if xray.GetXrayState() {
-		return C.CString("error:already running")
+	if id <= 0 {
+		return newCoreError(codeInvalidArgument, "invalid handle", false, map[string]interface{}{"handle": id})
 	}
-	cfgData := []byte(C.GoString(configC))
-	if err := androidStartXrayInternal(cfgData); err != nil {
-		return C.CString("error:" + err.Error())
+	if _, ok := androidTunnelSession.Load(id); !ok {
+		return newCoreError(codeSessionNotFound, "session not found", false, map[string]interface{}{"handle": id})
 	}
-	return C.CString("success")
-}
-
-//export StopXray
-func StopXray() *C.char {
-	androidInstMu.Lock()
-	defer androidInstMu.Unlock()
+	androidTunnelSession.Delete(id)
 
-	if !xray.GetXrayState() {
-		return C.CString("error:not running")
+	if err := stopXrayInternal("tunnel stopped"); err != nil && !errors.Is(err, errNotRunning) {
+		return err
 	}
-	if err := androidStopXrayInternal(); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	_ = os.Unsetenv(platform.TunFdKey)
-	_ = os.Unsetenv(platform.NormalizeEnvName(platform.TunFdKey))
-	clearAndroidNodeRegistry()
-	return C.CString("success")
+	return nil
 }
 
 //export StartXrayTunnel
 func StartXrayTunnel(configC *C.char) C.longlong {
-	androidInstMu.Lock()
-	defer androidInstMu.Unlock()
-
-	if xray.GetXrayState() {
-		return C.longlong(-1)
-	}
-
-	cfgData := []byte(C.GoString(configC))
-	if err := androidStartXrayInternal(cfgData); err != nil {
-		return C.longlong(-1)
-	}
-
-	handle := androidTunnelSeq.Add(1)
-	androidTunnelSession.Store(handle, true)
+	handle, _ := startTunnelInternal([]byte(C.GoString(configC)))
 	return C.longlong(handle)
 }
 
+//export StartXrayTunnelV2
+func StartXrayTunnelV2(configC *C.char) *C.char {
+	handle, err := startTunnelInternal([]byte(C.GoString(configC)))
+	return envelopeResult(map[string]interface{}{"handle": handle}, err)
+}
+
 //export StartXrayTunnelWithFd
 func StartXrayTunnelWithFd(configC *C.char, tunFd C.int32_t) C.longlong {
-	fd := int(tunFd)
-	if fd <= 0 {
-		return C.longlong(-1)
-	}
-
-	androidInstMu.Lock()
-	defer androidInstMu.Unlock()
-
-	if xray.GetXrayState() {
-		return C.longlong(-1)
-	}
-
-	_ = os.Setenv(platform.TunFdKey, strconv.Itoa(fd))
-	_ = os.Setenv(platform.NormalizeEnvName(platform.TunFdKey), strconv.Itoa(fd))
-
-	cfgData := []byte(C.GoString(configC))
-	if err := androidStartXrayInternal(cfgData); err != nil {
-		_ = os.Unsetenv(platform.TunFdKey)
-		_ = os.Unsetenv(platform.NormalizeEnvName(platform.TunFdKey))
-		return C.longlong(-1)
-	}
-
-	handle := androidTunnelSeq.Add(1)
-	androidTunnelSession.Store(handle, fd)
+	handle, _ := startTunnelWithFdInternal([]byte(C.GoString(configC)), int(tunFd))
 	return C.longlong(handle)
 }
 
+//export StartXrayTunnelWithFdV2
+func StartXrayTunnelWithFdV2(configC *C.char, tunFd C.int32_t) *C.char {
+	handle, err := startTunnelWithFdInternal([]byte(C.GoString(configC)), int(tunFd))
+	return envelopeResult(map[string]interface{}{"handle": handle}, err)
+}
+
 //export SubmitInboundPacket
 func SubmitInboundPacket(handle C.longlong, data *C.uint8_t, length C.int32_t, protocol C.int32_t) C.int32_t {
 	_ = data
@@ -227,7 +122,7 @@ func SubmitInboundPacket(handle C.longlong, data *C.uint8_t, length C.int32_t, p
 	if _, ok := androidTunnelSession.Load(id); !ok {
 		return C.int32_t(-1)
 	}
-	if !xray.GetXrayState() {
+	if !engine.running() {
 		return C.int32_t(-1)
 	}
 
@@ -237,27 +132,12 @@ func SubmitInboundPacket(handle C.longlong, data *C.uint8_t, length C.int32_t, p
 
 //export StopXrayTunnel
 func StopXrayTunnel(handle C.longlong) *C.char {
-	androidInstMu.Lock()
-	defer androidInstMu.Unlock()
-
-	id := int64(handle)
-	if id <= 0 {
-		return C.CString("error:invalid handle")
-	}
-	if _, ok := androidTunnelSession.Load(id); !ok {
-		return C.CString("error:session not found")
-	}
-	androidTunnelSession.Delete(id)
+	return resultString(stopTunnelInternal(int64(handle)))
+}
 
-	if xray.GetXrayState() {
-		if err := androidStopXrayInternal(); err != nil {
-			return C.CString("error:" + err.Error())
-		}
-	}
-	_ = os.Unsetenv(platform.TunFdKey)
-	_ = os.Unsetenv(platform.NormalizeEnvName(platform.TunFdKey))
-	clearAndroidNodeRegistry()
-	return C.CString("success")
+//export StopXrayTunnelV2
+func StopXrayTunnelV2(handle C.longlong) *C.char {
+	return envelopeResult(nil, stopTunnelInternal(int64(handle)))
 }
 
 //export FreeXrayTunnel
@@ -280,18 +160,5 @@ func CreateWindowsService(name, execPath, configPath *C.char) *C.char {
 
 //export PerformAction
 func PerformAction(action, password *C.char) *C.char {
-	_ = password
-	act := C.GoString(action)
-	if act == "isXrayDownloading" {
-		return C.CString("0")
-	}
-	return C.CString("error:unsupported")
+	return C.CString(dispatchAction(C.GoString(action), C.GoString(password)))
 }
-
-//export IsXrayDownloading
-func IsXrayDownloading() C.int { return 0 }
-
-//export FreeCString
-func FreeCString(str *C.char) { C.free(unsafe.Pointer(str)) }
-
-func main() {}
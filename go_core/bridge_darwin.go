@@ -0,0 +1,184 @@
+//go:build darwin
+
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var tunnelSeq atomic.Int64
+var tunnelSession sync.Map
+var tunnelLastError atomic.Value
+
+// platformConfigDir resolves to ~/Library/Application Support/plus.svc.xstream
+// on macOS. Sandboxed iOS extensions should use SetCoreDataDir with the app
+// group container instead.
+func platformConfigDir() string {
+	return userConfigSubdir("plus.svc.xstream")
+}
+
+func setTunnelLastError(msg string) {
+	tunnelLastError.Store(msg)
+	if msg != "" {
+		publishEvent(eventTunnelError, "", msg, nil)
+	}
+}
+
+func getTunnelLastError() string {
+	if value := tunnelLastError.Load(); value != nil {
+		if text, ok := value.(string); ok {
+			return text
+		}
+	}
+	return ""
+}
+
+func injectSockoptInterface(cfgData []byte, iface string) []byte {
+	if iface == "" {
+		return cfgData
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(cfgData, &doc); err != nil {
+		return cfgData
+	}
+
+	outbounds, ok := doc["outbounds"].([]interface{})
+	if !ok {
+		return cfgData
+	}
+	for i, ob := range outbounds {
+		obMap, ok := ob.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		streamSettings, ok := obMap["streamSettings"].(map[string]interface{})
+		if !ok {
+			streamSettings = make(map[string]interface{})
+			obMap["streamSettings"] = streamSettings
+		}
+		sockopt, ok := streamSettings["sockopt"].(map[string]interface{})
+		if !ok {
+			sockopt = make(map[string]interface{})
+			streamSettings["sockopt"] = sockopt
+		}
+		sockopt["interface"] = iface
+		outbounds[i] = obMap
+	}
+	if modifiedBytes, err := json.Marshal(doc); err == nil {
+		return modifiedBytes
+	}
+	return cfgData
+}
+
+func startTunnelWithFdInternal(cfgData []byte, fd int, iface string) (int64, error) {
+	instMu.Lock()
+	defer instMu.Unlock()
+
+	if engine.running() {
+		setTunnelLastError("xray already running")
+		return -1, errAlreadyRunning
+	}
+
+	if fd < 0 {
+		setTunnelLastError("invalid tun fd")
+		return -1, newCoreError(codeTunFdInvalid, "invalid tun fd", false, map[string]interface{}{"fd": fd})
+	}
+
+	// Set Xray TUN file descriptor environment variable natively supported by libxray's Darwin TUN implementation
+	os.Setenv("xray.tun.fd", strconv.Itoa(fd))
+
+	if iface != "" {
+		cfgData = injectSockoptInterface(cfgData, iface)
+	}
+
+	if err := startXrayInternal("", cfgData); err != nil {
+		setTunnelLastError(err.Error())
+		return -1, err
+	}
+
+	setTunnelLastError("")
+	handle := tunnelSeq.Add(1)
+	tunnelSession.Store(handle, true)
+	return handle, nil
+}
+
+func stopTunnelInternal(id int64) error {
+	instMu.Lock()
+	defer instMu.Unlock()
+
+	if id <= 0 {
+		return newCoreError(codeInvalidArgument, "invalid handle", false, map[string]interface{}{"handle": id})
+	}
+	if _, ok := tunnelSession.Load(id); !ok {
+		return newCoreError(codeSessionNotFound, "session not found", false, map[string]interface{}{"handle": id})
+	}
+	tunnelSession.Delete(id)
+
+	if err := stopXrayInternal("tunnel stopped"); err != nil && !errors.Is(err, errNotRunning) {
+		return err
+	}
+	return nil
+}
+
+func tunnelInterfaceName(interfaceC *C.char) string {
+	if interfaceC == nil {
+		return ""
+	}
+	return C.GoString(interfaceC)
+}
+
+//export StartXrayTunnelWithFd
+func StartXrayTunnelWithFd(configC *C.char, fd C.int, interfaceC *C.char) C.longlong {
+	handle, _ := startTunnelWithFdInternal([]byte(C.GoString(configC)), int(fd), tunnelInterfaceName(interfaceC))
+	return C.longlong(handle)
+}
+
+//export StartXrayTunnelWithFdV2
+func StartXrayTunnelWithFdV2(configC *C.char, fd C.int, interfaceC *C.char) *C.char {
+	handle, err := startTunnelWithFdInternal([]byte(C.GoString(configC)), int(fd), tunnelInterfaceName(interfaceC))
+	return envelopeResult(map[string]interface{}{"handle": handle}, err)
+}
+
+//export GetLastXrayTunnelError
+func GetLastXrayTunnelError() *C.char {
+	return C.CString(getTunnelLastError())
+}
+
+//export StopXrayTunnel
+func StopXrayTunnel(handle C.longlong) *C.char {
+	return resultString(stopTunnelInternal(int64(handle)))
+}
+
+//export StopXrayTunnelV2
+func StopXrayTunnelV2(handle C.longlong) *C.char {
+	return envelopeResult(nil, stopTunnelInternal(int64(handle)))
+}
+
+//export FreeXrayTunnel
+func FreeXrayTunnel(handle C.longlong) *C.char {
+	id := int64(handle)
+	if id <= 0 {
+		return C.CString("error:invalid handle")
+	}
+	tunnelSession.Delete(id)
+	return C.CString("success")
+}
+
+//export CreateWindowsService
+func CreateWindowsService(name, execPath, configPath *C.char) *C.char {
+	return C.CString("error:not supported")
+}
+
+//export PerformAction
+func PerformAction(action, password *C.char) *C.char {
+	return C.CString(dispatchAction(C.GoString(action), C.GoString(password)))
+}
@@ -1,4 +1,4 @@
-//go:build linux
+//go:build linux && !android
 
 package main
 
@@ -74,18 +74,15 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 	"unsafe"
 
 	"github.com/getlantern/systray"
-	"github.com/xtls/libxray/xray"
 )
 
-var procMap sync.Map
-var instMu sync.Mutex
-
 type desktopIntegrationRequest struct {
 	Action   string `json:"action"`
 	Enable   bool   `json:"enable,omitempty"`
@@ -104,27 +101,6 @@ type desktopIntegrationResponse struct {
 	HelperPath         string `json:"helperPath,omitempty"`
 }
 
-func startXrayInternal(cfgData []byte) error {
-	if xray.GetXrayState() {
-		return errors.New("already running")
-	}
-	return xray.RunXrayFromJSON("", "", string(cfgData))
-}
-
-func stopXrayInternal() error {
-	if !xray.GetXrayState() {
-		return errors.New("not running")
-	}
-	return xray.StopXray()
-}
-
-func clearNodeRegistry() {
-	procMap.Range(func(key, value any) bool {
-		procMap.Delete(key)
-		return true
-	})
-}
-
 func desktopIntegrationResult(resp desktopIntegrationResponse) *C.char {
 	data, err := json.Marshal(resp)
 	if err != nil {
@@ -165,6 +141,62 @@ func linuxConfigDir() string {
 	return filepath.Join(dir, "xstream")
 }
 
+func platformConfigDir() string {
+	return linuxConfigDir()
+}
+
+// linuxUserHZ is the USER_HZ tick rate /proc reports CPU times in; it is
+// fixed at 100 by the kernel ABI.
+const linuxUserHZ = 100
+
+// processMemoryBytes reports the resident set size from /proc/self/status.
+func processMemoryBytes() *int64 {
+	data, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "VmRSS:") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "VmRSS:"))
+		if len(fields) == 0 {
+			return nil
+		}
+		kb, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil
+		}
+		value := kb * 1024
+		return &value
+	}
+	return nil
+}
+
+// processCPUTime reads utime and stime from /proc/self/stat.
+func processCPUTime() (time.Duration, bool) {
+	data, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return 0, false
+	}
+	// The command name may contain spaces, so fields are counted from the
+	// closing parenthesis; utime and stime are fields 14 and 15.
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return 0, false
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 13 {
+		return 0, false
+	}
+	utime, err1 := strconv.ParseUint(fields[11], 10, 64)
+	stime, err2 := strconv.ParseUint(fields[12], 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, false
+	}
+	return time.Duration(utime+stime) * time.Second / linuxUserHZ, true
+}
+
 func linuxAutostartDesktopFile() string {
 	dir, err := os.UserConfigDir()
 	if err != nil || dir == "" {
@@ -536,149 +568,9 @@ func DesktopIntegrationCommand(requestC *C.char) *C.char {
 	return desktopIntegrationResult(resp)
 }
 
-//export WriteConfigFiles
-func WriteConfigFiles(xrayPathC, xrayContentC, servicePathC, serviceContentC, vpnPathC, vpnContentC, passwordC *C.char) *C.char {
-	xrayPath := C.GoString(xrayPathC)
-	xrayContent := C.GoString(xrayContentC)
-	servicePath := C.GoString(servicePathC)
-	serviceContent := C.GoString(serviceContentC)
-	vpnPath := C.GoString(vpnPathC)
-	vpnContent := C.GoString(vpnContentC)
-	_ = passwordC
-
-	if err := os.MkdirAll(filepath.Dir(xrayPath), 0755); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	if err := os.WriteFile(xrayPath, []byte(xrayContent), 0644); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	if err := os.MkdirAll(filepath.Dir(servicePath), 0755); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	if err := os.WriteFile(servicePath, []byte(serviceContent), 0644); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	if err := os.MkdirAll(filepath.Dir(vpnPath), 0755); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	var existing []map[string]interface{}
-	if data, err := os.ReadFile(vpnPath); err == nil {
-		json.Unmarshal(data, &existing)
-	}
-	var newNodes []map[string]interface{}
-	if err := json.Unmarshal([]byte(vpnContent), &newNodes); err == nil {
-		existing = append(existing, newNodes...)
-	} else {
-		return C.CString("error:invalid vpn node content")
-	}
-	updated, _ := json.MarshalIndent(existing, "", "  ")
-	if err := os.WriteFile(vpnPath, updated, 0644); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	return C.CString("success")
-}
-
-//export StartNodeService
-func StartNodeService(name *C.char) *C.char {
-	instMu.Lock()
-	defer instMu.Unlock()
-
-	node := C.GoString(name)
-	if _, ok := procMap.Load(node); ok && xray.GetXrayState() {
-		return C.CString("success")
-	}
-	if xray.GetXrayState() {
-		return C.CString("error:already running")
-	}
-
-	configPath := filepath.Join(os.TempDir(), node+".json")
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	if err := startXrayInternal(data); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	procMap.Store(node, true)
-	return C.CString("success")
-}
-
-//export StopNodeService
-func StopNodeService(name *C.char) *C.char {
-	instMu.Lock()
-	defer instMu.Unlock()
-
-	node := C.GoString(name)
-	if _, ok := procMap.Load(node); ok {
-		if xray.GetXrayState() {
-			if err := stopXrayInternal(); err != nil {
-				return C.CString("error:" + err.Error())
-			}
-		}
-		procMap.Delete(node)
-		return C.CString("success")
-	}
-	if xray.GetXrayState() {
-		if err := stopXrayInternal(); err != nil {
-			return C.CString("error:" + err.Error())
-		}
-	}
-	clearNodeRegistry()
-	return C.CString("success")
-}
-
-//export CheckNodeStatus
-func CheckNodeStatus(name *C.char) C.int {
-	node := C.GoString(name)
-	if _, ok := procMap.Load(node); ok && xray.GetXrayState() {
-		return 1
-	}
-	return 0
-}
-
 //export PerformAction
 func PerformAction(action, password *C.char) *C.char {
-	act := C.GoString(action)
-	if act == "isXrayDownloading" {
-		return C.CString("0")
-	}
-	return C.CString("error:unsupported")
-}
-
-//export IsXrayDownloading
-func IsXrayDownloading() C.int { return 0 }
-
-//export FreeCString
-func FreeCString(str *C.char) { C.free(unsafe.Pointer(str)) }
-
-//export StartXray
-func StartXray(configC *C.char) *C.char {
-	instMu.Lock()
-	defer instMu.Unlock()
-
-	if xray.GetXrayState() {
-		return C.CString("error:already running")
-	}
-	cfgData := []byte(C.GoString(configC))
-	if err := startXrayInternal(cfgData); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	return C.CString("success")
-}
-
-//export StopXray
-func StopXray() *C.char {
-	instMu.Lock()
-	defer instMu.Unlock()
-
-	if !xray.GetXrayState() {
-		return C.CString("error:not running")
-	}
-	if err := stopXrayInternal(); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	clearNodeRegistry()
-	return C.CString("success")
+	return C.CString(dispatchAction(C.GoString(action), C.GoString(password)))
 }
 
 // ---- System tray integration ----
@@ -7,8 +7,6 @@ package main
 */
 import "C"
 import (
-	"encoding/json"
-	"errors"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -17,35 +15,16 @@ import (
 	"unsafe"
 
 	"github.com/getlantern/systray"
-	"github.com/xtls/libxray/xray"
 	"golang.org/x/sys/windows"
 )
 
-var procMap sync.Map
-var instMu sync.Mutex
-var runtimeStatsMu sync.Mutex
-var lastCPUProcessTime uint64
-var lastCPUWallTime time.Time
-
-func startXrayInternal(cfgData []byte) error {
-	if xray.GetXrayState() {
-		return errors.New("already running")
+// platformConfigDir matches the LOCALAPPDATA\Xstream directory the Flutter
+// host falls back to for per-user data.
+func platformConfigDir() string {
+	if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+		return filepath.Join(dir, "Xstream")
 	}
-	return xray.RunXrayFromJSON("", "", string(cfgData))
-}
-
-func stopXrayInternal() error {
-	if !xray.GetXrayState() {
-		return errors.New("not running")
-	}
-	return xray.StopXray()
-}
-
-func clearNodeRegistry() {
-	procMap.Range(func(key, value any) bool {
-		procMap.Delete(key)
-		return true
-	})
+	return userConfigSubdir("Xstream")
 }
 
 type processMemoryCounters struct {
@@ -61,20 +40,11 @@ type processMemoryCounters struct {
 	PeakPagefileUsage          uintptr
 }
 
-type desktopRuntimeSnapshot struct {
-	Running                bool     `json:"running"`
-	DownloadBytesPerSecond *int     `json:"downloadBytesPerSecond,omitempty"`
-	UploadBytesPerSecond   *int     `json:"uploadBytesPerSecond,omitempty"`
-	MemoryBytes            *int64   `json:"memoryBytes,omitempty"`
-	CPUPercent             *float64 `json:"cpuPercent,omitempty"`
-	UpdatedAt              int64    `json:"updatedAt"`
-}
-
 func filetimeToUint64(value windows.Filetime) uint64 {
 	return uint64(value.HighDateTime)<<32 | uint64(value.LowDateTime)
 }
 
-func currentWorkingSetBytes() *int64 {
+func processMemoryBytes() *int64 {
 	psapi := windows.NewLazySystemDLL("psapi.dll")
 	proc := psapi.NewProc("GetProcessMemoryInfo")
 	counters := processMemoryCounters{CB: uint32(unsafe.Sizeof(processMemoryCounters{}))}
@@ -90,7 +60,8 @@ func currentWorkingSetBytes() *int64 {
 	return &value
 }
 
-func currentCPUPercent() *float64 {
+// processCPUTime returns the kernel plus user time of the process.
+func processCPUTime() (time.Duration, bool) {
 	var creation windows.Filetime
 	var exit windows.Filetime
 	var kernel windows.Filetime
@@ -102,89 +73,10 @@ func currentCPUPercent() *float64 {
 		&kernel,
 		&user,
 	); err != nil {
-		return nil
-	}
-
-	processTime := filetimeToUint64(kernel) + filetimeToUint64(user)
-	now := time.Now()
-
-	runtimeStatsMu.Lock()
-	defer runtimeStatsMu.Unlock()
-
-	if lastCPUWallTime.IsZero() {
-		lastCPUWallTime = now
-		lastCPUProcessTime = processTime
-		return nil
-	}
-
-	wallDelta := now.Sub(lastCPUWallTime)
-	processDelta := processTime - lastCPUProcessTime
-	lastCPUWallTime = now
-	lastCPUProcessTime = processTime
-	if wallDelta <= 0 {
-		return nil
-	}
-
-	wallTicks := float64(wallDelta.Nanoseconds()) / 100
-	if wallTicks <= 0 {
-		return nil
-	}
-	percent := (float64(processDelta) / wallTicks) * 100
-	if runtime.NumCPU() > 0 {
-		percent /= float64(runtime.NumCPU())
-	}
-	if percent < 0 {
-		percent = 0
-	}
-	return &percent
-}
-
-//export WriteConfigFiles
-func WriteConfigFiles(xrayPath, xrayContent, servicePath, serviceContent, vpnPath, vpnContent, password *C.char) *C.char {
-	if res := writeConfigFile(xrayPath, xrayContent); res != nil {
-		return res
-	}
-	if res := writeConfigFile(servicePath, serviceContent); res != nil {
-		return res
-	}
-	return updateVpnNodesConfig(vpnPath, vpnContent)
-}
-
-func writeConfigFile(pathC, contentC *C.char) *C.char {
-	p := C.GoString(pathC)
-	c := C.GoString(contentC)
-	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	if err := os.WriteFile(p, []byte(c), 0644); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	return nil
-}
-
-func updateVpnNodesConfig(pathC, contentC *C.char) *C.char {
-	p := C.GoString(pathC)
-	c := C.GoString(contentC)
-	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	var nodes []map[string]interface{}
-	if data, err := os.ReadFile(p); err == nil {
-		json.Unmarshal(data, &nodes)
-	}
-	var newNodes []map[string]interface{}
-	if err := json.Unmarshal([]byte(c), &newNodes); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	nodes = append(nodes, newNodes...)
-	out, err := json.MarshalIndent(nodes, "", "  ")
-	if err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	if err := os.WriteFile(p, out, 0644); err != nil {
-		return C.CString("error:" + err.Error())
+		return 0, false
 	}
-	return C.CString("success")
+	// FILETIME counts 100ns intervals.
+	return time.Duration(filetimeToUint64(kernel)+filetimeToUint64(user)) * 100, true
 }
 
 //export CreateWindowsService
@@ -192,122 +84,9 @@ func CreateWindowsService(name, execPath, configPath *C.char) *C.char {
 	return C.CString("error:not supported")
 }
 
-//export StartNodeService
-func StartNodeService(name *C.char) *C.char {
-	instMu.Lock()
-	defer instMu.Unlock()
-
-	node := C.GoString(name)
-	if _, ok := procMap.Load(node); ok && xray.GetXrayState() {
-		return C.CString("success")
-	}
-	if xray.GetXrayState() {
-		return C.CString("error:already running")
-	}
-
-	configPath := filepath.Join(os.TempDir(), node+".json")
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	if err := startXrayInternal(data); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	procMap.Store(node, true)
-	return C.CString("success")
-}
-
-//export StopNodeService
-func StopNodeService(name *C.char) *C.char {
-	instMu.Lock()
-	defer instMu.Unlock()
-
-	node := C.GoString(name)
-	if _, ok := procMap.Load(node); ok {
-		if xray.GetXrayState() {
-			if err := stopXrayInternal(); err != nil {
-				return C.CString("error:" + err.Error())
-			}
-		}
-		procMap.Delete(node)
-		return C.CString("success")
-	}
-	if xray.GetXrayState() {
-		if err := stopXrayInternal(); err != nil {
-			return C.CString("error:" + err.Error())
-		}
-	}
-	clearNodeRegistry()
-	return C.CString("success")
-}
-
-//export CheckNodeStatus
-func CheckNodeStatus(name *C.char) C.int {
-	node := C.GoString(name)
-	if _, ok := procMap.Load(node); ok && xray.GetXrayState() {
-		return 1
-	}
-	return 0
-}
-
 //export PerformAction
 func PerformAction(action, password *C.char) *C.char {
-	act := C.GoString(action)
-	if act == "isXrayDownloading" {
-		return C.CString("0")
-	}
-	return C.CString("error:unsupported")
-}
-
-//export IsXrayDownloading
-func IsXrayDownloading() C.int { return 0 }
-
-//export FreeCString
-func FreeCString(str *C.char) { C.free(unsafe.Pointer(str)) }
-
-//export StartXray
-func StartXray(configC *C.char) *C.char {
-	instMu.Lock()
-	defer instMu.Unlock()
-
-	if xray.GetXrayState() {
-		return C.CString("error:already running")
-	}
-	cfgData := []byte(C.GoString(configC))
-	if err := startXrayInternal(cfgData); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	return C.CString("success")
-}
-
-//export StopXray
-func StopXray() *C.char {
-	instMu.Lock()
-	defer instMu.Unlock()
-
-	if !xray.GetXrayState() {
-		return C.CString("error:not running")
-	}
-	if err := stopXrayInternal(); err != nil {
-		return C.CString("error:" + err.Error())
-	}
-	clearNodeRegistry()
-	return C.CString("success")
-}
-
-//export GetDesktopRuntimeSnapshot
-func GetDesktopRuntimeSnapshot() *C.char {
-	snapshot := desktopRuntimeSnapshot{
-		Running:     xray.GetXrayState(),
-		MemoryBytes: currentWorkingSetBytes(),
-		CPUPercent:  currentCPUPercent(),
-		UpdatedAt:   time.Now().UnixMilli(),
-	}
-	payload, err := json.Marshal(snapshot)
-	if err != nil {
-		return C.CString("{}")
-	}
-	return C.CString(string(payload))
+	return C.CString(dispatchAction(C.GoString(action), C.GoString(password)))
 }
 
 // ---- System tray integration ----
@@ -413,5 +192,3 @@ func InitTray() {
 		}()
 	})
 }
-
-func main() {}
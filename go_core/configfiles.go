@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+// configFilesMu serialises writers inside this process; the file lock covers
+// other processes such as a second app instance or the CLI.
+var configFilesMu sync.Mutex
+
+// writeConfigFilesInternal stores the xray config, the service definition and
+// the node list. Every file is replaced atomically with 0600 permissions since
+// they carry UUIDs and REALITY keys; vpn_nodes.json is also encrypted when the
+// vault is enabled. The xray config stays plaintext because the systemd,
+// launchd and Windows services run the xray binary on it directly. vpnContent
+// is a JSON array of nodes that is migrated to the current schema and
+// upserted by name into the existing list, so re-importing a node replaces it
+// instead of adding a duplicate.
+func writeConfigFilesInternal(xrayPath, xrayContent, servicePath, serviceContent, vpnPath, vpnContent string) error {
+	incoming, err := parseVpnNodes([]byte(vpnContent))
+	if err != nil {
+		return newCoreError(codeInvalidArgument, "invalid vpn node content", false, nil)
+	}
+	if len(incoming.Quarantined) > 0 {
+		reasons := make([]string, 0, len(incoming.Quarantined))
+		for _, q := range incoming.Quarantined {
+			reasons = append(reasons, q.Reason)
+		}
+		return newCoreError(codeInvalidArgument, "invalid vpn node: "+strings.Join(reasons, "; "), false, nil)
+	}
+
+	configFilesMu.Lock()
+	defer configFilesMu.Unlock()
+
+	if err := writeFileAtomic(xrayPath, []byte(xrayContent), 0o600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(servicePath, []byte(serviceContent), 0o600); err != nil {
+		return err
+	}
+	return withFileLock(vpnPath, func() error {
+		data, _, err := openVaultFileIfExists(vpnPath)
+		if err != nil {
+			return err
+		}
+		existing, err := parseVpnNodes(data)
+		if err != nil {
+			return err
+		}
+		existing.Nodes = upsertVpnNodes(existing.Nodes, incoming.Nodes)
+		return saveVpnNodesLocked(vpnPath, existing)
+	})
+}
+
+// upsertVpnNodes merges incoming into existing by node name. A replaced node
+// keeps its position and any fields it carried that the incoming record
+// lacks, since older writers drop fields they do not know. Duplicates already
+// present in existing collapse into the first entry.
+func upsertVpnNodes(existing, incoming []vpnNode) []vpnNode {
+	merged := make([]vpnNode, 0, len(existing)+len(incoming))
+	index := map[string]int{}
+	for _, list := range [][]vpnNode{existing, incoming} {
+		for _, node := range list {
+			name := strings.TrimSpace(node.Name)
+			if name == "" {
+				// Only records from a newer schema can lack a name.
+				merged = append(merged, node)
+				continue
+			}
+			i, ok := index[name]
+			if !ok {
+				index[name] = len(merged)
+				merged = append(merged, node)
+				continue
+			}
+			// A newer build's record is written back verbatim, so only
+			// records of this schema inherit the extra fields.
+			if node.raw == nil {
+				node.extra = mergeVpnNodeExtra(merged[i].extra, node.extra)
+			}
+			merged[i] = node
+		}
+	}
+	return merged
+}
+
+// mergeVpnNodeExtra returns current with any keys from previous it lacks.
+func mergeVpnNodeExtra(previous, current map[string]json.RawMessage) map[string]json.RawMessage {
+	if len(previous) == 0 {
+		return current
+	}
+	merged := make(map[string]json.RawMessage, len(previous)+len(current))
+	for key, value := range previous {
+		merged[key] = value
+	}
+	for key, value := range current {
+		merged[key] = value
+	}
+	return merged
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func vpnNodeContent(name, configPath string) string {
+	return fmt.Sprintf(`[{"name":%q,"countryCode":"jp","configPath":%q,"serviceName":"xstream.%s"}]`, name, configPath, name)
+}
+
+func TestWriteConfigFilesReplacesByName(t *testing.T) {
+	setTestDataDir(t)
+	dir := t.TempDir()
+	xrayPath := filepath.Join(dir, "node-jp-config.json")
+	servicePath := filepath.Join(dir, "xstream.jp.service")
+	vpnPath := filepath.Join(dir, "vpn_nodes.json")
+
+	// The list already holds jp twice and a field this version drops.
+	if err := os.WriteFile(vpnPath, []byte(`[
+  {"schemaVersion":1,"name":"jp","countryCode":"jp","configPath":"/old/jp.json","serviceName":"xstream.jp","latencyMs":42},
+  {"schemaVersion":1,"name":"us","countryCode":"us","configPath":"/c/us.json","serviceName":"xstream.us"},
+  {"schemaVersion":1,"name":"jp","countryCode":"jp","configPath":"/dup/jp.json","serviceName":"xstream.jp"}
+]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := writeConfigFilesInternal(xrayPath, `{"outbounds":[]}`, servicePath, "[Service]", vpnPath, vpnNodeContent("jp", xrayPath)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := loadVpnNodes(vpnPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Nodes) != 2 || list.Nodes[0].Name != "jp" || list.Nodes[1].Name != "us" {
+		t.Fatalf("nodes = %+v", list.Nodes)
+	}
+	jp := list.Nodes[0]
+	if jp.ConfigPath != xrayPath || string(jp.extra["latencyMs"]) != "42" {
+		t.Fatalf("jp = %+v", jp)
+	}
+
+	for _, path := range []string{xrayPath, servicePath, vpnPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runtime.GOOS != "windows" && info.Mode().Perm() != 0o600 {
+			t.Fatalf("%s mode = %v, want 0600", path, info.Mode().Perm())
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) == ".tmp" {
+			t.Fatalf("temp file %s left behind", entry.Name())
+		}
+	}
+}
+
+func TestWriteConfigFilesRejectsInvalidNodes(t *testing.T) {
+	setTestDataDir(t)
+	dir := t.TempDir()
+	xrayPath := filepath.Join(dir, "node-jp-config.json")
+	err := writeConfigFilesInternal(xrayPath, "{}", filepath.Join(dir, "svc"), "", filepath.Join(dir, "vpn_nodes.json"), `[{"name":"jp"}]`)
+	assertCoreErrorCode(t, err, codeInvalidArgument)
+	if _, err := os.Stat(xrayPath); !os.IsNotExist(err) {
+		t.Fatal("xray config written for an invalid node")
+	}
+}
+
+func TestWriteConfigFilesConcurrentWriters(t *testing.T) {
+	setTestDataDir(t)
+	dir := t.TempDir()
+	vpnPath := filepath.Join(dir, "vpn_nodes.json")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := "node" + strconv.Itoa(i)
+			xrayPath := filepath.Join(dir, name+".json")
+			if err := writeConfigFilesInternal(xrayPath, "{}", filepath.Join(dir, name+".service"), "", vpnPath, vpnNodeContent(name, xrayPath)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	list, err := loadVpnNodes(vpnPath)
+	if err != nil || len(list.Nodes) != 16 {
+		t.Fatalf("nodes = %d, %v; a concurrent write was lost", len(list.Nodes), err)
+	}
+}
+
+func TestFileLockSerialisesReadModifyWrite(t *testing.T) {
+	// Each writer opens its own lock file handle, as a second process would,
+	// so this covers the lock rather than configFilesMu.
+	path := filepath.Join(t.TempDir(), "counter")
+	if err := os.WriteFile(path, []byte("0"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := withFileLock(path, func() error {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				n, _ := strconv.Atoi(string(data))
+				return writeFileAtomic(path, []byte(strconv.Itoa(n+1)), 0o600)
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := string(readRaw(t, path)); got != "32" {
+		t.Fatalf("counter = %s, want 32", got)
+	}
+}
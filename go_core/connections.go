@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	xnet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/pipe"
+)
+
+// connectionInfo is one row of the live connection table: a client flow
+// the primary core dispatched to an outbound. Destination is what the client
+// asked for. Flows multiplexed over one transport connection (mux, xhttp)
+// are separate rows.
+type connectionInfo struct {
+	ID            string `json:"id"`
+	Network       string `json:"network"`
+	Source        string `json:"source,omitempty"`
+	Inbound       string `json:"inbound,omitempty"`
+	Destination   string `json:"destination"`
+	Domain        string `json:"domain,omitempty"`
+	Protocol      string `json:"protocol,omitempty"`
+	Rule          string `json:"rule,omitempty"`
+	Outbound      string `json:"outbound"`
+	UploadBytes   int64  `json:"uploadBytes"`
+	DownloadBytes int64  `json:"downloadBytes"`
+	StartedAt     int64  `json:"startedAt"`
+	AgeMs         int64  `json:"ageMs"`
+}
+
+// trackedFlow counts the bytes of one flow and removes itself from the table
+// when the outbound closes its downlink, or when CloseConnection aborts it.
+// The uplink is relayed into a pipe of the flow's own rather than wrapped,
+// because xray's mux and XUDP clients expect the link reader to be a
+// *pipe.Reader.
+type trackedFlow struct {
+	info      connectionInfo
+	started   time.Time
+	up, down  atomic.Int64
+	uplink    buf.Reader
+	relay     *pipe.Writer
+	downlink  buf.Writer
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (f *trackedFlow) relayUplink() {
+	for {
+		mb, err := f.uplink.ReadMultiBuffer()
+		if !mb.IsEmpty() {
+			f.up.Add(int64(mb.Len()))
+			if werr := f.relay.WriteMultiBuffer(mb); werr != nil {
+				// The outbound stopped reading the flow.
+				common.Interrupt(f.uplink)
+				return
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				_ = f.relay.Close()
+				return
+			}
+			// The client side is gone.
+			f.relay.Interrupt()
+			f.finish()
+			return
+		}
+	}
+}
+
+// finish removes the flow once the outbound is done with it. Outbounds always
+// interrupt their reader after closing the downlink, which for the relay
+// does not reach the dispatcher's uplink, so it is interrupted here.
+func (f *trackedFlow) finish() {
+	f.closeOnce.Do(func() {
+		connections.remove(f.info.ID)
+		common.Interrupt(f.uplink)
+		close(f.done)
+	})
+}
+
+// abort tears the flow down in both directions; the transport connection it
+// runs over, and other flows sharing it, are left alone.
+func (f *trackedFlow) abort() {
+	f.finish()
+	f.relay.Interrupt()
+	common.Interrupt(f.downlink)
+}
+
+func (f *trackedFlow) snapshot(now time.Time) connectionInfo {
+	info := f.info
+	info.UploadBytes, info.DownloadBytes = f.up.Load(), f.down.Load()
+	info.AgeMs = now.Sub(f.started).Milliseconds()
+	return info
+}
+
+// flowWriter is the downlink writer the outbound sees.
+type flowWriter struct {
+	flow *trackedFlow
+}
+
+func (w *flowWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	w.flow.down.Add(int64(mb.Len()))
+	return w.flow.downlink.WriteMultiBuffer(mb)
+}
+
+func (w *flowWriter) Close() error {
+	w.flow.finish()
+	return common.Close(w.flow.downlink)
+}
+
+func (w *flowWriter) Interrupt() {
+	w.flow.finish()
+	common.Interrupt(w.flow.downlink)
+}
+
+// connectionTable holds the open flows of the primary core. Side instances
+// (additional nodes, measurements) are not tracked.
+type connectionTable struct {
+	mu    sync.Mutex
+	seq   int64
+	items map[string]*trackedFlow
+}
+
+var connections = &connectionTable{items: map[string]*trackedFlow{}}
+
+// track registers a flow dispatched to the outbound tagged outboundTag and
+// returns the link to hand the outbound in place of the dispatcher's.
+func (t *connectionTable) track(ctx context.Context, outboundTag string, link *transport.Link) (*trackedFlow, *transport.Link) {
+	reader, writer := pipe.New(pipe.OptionsFromContext(ctx)...)
+	flow := &trackedFlow{
+		started:  time.Now(),
+		info:     connectionInfoFromContext(ctx),
+		uplink:   link.Reader,
+		relay:    writer,
+		downlink: link.Writer,
+		done:     make(chan struct{}),
+	}
+	flow.info.Outbound = outboundTag
+	flow.info.StartedAt = flow.started.UnixMilli()
+	if outbounds := session.OutboundsFromContext(ctx); len(outbounds) > 0 {
+		flow.info.Network = outbounds[0].Target.Network.SystemString()
+		if flow.info.Destination == "" && outbounds[0].Target.IsValid() {
+			flow.info.Destination = outbounds[0].Target.NetAddr()
+		}
+	}
+	t.mu.Lock()
+	t.seq++
+	flow.info.ID = "c" + strconv.FormatInt(t.seq, 10)
+	t.items[flow.info.ID] = flow
+	t.mu.Unlock()
+
+	go flow.relayUplink()
+	return flow, &transport.Link{Reader: reader, Writer: &flowWriter{flow: flow}}
+}
+
+func (t *connectionTable) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.items, id)
+}
+
+// clear forgets every flow when the core stops; closing the core ends them.
+func (t *connectionTable) clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.items = map[string]*trackedFlow{}
+}
+
+// list returns the open flows, oldest first. The matched rule is worked out
+// here rather than per flow so dispatching stays cheap.
+func (t *connectionTable) list() []connectionInfo {
+	t.mu.Lock()
+	flows := make([]*trackedFlow, 0, len(t.items))
+	for _, flow := range t.items {
+		flows = append(flows, flow)
+	}
+	t.mu.Unlock()
+
+	_, cfgData := engine.current()
+	routing := parseRoutingRules(cfgData)
+	now := time.Now()
+	out := make([]connectionInfo, 0, len(flows))
+	for _, flow := range flows {
+		info := flow.snapshot(now)
+		info.Rule = routing.match(info)
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].StartedAt != out[j].StartedAt {
+			return out[i].StartedAt < out[j].StartedAt
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// closeConnection aborts one flow.
+func (t *connectionTable) closeConnection(id string) error {
+	t.mu.Lock()
+	flow, ok := t.items[id]
+	t.mu.Unlock()
+	if !ok {
+		return newCoreError(codeNotFound, "connection not found", false, map[string]interface{}{"id": id})
+	}
+	flow.abort()
+	return nil
+}
+
+// attach wraps the tagged outbound handlers of the primary core, whose
+// manager the dispatcher asks for a handler on every flow. A handler is
+// removed and added back wrapped, so the default handler stays the default;
+// a flow routed in between is refused by xray. Untagged handlers cannot be
+// replaced and their flows are not tracked.
+func (t *connectionTable) attach(manager outbound.Manager) {
+	if manager == nil {
+		return
+	}
+	ctx := context.Background()
+	for _, handler := range manager.ListHandlers(ctx) {
+		tag := handler.Tag()
+		if _, wrapped := handler.(*flowHandler); wrapped || tag == "" {
+			continue
+		}
+		if err := manager.RemoveHandler(ctx, tag); err != nil {
+			continue
+		}
+		if err := manager.AddHandler(ctx, &flowHandler{Handler: handler}); err != nil {
+			_ = manager.AddHandler(ctx, handler)
+		}
+	}
+}
+
+// flowHandler passes the client flows an outbound handler takes through the
+// connection table.
+type flowHandler struct {
+	outbound.Handler
+}
+
+func (h *flowHandler) Dispatch(ctx context.Context, link *transport.Link) {
+	// Flows the core starts itself, such as observatory probes, have no
+	// inbound, and dialerProxy hops carry a flow that is already tracked.
+	if session.InboundFromContext(ctx) == nil || len(session.OutboundsFromContext(ctx)) != 1 {
+		h.Handler.Dispatch(ctx, link)
+		return
+	}
+	flow, flowLink := connections.track(ctx, h.Tag(), link)
+	h.Handler.Dispatch(ctx, flowLink)
+	// Inbounds that dispatch a link of their own close the client connection
+	// once Dispatch returns. mux waits for the flow in that case, but only
+	// when it can see the reader is not a pipe, so wait here instead.
+	if _, ok := link.Reader.(*pipe.Reader); !ok {
+		select {
+		case <-flow.done:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// connectionInfoFromContext reads the flow being dispatched: its inbound and
+// the target after sniffing.
+func connectionInfoFromContext(ctx context.Context) connectionInfo {
+	var info connectionInfo
+	if inbound := session.InboundFromContext(ctx); inbound != nil {
+		info.Inbound = inbound.Tag
+		if inbound.Source.IsValid() {
+			info.Source = inbound.Source.NetAddr()
+		}
+	}
+	if outbounds := session.OutboundsFromContext(ctx); len(outbounds) > 0 {
+		first := outbounds[0]
+		target := first.Target
+		if first.OriginalTarget.IsValid() {
+			target = first.OriginalTarget
+		}
+		if target.IsValid() {
+			info.Destination = target.NetAddr()
+		}
+		for _, dest := range []xnet.Destination{first.RouteTarget, first.Target, first.OriginalTarget} {
+			if dest.IsValid() && dest.Address != nil && dest.Address.Family().IsDomain() {
+				info.Domain = dest.Address.Domain()
+				break
+			}
+		}
+	}
+	if content := session.ContentFromContext(ctx); content != nil {
+		info.Protocol = content.Protocol
+	}
+	return info
+}
+
+// routingRules is the routing section of the running config, used to name
+// the rule a connection matched.
+type routingRules struct {
+	rules          []map[string]interface{}
+	domainStrategy string
+}
+
+func parseRoutingRules(cfgData []byte) routingRules {
+	var doc struct {
+		Routing struct {
+			DomainStrategy string                   `json:"domainStrategy"`
+			Rules          []map[string]interface{} `json:"rules"`
+		} `json:"routing"`
+	}
+	if err := json.Unmarshal(cfgData, &doc); err != nil {
+		return routingRules{}
+	}
+	return routingRules{rules: doc.Routing.Rules, domainStrategy: doc.Routing.DomainStrategy}
+}
+
+// Results of matching one rule condition. Conditions the core cannot check
+// without xray's data, such as geosite: and geoip:, are unknown.
+const (
+	ruleNoMatch = iota
+	ruleMatch
+	ruleUnknown
+)
+
+// match replays the routing rules against a connection and returns
+// "routing.rules[i]" (or the rule's ruleTag) for the rule that sent it to
+// the outbound it took. A rule whose conditions all match wins; otherwise the
+// first rule with unknown conditions and the same outbound is named. An empty
+// result means no rule matched and the connection used the default
+// outbound, or the table could not tell.
+func (r routingRules) match(info connectionInfo) string {
+	maybe := ""
+	for i, rule := range r.rules {
+		result := r.matchRule(rule, info)
+		outbound := stringField(rule, "outboundTag")
+		if result == ruleNoMatch || (outbound == "" && stringField(rule, "balancerTag") == "") {
+			continue
+		}
+		// Balancer members are not known here, so a balancer rule agrees
+		// with any outbound.
+		agrees := outbound == "" || outbound == info.Outbound
+		label := stringField(rule, "ruleTag")
+		if label == "" {
+			label = fmt.Sprintf("routing.rules[%d]", i)
+		}
+		if result == ruleMatch {
+			if agrees {
+				return label
+			}
+			// xray stops at this rule, so an earlier unknown one took it.
+			return maybe
+		}
+		if agrees && maybe == "" {
+			maybe = label
+		}
+	}
+	return maybe
+}
+
+func (r routingRules) matchRule(rule map[string]interface{}, info connectionInfo) int {
+	result := ruleMatch
+	combine := func(next int) {
+		if next == ruleNoMatch || result == ruleNoMatch {
+			result = ruleNoMatch
+		} else if next == ruleUnknown {
+			result = ruleUnknown
+		}
+	}
+	host, port, _ := net.SplitHostPort(info.Destination)
+	if tags := interfaceStrings(rule["inboundTag"]); len(tags) > 0 {
+		combine(boolMatch(containsString(tags, info.Inbound)))
+	}
+	if domains := interfaceStrings(rule["domain"]); len(domains) > 0 {
+		domain := info.Domain
+		if domain == "" && net.ParseIP(host) == nil {
+			domain = host
+		}
+		combine(matchRuleDomains(domains, domain))
+	}
+	if cidrs := interfaceStrings(rule["ip"]); len(cidrs) > 0 {
+		combine(r.matchRuleIPs(cidrs, host))
+	}
+	if ports := portString(rule["port"]); ports != "" {
+		combine(boolMatch(portInList(port, ports)))
+	}
+	if network := stringField(rule, "network"); network != "" {
+		combine(boolMatch(containsString(strings.Split(strings.ReplaceAll(network, " ", ""), ","), info.Network)))
+	}
+	if protocols := interfaceStrings(rule["protocol"]); len(protocols) > 0 {
+		combine(boolMatch(containsString(protocols, info.Protocol)))
+	}
+	for _, key := range []string{"source", "sourcePort", "user", "attrs"} {
+		if _, ok := rule[key]; ok {
+			combine(ruleUnknown)
+		}
+	}
+	return result
+}
+
+func boolMatch(ok bool) int {
+	if ok {
+		return ruleMatch
+	}
+	return ruleNoMatch
+}
+
+func matchRuleDomains(patterns []string, domain string) int {
+	if domain == "" {
+		return ruleNoMatch
+	}
+	domain = strings.ToLower(domain)
+	result := ruleNoMatch
+	for _, pattern := range patterns {
+		kind, value, found := strings.Cut(pattern, ":")
+		if !found {
+			kind, value = "keyword", pattern
+		}
+		value = strings.ToLower(value)
+		switch kind {
+		case "full":
+			if domain == value {
+				return ruleMatch
+			}
+		case "domain":
+			if domain == value || strings.HasSuffix(domain, "."+value) {
+				return ruleMatch
+			}
+		case "keyword":
+			if strings.Contains(domain, value) {
+				return ruleMatch
+			}
+		default:
+			result = ruleUnknown
+		}
+	}
+	return result
+}
+
+func (r routingRules) matchRuleIPs(patterns []string, host string) int {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// Domains only meet IP rules when xray resolves them for routing.
+		if r.domainStrategy == "" || strings.EqualFold(r.domainStrategy, "AsIs") {
+			return ruleNoMatch
+		}
+		return ruleUnknown
+	}
+	var literal []string
+	result := ruleNoMatch
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, ":") && net.ParseIP(pattern) == nil && !strings.Contains(pattern, "/") {
+			result = ruleUnknown
+			continue
+		}
+		literal = append(literal, pattern)
+	}
+	if ipInCIDRs(ip, literal) {
+		return ruleMatch
+	}
+	return result
+}
+
+// portInList reports whether port is in an xray port list such as
+// "53,443,1000-2000".
+func portInList(port, list string) bool {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		low, high, isRange := strings.Cut(part, "-")
+		if !isRange {
+			high = low
+		}
+		lo, errLo := strconv.Atoi(strings.TrimSpace(low))
+		hi, errHi := strconv.Atoi(strings.TrimSpace(high))
+		if errLo == nil && errHi == nil && n >= lo && n <= hi {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/infra/conf/serial"
+	"github.com/xtls/xray-core/transport/internet"
+)
+
+// useRealCore runs the primary core in this process with core.New, the way
+// libXray does, so starts go through the engine and its hooks.
+func useRealCore(t *testing.T) {
+	t.Helper()
+	var (
+		mu     sync.Mutex
+		server *core.Instance
+	)
+	run, stop, running := xrayRun, xrayStop, xrayRunning
+	xrayRun = func(cfg string) error {
+		jsonCfg, err := serial.DecodeJSONConfig(strings.NewReader(cfg))
+		if err != nil {
+			return err
+		}
+		coreCfg, err := jsonCfg.Build()
+		if err != nil {
+			return err
+		}
+		instance, err := core.New(coreCfg)
+		if err != nil {
+			return err
+		}
+		if err := instance.Start(); err != nil {
+			return err
+		}
+		mu.Lock()
+		server = instance
+		mu.Unlock()
+		return nil
+	}
+	xrayStop = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		err := server.Close()
+		server = nil
+		return err
+	}
+	xrayRunning = func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return server != nil
+	}
+	t.Cleanup(func() {
+		_ = stopXrayInternal("test cleanup")
+		xrayRun, xrayStop, xrayRunning = run, stop, running
+	})
+}
+
+// startEchoServer echoes every TCP connection back to the client.
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dialSocks opens a SOCKS5 CONNECT to target through the inbound at proxy.
+func dialSocks(t *testing.T, proxy, target string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	host, port, _ := net.SplitHostPort(target)
+	var portNum uint16
+	_, _ = fmt.Sscan(port, &portNum)
+	req := []byte{5, 1, 0, 5, 1, 0, 1}
+	req = append(req, net.ParseIP(host).To4()...)
+	req = binary.BigEndian.AppendUint16(req, portNum)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, resp); err != nil || resp[0] != 5 || resp[1] != 0 || resp[3] != 0 {
+		t.Fatalf("socks handshake = %v, %v", resp, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn
+}
+
+func assertEcho(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, []byte(msg)) {
+		t.Fatalf("echo = %q, %v", got, err)
+	}
+}
+
+// waitConnections polls the table until ok accepts it.
+func waitConnections(t *testing.T, ok func([]connectionInfo) bool) []connectionInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		list := connections.list()
+		if ok(list) {
+			return list
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connections = %+v", list)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+const testVlessID = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+func TestConnectionTableTracksMuxFlows(t *testing.T) {
+	setTestDataDir(t)
+	useRealCore(t)
+	echo := startEchoServer(t)
+
+	// The node is a side instance running a VLESS server; its own flows to
+	// the echo server must stay out of the table.
+	nodePort := freeTCPPort(t)
+	node, err := newSideInstance([]byte(fmt.Sprintf(`{
+  "inbounds": [{"tag": "node-in", "listen": "127.0.0.1", "port": %d, "protocol": "vless",
+    "settings": {"clients": [{"id": %q}], "decryption": "none"}}],
+  "outbounds": [{"tag": "node-direct", "protocol": "freedom"}]
+}`, nodePort, testVlessID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = node.Close() })
+
+	socksPort := freeTCPPort(t)
+	cfg := fmt.Sprintf(`{
+  "inbounds": [{"tag": "socks-in", "listen": "127.0.0.1", "port": %d, "protocol": "socks", "settings": {"udp": false}}],
+  "outbounds": [
+    {"tag": "proxy", "protocol": "vless", "mux": {"enabled": true, "concurrency": 8},
+      "settings": {"vnext": [{"address": "127.0.0.1", "port": %d, "users": [{"id": %q, "encryption": "none"}]}]}},
+    {"tag": "direct", "protocol": "freedom"}
+  ]
+}`, socksPort, nodePort, testVlessID)
+	if err := engine.start("mux", []byte(cfg)); err != nil {
+		t.Fatal(err)
+	}
+	socks := fmt.Sprintf("127.0.0.1:%d", socksPort)
+
+	first, second := dialSocks(t, socks, echo), dialSocks(t, socks, echo)
+	assertEcho(t, first, "first flow")
+	assertEcho(t, second, "second flow")
+
+	list := waitConnections(t, func(list []connectionInfo) bool {
+		return len(list) == 2 && list[0].DownloadBytes >= 10 && list[1].DownloadBytes >= 11
+	})
+	for _, row := range list {
+		if row.Inbound != "socks-in" || row.Outbound != "proxy" || row.Destination != echo || row.Network != "tcp" || row.UploadBytes < 10 {
+			t.Fatalf("row = %+v", row)
+		}
+	}
+
+	if err := connections.closeConnection(list[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	_ = first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := first.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("closed flow still open: %v", err)
+	}
+	// The other flow shares the mux connection and keeps working.
+	assertEcho(t, second, "still here")
+	remaining := list[1].ID
+	waitConnections(t, func(list []connectionInfo) bool { return len(list) == 1 && list[0].ID == remaining })
+
+	second.Close()
+	waitConnections(t, func(list []connectionInfo) bool { return len(list) == 0 })
+	err = connections.closeConnection(list[0].ID)
+	assertCoreErrorCode(t, err, codeNotFound)
+}
+
+func TestConnectionTableKeepsDialerControllers(t *testing.T) {
+	setTestDataDir(t)
+	useRealCore(t)
+	echo := startEchoServer(t)
+
+	// Android registers its socket protect hook this way; it needs xray's
+	// default system dialer to stay in place.
+	var mu sync.Mutex
+	var dialed []string
+	err := internet.RegisterDialerController(func(network, address string, conn syscall.RawConn) error {
+		mu.Lock()
+		dialed = append(dialed, address)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := freeTCPPort(t)
+	if err := engine.start("direct", socksNodeConfig(port)); err != nil {
+		t.Fatal(err)
+	}
+	conn := dialSocks(t, fmt.Sprintf("127.0.0.1:%d", port), echo)
+	assertEcho(t, conn, "protected")
+	waitConnections(t, func(list []connectionInfo) bool { return len(list) == 1 && list[0].Outbound == "direct" })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) == 0 || dialed[len(dialed)-1] != echo {
+		t.Fatalf("controller saw %v, want a dial to %s", dialed, echo)
+	}
+}
@@ -1,3 +1,9 @@
 package main
 
 const artifactBaseURL = "https://artifact.svc.plus"
+
+// geodataManifestPublicKey is the base64 ed25519 key that signs the geodata
+// manifest. build_scripts/go_ldflags.sh sets it with -ldflags -X from
+// XSTREAM_GEODATA_MANIFEST_PUBLIC_KEY; without it geodata updates are refused
+// rather than trusted unsigned.
+var geodataManifestPublicKey = ""
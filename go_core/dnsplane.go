@@ -0,0 +1,486 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Nameserver tags shared with lib/services/vpn_config_service.dart. Xray uses
+// the tag of a nameserver as the inbound tag of its queries, which is how
+// routing sends each resolver through direct or proxy.
+const (
+	dnsDirectPrimaryTag   = "dns-direct-primary"
+	dnsDirectSecondaryTag = "dns-direct-secondary"
+	dnsProxyPrimaryTag    = "dns-proxy-primary"
+	dnsProxySecondaryTag  = "dns-proxy-secondary"
+	dnsFakeTag            = "dns-fake"
+)
+
+const (
+	directOutboundTag = "direct"
+	dnsOutboundTag    = "dns"
+)
+
+// Defaults mirror DnsConfig in lib/utils/global_config.dart.
+var (
+	defaultDirectResolvers = []string{"1.1.1.1", "8.8.8.8"}
+	defaultProxyResolvers  = []string{"https://1.1.1.1/dns-query", "https://8.8.8.8/dns-query"}
+	defaultDirectDomains   = []string{
+		"full:localhost",
+		`regexp:^.*\.local$`,
+		"dotless:",
+		"domain:apple.com",
+		"domain:icloud.com",
+		"domain:apple-dns.net",
+		"full:captive.apple.com",
+		"full:connectivitycheck.gstatic.com",
+		"full:msftconnecttest.com",
+		"full:msftncsi.com",
+	}
+	defaultDirectIPCIDRs = []string{
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	}
+	defaultFakeDNSPools = []interface{}{
+		map[string]interface{}{"ipPool": "198.18.0.0/15", "lruSize": 32768},
+		map[string]interface{}{"ipPool": "fc00::/18", "lruSize": 32768},
+	}
+)
+
+const fakeDNSWarning = "FakeDNS is limited to the explicit fake domain set; stale fake mappings can linger in the system DNS cache after the tunnel stops"
+
+// dnsControlPlane is the Go form of DnsControlPlane from
+// docs/dns-secure-tunnel-design.md. Lists left out (null) take the DnsConfig
+// defaults; an explicit empty list means none.
+type dnsControlPlane struct {
+	Resolvers  dnsResolvers  `json:"resolvers"`
+	DomainSets dnsDomainSets `json:"domainSets"`
+	FakeDNS    dnsFakePolicy `json:"fakeDns"`
+	Tunnel     dnsTunnel     `json:"tunnel"`
+}
+
+type dnsResolvers struct {
+	Direct []string `json:"direct"`
+	Proxy  []string `json:"proxy"`
+}
+
+type dnsDomainSets struct {
+	Direct        []string `json:"direct"`
+	Proxy         []string `json:"proxy"`
+	Fake          []string `json:"fake"`
+	DirectIPCIDRs []string `json:"directIpCidrs"`
+}
+
+type dnsFakePolicy struct {
+	Enabled bool          `json:"enabled"`
+	Pools   []interface{} `json:"pools"`
+}
+
+// dnsTunnel sends system DNS queries aimed at the tunnel DNS addresses to the
+// built-in dns outbound.
+type dnsTunnel struct {
+	CaptureSystemDNS bool     `json:"captureSystemDns"`
+	Servers4         []string `json:"servers4"`
+	Servers6         []string `json:"servers6"`
+}
+
+// compiledDNS holds the xray sections generated from one control plane.
+type compiledDNS struct {
+	DNS                  map[string]interface{} `json:"dns"`
+	Rules                []interface{}          `json:"rules"`
+	FakeDNS              []interface{}          `json:"fakeDns,omitempty"`
+	SniffingDestOverride []string               `json:"sniffingDestOverride"`
+	Warnings             []string               `json:"warnings"`
+}
+
+func orDefault(values, fallback []string) []string {
+	if values == nil {
+		return fallback
+	}
+	return values
+}
+
+// compileDNSPolicy turns the control plane into matching dns and routing
+// sections; the system DNS capture rule only applies in tunnel mode. It
+// refuses policies that would leak: a proxy resolver that bypasses routing, a
+// domain in two sets, or any domain whose resolver path differs from its
+// traffic path.
+func compileDNSPolicy(cp dnsControlPlane, tunnel bool) (compiledDNS, error) {
+	directResolvers := orDefault(cp.Resolvers.Direct, defaultDirectResolvers)
+	proxyResolvers := orDefault(cp.Resolvers.Proxy, defaultProxyResolvers)
+	sets := dnsDomainSets{
+		Direct:        orDefault(cp.DomainSets.Direct, defaultDirectDomains),
+		Proxy:         orDefault(cp.DomainSets.Proxy, nil),
+		Fake:          orDefault(cp.DomainSets.Fake, nil),
+		DirectIPCIDRs: orDefault(cp.DomainSets.DirectIPCIDRs, defaultDirectIPCIDRs),
+	}
+	out := compiledDNS{Warnings: []string{}}
+
+	var issues []configDiagnostic
+	if len(directResolvers) == 0 {
+		issues = append(issues, configDiagnostic{Path: "resolvers.direct", Message: "at least one direct resolver is required"})
+	}
+	if len(proxyResolvers) == 0 {
+		issues = append(issues, configDiagnostic{Path: "resolvers.proxy", Message: "at least one proxy resolver is required"})
+	}
+	for i, address := range proxyResolvers {
+		if msg := checkProxyResolver(address); msg != "" {
+			issues = append(issues, configDiagnostic{Path: fmt.Sprintf("resolvers.proxy[%d]", i), Message: msg})
+		}
+	}
+	issues = append(issues, overlappingDomains(sets)...)
+	if len(issues) > 0 {
+		return out, dnsPolicyError(issues)
+	}
+
+	fakeEnabled := cp.FakeDNS.Enabled && len(sets.Fake) > 0
+	if cp.FakeDNS.Enabled && !fakeEnabled {
+		out.Warnings = append(out.Warnings, "FakeDNS is enabled but the fake domain set is empty; it stays off")
+	}
+
+	// Resolvers: fake first so it wins for its explicit set, then direct
+	// (restricted to the direct set, no fallback) and proxy as the fallback.
+	servers := []interface{}{}
+	if fakeEnabled {
+		servers = append(servers, dnsServer("fakedns", dnsFakeTag, sets.Fake, true))
+		out.FakeDNS = cp.FakeDNS.Pools
+		if out.FakeDNS == nil {
+			out.FakeDNS = defaultFakeDNSPools
+		}
+		out.Warnings = append(out.Warnings, fakeDNSWarning)
+	}
+	directTags := []string{dnsDirectPrimaryTag, dnsDirectSecondaryTag}
+	proxyTags := []string{dnsProxyPrimaryTag, dnsProxySecondaryTag}
+	var directResolverTags, proxyResolverTags []interface{}
+	for i, address := range directResolvers {
+		tag := resolverTag(directTags, i)
+		servers = append(servers, dnsServer(address, tag, sets.Direct, true))
+		directResolverTags = append(directResolverTags, tag)
+	}
+	for i, address := range proxyResolvers {
+		tag := resolverTag(proxyTags, i)
+		servers = append(servers, dnsServer(address, tag, nil, false))
+		proxyResolverTags = append(proxyResolverTags, tag)
+	}
+	out.DNS = map[string]interface{}{
+		"servers":                servers,
+		"queryStrategy":          "UseIPv4",
+		"disableFallbackIfMatch": true,
+	}
+
+	rules := []interface{}{}
+	if tunnel && cp.Tunnel.CaptureSystemDNS {
+		var cidrs []interface{}
+		for _, ip := range cp.Tunnel.Servers4 {
+			cidrs = append(cidrs, ip+"/32")
+		}
+		for _, ip := range cp.Tunnel.Servers6 {
+			cidrs = append(cidrs, ip+"/128")
+		}
+		if len(cidrs) == 0 {
+			return out, dnsPolicyError([]configDiagnostic{{Path: "tunnel", Message: "captureSystemDns needs the tunnel DNS addresses"}})
+		}
+		rules = append(rules, map[string]interface{}{
+			"type":        "field",
+			"inboundTag":  []interface{}{tunInboundTag},
+			"network":     "tcp,udp",
+			"port":        "53",
+			"ip":          cidrs,
+			"outboundTag": dnsOutboundTag,
+		})
+	}
+	if len(sets.Direct) > 0 {
+		rules = append(rules, map[string]interface{}{"type": "field", "domain": toInterfaces(sets.Direct), "outboundTag": directOutboundTag})
+	}
+	if len(sets.Proxy) > 0 {
+		rules = append(rules, map[string]interface{}{"type": "field", "domain": toInterfaces(sets.Proxy), "outboundTag": shareLinkOutboundTag})
+	}
+	if fakeEnabled {
+		rules = append(rules, map[string]interface{}{"type": "field", "domain": toInterfaces(sets.Fake), "outboundTag": shareLinkOutboundTag})
+	}
+	// Domain rules go before the direct CIDRs: the default IPv6 fake pool
+	// (fc00::/18) sits inside fc00::/7, and a fake answer must still be
+	// routed by its domain.
+	if len(sets.DirectIPCIDRs) > 0 {
+		rules = append(rules, map[string]interface{}{"type": "field", "ip": toInterfaces(sets.DirectIPCIDRs), "outboundTag": directOutboundTag})
+	}
+	rules = append(rules,
+		map[string]interface{}{"type": "field", "inboundTag": directResolverTags, "outboundTag": directOutboundTag},
+		map[string]interface{}{"type": "field", "inboundTag": proxyResolverTags, "outboundTag": shareLinkOutboundTag},
+	)
+	out.Rules = rules
+
+	out.SniffingDestOverride = []string{"http", "tls", "quic"}
+	if fakeEnabled {
+		out.SniffingDestOverride = append(out.SniffingDestOverride, "fakedns")
+	}
+
+	// The compiler should never produce a leaking policy; checking its own
+	// output keeps the generator and the validator honest with each other.
+	expect := dnsDomainSets{Direct: sets.Direct, Proxy: sets.Proxy}
+	if fakeEnabled {
+		expect.Fake = sets.Fake
+	} else {
+		expect.Proxy = append(append([]string{}, sets.Proxy...), sets.Fake...)
+	}
+	if issues := checkDNSRouting(out.DNS, rules, shareLinkOutboundTag, expect); len(issues) > 0 {
+		return out, dnsPolicyError(issues)
+	}
+	return out, nil
+}
+
+func resolverTag(tags []string, i int) string {
+	if i < len(tags) {
+		return tags[i]
+	}
+	return fmt.Sprintf("%s-%d", tags[len(tags)-1], i)
+}
+
+func dnsServer(address, tag string, domains []string, skipFallback bool) map[string]interface{} {
+	server := map[string]interface{}{
+		"address":       address,
+		"tag":           tag,
+		"queryStrategy": "UseIPv4",
+	}
+	if len(domains) > 0 {
+		server["domains"] = toInterfaces(domains)
+	}
+	if skipFallback {
+		server["skipFallback"] = true
+	}
+	return server
+}
+
+// checkProxyResolver enforces the DoH rule of the design doc: proxy resolvers
+// must go through xray routing, so "+local" transports and the system
+// resolver are rejected.
+func checkProxyResolver(address string) string {
+	address = strings.TrimSpace(address)
+	lower := strings.ToLower(address)
+	switch {
+	case address == "":
+		return "proxy resolver address is empty"
+	case lower == "localhost":
+		return "proxy resolver must not use the system resolver"
+	case strings.Contains(lower, "+local://"):
+		return "proxy resolver must not use a +local transport; it bypasses routing (use https://.../dns-query)"
+	case lower == "fakedns":
+		return "fakedns is only allowed for the explicit fake domain set"
+	}
+	if strings.HasPrefix(lower, "https://") {
+		u, err := url.Parse(address)
+		if err != nil || u.Host == "" {
+			return "DoH resolver is not a valid URL"
+		}
+		if u.Path != "/dns-query" {
+			return "DoH resolver must use the /dns-query path"
+		}
+	}
+	return ""
+}
+
+func overlappingDomains(sets dnsDomainSets) []configDiagnostic {
+	var issues []configDiagnostic
+	seen := map[string]string{}
+	for _, set := range []struct {
+		name    string
+		entries []string
+	}{{"direct", sets.Direct}, {"proxy", sets.Proxy}, {"fake", sets.Fake}} {
+		for _, entry := range set.entries {
+			if prev, ok := seen[entry]; ok && prev != set.name {
+				issues = append(issues, configDiagnostic{
+					Path:    "domainSets." + set.name,
+					Message: fmt.Sprintf("%q is also in the %s set", entry, prev),
+				})
+				continue
+			}
+			seen[entry] = set.name
+		}
+	}
+	return issues
+}
+
+// checkDNSRouting simulates where each domain set is resolved and where its
+// traffic is routed, using the matchers literally (xray matches dns.domains
+// and routing domain rules with the same syntax). A domain resolved through
+// one outbound but routed through another leaks queries or answers, so every
+// mismatch is reported. defaultOutbound is the tag xray uses for traffic no
+// rule matches.
+func checkDNSRouting(dns map[string]interface{}, rules []interface{}, defaultOutbound string, sets dnsDomainSets) []configDiagnostic {
+	servers, _ := dns["servers"].([]interface{})
+	resolverFor := func(domain string) (map[string]interface{}, bool) {
+		for _, raw := range servers {
+			server, _ := raw.(map[string]interface{})
+			for _, d := range interfaceStrings(server["domains"]) {
+				if d == domain {
+					return server, true
+				}
+			}
+		}
+		// Unmatched names go to the first server that takes fallback queries.
+		for _, raw := range servers {
+			server, _ := raw.(map[string]interface{})
+			if skip, _ := server["skipFallback"].(bool); !skip && stringField(server, "address") != "fakedns" {
+				return server, true
+			}
+		}
+		return nil, false
+	}
+	routeFor := func(match func(rule map[string]interface{}) bool) string {
+		for _, raw := range rules {
+			rule, _ := raw.(map[string]interface{})
+			if match(rule) {
+				return firstNonEmpty(stringField(rule, "outboundTag"), stringField(rule, "balancerTag"))
+			}
+		}
+		return defaultOutbound
+	}
+	domainRoute := func(domain string) string {
+		return routeFor(func(rule map[string]interface{}) bool {
+			if len(interfaceStrings(rule["inboundTag"])) > 0 || stringField(rule, "port") != "" {
+				return false
+			}
+			for _, d := range interfaceStrings(rule["domain"]) {
+				if d == domain {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	// A resolver query matches a rule by its inbound tag, or by an IP rule
+	// that covers the resolver address: a proxy resolver inside the direct
+	// CIDRs would otherwise leave the tunnel.
+	resolverRoute := func(server map[string]interface{}) string {
+		tag := stringField(server, "tag")
+		ip := resolverIP(stringField(server, "address"))
+		return routeFor(func(rule map[string]interface{}) bool {
+			if tags := interfaceStrings(rule["inboundTag"]); len(tags) > 0 {
+				if !containsString(tags, tag) {
+					return false
+				}
+			} else if len(interfaceStrings(rule["ip"])) == 0 {
+				return false
+			}
+			if len(interfaceStrings(rule["domain"])) > 0 || stringField(rule, "port") != "" {
+				return false
+			}
+			if cidrs := interfaceStrings(rule["ip"]); len(cidrs) > 0 {
+				return ip != nil && ipInCIDRs(ip, cidrs)
+			}
+			return true
+		})
+	}
+
+	var issues []configDiagnostic
+	check := func(set string, domains []string, want string, fake bool) {
+		for _, domain := range domains {
+			path := "domainSets." + set
+			server, ok := resolverFor(domain)
+			if !ok {
+				issues = append(issues, configDiagnostic{Path: path, Message: fmt.Sprintf("%q has no resolver", domain)})
+				continue
+			}
+			route := domainRoute(domain)
+			if route != want {
+				issues = append(issues, configDiagnostic{Path: path, Message: fmt.Sprintf("%q is routed to %q instead of %q", domain, route, want)})
+			}
+			if fake {
+				if stringField(server, "address") != "fakedns" {
+					issues = append(issues, configDiagnostic{Path: path, Message: fmt.Sprintf("%q is not answered by FakeDNS", domain)})
+				}
+				continue
+			}
+			if stringField(server, "address") == "fakedns" {
+				issues = append(issues, configDiagnostic{Path: path, Message: fmt.Sprintf("%q would get a FakeDNS answer outside the fake set", domain)})
+				continue
+			}
+			if resolved := resolverRoute(server); resolved != route {
+				issues = append(issues, configDiagnostic{
+					Path:    path,
+					Message: fmt.Sprintf("%q is resolved via %q (%s) but routed to %q", domain, resolved, stringField(server, "address"), route),
+				})
+			}
+		}
+	}
+	check("direct", sets.Direct, directOutboundTag, false)
+	check("proxy", sets.Proxy, shareLinkOutboundTag, false)
+	check("fake", sets.Fake, shareLinkOutboundTag, true)
+
+	// Names outside every set use the fallback resolver and the default route.
+	if server, ok := resolverFor(""); ok {
+		if resolved := resolverRoute(server); resolved != defaultOutbound {
+			issues = append(issues, configDiagnostic{
+				Path:    "resolvers.proxy",
+				Message: fmt.Sprintf("fallback resolver %s is routed to %q but other traffic goes to %q", stringField(server, "address"), resolved, defaultOutbound),
+			})
+		}
+	}
+	return issues
+}
+
+func dnsPolicyError(issues []configDiagnostic) error {
+	messages := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		messages = append(messages, issue.Path+": "+issue.Message)
+	}
+	return newCoreError(codeConfigInvalid, "DNS policy leaks: "+strings.Join(messages, "; "), false, map[string]interface{}{"issues": issues})
+}
+
+// resolverIP returns the IP literal a resolver address points at, or nil when
+// it names a host.
+func resolverIP(address string) net.IP {
+	host := address
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil
+		}
+		host = u.Hostname()
+	} else if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	return net.ParseIP(strings.Trim(host, "[]"))
+}
+
+func ipInCIDRs(ip net.IP, cidrs []string) bool {
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if other := net.ParseIP(cidr); other != nil && other.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+func toInterfaces(values []string) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		out[i] = v
+	}
+	return out
+}
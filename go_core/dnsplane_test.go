@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCompileDNSPolicyDefaults(t *testing.T) {
+	compiled, err := compileDNSPolicy(dnsControlPlane{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := compiled.DNS["servers"].([]interface{})
+	if len(servers) != 4 {
+		t.Fatalf("servers = %v", servers)
+	}
+	first := servers[0].(map[string]interface{})
+	if first["tag"] != dnsDirectPrimaryTag || first["skipFallback"] != true {
+		t.Fatalf("first server = %v", first)
+	}
+	if compiled.FakeDNS != nil {
+		t.Fatalf("FakeDNS is on by default: %v", compiled.FakeDNS)
+	}
+	for _, raw := range compiled.Rules {
+		if raw.(map[string]interface{})["outboundTag"] == dnsOutboundTag {
+			t.Fatal("system DNS capture outside tunnel mode")
+		}
+	}
+}
+
+func TestCompileDNSPolicyFakeNeedsExplicitSet(t *testing.T) {
+	compiled, err := compileDNSPolicy(dnsControlPlane{FakeDNS: dnsFakePolicy{Enabled: true}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compiled.FakeDNS != nil || len(compiled.Warnings) == 0 {
+		t.Fatalf("fake without domains: pools %v warnings %v", compiled.FakeDNS, compiled.Warnings)
+	}
+	for _, override := range compiled.SniffingDestOverride {
+		if override == "fakedns" {
+			t.Fatal("fakedns sniffing without a fake set")
+		}
+	}
+}
+
+func TestCompileDNSPolicyRejectsLeaks(t *testing.T) {
+	cases := map[string]dnsControlPlane{
+		"local DoH":       {Resolvers: dnsResolvers{Proxy: []string{"https+local://1.1.1.1/dns-query"}}},
+		"DoH path":        {Resolvers: dnsResolvers{Proxy: []string{"https://dns.example.com/resolve"}}},
+		"system resolver": {Resolvers: dnsResolvers{Proxy: []string{"localhost"}}},
+		"overlap":         {DomainSets: dnsDomainSets{Direct: []string{"domain:example.com"}, Proxy: []string{"domain:example.com"}}},
+		"proxy resolver routed direct": {
+			Resolvers:  dnsResolvers{Proxy: []string{"10.1.1.1"}},
+			DomainSets: dnsDomainSets{DirectIPCIDRs: []string{"10.0.0.0/8"}},
+		},
+		"capture without addresses": {Tunnel: dnsTunnel{CaptureSystemDNS: true}},
+	}
+	for name, cp := range cases {
+		_, err := compileDNSPolicy(cp, true)
+		var ce *coreError
+		if !errors.As(err, &ce) || ce.Code != codeConfigInvalid {
+			t.Errorf("%s: err = %v, want CONFIG_INVALID", name, err)
+		}
+	}
+}
+
+func TestCheckDNSRoutingFindsSplitPaths(t *testing.T) {
+	dns := map[string]interface{}{"servers": []interface{}{
+		map[string]interface{}{"address": "223.5.5.5", "tag": dnsDirectPrimaryTag, "domains": []interface{}{"domain:example.com"}, "skipFallback": true},
+		map[string]interface{}{"address": "https://1.1.1.1/dns-query", "tag": dnsProxyPrimaryTag},
+	}}
+	rules := []interface{}{
+		map[string]interface{}{"type": "field", "inboundTag": []interface{}{dnsDirectPrimaryTag}, "outboundTag": directOutboundTag},
+		map[string]interface{}{"type": "field", "inboundTag": []interface{}{dnsProxyPrimaryTag}, "outboundTag": shareLinkOutboundTag},
+	}
+	// example.com is answered by the direct resolver but its traffic takes
+	// the default (proxy) route.
+	issues := checkDNSRouting(dns, rules, shareLinkOutboundTag, dnsDomainSets{Proxy: []string{"domain:example.com"}})
+	if len(issues) != 1 || !strings.Contains(issues[0].Message, "resolved via") {
+		t.Fatalf("issues = %v", issues)
+	}
+}
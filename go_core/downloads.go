@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Artifact kinds accepted by StartArtifactDownload.
+const (
+	artifactKindXray    = "xray"
+	artifactKindGeodata = "geodata"
+	artifactKindRuleSet = "ruleset"
+)
+
+// Download states reported by GetDownloadProgress.
+const (
+	downloadRunning  = "running"
+	downloadDone     = "done"
+	downloadFailed   = "failed"
+	downloadCanceled = "canceled"
+)
+
+const (
+	downloadPartExt          = ".part"
+	downloadProgressInterval = 250 * time.Millisecond
+	// downloadKeepFinished bounds how many finished downloads stay visible.
+	downloadKeepFinished = 32
+)
+
+// downloadIdleTimeout aborts a transfer that stops delivering bytes; there is
+// no overall deadline because artifacts can be large. Tests shorten it.
+var downloadIdleTimeout = 60 * time.Second
+
+// downloadRequest describes one artifact transfer. The file is written to
+// Dest+".part" and renamed into place only after the checksum matches, so an
+// interrupted download resumes from the partial file next time. Only one
+// running transfer may write to a given Dest.
+type downloadRequest struct {
+	ID         string `json:"id"`
+	Kind       string `json:"kind"`
+	URL        string `json:"url,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Dest       string `json:"dest,omitempty"`
+	SHA256     string `json:"sha256"`
+	Size       int64  `json:"size,omitempty"`
+	Executable bool   `json:"executable,omitempty"`
+	mode       os.FileMode
+}
+
+type downloadStatus struct {
+	ID        string `json:"id"`
+	Kind      string `json:"kind"`
+	URL       string `json:"url"`
+	Dest      string `json:"dest"`
+	State     string `json:"state"`
+	Received  int64  `json:"received"`
+	Total     int64  `json:"total"`
+	Resumed   bool   `json:"resumed"`
+	StartedAt int64  `json:"startedAt"`
+	UpdatedAt int64  `json:"updatedAt"`
+	Error     string `json:"error,omitempty"`
+}
+
+type downloadEntry struct {
+	status    downloadStatus
+	cancel    context.CancelFunc
+	published time.Time
+}
+
+// downloadManager tracks every artifact transfer so IsXrayDownloading and
+// GetDownloadProgress report what is really happening.
+type downloadManager struct {
+	mu      sync.Mutex
+	entries map[string]*downloadEntry
+	client  *http.Client
+}
+
+var downloads = &downloadManager{
+	entries: map[string]*downloadEntry{},
+	client:  &http.Client{},
+}
+
+// active reports whether any transfer is running.
+func (m *downloadManager) active() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, entry := range m.entries {
+		if entry.status.State == downloadRunning {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *downloadManager) snapshot() []downloadStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]downloadStatus, 0, len(m.entries))
+	for _, entry := range m.entries {
+		out = append(out, entry.status)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt < out[j].StartedAt })
+	return out
+}
+
+// cancelDownload stops a running transfer. Its partial file is kept for resume.
+func (m *downloadManager) cancelDownload(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[id]
+	if !ok || entry.status.State != downloadRunning {
+		return newCoreError(codeNotFound, "no running download with this id", false, map[string]interface{}{"id": id})
+	}
+	entry.cancel()
+	return nil
+}
+
+// begin registers a transfer, refusing a second one with the same id or the
+// same destination, since both would write the same partial file.
+func (m *downloadManager) begin(ctx context.Context, req downloadRequest) (context.Context, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry, ok := m.entries[req.ID]; ok && entry.status.State == downloadRunning {
+		return nil, newCoreError(codeAlreadyRunning, "download already in progress", true, map[string]interface{}{"id": req.ID})
+	}
+	dest := filepath.Clean(req.Dest)
+	for _, entry := range m.entries {
+		if entry.status.State == downloadRunning && filepath.Clean(entry.status.Dest) == dest {
+			return nil, newCoreError(codeAlreadyRunning, "another download is writing to this destination", true, map[string]interface{}{
+				"id":   entry.status.ID,
+				"dest": req.Dest,
+			})
+		}
+	}
+	m.pruneLocked()
+	ctx, cancel := context.WithCancel(ctx)
+	now := time.Now().UnixMilli()
+	m.entries[req.ID] = &downloadEntry{
+		status: downloadStatus{
+			ID:        req.ID,
+			Kind:      req.Kind,
+			URL:       req.URL,
+			Dest:      req.Dest,
+			State:     downloadRunning,
+			Total:     req.Size,
+			StartedAt: now,
+			UpdatedAt: now,
+		},
+		cancel: cancel,
+	}
+	return ctx, nil
+}
+
+func (m *downloadManager) pruneLocked() {
+	var finished []*downloadEntry
+	for _, entry := range m.entries {
+		if entry.status.State != downloadRunning {
+			finished = append(finished, entry)
+		}
+	}
+	if len(finished) < downloadKeepFinished {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].status.UpdatedAt < finished[j].status.UpdatedAt })
+	for _, entry := range finished[:len(finished)-downloadKeepFinished+1] {
+		delete(m.entries, entry.status.ID)
+	}
+}
+
+// update applies fn to the entry and publishes a download_progress event,
+// throttled while running so large files do not flood the event bus.
+func (m *downloadManager) update(id string, fn func(*downloadStatus)) {
+	m.mu.Lock()
+	entry, ok := m.entries[id]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	fn(&entry.status)
+	now := time.Now()
+	entry.status.UpdatedAt = now.UnixMilli()
+	publish := entry.status.State != downloadRunning || now.Sub(entry.published) >= downloadProgressInterval
+	if publish {
+		entry.published = now
+	}
+	status := entry.status
+	m.mu.Unlock()
+	if publish {
+		publishEvent(eventDownloadProgress, "", status.ID, status)
+	}
+}
+
+// fetch runs one transfer to completion. A checksum mismatch after resuming
+// discards the partial file and retries once from the start, since the
+// server copy may have changed under the old bytes.
+func (m *downloadManager) fetch(ctx context.Context, req downloadRequest) error {
+	ctx, err := m.begin(ctx, req)
+	if err != nil {
+		return err
+	}
+	return m.run(ctx, req)
+}
+
+func (m *downloadManager) run(ctx context.Context, req downloadRequest) error {
+	resumed, err := m.transfer(ctx, req)
+	if err != nil && resumed && isChecksumError(err) {
+		m.update(req.ID, func(s *downloadStatus) { s.Received = 0; s.Resumed = false })
+		_, err = m.transfer(ctx, req)
+	}
+
+	canceled := ctx.Err() != nil
+	m.mu.Lock()
+	if entry, ok := m.entries[req.ID]; ok {
+		entry.cancel()
+	}
+	m.mu.Unlock()
+	switch {
+	case err == nil:
+		m.update(req.ID, func(s *downloadStatus) { s.State = downloadDone })
+	case canceled:
+		err = newCoreError(codeCanceled, "download canceled", true, map[string]interface{}{"id": req.ID})
+		m.update(req.ID, func(s *downloadStatus) { s.State = downloadCanceled; s.Error = err.Error() })
+	default:
+		msg := err.Error()
+		m.update(req.ID, func(s *downloadStatus) { s.State = downloadFailed; s.Error = msg })
+	}
+	return err
+}
+
+func (m *downloadManager) transfer(ctx context.Context, req downloadRequest) (bool, error) {
+	if err := os.MkdirAll(filepath.Dir(req.Dest), 0o700); err != nil {
+		return false, err
+	}
+	part := req.Dest + downloadPartExt
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	// Hash what is already on disk so the final checksum covers the whole
+	// file without a second pass.
+	digest := sha256.New()
+	offset, err := io.Copy(digest, f)
+	if err != nil {
+		return false, err
+	}
+	if req.Size > 0 && offset > req.Size {
+		offset = 0
+	}
+	if offset == 0 {
+		digest.Reset()
+		if err := f.Truncate(0); err != nil {
+			return false, err
+		}
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, req.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	httpReq.Header.Set("User-Agent", subscriptionUserAgent)
+	if offset > 0 {
+		httpReq.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := m.client.Do(httpReq)
+	if err != nil {
+		return false, downloadError(parent, err, req.URL)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			return false, newCoreError(codeIO, "artifact server sent an unexpected range", true, map[string]interface{}{"url": req.URL})
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file already holds every byte.
+		resp.Body.Close()
+		return true, finishDownload(f, part, req, digest, offset)
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		// Server ignored the range; start over.
+		offset = 0
+		digest.Reset()
+		if err := f.Truncate(0); err != nil {
+			return false, err
+		}
+	default:
+		return false, newCoreError(codeIO, fmt.Sprintf("artifact server returned %d", resp.StatusCode), resp.StatusCode >= 500, map[string]interface{}{
+			"url":    req.URL,
+			"status": resp.StatusCode,
+		})
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return false, err
+	}
+	resumed := offset > 0
+	total := req.Size
+	if total == 0 && resp.ContentLength > 0 {
+		total = offset + resp.ContentLength
+	}
+	m.update(req.ID, func(s *downloadStatus) {
+		s.Received, s.Total, s.Resumed = offset, total, resumed
+	})
+
+	// Reset the idle timer on every read; a stalled server cancels the request.
+	idle := time.AfterFunc(downloadIdleTimeout, cancel)
+	defer idle.Stop()
+	buf := make([]byte, 64<<10)
+	received := offset
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			idle.Reset(downloadIdleTimeout)
+			if _, err := f.Write(buf[:n]); err != nil {
+				return resumed, err
+			}
+			digest.Write(buf[:n])
+			received += int64(n)
+			if req.Size > 0 && received > req.Size {
+				return resumed, newCoreError(codeIO, "artifact is larger than expected", false, map[string]interface{}{"url": req.URL})
+			}
+			m.update(req.ID, func(s *downloadStatus) { s.Received = received })
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return resumed, downloadError(parent, readErr, req.URL)
+		}
+	}
+	return resumed, finishDownload(f, part, req, digest, received)
+}
+
+// finishDownload verifies size and checksum and moves the partial file into
+// place. A mismatch deletes the partial file so the next attempt starts clean.
+func finishDownload(f *os.File, part string, req downloadRequest, digest hash.Hash, size int64) error {
+	if req.Size > 0 && size != req.Size {
+		return newCoreError(codeIO, fmt.Sprintf("got %d bytes, expected %d", size, req.Size), true, map[string]interface{}{"url": req.URL})
+	}
+	if sum := hex.EncodeToString(digest.Sum(nil)); !strings.EqualFold(sum, req.SHA256) {
+		f.Close()
+		os.Remove(part)
+		return newCoreError(codeConfigInvalid, filepath.Base(req.Dest)+" failed sha256 verification", true, map[string]interface{}{
+			"url":      req.URL,
+			"expected": req.SHA256,
+			"actual":   sum,
+			"checksum": true,
+		})
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	mode := req.mode
+	if mode == 0 {
+		mode = 0o600
+	}
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(part, req.Dest)
+}
+
+func isChecksumError(err error) bool {
+	var ce *coreError
+	return errors.As(err, &ce) && ce.Details != nil && ce.Details["checksum"] == true
+}
+
+// downloadError maps a transport error. parent is the caller's context: when
+// it is done the host canceled; otherwise a canceled request means the idle
+// timer fired.
+func downloadError(parent context.Context, err error, rawURL string) error {
+	if parent.Err() != nil {
+		return context.Canceled
+	}
+	if errors.Is(err, context.Canceled) {
+		return newCoreError(codeIO, "download stalled", true, map[string]interface{}{"url": rawURL})
+	}
+	return wrapCoreError(codeIO, err, true, map[string]interface{}{"url": rawURL})
+}
+
+// contentRangeStart parses the first byte offset of "bytes start-end/total".
+func contentRangeStart(header string) (int64, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(header), "bytes ")
+	if !ok {
+		return 0, false
+	}
+	start, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(start, 10, 64)
+	return n, err == nil
+}
+
+// prepareArtifactDownload validates a host request: artifacts only come from
+// artifactBaseURL, must carry a sha256 and land under the data directory
+// unless the host names an absolute destination.
+func prepareArtifactDownload(req downloadRequest) (downloadRequest, error) {
+	switch req.Kind {
+	case artifactKindXray, artifactKindGeodata, artifactKindRuleSet:
+	default:
+		return req, newCoreError(codeInvalidArgument, "kind must be xray, geodata or ruleset", false, map[string]interface{}{"kind": req.Kind})
+	}
+	if sum, err := hex.DecodeString(req.SHA256); err != nil || len(sum) != sha256.Size {
+		return req, newCoreError(codeInvalidArgument, "sha256 must be 64 hex characters", false, nil)
+	}
+	if req.Size < 0 {
+		return req, newCoreError(codeInvalidArgument, "size must not be negative", false, nil)
+	}
+	clean := path.Clean("/" + strings.TrimSpace(req.Path))
+	if req.URL != "" || clean == "/" || strings.Contains(req.Path, "..") {
+		return req, newCoreError(codeInvalidArgument, "path must be a file under the artifact server", false, map[string]interface{}{"path": req.Path})
+	}
+	base, _ := url.Parse(artifactBaseURL)
+	req.URL = base.JoinPath(clean).String()
+	if req.Dest == "" {
+		req.Dest = filepath.Join(coreDataDir(), "artifacts", req.Kind, path.Base(clean))
+	} else if !filepath.IsAbs(req.Dest) {
+		return req, newCoreError(codeInvalidArgument, "dest must be an absolute path", false, map[string]interface{}{"dest": req.Dest})
+	}
+	if req.ID == "" {
+		req.ID = req.Kind + ":" + clean
+	}
+	if req.Kind == artifactKindXray || req.Executable {
+		req.mode = 0o700
+	}
+	return req, nil
+}
+
+// startArtifactDownload begins a transfer in the background and returns its
+// initial status; progress is reported through events and
+// GetDownloadProgress.
+func startArtifactDownload(req downloadRequest) (downloadStatus, error) {
+	req, err := prepareArtifactDownload(req)
+	if err != nil {
+		return downloadStatus{}, err
+	}
+	ctx, err := downloads.begin(context.Background(), req)
+	if err != nil {
+		return downloadStatus{}, err
+	}
+	downloads.mu.Lock()
+	status := downloads.entries[req.ID].status
+	downloads.mu.Unlock()
+	go func() {
+		_ = downloads.run(ctx, req)
+	}()
+	return status, nil
+}
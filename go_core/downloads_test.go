@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// artifactServer serves content with Range support and records the Range
+// header of every request.
+type artifactServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	content []byte
+	ranges  []string
+}
+
+func newArtifactServer(t *testing.T, content []byte) *artifactServer {
+	t.Helper()
+	s := &artifactServer{content: content}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		content := s.content
+		s.mu.Unlock()
+		http.ServeContent(w, r, "artifact", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *artifactServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+func testDownloadRequest(t *testing.T, id, rawURL string, content []byte) downloadRequest {
+	t.Helper()
+	sum := sha256.Sum256(content)
+	return downloadRequest{
+		ID:     id,
+		Kind:   artifactKindRuleSet,
+		URL:    rawURL,
+		Dest:   filepath.Join(t.TempDir(), "artifact.dat"),
+		SHA256: hex.EncodeToString(sum[:]),
+		Size:   int64(len(content)),
+	}
+}
+
+func downloadState(id string) downloadStatus {
+	for _, status := range downloads.snapshot() {
+		if status.ID == id {
+			return status
+		}
+	}
+	return downloadStatus{}
+}
+
+func assertDownloaded(t *testing.T, req downloadRequest, content []byte) {
+	t.Helper()
+	got, err := os.ReadFile(req.Dest)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("dest = %q, %v", got, err)
+	}
+	if _, err := os.Stat(req.Dest + downloadPartExt); !os.IsNotExist(err) {
+		t.Fatalf("partial file left behind: %v", err)
+	}
+}
+
+func TestDownloadResumesFromPartialFile(t *testing.T) {
+	content := bytes.Repeat([]byte("geodata-"), 4096)
+	server := newArtifactServer(t, content)
+	req := testDownloadRequest(t, "resume", server.URL, content)
+	half := len(content) / 2
+	if err := os.WriteFile(req.Dest+downloadPartExt, content[:half], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := downloads.fetch(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	assertDownloaded(t, req, content)
+	if got := server.requests(); len(got) != 1 || got[0] != "bytes="+strconv.Itoa(half)+"-" {
+		t.Fatalf("requests = %q", got)
+	}
+	if status := downloadState("resume"); status.State != downloadDone || !status.Resumed || status.Received != int64(len(content)) {
+		t.Fatalf("status = %+v", status)
+	}
+}
+
+func TestDownloadCompletePartialFile(t *testing.T) {
+	content := []byte("already complete")
+	server := newArtifactServer(t, content)
+	req := testDownloadRequest(t, "complete", server.URL, content)
+	if err := os.WriteFile(req.Dest+downloadPartExt, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server answers 416 for a range starting at the end of the file.
+	if err := downloads.fetch(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	assertDownloaded(t, req, content)
+	if got := server.requests(); len(got) != 1 || got[0] != "bytes="+strconv.Itoa(len(content))+"-" {
+		t.Fatalf("requests = %q", got)
+	}
+}
+
+func TestDownloadRetriesAfterStaleResume(t *testing.T) {
+	stale := bytes.Repeat([]byte("old!"), 1024)
+	content := bytes.Repeat([]byte("new!"), 1024)
+	server := newArtifactServer(t, content)
+	req := testDownloadRequest(t, "stale", server.URL, content)
+	if err := os.WriteFile(req.Dest+downloadPartExt, stale[:1000], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := downloads.fetch(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	assertDownloaded(t, req, content)
+	if got := server.requests(); len(got) != 2 || got[0] != "bytes=1000-" || got[1] != "" {
+		t.Fatalf("requests = %q, want a resume then a full retry", got)
+	}
+	if status := downloadState("stale"); status.Resumed {
+		t.Fatalf("status = %+v, want the retry reported as a fresh download", status)
+	}
+}
+
+// stallingServer sends the first chunk and then holds the response open
+// until the client goes away.
+func stallingServer(t *testing.T, chunk []byte) (*httptest.Server, <-chan struct{}) {
+	t.Helper()
+	sent := make(chan struct{})
+	var once sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(chunk)*2))
+		_, _ = w.Write(chunk)
+		w.(http.Flusher).Flush()
+		once.Do(func() { close(sent) })
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+	return server, sent
+}
+
+func TestDownloadCancelKeepsPartialFile(t *testing.T) {
+	chunk := []byte(strings.Repeat("x", 1024))
+	server, sent := stallingServer(t, chunk)
+	req := testDownloadRequest(t, "cancel", server.URL, append(chunk, chunk...))
+
+	done := make(chan error, 1)
+	go func() { done <- downloads.fetch(context.Background(), req) }()
+	<-sent
+	deadline := time.Now().Add(5 * time.Second)
+	for downloadState("cancel").Received < int64(len(chunk)) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := downloads.cancelDownload("cancel"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := <-done
+	assertCoreErrorCode(t, err, codeCanceled)
+	if status := downloadState("cancel"); status.State != downloadCanceled {
+		t.Fatalf("status = %+v", status)
+	}
+	if part, err := os.ReadFile(req.Dest + downloadPartExt); err != nil || !bytes.Equal(part, chunk) {
+		t.Fatalf("partial file = %d bytes, %v", len(part), err)
+	}
+	if err := downloads.cancelDownload("cancel"); err == nil {
+		t.Fatal("canceled a finished download")
+	}
+}
+
+func TestDownloadIdleTimeout(t *testing.T) {
+	old := downloadIdleTimeout
+	downloadIdleTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { downloadIdleTimeout = old })
+	chunk := []byte("first bytes")
+	server, _ := stallingServer(t, chunk)
+	req := testDownloadRequest(t, "idle", server.URL, append(chunk, chunk...))
+
+	err := downloads.fetch(context.Background(), req)
+	var ce *coreError
+	if !errors.As(err, &ce) || ce.Code != codeIO || !strings.Contains(ce.Message, "stalled") {
+		t.Fatalf("err = %v, want a stalled IO error", err)
+	}
+	if status := downloadState("idle"); status.State != downloadFailed {
+		t.Fatalf("status = %+v", status)
+	}
+}
+
+func TestDownloadRefusesSharedDest(t *testing.T) {
+	chunk := []byte("slow")
+	server, _ := stallingServer(t, chunk)
+	first := testDownloadRequest(t, "first", server.URL, append(chunk, chunk...))
+	ctx, err := downloads.begin(context.Background(), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- downloads.run(ctx, first) }()
+	t.Cleanup(func() {
+		_ = downloads.cancelDownload("first")
+		<-done
+	})
+
+	second := first
+	second.ID = "second"
+	_, err = downloads.begin(context.Background(), second)
+	assertCoreErrorCode(t, err, codeAlreadyRunning)
+	if status := downloadState("second"); status.ID != "" {
+		t.Fatalf("second download registered: %+v", status)
+	}
+
+	other := second
+	other.Dest = filepath.Join(t.TempDir(), "other.dat")
+	if _, err := downloads.begin(context.Background(), other); err != nil {
+		t.Fatalf("download to another dest refused: %v", err)
+	}
+	_ = downloads.cancelDownload("second")
+	// Drop the entry so a repeated run starts without a "second" download.
+	downloads.mu.Lock()
+	delete(downloads.entries, "second")
+	downloads.mu.Unlock()
+}
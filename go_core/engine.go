@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/xtls/libxray/xray"
+)
+
+// engineState is the lifecycle state of the embedded xray core.
+type engineState string
+
+const (
+	engineStopped  engineState = "stopped"
+	engineStarting engineState = "starting"
+	engineRunning  engineState = "running"
+	engineStopping engineState = "stopping"
+	engineFailed   engineState = "failed"
+)
+
+// engineHistoryLimit bounds the number of transitions kept for diagnostics.
+const engineHistoryLimit = 32
+
+// tunFdEnvKey is the environment variable xray-core reads the TUN fd from.
+const tunFdEnvKey = "xray.tun.fd"
+
+var (
+	errAlreadyRunning = errors.New("already running")
+	errNotRunning     = errors.New("not running")
+)
+
+type engineTransition struct {
+	From  engineState `json:"from"`
+	To    engineState `json:"to"`
+	At    int64       `json:"at"`
+	Cause string      `json:"cause,omitempty"`
+}
+
+type engineSnapshot struct {
+	State    engineState        `json:"state"`
+	Node     string             `json:"node,omitempty"`
+	Since    int64              `json:"since"`
+	Cause    string             `json:"cause,omitempty"`
+	Restarts int                `json:"restarts"`
+	LastExit string             `json:"lastExit,omitempty"`
+	History  []engineTransition `json:"history"`
+}
+
+// coreEngine tracks the xray core lifecycle. Every state change is recorded
+// with a timestamp and cause so hosts can tell a crash from a clean stop.
+type coreEngine struct {
+	mu      sync.Mutex
+	state   engineState
+	node    string
+	cfg     []byte
+	since   time.Time
+	cause   string
+	history []engineTransition
+
+	// gen changes on every successful start so a supervisor can tell whether
+	// the instance it watches is still the current one.
+	gen      uint64
+	crashed  bool
+	restarts int
+	lastExit string
+}
+
+// instMu serialises start/stop requests coming from the FFI exports.
+var instMu sync.Mutex
+
+var engine = &coreEngine{state: engineStopped, since: time.Now()}
+
+// The libXray calls the engine drives. Tests replace them with a fake core.
+var (
+	xrayRun = func(cfg string) error {
+		return xray.RunXrayFromJSON("", "", cfg)
+	}
+	xrayStop    = xray.StopXray
+	xrayRunning = xray.GetXrayState
+)
+
+func (e *coreEngine) transitionLocked(to engineState, cause string) {
+	now := time.Now()
+	from := e.state
+	e.history = append(e.history, engineTransition{
+		From:  from,
+		To:    to,
+		At:    now.UnixMilli(),
+		Cause: cause,
+	})
+	if len(e.history) > engineHistoryLimit {
+		e.history = e.history[len(e.history)-engineHistoryLimit:]
+	}
+	e.state = to
+	e.since = now
+	e.cause = cause
+	publishEvent(eventStateChanged, e.node, cause, map[string]string{
+		"from": string(from),
+		"to":   string(to),
+	})
+}
+
+// reconcileLocked notices a core that stopped without going through stop().
+func (e *coreEngine) reconcileLocked() {
+	if e.state == engineRunning && !xrayRunning() {
+		reason := "core stopped unexpectedly"
+		if last := lastCoreError(); last != "" {
+			reason += ": " + last
+		}
+		e.crashed = true
+		e.lastExit = reason
+		e.transitionLocked(engineFailed, reason)
+	}
+}
+
+func (e *coreEngine) snapshot() engineSnapshot {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.reconcileLocked()
+	history := make([]engineTransition, len(e.history))
+	copy(history, e.history)
+	return engineSnapshot{
+		State:    e.state,
+		Node:     e.node,
+		Since:    e.since.UnixMilli(),
+		Cause:    e.cause,
+		Restarts: e.restarts,
+		LastExit: e.lastExit,
+		History:  history,
+	}
+}
+
+func (e *coreEngine) running() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.reconcileLocked()
+	return e.state == engineRunning
+}
+
+// isActive reports whether the core is running with the given node.
+func (e *coreEngine) isActive(node string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.reconcileLocked()
+	return e.state == engineRunning && e.node == node
+}
+
+// start launches the core. The engine lock is released while xray boots so
+// state queries observe "starting"; callers serialise through instMu.
+func (e *coreEngine) start(node string, cfgData []byte) error {
+	return e.launch(node, cfgData, "start requested", false)
+}
+
+// launch starts the core and hands it to the supervisor. Restarts keep the
+// restart counter; every other start resets it.
+func (e *coreEngine) launch(node string, cfgData []byte, cause string, restart bool) error {
+	if holder, port := instances.portHolder(cfgData); holder != "" {
+		return newCoreError(codePortInUse, "inbound port is held by another node instance", true, map[string]interface{}{
+			"port":     port,
+			"instance": holder,
+		})
+	}
+	e.mu.Lock()
+	e.reconcileLocked()
+	if e.state == engineRunning || xrayRunning() {
+		e.mu.Unlock()
+		return errAlreadyRunning
+	}
+	e.node = node
+	e.cfg = append([]byte(nil), cfgData...)
+	e.crashed = false
+	lastCoreErrorMsg.Store("")
+	if !restart {
+		e.restarts = 0
+		e.lastExit = ""
+	}
+	e.transitionLocked(engineStarting, cause)
+	e.mu.Unlock()
+
+	runCfg, apiAddr, apiTag := prepareTrafficStats(cfgData)
+	err := xrayRun(string(runCfg))
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil {
+		e.transitionLocked(engineFailed, err.Error())
+		publishEvent(eventStartFailed, node, err.Error(), nil)
+		return err
+	}
+	traffic.attach(apiAddr, apiTag, restart)
+	// Callers hold instMu, so the dialer's outbound manager is the one this
+	// start registered.
+	connections.clear()
+	connections.attach(xrayDialerOutbounds)
+	e.gen++
+	e.transitionLocked(engineRunning, "core started")
+	go coreSupervisor.watch(e.gen)
+	return nil
+}
+
+func (e *coreEngine) stop(cause string) error {
+	e.mu.Lock()
+	e.reconcileLocked()
+	if !xrayRunning() {
+		if e.state != engineStopped {
+			e.transitionLocked(engineStopped, cause)
+		}
+		e.mu.Unlock()
+		clearTunFdEnv()
+		return errNotRunning
+	}
+	e.transitionLocked(engineStopping, cause)
+	e.mu.Unlock()
+
+	err := xrayStop()
+	traffic.detach()
+	connections.clear()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil {
+		e.transitionLocked(engineFailed, err.Error())
+		publishEvent(eventStopFailed, e.node, err.Error(), nil)
+		return err
+	}
+	e.transitionLocked(engineStopped, cause)
+	clearTunFdEnv()
+	return nil
+}
+
+// current returns the node and config the core was last started with.
+func (e *coreEngine) current() (string, []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.node, e.cfg
+}
+
+// tunFdEnvKeys are the spellings of the TUN fd variable the bridges set.
+var tunFdEnvKeys = []string{tunFdEnvKey, "XRAY_TUN_FD"}
+
+func clearTunFdEnv() {
+	for _, key := range tunFdEnvKeys {
+		_ = os.Unsetenv(key)
+	}
+}
+
+// tunFdEnv is the TUN fd handed to the running core by a tunnel bridge.
+// stop() clears it, so callers that restart the core inside one tunnel
+// session save it first and restore it before each start.
+type tunFdEnv map[string]string
+
+func saveTunFdEnv() tunFdEnv {
+	env := tunFdEnv{}
+	for _, key := range tunFdEnvKeys {
+		if value, ok := os.LookupEnv(key); ok {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+func (env tunFdEnv) restore() {
+	for key, value := range env {
+		_ = os.Setenv(key, value)
+	}
+}
+
+func startXrayInternal(node string, cfgData []byte) error {
+	return engine.start(node, cfgData)
+}
+
+func stopXrayInternal(cause string) error {
+	return engine.stop(cause)
+}
+
+func startNode(node string) error {
+	instMu.Lock()
+	defer instMu.Unlock()
+
+	if engine.isActive(node) {
+		return nil
+	}
+	if engine.running() {
+		return errAlreadyRunning
+	}
+	data, err := readNodeConfig(node)
+	if err != nil {
+		return err
+	}
+	if err := preflightConfig(data); err != nil {
+		return err
+	}
+	return startXrayInternal(node, data)
+}
+
+// stopNode stops the additional instance running node if there is one.
+// Otherwise it stops the primary core regardless of which node it was started
+// with, matching the previous single-instance behaviour of StopNodeService.
+func stopNode(node string) error {
+	if node != "" && instances.running(node) {
+		return instances.stop(node)
+	}
+
+	instMu.Lock()
+	defer instMu.Unlock()
+
+	if err := stopXrayInternal("stop requested"); err != nil && !errors.Is(err, errNotRunning) {
+		return err
+	}
+	return nil
+}
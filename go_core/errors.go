@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Stable error codes returned by the v2 exports. Hosts should branch on
+// these instead of matching error text.
+const (
+	codeAlreadyRunning   = "ALREADY_RUNNING"
+	codeNotRunning       = "NOT_RUNNING"
+	codeConfigInvalid    = "CONFIG_INVALID"
+	codePortInUse        = "PORT_IN_USE"
+	codeTunFdInvalid     = "TUN_FD_INVALID"
+	codeInvalidArgument  = "INVALID_ARGUMENT"
+	codeNotFound         = "NOT_FOUND"
+	codeSessionNotFound  = "SESSION_NOT_FOUND"
+	codePermissionDenied = "PERMISSION_DENIED"
+	codeIO               = "IO_ERROR"
+	codeUnsupported      = "UNSUPPORTED"
+	codeStartFailed      = "START_FAILED"
+	codeInternal         = "INTERNAL"
+	codeVaultLocked      = "VAULT_LOCKED"
+	codeCanceled         = "CANCELED"
+)
+
+// coreError is the structured error carried by the v2 JSON envelope.
+type coreError struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Retryable bool                   `json:"retryable"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	cause     error
+}
+
+func (e *coreError) Error() string {
+	return e.Message
+}
+
+func (e *coreError) Unwrap() error {
+	return e.cause
+}
+
+func newCoreError(code, message string, retryable bool, details map[string]interface{}) *coreError {
+	return &coreError{
+		Code:      code,
+		Message:   message,
+		Retryable: retryable,
+		Details:   details,
+	}
+}
+
+// wrapCoreError attaches a code to an underlying error, keeping it
+// reachable through errors.Is/As.
+func wrapCoreError(code string, err error, retryable bool, details map[string]interface{}) *coreError {
+	return &coreError{
+		Code:      code,
+		Message:   err.Error(),
+		Retryable: retryable,
+		Details:   details,
+		cause:     err,
+	}
+}
+
+// classifyError maps any error produced by the core into a coreError. Typed
+// errors are matched first; xray-core messages are only inspected as a last
+// resort so their wording is interpreted in exactly one place.
+func classifyError(err error) *coreError {
+	if err == nil {
+		return nil
+	}
+	var ce *coreError
+	if errors.As(err, &ce) {
+		return ce
+	}
+	switch {
+	case errors.Is(err, errAlreadyRunning):
+		return wrapCoreError(codeAlreadyRunning, err, false, nil)
+	case errors.Is(err, errNotRunning):
+		return wrapCoreError(codeNotRunning, err, false, nil)
+	case errors.Is(err, syscall.EADDRINUSE):
+		return wrapCoreError(codePortInUse, err, true, nil)
+	case errors.Is(err, os.ErrNotExist):
+		return wrapCoreError(codeNotFound, err, false, pathDetails(err))
+	case errors.Is(err, os.ErrPermission):
+		return wrapCoreError(codePermissionDenied, err, false, pathDetails(err))
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) {
+		return wrapCoreError(codeConfigInvalid, err, false, map[string]interface{}{"offset": syntaxErr.Offset})
+	}
+	if errors.As(err, &typeErr) {
+		return wrapCoreError(codeConfigInvalid, err, false, map[string]interface{}{"field": typeErr.Field})
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return wrapCoreError(codeIO, err, true, pathDetails(err))
+	}
+
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "address already in use"),
+		strings.Contains(msg, "only one usage of each socket address"):
+		return wrapCoreError(codePortInUse, err, true, nil)
+	case strings.Contains(msg, "failed to load config"),
+		strings.Contains(msg, "failed to build"),
+		strings.Contains(msg, "infra/conf"),
+		strings.Contains(msg, "invalid config"):
+		return wrapCoreError(codeConfigInvalid, err, false, nil)
+	case strings.Contains(msg, "failed to start"):
+		return wrapCoreError(codeStartFailed, err, true, nil)
+	}
+	return wrapCoreError(codeInternal, err, false, nil)
+}
+
+func pathDetails(err error) map[string]interface{} {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return map[string]interface{}{"path": pathErr.Path, "op": pathErr.Op}
+	}
+	return nil
+}
+
+// bridgeEnvelope is the JSON shape returned by every v2 export.
+type bridgeEnvelope struct {
+	OK    bool        `json:"ok"`
+	Data  interface{} `json:"data,omitempty"`
+	Error *coreError  `json:"error,omitempty"`
+}
+
+func envelopeJSON(data interface{}, err error) string {
+	env := bridgeEnvelope{OK: err == nil, Data: data}
+	if err != nil {
+		env.Data = nil
+		env.Error = classifyError(err)
+	}
+	payload, mErr := json.Marshal(env)
+	if mErr != nil {
+		return `{"ok":false,"error":{"code":"INTERNAL","message":"failed to encode response","retryable":false}}`
+	}
+	return string(payload)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	applog "github.com/xtls/xray-core/app/log"
+	"github.com/xtls/xray-core/common/log"
+)
+
+// Event kinds published on the core event bus.
+const (
+	eventStateChanged      = "state"
+	eventStartFailed       = "start_failed"
+	eventStopFailed        = "stop_failed"
+	eventTunnelError       = "tunnel_error"
+	eventLog               = "log"
+	eventDownloadProgress  = "download_progress"
+	eventNodeSwitched      = "node_switched"
+	eventCoreRestart       = "core_restart"
+	eventGeodataUpdated    = "geodata_updated"
+	eventNodeMeasured      = "node_measured"
+	eventMeasureFinished   = "measure_finished"
+	eventFailoverDecision  = "failover_decision"
+	eventSpeedTestProgress = "speedtest_progress"
+)
+
+// eventBufferSize bounds how many events are retained for polling hosts.
+const eventBufferSize = 512
+
+type coreEvent struct {
+	Seq     int64       `json:"seq"`
+	Kind    string      `json:"kind"`
+	At      int64       `json:"at"`
+	Node    string      `json:"node,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type coreEventBatch struct {
+	Cursor  int64       `json:"cursor"`
+	Dropped int64       `json:"dropped,omitempty"`
+	Events  []coreEvent `json:"events"`
+}
+
+// eventBus keeps a bounded, sequence-numbered history of core events.
+// Hosts drain it with a cursor; listeners are notified asynchronously so
+// publishers never block on a slow consumer.
+type eventBus struct {
+	mu        sync.Mutex
+	seq       int64
+	events    []coreEvent
+	listeners []func(coreEvent)
+	notify    chan coreEvent
+	startOnce sync.Once
+}
+
+var coreEvents = &eventBus{}
+
+func (b *eventBus) publish(kind, node, message string, data interface{}) {
+	b.mu.Lock()
+	b.seq++
+	event := coreEvent{
+		Seq:     b.seq,
+		Kind:    kind,
+		At:      time.Now().UnixMilli(),
+		Node:    node,
+		Message: message,
+		Data:    data,
+	}
+	b.events = append(b.events, event)
+	if len(b.events) > eventBufferSize {
+		b.events = b.events[len(b.events)-eventBufferSize:]
+	}
+	hasListeners := len(b.listeners) > 0
+	b.mu.Unlock()
+
+	if hasListeners {
+		select {
+		case b.notify <- event:
+		default:
+			// Listener is behind; it can catch up through poll().
+		}
+	}
+}
+
+// poll returns events with a sequence number greater than cursor. Dropped
+// reports how many events fell out of the buffer before they were read.
+func (b *eventBus) poll(cursor int64, limit int) coreEventBatch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	batch := coreEventBatch{Cursor: cursor, Events: []coreEvent{}}
+	if cursor < 0 {
+		cursor = 0
+	}
+	if len(b.events) > 0 && b.events[0].Seq > cursor+1 {
+		batch.Dropped = b.events[0].Seq - cursor - 1
+	}
+	for _, event := range b.events {
+		if event.Seq <= cursor {
+			continue
+		}
+		if limit > 0 && len(batch.Events) >= limit {
+			break
+		}
+		batch.Events = append(batch.Events, event)
+		batch.Cursor = event.Seq
+	}
+	return batch
+}
+
+func (b *eventBus) subscribe(listener func(coreEvent)) {
+	b.startOnce.Do(func() {
+		b.notify = make(chan coreEvent, 256)
+		go b.dispatch()
+	})
+	b.mu.Lock()
+	b.listeners = append(b.listeners, listener)
+	b.mu.Unlock()
+}
+
+func (b *eventBus) dispatch() {
+	for event := range b.notify {
+		b.mu.Lock()
+		listeners := append([]func(coreEvent){}, b.listeners...)
+		b.mu.Unlock()
+		for _, listener := range listeners {
+			listener(event)
+		}
+	}
+}
+
+func publishEvent(kind, node, message string, data interface{}) {
+	coreEvents.publish(kind, node, message, data)
+}
+
+// eventLogMinSeverity is the least severe xray log line that reaches the
+// event bus. Info and debug lines are written per connection under normal
+// traffic and would push state and failover events out of the buffer.
+const eventLogMinSeverity = log.Severity_Warning
+
+// eventLogHandler forwards xray warnings and errors to the event bus while
+// keeping the regular console output. Access logs only go to the console.
+type eventLogHandler struct {
+	next log.Handler
+}
+
+func (h *eventLogHandler) Handle(msg log.Message) {
+	if h.next != nil {
+		h.next.Handle(msg)
+	}
+	m, ok := msg.(*log.GeneralMessage)
+	if !ok || m.Severity == log.Severity_Unknown || m.Severity > eventLogMinSeverity {
+		return
+	}
+	level := strings.ToLower(m.Severity.String())
+	if m.Severity == log.Severity_Error {
+		lastCoreErrorMsg.Store(msg.String())
+	}
+	publishEvent(eventLog, "", msg.String(), map[string]string{"level": level})
+}
+
+// lastCoreErrorMsg keeps the most recent error logged by xray so an
+// unexpected stop can be reported with its likely reason.
+var lastCoreErrorMsg atomic.Value
+
+func lastCoreError() string {
+	if value, ok := lastCoreErrorMsg.Load().(string); ok {
+		return value
+	}
+	return ""
+}
+
+// Console and file logs both go through eventLogHandler, so a config that
+// sends its error log to a file still reports errors on the event bus.
+func init() {
+	_ = applog.RegisterHandlerCreator(applog.LogType_Console, func(applog.LogType, applog.HandlerCreatorOptions) (log.Handler, error) {
+		return &eventLogHandler{next: log.NewLogger(log.CreateStdoutLogWriter())}, nil
+	})
+	_ = applog.RegisterHandlerCreator(applog.LogType_File, func(_ applog.LogType, options applog.HandlerCreatorOptions) (log.Handler, error) {
+		writer, err := log.CreateFileLogWriter(options.Path)
+		if err != nil {
+			return nil, err
+		}
+		return &eventLogHandler{next: log.NewLogger(writer)}, nil
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/log"
+)
+
+func TestFileErrorLogReachesEventBus(t *testing.T) {
+	setTestDataDir(t)
+	useRealCore(t)
+	logPath := filepath.Join(t.TempDir(), "error.log")
+	cfg := fmt.Sprintf(`{
+  "log": {"loglevel": "warning", "error": %q},
+  "inbounds": [{"tag": "socks-in", "listen": "127.0.0.1", "port": %d, "protocol": "socks", "settings": {"udp": false}}],
+  "outbounds": [{"tag": "direct", "protocol": "freedom"}]
+}`, logPath, freeTCPPort(t))
+	if err := engine.start("file-log", []byte(cfg)); err != nil {
+		t.Fatal(err)
+	}
+
+	cursor := coreEvents.poll(0, 0).Cursor
+	marker := "file-log-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	log.Record(&log.GeneralMessage{Severity: log.Severity_Error, Content: marker})
+	if !strings.Contains(lastCoreError(), marker) {
+		t.Fatalf("last error = %q", lastCoreError())
+	}
+	var published bool
+	for _, event := range coreEvents.poll(cursor, 0).Events {
+		if event.Kind == eventLog && strings.Contains(event.Message, marker) {
+			published = event.Data.(map[string]string)["level"] == "error"
+		}
+	}
+	if !published {
+		t.Fatal("file-configured error log did not reach the event bus")
+	}
+
+	// The file keeps receiving the log as before.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(logPath)
+		if strings.Contains(string(data), marker) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("error log file = %q", data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Formats accepted by ExportNode.
+const (
+	exportFormatURI   = "uri"
+	exportFormatQRPNG = "qr-png"
+	exportFormatQRSVG = "qr-svg"
+)
+
+// exportQRSize is the edge length in pixels of exported PNG codes.
+const exportQRSize = 512
+
+type nodeExport struct {
+	Name        string `json:"name"`
+	Format      string `json:"format"`
+	URI         string `json:"uri"`
+	ContentType string `json:"contentType,omitempty"`
+	// Data is the base64 encoded QR image for the qr-* formats.
+	Data string `json:"data,omitempty"`
+}
+
+// exportNode renders a registered node as a share link and, for the qr-*
+// formats, as a QR code image of that link.
+func exportNode(name, format string) (nodeExport, error) {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format == "" {
+		format = exportFormatURI
+	}
+	switch format {
+	case exportFormatURI, exportFormatQRPNG, exportFormatQRSVG:
+	default:
+		return nodeExport{}, newCoreError(codeInvalidArgument, "unknown export format", false, map[string]interface{}{"format": format})
+	}
+	rec, err := nodes.get(name)
+	if err != nil {
+		return nodeExport{}, err
+	}
+	outbound, err := proxyOutbound(rec.Config)
+	if err != nil {
+		return nodeExport{}, err
+	}
+	spec, err := outboundSpec(outbound)
+	if err != nil {
+		return nodeExport{}, err
+	}
+	spec.Name = rec.Name
+	uri, err := spec.shareLink()
+	if err != nil {
+		return nodeExport{}, err
+	}
+
+	result := nodeExport{Name: rec.Name, Format: format, URI: uri}
+	if format == exportFormatURI {
+		return result, nil
+	}
+	code, err := qrcode.New(uri, qrcode.Medium)
+	if err != nil {
+		return nodeExport{}, wrapCoreError(codeInvalidArgument, err, false, nil)
+	}
+	var image []byte
+	if format == exportFormatQRPNG {
+		result.ContentType = "image/png"
+		if image, err = code.PNG(exportQRSize); err != nil {
+			return nodeExport{}, err
+		}
+	} else {
+		result.ContentType = "image/svg+xml"
+		image = qrSVG(code.Bitmap())
+	}
+	result.Data = base64.StdEncoding.EncodeToString(image)
+	return result, nil
+}
+
+// qrSVG draws a QR bitmap (quiet zone included) as one path of unit squares.
+func qrSVG(bitmap [][]bool) []byte {
+	size := len(bitmap)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.Bytes()
+}
+
+// proxyOutbound returns the outbound tagged "proxy", or the first outbound
+// that is not direct, blackhole or dns.
+func proxyOutbound(cfgData []byte) (map[string]interface{}, error) {
+	var doc struct {
+		Outbounds []map[string]interface{} `json:"outbounds"`
+	}
+	if err := json.Unmarshal(cfgData, &doc); err != nil {
+		return nil, wrapCoreError(codeConfigInvalid, err, false, nil)
+	}
+	var first map[string]interface{}
+	for _, outbound := range doc.Outbounds {
+		switch stringField(outbound, "protocol") {
+		case "freedom", "blackhole", "dns", "":
+			continue
+		}
+		if stringField(outbound, "tag") == shareLinkOutboundTag {
+			return outbound, nil
+		}
+		if first == nil {
+			first = outbound
+		}
+	}
+	if first == nil {
+		return nil, newCoreError(codeUnsupported, "node has no proxy outbound to export", false, nil)
+	}
+	return first, nil
+}
+
+// outboundSpec is the inverse of proxySpec.node for the fields share links
+// can carry.
+func outboundSpec(outbound map[string]interface{}) (proxySpec, error) {
+	protocol := stringField(outbound, "protocol")
+	settings, _ := outbound["settings"].(map[string]interface{})
+	stream, _ := outbound["streamSettings"].(map[string]interface{})
+	spec := proxySpec{Protocol: protocol}
+
+	// Both the vnext/servers list and the flat single-server form are
+	// accepted by xray.
+	server := settings
+	for _, key := range []string{"vnext", "servers"} {
+		if list, ok := settings[key].([]interface{}); ok && len(list) > 0 {
+			server, _ = list[0].(map[string]interface{})
+			break
+		}
+	}
+	user := server
+	if users, ok := server["users"].([]interface{}); ok && len(users) > 0 {
+		user, _ = users[0].(map[string]interface{})
+	}
+	spec.Address = stringField(server, "address")
+	spec.Port = fixedPort(server["port"])
+
+	switch protocol {
+	case "vless":
+		spec.ID = stringField(user, "id")
+		spec.Flow = stringField(user, "flow")
+		spec.Encryption = stringField(user, "encryption")
+	case "vmess":
+		spec.ID = stringField(user, "id")
+		spec.AlterID = fixedPort(user["alterId"])
+		spec.Cipher = stringField(user, "security")
+	case "trojan":
+		spec.Password = stringField(server, "password")
+		spec.Flow = stringField(server, "flow")
+	case "shadowsocks":
+		spec.Method = stringField(server, "method")
+		spec.Password = stringField(server, "password")
+		return spec, nil
+	case "hysteria":
+		spec.Protocol = "hysteria2"
+		hysteria, _ := stream["hysteriaSettings"].(map[string]interface{})
+		spec.Password = stringField(hysteria, "auth")
+		tls, _ := stream["tlsSettings"].(map[string]interface{})
+		spec.Stream.sni = stringField(tls, "serverName")
+		if allow, _ := tls["allowInsecure"].(bool); allow {
+			spec.Stream.insecure = "1"
+		}
+		if pins, ok := tls["pinnedPeerCertificateChainSha256"].([]interface{}); ok && len(pins) > 0 {
+			spec.PinSHA256, _ = pins[0].(string)
+		}
+		return spec, nil
+	default:
+		return spec, newCoreError(codeUnsupported, "protocol cannot be exported as a share link", false, map[string]interface{}{"protocol": protocol})
+	}
+	spec.Stream = streamParams(stream)
+	return spec, nil
+}
+
+// streamParams is the inverse of buildLinkStream.
+func streamParams(stream map[string]interface{}) linkStreamParams {
+	p := linkStreamParams{
+		network:  strings.ToLower(firstNonEmpty(stringField(stream, "network"), "tcp")),
+		security: strings.ToLower(firstNonEmpty(stringField(stream, "security"), "none")),
+	}
+	if p.network == "raw" {
+		p.network = "tcp"
+	}
+	switch p.network {
+	case "tcp":
+		tcp, _ := firstMap(stream, "tcpSettings", "rawSettings")["header"].(map[string]interface{})
+		if stringField(tcp, "type") == "http" {
+			p.headerType = "http"
+			request, _ := tcp["request"].(map[string]interface{})
+			// Links carry a single path, as other clients export it.
+			if paths := interfaceStrings(request["path"]); len(paths) > 0 {
+				p.path = paths[0]
+			}
+			headers, _ := request["headers"].(map[string]interface{})
+			p.host = strings.Join(interfaceStrings(headers["Host"]), ",")
+		}
+	case "ws", "httpupgrade":
+		settings := firstMap(stream, p.network+"Settings")
+		p.path = stringField(settings, "path")
+		p.host = stringField(settings, "host")
+		if p.host == "" {
+			headers, _ := settings["headers"].(map[string]interface{})
+			p.host = stringField(headers, "Host")
+		}
+	case "grpc":
+		settings := firstMap(stream, "grpcSettings")
+		p.serviceName = stringField(settings, "serviceName")
+		p.authority = stringField(settings, "authority")
+		if multi, _ := settings["multiMode"].(bool); multi {
+			p.mode = "multi"
+		}
+	case "xhttp", "splithttp":
+		p.network = "xhttp"
+		settings := firstMap(stream, "xhttpSettings", "splithttpSettings")
+		p.path = stringField(settings, "path")
+		p.host = stringField(settings, "host")
+		p.mode = stringField(settings, "mode")
+		if extra, ok := settings["extra"]; ok && extra != nil {
+			if encoded, err := json.Marshal(extra); err == nil {
+				p.extra = string(encoded)
+			}
+		}
+	}
+
+	switch p.security {
+	case "tls":
+		tls := firstMap(stream, "tlsSettings")
+		p.sni = stringField(tls, "serverName")
+		p.fingerprint = stringField(tls, "fingerprint")
+		p.alpn = strings.Join(interfaceStrings(tls["alpn"]), ",")
+		if allow, _ := tls["allowInsecure"].(bool); allow {
+			p.insecure = "1"
+		}
+	case "reality":
+		reality := firstMap(stream, "realitySettings")
+		p.sni = stringField(reality, "serverName")
+		p.fingerprint = stringField(reality, "fingerprint")
+		p.publicKey = stringField(reality, "publicKey")
+		p.shortID = stringField(reality, "shortId")
+		p.spiderX = stringField(reality, "spiderX")
+		p.mldsa65 = stringField(reality, "mldsa65Verify")
+	}
+	return p
+}
+
+// shareLink renders the spec in the canonical link format of its protocol.
+// Query keys are sorted so equal nodes always produce equal links.
+func (s proxySpec) shareLink() (string, error) {
+	if s.Address == "" || s.Port <= 0 {
+		return "", newCoreError(codeConfigInvalid, "outbound has no server address or port", false, nil)
+	}
+	host := net.JoinHostPort(s.Address, strconv.Itoa(s.Port))
+	switch s.Protocol {
+	case "vless", "trojan":
+		query := s.Stream.query()
+		secret := s.ID
+		if s.Protocol == "vless" {
+			query.Set("encryption", firstNonEmpty(s.Encryption, "none"))
+		} else {
+			secret = s.Password
+		}
+		if s.Flow != "" {
+			query.Set("flow", s.Flow)
+		}
+		u := url.URL{
+			Scheme:   s.Protocol,
+			User:     url.User(secret),
+			Host:     host,
+			RawQuery: query.Encode(),
+			Fragment: s.Name,
+		}
+		return u.String(), nil
+	case "vmess":
+		payload, err := json.Marshal(s.vmessLink())
+		if err != nil {
+			return "", err
+		}
+		return "vmess://" + base64.StdEncoding.EncodeToString(payload), nil
+	case "shadowsocks":
+		// SIP002: 2022 ciphers carry the key percent-encoded, older ones as
+		// base64url(method:password).
+		user := url.User(base64.RawURLEncoding.EncodeToString([]byte(s.Method + ":" + s.Password)))
+		if strings.HasPrefix(s.Method, "2022-") {
+			user = url.UserPassword(s.Method, s.Password)
+		}
+		u := url.URL{Scheme: "ss", User: user, Host: host, Fragment: s.Name}
+		return u.String(), nil
+	case "hysteria2":
+		query := url.Values{}
+		if s.Stream.sni != "" {
+			query.Set("sni", s.Stream.sni)
+		}
+		if isTruthy(s.Stream.insecure) {
+			query.Set("insecure", "1")
+		}
+		if s.PinSHA256 != "" {
+			query.Set("pinSHA256", s.PinSHA256)
+		}
+		u := url.URL{
+			Scheme:   "hysteria2",
+			User:     url.User(s.Password),
+			Host:     host,
+			RawQuery: query.Encode(),
+			Fragment: s.Name,
+		}
+		return u.String(), nil
+	}
+	return "", newCoreError(codeUnsupported, "protocol cannot be exported as a share link", false, map[string]interface{}{"protocol": s.Protocol})
+}
+
+// query encodes the transport and security parameters with the keys used by
+// vless:// and trojan:// links.
+func (p linkStreamParams) query() url.Values {
+	q := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+	set("type", p.network)
+	set("security", p.security)
+	set("headerType", p.headerType)
+	set("host", p.host)
+	set("path", p.path)
+	set("serviceName", p.serviceName)
+	set("authority", p.authority)
+	set("mode", p.mode)
+	set("extra", p.extra)
+	set("sni", p.sni)
+	set("fp", p.fingerprint)
+	set("alpn", p.alpn)
+	set("pbk", p.publicKey)
+	set("sid", p.shortID)
+	set("spx", p.spiderX)
+	set("pqv", p.mldsa65)
+	if isTruthy(p.insecure) {
+		q.Set("allowInsecure", "1")
+	}
+	return q
+}
+
+func (s proxySpec) vmessLink() vmessLink {
+	p := s.Stream
+	link := vmessLink{
+		V:    "2",
+		PS:   s.Name,
+		Add:  s.Address,
+		Port: strconv.Itoa(s.Port),
+		ID:   s.ID,
+		Aid:  strconv.Itoa(s.AlterID),
+		Scy:  s.Cipher,
+		Net:  p.network,
+		Host: p.host,
+		Path: p.path,
+		SNI:  p.sni,
+		ALPN: p.alpn,
+		FP:   p.fingerprint,
+	}
+	if p.security != "none" {
+		link.TLS = p.security
+	}
+	switch p.network {
+	case "grpc":
+		link.Path = p.serviceName
+		link.Type = firstNonEmpty(p.mode, "gun")
+	case "xhttp":
+		link.Type = p.mode
+	default:
+		link.Type = firstNonEmpty(p.headerType, "none")
+	}
+	return link
+}
+
+func firstMap(m map[string]interface{}, keys ...string) map[string]interface{} {
+	for _, key := range keys {
+		if value, ok := m[key].(map[string]interface{}); ok {
+			return value
+		}
+	}
+	return nil
+}
+
+// interfaceStrings accepts a JSON string or list of strings.
+func interfaceStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// exportLink renders an imported node's outbound back into a share link the
+// way ExportNode does once the node has been stored as JSON.
+func exportLink(t *testing.T, node shareLinkNode) string {
+	t.Helper()
+	stored, _ := normalizeOutbound(t, node.Outbound).(map[string]interface{})
+	spec, err := outboundSpec(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec.Name = node.Name
+	link, err := spec.shareLink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
+
+// normalizeOutbound drops the Go types of an outbound so maps built by the
+// importer compare equal to ones decoded from JSON.
+func normalizeOutbound(t *testing.T, outbound map[string]interface{}) interface{} {
+	t.Helper()
+	data, err := json.Marshal(outbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestShareLinkRoundTrip(t *testing.T) {
+	links := map[string]string{
+		"vless reality":  "vless://0f0a8a4e-4f2e-4c9b-9f00-3c3a1e4d5b6a@reality.example.com:443?encryption=none&flow=xtls-rprx-vision&security=reality&sni=www.example.com&fp=chrome&pbk=Z84J2IelR9ch3k8VtlVhhs5ycBUlXA7wHBWcBrjqnAw&sid=6ba85179e30d4fc2&spx=%2F&type=tcp#Tokyo%20Reality",
+		"vless xhttp":    "vless://0f0a8a4e-4f2e-4c9b-9f00-3c3a1e4d5b6a@xhttp.example.com:443?encryption=none&security=tls&sni=xhttp.example.com&alpn=h2,http/1.1&type=xhttp&path=%2Fsplit&host=cdn.example.com&mode=packet-up#xhttp",
+		"vless tcp http": "vless://0f0a8a4e-4f2e-4c9b-9f00-3c3a1e4d5b6a@http.example.com:80?encryption=none&security=none&type=tcp&headerType=http&host=a.example.com,b.example.com&path=%2Fone,%2Ftwo%252Cthree#tcp-http",
+		"vmess ws":       "vmess://" + vmessPayload(t, vmessLink{V: "2", PS: "vmess ws", Add: "ws.example.com", Port: "443", ID: "0f0a8a4e-4f2e-4c9b-9f00-3c3a1e4d5b6a", Aid: "0", Scy: "auto", Net: "ws", Type: "none", Host: "ws.example.com", Path: "/ws", TLS: "tls", SNI: "ws.example.com"}),
+		"vmess tcp http": "vmess://" + vmessPayload(t, vmessLink{V: "2", PS: "vmess http", Add: "http.example.com", Port: "8080", ID: "0f0a8a4e-4f2e-4c9b-9f00-3c3a1e4d5b6a", Aid: "0", Scy: "auto", Net: "tcp", Type: "http", Host: "a.example.com", Path: "/a,/b%2Cc"}),
+		"vmess grpc":     "vmess://" + vmessPayload(t, vmessLink{V: "2", PS: "vmess grpc", Add: "grpc.example.com", Port: "443", ID: "0f0a8a4e-4f2e-4c9b-9f00-3c3a1e4d5b6a", Aid: "0", Scy: "auto", Net: "grpc", Type: "multi", Path: "svc", TLS: "tls", SNI: "grpc.example.com"}),
+		"trojan ws":      "trojan://secret%40pass@trojan.example.com:443?security=tls&sni=trojan.example.com&type=ws&path=%2Fws&host=trojan.example.com#trojan",
+		"trojan grpc":    "trojan://secret@trojan.example.com:443?security=tls&type=grpc&serviceName=svc&mode=multi#trojan-grpc",
+		"ss 2022":        "ss://2022-blake3-aes-128-gcm:YctPZ6U7xPPcU%2Bgp3u%2B0tx%2FtRizJN9K8y%2BuKlW2qjlI%3D@ss.example.com:8388#ss%202022",
+		"ss legacy":      "ss://YWVzLTI1Ni1nY206c2VjcmV0@ss.example.com:8388#ss-legacy",
+		"hysteria2":      "hysteria2://auth-token@hy2.example.com:443?sni=hy2.example.com&insecure=1&pinSHA256=deadbeef#hy2",
+	}
+	for name, link := range links {
+		t.Run(name, func(t *testing.T) {
+			imported, err := parseShareLink(link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exported := exportLink(t, imported)
+			again, err := parseShareLink(exported)
+			if err != nil {
+				t.Fatalf("exported link %q does not import: %v", exported, err)
+			}
+			if again.Name != imported.Name {
+				t.Errorf("name = %q, want %q", again.Name, imported.Name)
+			}
+			if got, want := normalizeOutbound(t, again.Outbound), normalizeOutbound(t, imported.Outbound); !reflect.DeepEqual(got, want) {
+				t.Errorf("outbound changed across export and import\nlink: %s\ngot:  %v\nwant: %v", exported, got, want)
+			}
+		})
+	}
+}
+
+func vmessPayload(t *testing.T, link vmessLink) string {
+	t.Helper()
+	data, err := json.Marshal(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func TestExportNodeKeepsFirstHeaderPath(t *testing.T) {
+	setTestDataDir(t)
+	cfg := []byte(`{"outbounds": [{
+  "tag": "proxy",
+  "protocol": "vless",
+  "settings": {"vnext": [{"address": "http.example.com", "port": 80, "users": [{"id": "0f0a8a4e-4f2e-4c9b-9f00-3c3a1e4d5b6a", "encryption": "none"}]}]},
+  "streamSettings": {"network": "tcp", "security": "none", "tcpSettings": {"header": {"type": "http", "request": {
+    "path": ["/one,two%", "/three"],
+    "headers": {"Host": ["a.example.com", "b.example.com"]}
+  }}}}
+}]}`)
+	// Other clients read the path parameter as one path, so only the first
+	// one is exported and it is not split again on import.
+	if _, err := nodes.upsert(nodeRecord{Name: "multi-path", Config: cfg}); err != nil {
+		t.Fatal(err)
+	}
+	export, err := exportNode("multi-path", exportFormatURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := parseShareLink(export.URI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, _ := node.Outbound["streamSettings"].(map[string]interface{})
+	header := stream["tcpSettings"].(map[string]interface{})["header"].(map[string]interface{})
+	request := header["request"].(map[string]interface{})
+	if got := interfaceStrings(request["path"]); !reflect.DeepEqual(got, []string{"/one,two%"}) {
+		t.Fatalf("paths = %q from %s", got, export.URI)
+	}
+	if !strings.HasPrefix(export.URI, "vless://") {
+		t.Fatalf("uri = %s", export.URI)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Failover decision actions.
+const (
+	failoverStay   = "stay"
+	failoverHold   = "hold"
+	failoverSwitch = "switch"
+)
+
+// Failover decision reasons, recorded with every failover_decision event.
+const (
+	failoverReasonHealthy      = "active_healthy"
+	failoverReasonActiveDown   = "active_down"
+	failoverReasonBetter       = "better_candidate"
+	failoverReasonConfirming   = "awaiting_confirmation"
+	failoverReasonCooldown     = "cooldown"
+	failoverReasonRateLimited  = "rate_limited"
+	failoverReasonNoCandidate  = "no_healthy_candidate"
+	failoverReasonSwitchFailed = "switch_failed"
+	failoverReasonNodeChanged  = "active_changed"
+)
+
+// failoverLossPenaltyMs is added to a node's score per unit of sample loss,
+// so a fast but lossy node ranks behind a slower reliable one.
+const failoverLossPenaltyMs = 1000
+
+// failoverConfig is the automatic node selection policy. The active node is
+// always measured alongside Group; it is replaced when it is down for
+// FailRounds rounds in a row, or when another node beats it by MarginMs for
+// ConfirmRounds rounds in a row. Switches for a better node wait
+// MinSwitchIntervalMs after the previous switch, and no more than
+// MaxSwitchesPerHour happen for any reason.
+type failoverConfig struct {
+	Enabled             bool     `json:"enabled"`
+	Group               []string `json:"group"`
+	Mode                string   `json:"mode"`
+	IntervalMs          int64    `json:"intervalMs"`
+	MarginMs            int64    `json:"marginMs"`
+	ConfirmRounds       int      `json:"confirmRounds"`
+	FailRounds          int      `json:"failRounds"`
+	MinSwitchIntervalMs int64    `json:"minSwitchIntervalMs"`
+	MaxSwitchesPerHour  int      `json:"maxSwitchesPerHour"`
+}
+
+var defaultFailoverConfig = failoverConfig{
+	Group:               []string{},
+	Mode:                measureModeReal,
+	IntervalMs:          60000,
+	MarginMs:            80,
+	ConfirmRounds:       3,
+	FailRounds:          2,
+	MinSwitchIntervalMs: 300000,
+	MaxSwitchesPerHour:  6,
+}
+
+// failoverDecision is the outcome of one health-check round.
+type failoverDecision struct {
+	Action           string `json:"action"`
+	Reason           string `json:"reason"`
+	Active           string `json:"active"`
+	Candidate        string `json:"candidate,omitempty"`
+	ActiveScoreMs    int64  `json:"activeScoreMs,omitempty"`
+	CandidateScoreMs int64  `json:"candidateScoreMs,omitempty"`
+	Rounds           int    `json:"rounds,omitempty"`
+	Detail           string `json:"detail,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+type failoverStatus struct {
+	Config           failoverConfig    `json:"config"`
+	Active           string            `json:"active,omitempty"`
+	LastRunAt        int64             `json:"lastRunAt,omitempty"`
+	LastDecision     *failoverDecision `json:"lastDecision,omitempty"`
+	Results          []nodeMeasurement `json:"results"`
+	SwitchesLastHour int               `json:"switchesLastHour"`
+}
+
+// failoverState is what the policy remembers between rounds.
+type failoverState struct {
+	active       string
+	downRounds   int
+	leader       string
+	leaderRounds int
+	switches     []time.Time
+}
+
+type failoverManager struct {
+	mu      sync.Mutex
+	cfg     failoverConfig
+	state   failoverState
+	status  failoverStatus
+	cancel  context.CancelFunc
+	runSeq  int64
+	running bool
+}
+
+var coreFailover = &failoverManager{cfg: defaultFailoverConfig}
+
+// failoverSwitchNode moves the core to node, keeping the TUN fd like any
+// other switch; tests replace it to simulate a failed switch.
+var failoverSwitchNode = func(node string) (switchResult, error) {
+	return switchNode(node, defaultSwitchTimeout)
+}
+
+func (f *failoverManager) config() failoverConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cfg
+}
+
+// configure applies cfg, filling zero values from the defaults, and starts
+// or stops the health-check loop to match Enabled.
+func (f *failoverManager) configure(cfg failoverConfig) (failoverStatus, error) {
+	if cfg.IntervalMs < 0 || cfg.MarginMs < 0 || cfg.ConfirmRounds < 0 || cfg.FailRounds < 0 ||
+		cfg.MinSwitchIntervalMs < 0 || cfg.MaxSwitchesPerHour < 0 {
+		return failoverStatus{}, newCoreError(codeInvalidArgument, "failover limits must not be negative", false, nil)
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = defaultFailoverConfig.Mode
+	}
+	if cfg.Mode != measureModeTCP && cfg.Mode != measureModeReal {
+		return failoverStatus{}, newCoreError(codeInvalidArgument, "failover mode must be tcp or real", false, map[string]interface{}{"mode": cfg.Mode})
+	}
+	if cfg.Group == nil {
+		cfg.Group = []string{}
+	}
+	if cfg.Enabled && len(cfg.Group) == 0 {
+		return failoverStatus{}, newCoreError(codeInvalidArgument, "failover needs a candidate group", false, nil)
+	}
+	if cfg.IntervalMs == 0 {
+		cfg.IntervalMs = defaultFailoverConfig.IntervalMs
+	}
+	if cfg.IntervalMs < 5000 {
+		cfg.IntervalMs = 5000
+	}
+	if cfg.MarginMs == 0 {
+		cfg.MarginMs = defaultFailoverConfig.MarginMs
+	}
+	if cfg.ConfirmRounds == 0 {
+		cfg.ConfirmRounds = defaultFailoverConfig.ConfirmRounds
+	}
+	if cfg.FailRounds == 0 {
+		cfg.FailRounds = defaultFailoverConfig.FailRounds
+	}
+	if cfg.MinSwitchIntervalMs == 0 {
+		cfg.MinSwitchIntervalMs = defaultFailoverConfig.MinSwitchIntervalMs
+	}
+	if cfg.MaxSwitchesPerHour == 0 {
+		cfg.MaxSwitchesPerHour = defaultFailoverConfig.MaxSwitchesPerHour
+	}
+
+	f.mu.Lock()
+	if f.cancel != nil {
+		f.cancel()
+		f.cancel = nil
+	}
+	f.cfg = cfg
+	f.state.leader, f.state.leaderRounds, f.state.downRounds = "", 0, 0
+	if cfg.Enabled {
+		ctx, cancel := context.WithCancel(context.Background())
+		f.cancel = cancel
+		go f.loop(ctx, time.Duration(cfg.IntervalMs)*time.Millisecond)
+	}
+	f.mu.Unlock()
+	return f.snapshot(), nil
+}
+
+func (f *failoverManager) snapshot() failoverStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := f.status
+	status.Config = f.cfg
+	if status.Results == nil {
+		status.Results = []nodeMeasurement{}
+	}
+	status.SwitchesLastHour = len(recentSwitches(f.state.switches, time.Now()))
+	return status
+}
+
+func (f *failoverManager) loop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		f.round(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// round measures the active node and the group, decides and, when the
+// decision is to switch, moves the core. Rounds are skipped while the core
+// is not running a registered node or another round is still in flight.
+func (f *failoverManager) round(ctx context.Context) {
+	active, _ := engine.current()
+	if active == "" || !engine.running() {
+		return
+	}
+	f.mu.Lock()
+	if f.running {
+		f.mu.Unlock()
+		return
+	}
+	f.running = true
+	f.runSeq++
+	cfg := f.cfg
+	runID := "failover-" + strconv.FormatInt(f.runSeq, 10)
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.running = false
+		f.mu.Unlock()
+	}()
+
+	candidates := []string{active}
+	for _, name := range cfg.Group {
+		if name != active {
+			candidates = append(candidates, name)
+		}
+	}
+	results := measureNodes(ctx, measureRun{RunID: runID, Mode: cfg.Mode, Nodes: candidates}, func(nodeMeasurement) {})
+	if ctx.Err() != nil {
+		return
+	}
+	byNode := make(map[string]nodeMeasurement, len(results))
+	for _, m := range results {
+		byNode[m.Node] = m
+	}
+
+	f.mu.Lock()
+	if now, _ := engine.current(); now != active {
+		// The host switched while we were measuring; these results no
+		// longer describe the active node.
+		decision := failoverDecision{Action: failoverStay, Reason: failoverReasonNodeChanged, Active: now}
+		f.record(decision, results)
+		f.mu.Unlock()
+		publishEvent(eventFailoverDecision, now, decision.Reason, decision)
+		return
+	}
+	decision := decideFailover(cfg, &f.state, active, byNode, time.Now())
+	if decision.Action == failoverSwitch {
+		f.state.switches = append(recentSwitches(f.state.switches, time.Now()), time.Now())
+	}
+	f.record(decision, results)
+	f.mu.Unlock()
+	publishEvent(eventFailoverDecision, active, decision.Reason, decision)
+	if decision.Action != failoverSwitch {
+		return
+	}
+
+	// switchNode rolls back to the active node when the candidate does not
+	// come up; the attempt still counts against the switch limits.
+	if _, err := failoverSwitchNode(decision.Candidate); err != nil {
+		decision.Action = failoverHold
+		decision.Detail = decision.Reason
+		decision.Reason = failoverReasonSwitchFailed
+		decision.Error = err.Error()
+		f.mu.Lock()
+		f.record(decision, results)
+		f.mu.Unlock()
+		publishEvent(eventFailoverDecision, active, decision.Reason, decision)
+	}
+}
+
+func (f *failoverManager) record(decision failoverDecision, results []nodeMeasurement) {
+	f.status.Active = decision.Active
+	f.status.LastRunAt = time.Now().UnixMilli()
+	f.status.LastDecision = &decision
+	f.status.Results = results
+}
+
+// decideFailover applies the policy to one round of measurements. It updates
+// the round counters in st; the caller records the switch itself.
+func decideFailover(cfg failoverConfig, st *failoverState, active string, results map[string]nodeMeasurement, now time.Time) failoverDecision {
+	if st.active != active {
+		st.active, st.downRounds, st.leader, st.leaderRounds = active, 0, "", 0
+	}
+	decision := failoverDecision{Action: failoverStay, Reason: failoverReasonHealthy, Active: active}
+
+	activeResult, measured := results[active]
+	activeDown := !measured || activeResult.Loss >= 1
+	if activeDown {
+		st.downRounds++
+	} else {
+		st.downRounds = 0
+		decision.ActiveScoreMs = failoverScore(activeResult)
+	}
+
+	best, bestScore := bestFailoverCandidate(active, results)
+	if best == "" {
+		st.leader, st.leaderRounds = "", 0
+		if activeDown {
+			decision.Reason = failoverReasonNoCandidate
+			decision.Rounds = st.downRounds
+		}
+		return decision
+	}
+	decision.Candidate, decision.CandidateScoreMs = best, bestScore
+
+	urgent := false
+	switch {
+	case activeDown:
+		decision.Reason = failoverReasonActiveDown
+		decision.Rounds = st.downRounds
+		if st.downRounds < cfg.FailRounds {
+			decision.Action = failoverHold
+			return decision
+		}
+		urgent = true
+	case decision.ActiveScoreMs-bestScore >= cfg.MarginMs:
+		if st.leader == best {
+			st.leaderRounds++
+		} else {
+			st.leader, st.leaderRounds = best, 1
+		}
+		decision.Rounds = st.leaderRounds
+		if st.leaderRounds < cfg.ConfirmRounds {
+			decision.Action = failoverHold
+			decision.Reason = failoverReasonConfirming
+			return decision
+		}
+		decision.Reason = failoverReasonBetter
+	default:
+		st.leader, st.leaderRounds = "", 0
+		return decision
+	}
+
+	recent := recentSwitches(st.switches, now)
+	if len(recent) > 0 && !urgent && now.Sub(recent[len(recent)-1]) < time.Duration(cfg.MinSwitchIntervalMs)*time.Millisecond {
+		decision.Action = failoverHold
+		decision.Detail = fmt.Sprintf("%s; last switch %s ago", decision.Reason, now.Sub(recent[len(recent)-1]).Round(time.Second))
+		decision.Reason = failoverReasonCooldown
+		return decision
+	}
+	if len(recent) >= cfg.MaxSwitchesPerHour {
+		decision.Action = failoverHold
+		decision.Detail = fmt.Sprintf("%s; %d switches in the last hour", decision.Reason, len(recent))
+		decision.Reason = failoverReasonRateLimited
+		return decision
+	}
+	decision.Action = failoverSwitch
+	st.downRounds, st.leader, st.leaderRounds = 0, "", 0
+	return decision
+}
+
+// failoverScore ranks a measurement: lower is better.
+func failoverScore(m nodeMeasurement) int64 {
+	return m.MedianMs + m.JitterMs + int64(m.Loss*failoverLossPenaltyMs)
+}
+
+// bestFailoverCandidate returns the healthy non-active node with the lowest
+// score, breaking ties by name so the choice is stable.
+func bestFailoverCandidate(active string, results map[string]nodeMeasurement) (string, int64) {
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	best, bestScore := "", int64(0)
+	for _, name := range names {
+		m := results[name]
+		if name == active || m.Loss >= 1 {
+			continue
+		}
+		if score := failoverScore(m); best == "" || score < bestScore {
+			best, bestScore = name, score
+		}
+	}
+	return best, bestScore
+}
+
+// recentSwitches drops switch times older than an hour.
+func recentSwitches(switches []time.Time, now time.Time) []time.Time {
+	kept := switches[:0:0]
+	for _, at := range switches {
+		if now.Sub(at) < time.Hour {
+			kept = append(kept, at)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func upMs(ms int64) nodeMeasurement { return nodeMeasurement{MedianMs: ms} }
+
+var downNode = nodeMeasurement{Loss: 1}
+
+// failoverRound is one health-check round fed to decideFailover.
+type failoverRound struct {
+	active  string
+	results map[string]nodeMeasurement
+	// want is action/reason, plus /candidate when a candidate is expected.
+	want string
+}
+
+func TestDecideFailover(t *testing.T) {
+	cfg := failoverConfig{
+		MarginMs:            50,
+		ConfirmRounds:       3,
+		FailRounds:          2,
+		MinSwitchIntervalMs: 5 * 60 * 1000,
+		MaxSwitchesPerHour:  2,
+	}
+	better := map[string]nodeMeasurement{"a": upMs(200), "b": upMs(100)}
+	activeDown := map[string]nodeMeasurement{"a": downNode, "b": upMs(100)}
+
+	cases := []struct {
+		name     string
+		switches []time.Duration // ago
+		rounds   []failoverRound
+	}{
+		{
+			name: "healthy active stays",
+			rounds: []failoverRound{
+				{results: map[string]nodeMeasurement{"a": upMs(100), "b": upMs(60)}, want: "stay/active_healthy/b"},
+			},
+		},
+		{
+			name: "margin is the hysteresis threshold",
+			rounds: []failoverRound{
+				{results: map[string]nodeMeasurement{"a": upMs(100), "b": upMs(51)}, want: "stay/active_healthy/b"},
+				{results: map[string]nodeMeasurement{"a": upMs(100), "b": upMs(50)}, want: "hold/awaiting_confirmation/b"},
+			},
+		},
+		{
+			name: "better node switches after confirm rounds",
+			rounds: []failoverRound{
+				{results: better, want: "hold/awaiting_confirmation/b"},
+				{results: better, want: "hold/awaiting_confirmation/b"},
+				{results: better, want: "switch/better_candidate/b"},
+			},
+		},
+		{
+			name: "a healthy round resets confirmation",
+			rounds: []failoverRound{
+				{results: better, want: "hold/awaiting_confirmation/b"},
+				{results: better, want: "hold/awaiting_confirmation/b"},
+				{results: map[string]nodeMeasurement{"a": upMs(100), "b": upMs(100)}, want: "stay/active_healthy/b"},
+				{results: better, want: "hold/awaiting_confirmation/b"},
+			},
+		},
+		{
+			name: "a new leader restarts confirmation",
+			rounds: []failoverRound{
+				{results: better, want: "hold/awaiting_confirmation/b"},
+				{results: better, want: "hold/awaiting_confirmation/b"},
+				{results: map[string]nodeMeasurement{"a": upMs(200), "b": upMs(180), "c": upMs(90)}, want: "hold/awaiting_confirmation/c"},
+				{results: map[string]nodeMeasurement{"a": upMs(200), "b": upMs(180), "c": upMs(90)}, want: "hold/awaiting_confirmation/c"},
+				{results: map[string]nodeMeasurement{"a": upMs(200), "b": upMs(180), "c": upMs(90)}, want: "switch/better_candidate/c"},
+			},
+		},
+		{
+			name: "loss ranks a fast lossy node behind a reliable one",
+			rounds: []failoverRound{
+				{results: map[string]nodeMeasurement{"a": upMs(300), "b": {MedianMs: 50, Loss: 0.34}, "c": upMs(150)}, want: "hold/awaiting_confirmation/c"},
+			},
+		},
+		{
+			name: "switching the active node by hand resets the counters",
+			rounds: []failoverRound{
+				{results: better, want: "hold/awaiting_confirmation/b"},
+				{results: better, want: "hold/awaiting_confirmation/b"},
+				{active: "c", results: map[string]nodeMeasurement{"c": upMs(200), "b": upMs(100)}, want: "hold/awaiting_confirmation/b"},
+			},
+		},
+		{
+			name:     "cooldown holds a better node",
+			switches: []time.Duration{time.Minute},
+			rounds: []failoverRound{
+				{results: better, want: "hold/awaiting_confirmation/b"},
+				{results: better, want: "hold/awaiting_confirmation/b"},
+				{results: better, want: "hold/cooldown/b"},
+			},
+		},
+		{
+			name:     "cooldown ends after the minimum interval",
+			switches: []time.Duration{10 * time.Minute},
+			rounds: []failoverRound{
+				{results: better, want: "hold/awaiting_confirmation/b"},
+				{results: better, want: "hold/awaiting_confirmation/b"},
+				{results: better, want: "switch/better_candidate/b"},
+			},
+		},
+		{
+			name: "active down switches after fail rounds",
+			rounds: []failoverRound{
+				{results: activeDown, want: "hold/active_down/b"},
+				{results: activeDown, want: "switch/active_down/b"},
+			},
+		},
+		{
+			name: "an unmeasured active node counts as down",
+			rounds: []failoverRound{
+				{results: map[string]nodeMeasurement{"b": upMs(100)}, want: "hold/active_down/b"},
+				{results: map[string]nodeMeasurement{"b": upMs(100)}, want: "switch/active_down/b"},
+			},
+		},
+		{
+			name: "a recovered round resets the down count",
+			rounds: []failoverRound{
+				{results: activeDown, want: "hold/active_down/b"},
+				{results: map[string]nodeMeasurement{"a": upMs(100), "b": upMs(100)}, want: "stay/active_healthy/b"},
+				{results: activeDown, want: "hold/active_down/b"},
+			},
+		},
+		{
+			name:     "a down active node skips the cooldown",
+			switches: []time.Duration{time.Minute},
+			rounds: []failoverRound{
+				{results: activeDown, want: "hold/active_down/b"},
+				{results: activeDown, want: "switch/active_down/b"},
+			},
+		},
+		{
+			name:     "the hourly limit holds even a down node",
+			switches: []time.Duration{10 * time.Minute, 20 * time.Minute},
+			rounds: []failoverRound{
+				{results: activeDown, want: "hold/active_down/b"},
+				{results: activeDown, want: "hold/rate_limited/b"},
+			},
+		},
+		{
+			name:     "switches older than an hour do not count",
+			switches: []time.Duration{61 * time.Minute, 2 * time.Hour},
+			rounds: []failoverRound{
+				{results: activeDown, want: "hold/active_down/b"},
+				{results: activeDown, want: "switch/active_down/b"},
+			},
+		},
+		{
+			name: "no healthy candidate",
+			rounds: []failoverRound{
+				{results: map[string]nodeMeasurement{"a": downNode, "b": downNode}, want: "stay/no_healthy_candidate"},
+				{results: map[string]nodeMeasurement{"a": downNode, "b": downNode}, want: "stay/no_healthy_candidate"},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			st := &failoverState{}
+			for _, ago := range tc.switches {
+				st.switches = append(st.switches, now.Add(-ago))
+			}
+			for i, round := range tc.rounds {
+				active := round.active
+				if active == "" {
+					active = "a"
+				}
+				d := decideFailover(cfg, st, active, round.results, now)
+				got := d.Action + "/" + d.Reason
+				if d.Candidate != "" {
+					got += "/" + d.Candidate
+				}
+				if got != round.want {
+					t.Fatalf("round %d = %s (%+v), want %s", i+1, got, d, round.want)
+				}
+			}
+		})
+	}
+}
+
+// startFailoverForTest runs node "a" (down) on the fake core with a TUN fd,
+// next to a healthy "b", and returns a manager that switches on the first
+// down round.
+func startFailoverForTest(t *testing.T) (*fakeCore, *failoverManager) {
+	t.Helper()
+	setTestDataDir(t)
+	core := useFakeCore(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	addMeasureNode(t, "a", closedAddr(t))
+	addMeasureNode(t, "b", ln.Addr().String())
+	for _, key := range tunFdEnvKeys {
+		t.Setenv(key, "42")
+	}
+	if err := startNode("a"); err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultFailoverConfig
+	cfg.Group, cfg.Mode, cfg.FailRounds = []string{"b"}, measureModeTCP, 1
+	return core, &failoverManager{cfg: cfg}
+}
+
+func TestFailoverRoundSwitchesNode(t *testing.T) {
+	core, f := startFailoverForTest(t)
+
+	f.round(context.Background())
+
+	status := f.snapshot()
+	if d := status.LastDecision; d == nil || d.Action != failoverSwitch || d.Candidate != "b" {
+		t.Fatalf("decision = %+v", status.LastDecision)
+	}
+	if node, _ := engine.current(); node != "b" || !engine.running() {
+		t.Fatalf("core runs %q (running %v), want b", node, engine.running())
+	}
+	if status.SwitchesLastHour != 1 {
+		t.Fatalf("switches = %d", status.SwitchesLastHour)
+	}
+	for i, fd := range core.startFds() {
+		if fd != "42" {
+			t.Fatalf("start %d saw TUN fd %q", i+1, fd)
+		}
+	}
+}
+
+func TestFailoverRoundRecordsFailedSwitch(t *testing.T) {
+	_, f := startFailoverForTest(t)
+	old := failoverSwitchNode
+	t.Cleanup(func() { failoverSwitchNode = old })
+	var asked []string
+	failoverSwitchNode = func(node string) (switchResult, error) {
+		asked = append(asked, node)
+		return switchResult{}, errors.New("candidate did not come up")
+	}
+
+	f.round(context.Background())
+
+	d := f.snapshot().LastDecision
+	if len(asked) != 1 || asked[0] != "b" {
+		t.Fatalf("switch requests = %v", asked)
+	}
+	if d == nil || d.Action != failoverHold || d.Reason != failoverReasonSwitchFailed || d.Detail != failoverReasonActiveDown || d.Error == "" {
+		t.Fatalf("decision = %+v", d)
+	}
+	if node, _ := engine.current(); node != "a" {
+		t.Fatalf("core runs %q, want a", node)
+	}
+	if n := f.snapshot().SwitchesLastHour; n != 1 {
+		t.Fatalf("failed attempt not counted: %d", n)
+	}
+}
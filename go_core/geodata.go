@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// geodataAssetEnv is the xray-core setting (platform.AssetLocation) that
+// decides where geoip.dat and geosite.dat are loaded from.
+const geodataAssetEnv = "xray.location.asset"
+
+const (
+	geodataTimeout      = 5 * time.Minute
+	geodataManifestMax  = 1 << 20
+	geodataManifestName = "manifest.json"
+	geodataSignatureExt = ".sig"
+)
+
+// geodataRequiredFiles must be present in every manifest; routing rules using
+// geoip:/geosite: fail to build without them.
+var geodataRequiredFiles = []string{"geoip.dat", "geosite.dat"}
+
+// geodataManifestURL is the signed manifest published next to the other
+// release artifacts; the detached ed25519 signature lives at the same URL
+// plus ".sig".
+var geodataManifestURL = artifactBaseURL + "/xstream/geodata/" + geodataManifestName
+
+// geodataManifest lists one published set of geo files. File URLs may be
+// relative to the manifest URL.
+type geodataManifest struct {
+	Version string        `json:"version"`
+	Files   []geodataFile `json:"files"`
+}
+
+type geodataFile struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+type geodataVersion struct {
+	Version     string              `json:"version"`
+	InstalledAt int64               `json:"installedAt"`
+	Files       []geodataFileStatus `json:"files"`
+}
+
+type geodataFileStatus struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Valid reports whether the file on disk still matches the manifest.
+	Valid bool `json:"valid"`
+}
+
+type geodataStatus struct {
+	AssetDir    string          `json:"assetDir"`
+	ManifestURL string          `json:"manifestUrl"`
+	Active      bool            `json:"active"`
+	Updating    bool            `json:"updating"`
+	UpToDate    bool            `json:"upToDate,omitempty"`
+	Current     *geodataVersion `json:"current,omitempty"`
+	Previous    *geodataVersion `json:"previous,omitempty"`
+	LastError   string          `json:"lastError,omitempty"`
+}
+
+var (
+	geodataMu       sync.Mutex
+	geodataUpdating bool
+	geodataLastErr  string
+	geodataClient   = &http.Client{}
+)
+
+func init() {
+	applyGeodataAssetDir()
+}
+
+// geodataRoot holds current/ (the active set) and previous/ (the set
+// replaced by the last update, kept for rollback).
+func geodataRoot() string {
+	return filepath.Join(coreDataDir(), "geodata")
+}
+
+func geodataCurrentDir() string  { return filepath.Join(geodataRoot(), "current") }
+func geodataPreviousDir() string { return filepath.Join(geodataRoot(), "previous") }
+
+// applyGeodataAssetDir points xray at the managed directory once it holds a
+// complete set, so configs built afterwards resolve geoip:/geosite: there.
+func applyGeodataAssetDir() {
+	dir := geodataCurrentDir()
+	for _, name := range geodataRequiredFiles {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return
+		}
+	}
+	_ = os.Setenv(geodataAssetEnv, dir)
+}
+
+// updateGeodata fetches and verifies the signed manifest, downloads files
+// whose checksum changed and swaps the new set in, keeping the old one as
+// previous/.
+func updateGeodata(ctx context.Context) (geodataStatus, error) {
+	geodataMu.Lock()
+	if geodataUpdating {
+		geodataMu.Unlock()
+		return geodataStatus{}, newCoreError(codeAlreadyRunning, "geodata update already in progress", true, nil)
+	}
+	geodataUpdating = true
+	geodataMu.Unlock()
+
+	upToDate, err := installGeodata(ctx)
+
+	geodataMu.Lock()
+	geodataUpdating = false
+	geodataLastErr = ""
+	if err != nil {
+		geodataLastErr = err.Error()
+	}
+	geodataMu.Unlock()
+	if err != nil {
+		return geodataStatus{}, err
+	}
+	status, err := getGeodataStatus()
+	status.UpToDate = upToDate
+	return status, err
+}
+
+func installGeodata(ctx context.Context) (bool, error) {
+	raw, sig, manifest, err := fetchGeodataManifest(ctx)
+	if err != nil {
+		return false, err
+	}
+	current := geodataCurrentDir()
+	if installed, err := readGeodataManifest(current); err == nil && installed.Version == manifest.Version && geodataSetValid(current, installed) {
+		return true, nil
+	}
+
+	root := geodataRoot()
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return false, err
+	}
+	staging, err := os.MkdirTemp(root, ".staging-")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(staging)
+
+	base, _ := url.Parse(geodataManifestURL)
+	for _, file := range manifest.Files {
+		dst := filepath.Join(staging, file.Name)
+		// Unchanged files are copied from the active set instead of downloaded.
+		if sum, err := fileSHA256(filepath.Join(current, file.Name)); err == nil && strings.EqualFold(sum, file.SHA256) {
+			if err := copyFile(filepath.Join(current, file.Name), dst); err != nil {
+				return false, err
+			}
+			continue
+		}
+		ref, err := url.Parse(file.URL)
+		if err != nil {
+			return false, newCoreError(codeConfigInvalid, "geodata manifest has an invalid URL", false, map[string]interface{}{"file": file.Name})
+		}
+		if err := downloadGeodataFile(ctx, base.ResolveReference(ref).String(), dst, file); err != nil {
+			return false, err
+		}
+	}
+	if err := os.WriteFile(filepath.Join(staging, geodataManifestName), raw, 0o600); err != nil {
+		return false, err
+	}
+	if err := os.WriteFile(filepath.Join(staging, geodataManifestName+geodataSignatureExt), sig, 0o600); err != nil {
+		return false, err
+	}
+
+	previous := geodataPreviousDir()
+	if err := os.RemoveAll(previous); err != nil {
+		return false, err
+	}
+	hadCurrent := false
+	if _, err := os.Stat(current); err == nil {
+		if err := os.Rename(current, previous); err != nil {
+			return false, err
+		}
+		hadCurrent = true
+	}
+	if err := os.Rename(staging, current); err != nil {
+		if hadCurrent {
+			_ = os.Rename(previous, current)
+		}
+		return false, err
+	}
+	applyGeodataAssetDir()
+	publishEvent(eventGeodataUpdated, "", manifest.Version, nil)
+	return false, nil
+}
+
+// rollbackGeodata swaps current/ and previous/, so a second rollback undoes
+// the first.
+func rollbackGeodata() (geodataStatus, error) {
+	geodataMu.Lock()
+	if geodataUpdating {
+		geodataMu.Unlock()
+		return geodataStatus{}, newCoreError(codeAlreadyRunning, "geodata update in progress", true, nil)
+	}
+	// Hold the flag so an update cannot start halfway through the swap.
+	geodataUpdating = true
+	geodataMu.Unlock()
+
+	err := swapGeodataVersions()
+
+	geodataMu.Lock()
+	geodataUpdating = false
+	geodataMu.Unlock()
+	if err != nil {
+		return geodataStatus{}, err
+	}
+	return getGeodataStatus()
+}
+
+func swapGeodataVersions() error {
+	current, previous := geodataCurrentDir(), geodataPreviousDir()
+	manifest, err := readGeodataManifest(previous)
+	if err != nil {
+		return newCoreError(codeNotFound, "no previous geodata version to roll back to", false, nil)
+	}
+	if !geodataSetValid(previous, manifest) {
+		return newCoreError(codeConfigInvalid, "previous geodata version failed checksum verification", false, nil)
+	}
+	swap := filepath.Join(geodataRoot(), ".rollback")
+	if err := os.RemoveAll(swap); err != nil {
+		return err
+	}
+	if err := os.Rename(current, swap); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Rename(previous, current); err != nil {
+		_ = os.Rename(swap, current)
+		return err
+	}
+	if err := os.Rename(swap, previous); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	applyGeodataAssetDir()
+	publishEvent(eventGeodataUpdated, "", manifest.Version, map[string]interface{}{"rollback": true})
+	return nil
+}
+
+func getGeodataStatus() (geodataStatus, error) {
+	geodataMu.Lock()
+	status := geodataStatus{
+		AssetDir:    geodataCurrentDir(),
+		ManifestURL: geodataManifestURL,
+		Updating:    geodataUpdating,
+		LastError:   geodataLastErr,
+	}
+	geodataMu.Unlock()
+	status.Active = os.Getenv(geodataAssetEnv) == status.AssetDir
+	status.Current = geodataVersionAt(geodataCurrentDir())
+	status.Previous = geodataVersionAt(geodataPreviousDir())
+	return status, nil
+}
+
+func geodataVersionAt(dir string) *geodataVersion {
+	manifest, err := readGeodataManifest(dir)
+	if err != nil {
+		return nil
+	}
+	version := &geodataVersion{Version: manifest.Version, Files: []geodataFileStatus{}}
+	if info, err := os.Stat(filepath.Join(dir, geodataManifestName)); err == nil {
+		version.InstalledAt = info.ModTime().UnixMilli()
+	}
+	for _, file := range manifest.Files {
+		sum, err := fileSHA256(filepath.Join(dir, file.Name))
+		version.Files = append(version.Files, geodataFileStatus{
+			Name:   file.Name,
+			Size:   file.Size,
+			SHA256: file.SHA256,
+			Valid:  err == nil && strings.EqualFold(sum, file.SHA256),
+		})
+	}
+	return version
+}
+
+func fetchGeodataManifest(ctx context.Context) ([]byte, []byte, geodataManifest, error) {
+	var manifest geodataManifest
+	raw, err := fetchGeodataBytes(ctx, geodataManifestURL)
+	if err != nil {
+		return nil, nil, manifest, err
+	}
+	sig, err := fetchGeodataBytes(ctx, geodataManifestURL+geodataSignatureExt)
+	if err != nil {
+		return nil, nil, manifest, err
+	}
+	if err := verifyGeodataManifest(raw, sig); err != nil {
+		return nil, nil, manifest, err
+	}
+	manifest, err = parseGeodataManifest(raw)
+	return raw, sig, manifest, err
+}
+
+// verifyGeodataManifest checks the base64 ed25519 signature over the raw
+// manifest bytes against geodataManifestPublicKey.
+func verifyGeodataManifest(raw, sig []byte) error {
+	if geodataManifestPublicKey == "" {
+		return newCoreError(codeUnsupported, "this build has no geodata signing key", false, nil)
+	}
+	key, err := base64.StdEncoding.DecodeString(geodataManifestPublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return newCoreError(codeInternal, "geodata signing key is malformed", false, nil)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), raw, signature) {
+		return newCoreError(codePermissionDenied, "geodata manifest signature is invalid", false, nil)
+	}
+	return nil
+}
+
+func parseGeodataManifest(raw []byte) (geodataManifest, error) {
+	var manifest geodataManifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return manifest, newCoreError(codeConfigInvalid, "geodata manifest is not valid JSON: "+err.Error(), false, nil)
+	}
+	if manifest.Version == "" {
+		return manifest, newCoreError(codeConfigInvalid, "geodata manifest has no version", false, nil)
+	}
+	seen := map[string]bool{}
+	for _, file := range manifest.Files {
+		if file.Name == "" || file.Name != filepath.Base(file.Name) || file.Name == geodataManifestName || strings.HasPrefix(file.Name, ".") {
+			return manifest, newCoreError(codeConfigInvalid, "geodata manifest has an invalid file name", false, map[string]interface{}{"file": file.Name})
+		}
+		if sum, err := hex.DecodeString(file.SHA256); err != nil || len(sum) != sha256.Size {
+			return manifest, newCoreError(codeConfigInvalid, "geodata manifest has an invalid sha256", false, map[string]interface{}{"file": file.Name})
+		}
+		if file.URL == "" {
+			return manifest, newCoreError(codeConfigInvalid, "geodata manifest entry has no URL", false, map[string]interface{}{"file": file.Name})
+		}
+		seen[file.Name] = true
+	}
+	for _, name := range geodataRequiredFiles {
+		if !seen[name] {
+			return manifest, newCoreError(codeConfigInvalid, "geodata manifest is missing "+name, false, nil)
+		}
+	}
+	return manifest, nil
+}
+
+func readGeodataManifest(dir string) (geodataManifest, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, geodataManifestName))
+	if err != nil {
+		return geodataManifest{}, err
+	}
+	return parseGeodataManifest(raw)
+}
+
+func geodataSetValid(dir string, manifest geodataManifest) bool {
+	for _, file := range manifest.Files {
+		sum, err := fileSHA256(filepath.Join(dir, file.Name))
+		if err != nil || !strings.EqualFold(sum, file.SHA256) {
+			return false
+		}
+	}
+	return true
+}
+
+func fetchGeodataBytes(ctx context.Context, rawURL string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, geodataTimeout)
+	defer cancel()
+	resp, err := geodataGet(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, geodataManifestMax+1))
+	if err != nil {
+		return nil, wrapCoreError(codeIO, err, true, map[string]interface{}{"url": rawURL})
+	}
+	if len(data) > geodataManifestMax {
+		return nil, newCoreError(codeConfigInvalid, "geodata manifest is too large", false, map[string]interface{}{"url": rawURL})
+	}
+	return data, nil
+}
+
+// downloadGeodataFile fetches one file through the download manager into
+// geodata/.downloads/<sha256>, so an interrupted update resumes where it
+// stopped, and moves it into the staging directory once verified.
+func downloadGeodataFile(ctx context.Context, rawURL, dst string, file geodataFile) error {
+	cached := filepath.Join(geodataRoot(), ".downloads", strings.ToLower(file.SHA256))
+	err := downloads.fetch(ctx, downloadRequest{
+		ID:     "geodata:" + file.Name,
+		Kind:   artifactKindGeodata,
+		URL:    rawURL,
+		Dest:   cached,
+		SHA256: file.SHA256,
+		Size:   file.Size,
+	})
+	if err != nil {
+		return err
+	}
+	return os.Rename(cached, dst)
+}
+
+func geodataGet(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", subscriptionUserAgent)
+	resp, err := geodataClient.Do(req)
+	if err != nil {
+		return nil, wrapCoreError(codeIO, err, true, map[string]interface{}{"url": rawURL})
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, newCoreError(codeIO, fmt.Sprintf("artifact server returned %d", resp.StatusCode), resp.StatusCode >= 500, map[string]interface{}{
+			"url":    rawURL,
+			"status": resp.StatusCode,
+		})
+	}
+	return resp, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// geodataTestServer publishes a signed manifest and its files. publish
+// replaces the set; requests counts file downloads by name.
+type geodataTestServer struct {
+	t        *testing.T
+	priv     ed25519.PrivateKey
+	mu       sync.Mutex
+	manifest []byte
+	sig      []byte
+	files    map[string][]byte
+	requests map[string]int
+}
+
+func newGeodataTestServer(t *testing.T) *geodataTestServer {
+	t.Helper()
+	setTestDataDir(t)
+	t.Setenv(geodataAssetEnv, "")
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &geodataTestServer{t: t, priv: priv, requests: map[string]int{}}
+	server := httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(server.Close)
+
+	oldURL, oldKey := geodataManifestURL, geodataManifestPublicKey
+	t.Cleanup(func() { geodataManifestURL, geodataManifestPublicKey = oldURL, oldKey })
+	geodataManifestURL = server.URL + "/geodata/" + geodataManifestName
+	geodataManifestPublicKey = base64.StdEncoding.EncodeToString(pub)
+	return s
+}
+
+func (s *geodataTestServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := strings.TrimPrefix(r.URL.Path, "/geodata/")
+	switch name {
+	case geodataManifestName:
+		_, _ = w.Write(s.manifest)
+	case geodataManifestName + geodataSignatureExt:
+		_, _ = w.Write(s.sig)
+	default:
+		data, ok := s.files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.requests[name]++
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+	}
+}
+
+// publish signs a manifest for files with s's key.
+func (s *geodataTestServer) publish(version string, files map[string]string) {
+	s.t.Helper()
+	manifest := geodataManifest{Version: version}
+	published := map[string][]byte{}
+	for name, content := range files {
+		sum := sha256.Sum256([]byte(content))
+		manifest.Files = append(manifest.Files, geodataFile{
+			Name:   name,
+			URL:    name,
+			SHA256: hex.EncodeToString(sum[:]),
+			Size:   int64(len(content)),
+		})
+		published[name] = []byte(content)
+	}
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.manifest, s.files = raw, published
+	s.sig = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(s.priv, raw)))
+	s.mu.Unlock()
+}
+
+func (s *geodataTestServer) downloads(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[name]
+}
+
+func geodataContent(t *testing.T, dir, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestUpdateGeodataRejectsBadSignatures(t *testing.T) {
+	s := newGeodataTestServer(t)
+	s.publish("1", map[string]string{"geoip.dat": "ip-1", "geosite.dat": "site-1"})
+
+	key := geodataManifestPublicKey
+	geodataManifestPublicKey = ""
+	_, err := updateGeodata(context.Background())
+	assertCoreErrorCode(t, err, codeUnsupported)
+	geodataManifestPublicKey = key
+
+	s.mu.Lock()
+	s.manifest = []byte(strings.Replace(string(s.manifest), `"version":"1"`, `"version":"2"`, 1))
+	s.mu.Unlock()
+	_, err = updateGeodata(context.Background())
+	assertCoreErrorCode(t, err, codePermissionDenied)
+
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	s.publish("1", map[string]string{"geoip.dat": "ip-1", "geosite.dat": "site-1"})
+	s.mu.Lock()
+	s.sig = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(other, s.manifest)))
+	s.mu.Unlock()
+	_, err = updateGeodata(context.Background())
+	assertCoreErrorCode(t, err, codePermissionDenied)
+
+	if s.downloads("geoip.dat") != 0 {
+		t.Fatal("files were downloaded for an unverified manifest")
+	}
+	if _, err := os.Stat(geodataCurrentDir()); !os.IsNotExist(err) {
+		t.Fatalf("current set installed from an unverified manifest: %v", err)
+	}
+	if status, _ := getGeodataStatus(); status.LastError == "" || status.Active {
+		t.Fatalf("status = %+v", status)
+	}
+}
+
+func TestUpdateGeodataKeepsPreviousVersion(t *testing.T) {
+	s := newGeodataTestServer(t)
+	s.publish("1", map[string]string{"geoip.dat": "ip-1", "geosite.dat": "site-1"})
+	status, err := updateGeodata(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Current == nil || status.Current.Version != "1" || status.Previous != nil || !status.Active {
+		t.Fatalf("first install = %+v", status)
+	}
+	if os.Getenv(geodataAssetEnv) != geodataCurrentDir() {
+		t.Fatalf("%s = %q", geodataAssetEnv, os.Getenv(geodataAssetEnv))
+	}
+
+	status, err = updateGeodata(context.Background())
+	if err != nil || !status.UpToDate {
+		t.Fatalf("same version = %+v, %v", status, err)
+	}
+
+	s.publish("2", map[string]string{"geoip.dat": "ip-2", "geosite.dat": "site-1"})
+	status, err = updateGeodata(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Current.Version != "2" || status.Previous == nil || status.Previous.Version != "1" {
+		t.Fatalf("after update: current %+v, previous %+v", status.Current, status.Previous)
+	}
+	for _, f := range append(status.Current.Files, status.Previous.Files...) {
+		if !f.Valid {
+			t.Fatalf("file %s failed verification", f.Name)
+		}
+	}
+	if got := geodataContent(t, geodataCurrentDir(), "geoip.dat"); got != "ip-2" {
+		t.Fatalf("current geoip = %q", got)
+	}
+	if got := geodataContent(t, geodataPreviousDir(), "geoip.dat"); got != "ip-1" {
+		t.Fatalf("previous geoip = %q", got)
+	}
+	// The unchanged file comes from the active set rather than the server.
+	if n := s.downloads("geosite.dat"); n != 1 {
+		t.Fatalf("geosite.dat downloaded %d times", n)
+	}
+}
+
+func TestRollbackGeodata(t *testing.T) {
+	s := newGeodataTestServer(t)
+	_, err := rollbackGeodata()
+	assertCoreErrorCode(t, err, codeNotFound)
+
+	s.publish("1", map[string]string{"geoip.dat": "ip-1", "geosite.dat": "site-1"})
+	if _, err := updateGeodata(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.publish("2", map[string]string{"geoip.dat": "ip-2", "geosite.dat": "site-2"})
+	if _, err := updateGeodata(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := rollbackGeodata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Current.Version != "1" || status.Previous.Version != "2" || !status.Active {
+		t.Fatalf("after rollback: current %+v, previous %+v", status.Current, status.Previous)
+	}
+	if got := geodataContent(t, geodataCurrentDir(), "geosite.dat"); got != "site-1" {
+		t.Fatalf("current geosite = %q", got)
+	}
+
+	status, err = rollbackGeodata()
+	if err != nil || status.Current.Version != "2" || status.Previous.Version != "1" {
+		t.Fatalf("second rollback = %+v, %v", status, err)
+	}
+
+	// A damaged previous set is refused and the current one left in place.
+	if err := os.WriteFile(filepath.Join(geodataPreviousDir(), "geoip.dat"), []byte("corrupt"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = rollbackGeodata()
+	assertCoreErrorCode(t, err, codeConfigInvalid)
+	if got := geodataContent(t, geodataCurrentDir(), "geoip.dat"); got != "ip-2" {
+		t.Fatalf("current geoip after refused rollback = %q", got)
+	}
+}
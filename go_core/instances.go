@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	_ "unsafe" // for go:linkname
+
+	applog "github.com/xtls/xray-core/app/log"
+	xserial "github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/dns"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/infra/conf/serial"
+	"github.com/xtls/xray-core/transport/internet"
+)
+
+// The primary core is the libXray singleton driven by StartNodeService and
+// the tunnel exports; it owns the TUN device and the system proxy. Additional
+// nodes run as independent xray-core instances next to it, each with its own
+// local inbounds, so several regions can be exposed at once.
+
+// Building an xray-core instance takes over two process-wide hooks: app/log
+// registers itself as the global log handler, and core.New points the system
+// dialer's DNS client and outbound manager, which domainStrategy lookups and
+// dialerProxy use, at its own features. Neither is put back when the
+// instance closes. Side instances (additional nodes and real-delay probes)
+// therefore run without a log app, so their lines go to the primary core's
+// handler, and the dialer hooks are restored right after core.New. xray has
+// no getter for the hooks, so they are read through linkname, which the
+// compiler does not check; TestDialerHooksLinkname fails if an xray-core
+// bump renames or retypes them.
+
+//go:linkname xrayDialerDNS github.com/xtls/xray-core/transport/internet.dnsClient
+var xrayDialerDNS dns.Client
+
+//go:linkname xrayDialerOutbounds github.com/xtls/xray-core/transport/internet.obm
+var xrayDialerOutbounds outbound.Manager
+
+var logAppType = xserial.GetMessageType(&applog.Config{})
+
+// newSideInstance builds and starts an xray instance from cfgData next to the
+// primary core without taking the primary's hooks. A side instance built
+// before any other keeps its own dialer hooks until the primary starts.
+// Builds are serialised with primary starts through instMu so the hooks
+// saved are never half replaced.
+func newSideInstance(cfgData []byte) (*core.Instance, error) {
+	jsonCfg, err := serial.DecodeJSONConfig(bytes.NewReader(cfgData))
+	if err != nil {
+		return nil, wrapCoreError(codeConfigInvalid, err, false, nil)
+	}
+	coreCfg, err := jsonCfg.Build()
+	if err != nil {
+		return nil, wrapCoreError(codeConfigInvalid, err, false, nil)
+	}
+	apps := coreCfg.App[:0]
+	for _, app := range coreCfg.App {
+		if app.Type != logAppType {
+			apps = append(apps, app)
+		}
+	}
+	coreCfg.App = apps
+
+	instMu.Lock()
+	dnsClient, outbounds := xrayDialerDNS, xrayDialerOutbounds
+	server, err := core.New(coreCfg)
+	if dnsClient != nil || outbounds != nil {
+		internet.InitSystemDialer(dnsClient, outbounds)
+	}
+	instMu.Unlock()
+	if err != nil {
+		return nil, wrapCoreError(codeConfigInvalid, err, false, nil)
+	}
+	if err := server.Start(); err != nil {
+		_ = server.Close()
+		return nil, err
+	}
+	return server, nil
+}
+
+type instanceInbound struct {
+	Tag           string `json:"tag,omitempty"`
+	Protocol      string `json:"protocol"`
+	Listen        string `json:"listen"`
+	Port          int    `json:"port"`
+	RequestedPort int    `json:"requestedPort,omitempty"`
+}
+
+type nodeInstanceInfo struct {
+	Node      string            `json:"node"`
+	Primary   bool              `json:"primary"`
+	State     engineState       `json:"state"`
+	StartedAt int64             `json:"startedAt,omitempty"`
+	Inbounds  []instanceInbound `json:"inbounds"`
+}
+
+type nodeInstance struct {
+	node      string
+	cfg       []byte
+	inbounds  []instanceInbound
+	startedAt time.Time
+	server    *core.Instance
+}
+
+type instanceTable struct {
+	mu    sync.Mutex
+	items map[string]*nodeInstance
+	// starting holds the inbound ports of instances that are still being
+	// built. The table lock is not held while xray boots, since that takes
+	// instMu, which primary starts hold while they call portHolder.
+	starting map[string][]instanceInbound
+}
+
+var instances = &instanceTable{
+	items:    map[string]*nodeInstance{},
+	starting: map[string][]instanceInbound{},
+}
+
+// start launches node as an additional instance. Inbound ports that are
+// already taken by the primary core, another instance or any other process
+// are moved to a free port; the response lists the ports actually used.
+func (t *instanceTable) start(node string) (nodeInstanceInfo, error) {
+	if node == "" {
+		return nodeInstanceInfo{}, newCoreError(codeInvalidArgument, "node name is required", false, nil)
+	}
+	if engine.isActive(node) {
+		return nodeInstanceInfo{}, newCoreError(codeAlreadyRunning, "node is running as the primary core", false, map[string]interface{}{"node": node})
+	}
+	data, err := readNodeConfig(node)
+	if err != nil {
+		return nodeInstanceInfo{}, err
+	}
+	if err := preflightConfig(data); err != nil {
+		return nodeInstanceInfo{}, err
+	}
+
+	t.mu.Lock()
+	if inst, ok := t.items[node]; ok && inst.server.IsRunning() {
+		info := inst.info()
+		t.mu.Unlock()
+		return info, newCoreError(codeAlreadyRunning, "node instance is already running", false, map[string]interface{}{"node": node})
+	}
+	if _, ok := t.starting[node]; ok {
+		t.mu.Unlock()
+		return nodeInstanceInfo{}, newCoreError(codeAlreadyRunning, "node instance is already starting", false, map[string]interface{}{"node": node})
+	}
+	cfgData, inbounds, err := allocateInboundPorts(data, t.reservedPortsLocked())
+	if err != nil {
+		t.mu.Unlock()
+		return nodeInstanceInfo{}, err
+	}
+	t.starting[node] = inbounds
+	t.mu.Unlock()
+
+	server, err := newSideInstance(cfgData)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.starting, node)
+	if err != nil {
+		publishEvent(eventStartFailed, node, err.Error(), nil)
+		return nodeInstanceInfo{}, err
+	}
+	inst := &nodeInstance{
+		node:      node,
+		cfg:       cfgData,
+		inbounds:  inbounds,
+		startedAt: time.Now(),
+		server:    server,
+	}
+	t.items[node] = inst
+	publishEvent(eventStateChanged, node, "instance started", map[string]string{
+		"from": string(engineStopped),
+		"to":   string(engineRunning),
+	})
+	return inst.info(), nil
+}
+
+func (t *instanceTable) stop(node string) error {
+	t.mu.Lock()
+	inst, ok := t.items[node]
+	delete(t.items, node)
+	t.mu.Unlock()
+	if !ok {
+		return newCoreError(codeNotRunning, "node instance is not running", false, map[string]interface{}{"node": node})
+	}
+	if err := inst.server.Close(); err != nil {
+		publishEvent(eventStopFailed, node, err.Error(), nil)
+		return err
+	}
+	publishEvent(eventStateChanged, node, "instance stopped", map[string]string{
+		"from": string(engineRunning),
+		"to":   string(engineStopped),
+	})
+	return nil
+}
+
+func (t *instanceTable) running(node string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	inst, ok := t.items[node]
+	return ok && inst.server.IsRunning()
+}
+
+// status reports node as either the primary core or an additional instance.
+func (t *instanceTable) status(node string) (nodeInstanceInfo, error) {
+	if engine.isActive(node) {
+		return primaryInstanceInfo(), nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if inst, ok := t.items[node]; ok {
+		return inst.info(), nil
+	}
+	return nodeInstanceInfo{}, newCoreError(codeNotRunning, "node instance is not running", false, map[string]interface{}{"node": node})
+}
+
+// list returns the primary core (when not stopped) followed by every
+// additional instance sorted by node name.
+func (t *instanceTable) list() []nodeInstanceInfo {
+	infos := []nodeInstanceInfo{}
+	if primary := primaryInstanceInfo(); primary.State != engineStopped {
+		infos = append(infos, primary)
+	}
+	t.mu.Lock()
+	extra := make([]nodeInstanceInfo, 0, len(t.items))
+	for _, inst := range t.items {
+		extra = append(extra, inst.info())
+	}
+	t.mu.Unlock()
+	sort.Slice(extra, func(i, j int) bool { return extra[i].Node < extra[j].Node })
+	return append(infos, extra...)
+}
+
+func (t *instanceTable) reservedPortsLocked() map[int]bool {
+	reserved := map[int]bool{}
+	if engine.running() {
+		_, cfg := engine.current()
+		for _, inbound := range configInbounds(cfg) {
+			reserved[inbound.Port] = true
+		}
+	}
+	for _, inst := range t.items {
+		for _, inbound := range inst.inbounds {
+			reserved[inbound.Port] = true
+		}
+	}
+	for _, inbounds := range t.starting {
+		for _, inbound := range inbounds {
+			reserved[inbound.Port] = true
+		}
+	}
+	return reserved
+}
+
+// portHolder returns the node whose instance holds one of the fixed inbound
+// ports of cfgData, so the primary core does not start on a port an
+// additional instance was given.
+func (t *instanceTable) portHolder(cfgData []byte) (string, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, inbound := range configInbounds(cfgData) {
+		for _, inst := range t.items {
+			for _, held := range inst.inbounds {
+				if held.Port == inbound.Port {
+					return inst.node, inbound.Port
+				}
+			}
+		}
+		for node, inbounds := range t.starting {
+			for _, held := range inbounds {
+				if held.Port == inbound.Port {
+					return node, inbound.Port
+				}
+			}
+		}
+	}
+	return "", 0
+}
+
+func (inst *nodeInstance) info() nodeInstanceInfo {
+	state := engineRunning
+	if !inst.server.IsRunning() {
+		state = engineFailed
+	}
+	return nodeInstanceInfo{
+		Node:      inst.node,
+		State:     state,
+		StartedAt: inst.startedAt.UnixMilli(),
+		Inbounds:  append([]instanceInbound(nil), inst.inbounds...),
+	}
+}
+
+func primaryInstanceInfo() nodeInstanceInfo {
+	snap := engine.snapshot()
+	info := nodeInstanceInfo{
+		Node:     snap.Node,
+		Primary:  true,
+		State:    snap.State,
+		Inbounds: []instanceInbound{},
+	}
+	if snap.State == engineRunning {
+		info.StartedAt = snap.Since
+		_, cfg := engine.current()
+		info.Inbounds = configInbounds(cfg)
+	}
+	return info
+}
+
+// configInbounds lists the inbounds of a config that listen on a fixed port.
+func configInbounds(cfgData []byte) []instanceInbound {
+	var doc struct {
+		Inbounds []struct {
+			Tag      string      `json:"tag"`
+			Protocol string      `json:"protocol"`
+			Listen   string      `json:"listen"`
+			Port     interface{} `json:"port"`
+		} `json:"inbounds"`
+	}
+	inbounds := []instanceInbound{}
+	if err := json.Unmarshal(cfgData, &doc); err != nil {
+		return inbounds
+	}
+	for _, inbound := range doc.Inbounds {
+		port := fixedPort(inbound.Port)
+		if port <= 0 {
+			continue
+		}
+		inbounds = append(inbounds, instanceInbound{
+			Tag:      inbound.Tag,
+			Protocol: inbound.Protocol,
+			Listen:   inbound.Listen,
+			Port:     port,
+		})
+	}
+	return inbounds
+}
+
+// fixedPort returns the port of an inbound, or 0 for port ranges and
+// missing ports.
+func fixedPort(value interface{}) int {
+	port, err := strconv.Atoi(portString(value))
+	if err != nil {
+		return 0
+	}
+	return port
+}
+
+// allocateInboundPorts rewrites every fixed inbound port that is reserved or
+// cannot be bound to a free port chosen by the OS.
+func allocateInboundPorts(cfgData []byte, reserved map[int]bool) ([]byte, []instanceInbound, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(cfgData, &doc); err != nil {
+		return nil, nil, err
+	}
+	rawInbounds, _ := doc["inbounds"].([]interface{})
+	inbounds := []instanceInbound{}
+	for i, raw := range rawInbounds {
+		inbound, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		protocol := stringField(inbound, "protocol")
+		if protocol == "tun" {
+			return nil, nil, newCoreError(codeUnsupported, "tun inbounds can only run in the primary core", false, map[string]interface{}{
+				"path": "inbounds[" + strconv.Itoa(i) + "]",
+			})
+		}
+		requested := fixedPort(inbound["port"])
+		if requested <= 0 {
+			continue
+		}
+		listen := stringField(inbound, "listen")
+		port := requested
+		if reserved[port] || !portAvailable(listen, port) {
+			free, err := freePort(listen)
+			if err != nil {
+				return nil, nil, wrapCoreError(codePortInUse, err, true, map[string]interface{}{"port": requested})
+			}
+			port = free
+			inbound["port"] = port
+		}
+		reserved[port] = true
+		entry := instanceInbound{
+			Tag:      stringField(inbound, "tag"),
+			Protocol: protocol,
+			Listen:   listen,
+			Port:     port,
+		}
+		if port != requested {
+			entry.RequestedPort = requested
+		}
+		inbounds = append(inbounds, entry)
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, inbounds, nil
+}
+
+func bindHost(listen string) string {
+	if listen == "" {
+		return "0.0.0.0"
+	}
+	return listen
+}
+
+func portAvailable(listen string, port int) bool {
+	ln, err := net.Listen("tcp", net.JoinHostPort(bindHost(listen), strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	_ = ln.Close()
+	return true
+}
+
+func freePort(listen string) (int, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(bindHost(listen), "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/dns"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/infra/conf/serial"
+	"github.com/xtls/xray-core/transport/internet"
+	// libXray links the full feature set in the shipped library; tests
+	// build cores without it.
+	_ "github.com/xtls/xray-core/main/distro/all"
+)
+
+func freeTCPPort(t *testing.T) int {
+	t.Helper()
+	port, err := freePort("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func socksNodeConfig(port int) []byte {
+	return []byte(fmt.Sprintf(`{
+  "inbounds": [{"tag": "socks-in", "listen": "127.0.0.1", "port": %d, "protocol": "socks", "settings": {"udp": false}}],
+  "outbounds": [{"tag": "direct", "protocol": "freedom"}]
+}`, port))
+}
+
+// startPrimaryForTest builds the primary core the way libXray does, with
+// core.New in this process. Its outbound dials through dialerProxy, which
+// only works while the system dialer still points at this instance, and its
+// error log reaches lastCoreError only while its log handler is installed.
+// It returns the address of its socks inbound.
+func startPrimaryForTest(t *testing.T) string {
+	t.Helper()
+	port := freeTCPPort(t)
+	cfg := fmt.Sprintf(`{
+  "log": {"loglevel": "warning"},
+  "inbounds": [{"tag": "socks-in", "listen": "127.0.0.1", "port": %d, "protocol": "socks", "settings": {"udp": false}}],
+  "outbounds": [
+    {"tag": "out", "protocol": "freedom", "streamSettings": {"sockopt": {"dialerProxy": "hop"}}},
+    {"tag": "hop", "protocol": "freedom"}
+  ]
+}`, port)
+	jsonCfg, err := serial.DecodeJSONConfig(strings.NewReader(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	coreCfg, err := jsonCfg.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := core.New(coreCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
+// assertPrimaryHooks checks that the primary core still logs and dials.
+func assertPrimaryHooks(t *testing.T, socksAddr string) {
+	t.Helper()
+	marker := "primary-log-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	log.Record(&log.GeneralMessage{Severity: log.Severity_Error, Content: marker})
+	if !strings.Contains(lastCoreError(), marker) {
+		t.Errorf("primary core log handler was replaced; last error = %q", lastCoreError())
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "through primary")
+	}))
+	defer target.Close()
+	proxy := &url.URL{Scheme: "socks5", Host: socksAddr}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}, Timeout: 5 * time.Second}
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		t.Fatalf("primary core can no longer dial: %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); !bytes.Equal(body, []byte("through primary")) {
+		t.Fatalf("body = %q", body)
+	}
+}
+
+func TestSideInstanceKeepsPrimaryHooks(t *testing.T) {
+	setTestDataDir(t)
+	primary := startPrimaryForTest(t)
+	assertPrimaryHooks(t, primary)
+
+	if _, err := nodes.upsert(nodeRecord{Name: "side", Config: socksNodeConfig(freeTCPPort(t))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := instances.start("side"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = instances.stop("side") })
+	assertPrimaryHooks(t, primary)
+	if err := instances.stop("side"); err != nil {
+		t.Fatal(err)
+	}
+	assertPrimaryHooks(t, primary)
+}
+
+func TestPrimaryStartSkipsInstancePorts(t *testing.T) {
+	setTestDataDir(t)
+	useFakeCore(t)
+	port := freeTCPPort(t)
+	if _, err := nodes.upsert(nodeRecord{Name: "side", Config: socksNodeConfig(port)}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := instances.start("side")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = instances.stop("side") })
+	if info.Inbounds[0].Port != port {
+		t.Fatalf("instance inbounds = %+v, want port %d", info.Inbounds, port)
+	}
+
+	err = startXrayInternal("primary", socksNodeConfig(port))
+	var ce *coreError
+	if !errors.As(err, &ce) || ce.Code != codePortInUse || ce.Details["instance"] != "side" {
+		t.Fatalf("err = %v, want PORT_IN_USE held by side", err)
+	}
+	if engine.running() {
+		t.Fatal("primary started on a port held by an instance")
+	}
+}
+
+// The dialer hooks are read through linkname, which the compiler does not
+// check; this fails if xray-core renames or retypes them.
+func TestDialerHooksLinkname(t *testing.T) {
+	dnsClient, outbounds := xrayDialerDNS, xrayDialerOutbounds
+	t.Cleanup(func() { internet.InitSystemDialer(dnsClient, outbounds) })
+
+	jsonCfg, err := serial.DecodeJSONConfig(strings.NewReader(string(socksNodeConfig(freeTCPPort(t)))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	coreCfg, err := jsonCfg.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := core.New(coreCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+
+	if xrayDialerDNS == nil || xrayDialerDNS != server.GetFeature(dns.ClientType()) {
+		t.Fatalf("dialer DNS client = %T, want the one core.New installed", xrayDialerDNS)
+	}
+	if xrayDialerOutbounds == nil || xrayDialerOutbounds != server.GetFeature(outbound.ManagerType()) {
+		t.Fatalf("dialer outbound manager = %T, want the one core.New installed", xrayDialerOutbounds)
+	}
+}
+
+func TestInstanceStartRacesPrimaryStart(t *testing.T) {
+	setTestDataDir(t)
+	useFakeCore(t)
+	for name, port := range map[string]int{"side": freeTCPPort(t), "prim": freeTCPPort(t)} {
+		if _, err := nodes.upsert(nodeRecord{Name: name, Config: socksNodeConfig(port)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A deadlock holds the table lock, so nothing here may clean up through
+	// it once the test gives up.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if _, err := instances.start("side"); err != nil {
+					t.Errorf("instance start: %v", err)
+					return
+				}
+				if err := instances.stop("side"); err != nil {
+					t.Errorf("instance stop: %v", err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := startNode("prim"); err != nil {
+					t.Errorf("primary start: %v", err)
+					return
+				}
+				if err := stopNode(""); err != nil {
+					t.Errorf("primary stop: %v", err)
+					return
+				}
+			}
+		}()
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("instance and primary starts deadlocked")
+	}
+}
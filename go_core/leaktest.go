@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Leak test checks, in report order.
+const (
+	leakCheckIPv4    = "egress_ipv4"
+	leakCheckIPv6    = "egress_ipv6"
+	leakCheckDNSA    = "dns_a"
+	leakCheckDNSAAAA = "dns_aaaa"
+)
+
+// Leak check statuses. Only fail makes the report fail; warn means the
+// result could not be tied to the policy either way.
+const (
+	leakPass = "pass"
+	leakFail = "fail"
+	leakWarn = "warn"
+	leakSkip = "skip"
+)
+
+// leakTestTimeout bounds every probe request and lookup.
+const leakTestTimeout = 5 * time.Second
+
+// leakProbe is the outside observer a leak test asks. Egress reports the
+// public address a request over client arrives from, using an endpoint only
+// reachable over the given family ("4" or "6"). Names under the probe's zone
+// are only answered by its nameserver, so Resolvers can report which
+// resolvers asked for them.
+type leakProbe interface {
+	Egress(ctx context.Context, client *http.Client, family string) (string, error)
+	Resolvers(ctx context.Context, name string) ([]string, error)
+}
+
+// httpLeakProbe is a leakProbe backed by a web service the host supplies:
+// the egress URLs answer with the caller's IP as text or {"ip": ...},
+// ResolversURL answers {"resolvers": [...]} for ?name=, and Zone is served
+// by the service's authoritative nameserver.
+type httpLeakProbe struct {
+	IPv4URL      string `json:"ipv4Url"`
+	IPv6URL      string `json:"ipv6Url"`
+	ResolversURL string `json:"resolversUrl"`
+	Zone         string `json:"zone"`
+}
+
+func (p httpLeakProbe) Egress(ctx context.Context, client *http.Client, family string) (string, error) {
+	target := p.IPv4URL
+	if family == "6" {
+		target = p.IPv6URL
+	}
+	body, err := leakProbeGet(ctx, client, target)
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSpace(string(body))
+	var doc struct {
+		IP string `json:"ip"`
+	}
+	if json.Unmarshal(body, &doc) == nil && doc.IP != "" {
+		text = doc.IP
+	}
+	ip := net.ParseIP(text)
+	if ip == nil || (ip.To4() == nil) != (family == "6") {
+		return "", fmt.Errorf("probe returned %q, not an IPv%s address", text, family)
+	}
+	return ip.String(), nil
+}
+
+// inZone reports whether name is a subdomain of the probe zone.
+func (p httpLeakProbe) inZone(name string) bool {
+	zone := strings.ToLower(strings.Trim(p.Zone, "."))
+	return zone != "" && strings.HasSuffix(strings.ToLower(strings.TrimSuffix(name, ".")), "."+zone)
+}
+
+func (p httpLeakProbe) Resolvers(ctx context.Context, name string) ([]string, error) {
+	u, err := url.Parse(p.ResolversURL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Set("name", name)
+	u.RawQuery = query.Encode()
+	body, err := leakProbeGet(ctx, &http.Client{}, u.String())
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Resolvers []string `json:"resolvers"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("probe resolver list is not valid JSON: %v", err)
+	}
+	return doc.Resolvers, nil
+}
+
+func leakProbeGet(ctx context.Context, client *http.Client, target string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, leakTestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", subscriptionUserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d", target, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+}
+
+// leakPolicy is what the active config promises: in tunnel mode all system
+// traffic leaves through the node, and names outside the direct domain sets
+// are resolved by the proxy resolvers.
+type leakPolicy struct {
+	Tunnel          bool     `json:"tunnel"`
+	ProxyResolvers  []string `json:"proxyResolvers"`
+	DirectResolvers []string `json:"directResolvers"`
+	QueryStrategy   string   `json:"queryStrategy,omitempty"`
+}
+
+// leakPolicyFromConfig reads the policy from a rendered xray config. Servers
+// tagged by the DNS control plane are split by tag; untagged servers count as
+// proxy resolvers, except localhost, which is the system resolver.
+func leakPolicyFromConfig(cfgData []byte) leakPolicy {
+	policy := leakPolicy{ProxyResolvers: []string{}, DirectResolvers: []string{}}
+	var doc struct {
+		DNS      map[string]interface{}   `json:"dns"`
+		Inbounds []map[string]interface{} `json:"inbounds"`
+	}
+	if err := json.Unmarshal(cfgData, &doc); err != nil {
+		return policy
+	}
+	for _, inbound := range doc.Inbounds {
+		if stringField(inbound, "protocol") == "tun" {
+			policy.Tunnel = true
+		}
+	}
+	policy.QueryStrategy = stringField(doc.DNS, "queryStrategy")
+	servers, _ := doc.DNS["servers"].([]interface{})
+	for _, entry := range servers {
+		var address, tag string
+		switch server := entry.(type) {
+		case string:
+			address = server
+		case map[string]interface{}:
+			address, tag = stringField(server, "address"), stringField(server, "tag")
+		}
+		if address == "" || address == "fakedns" {
+			continue
+		}
+		resolver := address
+		if ip := resolverIP(address); ip != nil {
+			resolver = ip.String()
+		}
+		switch {
+		case strings.HasPrefix(tag, "dns-direct"), address == "localhost":
+			policy.DirectResolvers = append(policy.DirectResolvers, resolver)
+		case tag == dnsFakeTag:
+		default:
+			policy.ProxyResolvers = append(policy.ProxyResolvers, resolver)
+		}
+	}
+	return policy
+}
+
+// leakHostReport is what the host app saw on the system path: the egress
+// address its own requests to the probe arrived from, or why they failed,
+// and its lookups of fresh names under the probe zone. The host makes these
+// requests because the core's own sockets may bypass the tunnel, as in the
+// iOS and macOS packet tunnel extension.
+type leakHostReport struct {
+	IPv4      string     `json:"ipv4"`
+	IPv4Error string     `json:"ipv4Error"`
+	IPv6      string     `json:"ipv6"`
+	IPv6Error string     `json:"ipv6Error"`
+	A         leakLookup `json:"a"`
+	AAAA      leakLookup `json:"aaaa"`
+}
+
+// leakLookup is one system resolver lookup made by the host.
+type leakLookup struct {
+	Name    string   `json:"name"`
+	Answers []string `json:"answers"`
+	Error   string   `json:"error"`
+}
+
+// leakTestRequest is the RunLeakTest parameter.
+type leakTestRequest struct {
+	Probe  httpLeakProbe  `json:"probe"`
+	System leakHostReport `json:"system"`
+}
+
+var errLeakNotReported = errors.New("not reported by the host")
+
+// hostEgress turns one egress observation into the address or the error the
+// host saw.
+func hostEgress(ip, errMsg string) (string, error) {
+	switch {
+	case ip != "":
+		return ip, nil
+	case errMsg != "":
+		return "", errors.New(errMsg)
+	default:
+		return "", errLeakNotReported
+	}
+}
+
+type leakCheck struct {
+	Name     string   `json:"name"`
+	Status   string   `json:"status"`
+	Message  string   `json:"message"`
+	Expected []string `json:"expected"`
+	Observed []string `json:"observed"`
+}
+
+type leakReport struct {
+	Passed bool        `json:"passed"`
+	Mode   string      `json:"mode"`
+	Node   string      `json:"node,omitempty"`
+	Policy leakPolicy  `json:"policy"`
+	Checks []leakCheck `json:"checks"`
+}
+
+// runLeakTest runs every check against probe. The host's system path egress
+// is compared with the egress of proxy, the core's local inbound (nil when
+// the config has none); the resolvers that asked for the host's lookups are
+// compared with the policy. In proxy mode system traffic is not expected to
+// be tunneled, so those checks are skipped.
+func runLeakTest(ctx context.Context, probe leakProbe, proxy *http.Client, system leakHostReport, policy leakPolicy) leakReport {
+	report := leakReport{Mode: renderModeProxy, Policy: policy}
+	if policy.Tunnel {
+		report.Mode = renderModeTunnel
+	}
+	var proxyEgress []string
+	egress := func(family string) (string, error) {
+		if proxy == nil {
+			return "", fmt.Errorf("no local proxy inbound")
+		}
+		return probe.Egress(ctx, proxy, family)
+	}
+
+	sys4, sysErr4 := hostEgress(system.IPv4, system.IPv4Error)
+	node4, nodeErr4 := egress("4")
+	if nodeErr4 == nil {
+		proxyEgress = append(proxyEgress, node4)
+	}
+	check := leakCheck{Name: leakCheckIPv4, Expected: nonEmpty(node4), Observed: nonEmpty(sys4)}
+	switch {
+	case !policy.Tunnel:
+		check.Status, check.Message = leakSkip, "proxy mode: only traffic sent to the local inbound is proxied"
+	case sysErr4 == errLeakNotReported:
+		check.Status, check.Message = leakWarn, "the host did not report its IPv4 egress"
+	case sysErr4 != nil:
+		check.Status, check.Message = leakWarn, "system IPv4 probe failed: "+sysErr4.Error()
+	case nodeErr4 != nil:
+		check.Status, check.Message = leakWarn, "could not learn the node's IPv4 egress: "+nodeErr4.Error()
+	case sys4 != node4:
+		check.Status, check.Message = leakFail, fmt.Sprintf("IPv4 traffic leaves from %s instead of the node's %s", sys4, node4)
+	default:
+		check.Status, check.Message = leakPass, "IPv4 traffic leaves through the node"
+	}
+	report.Checks = append(report.Checks, check)
+
+	sys6, sysErr6 := hostEgress(system.IPv6, system.IPv6Error)
+	node6, nodeErr6 := egress("6")
+	if nodeErr6 == nil {
+		proxyEgress = append(proxyEgress, node6)
+	}
+	check = leakCheck{Name: leakCheckIPv6, Expected: nonEmpty(node6), Observed: nonEmpty(sys6)}
+	switch {
+	case !policy.Tunnel:
+		check.Status, check.Message = leakSkip, "proxy mode: only traffic sent to the local inbound is proxied"
+	case sysErr6 == errLeakNotReported:
+		check.Status, check.Message = leakWarn, "the host did not report its IPv6 egress"
+	case sysErr6 != nil:
+		check.Status, check.Message = leakPass, "no IPv6 route outside the tunnel"
+	case nodeErr6 != nil:
+		check.Status, check.Message = leakFail, fmt.Sprintf("IPv6 bypasses the tunnel: system traffic leaves from %s and the node has no IPv6 egress", sys6)
+	case sys6 != node6:
+		check.Status, check.Message = leakFail, fmt.Sprintf("IPv6 bypasses the tunnel: system traffic leaves from %s instead of the node's %s", sys6, node6)
+	default:
+		check.Status, check.Message = leakPass, "IPv6 traffic leaves through the node"
+	}
+	report.Checks = append(report.Checks, check)
+
+	report.Checks = append(report.Checks,
+		checkLeakDNS(ctx, probe, system.A, policy, proxyEgress, leakCheckDNSA, "ip4"),
+		checkLeakDNS(ctx, probe, system.AAAA, policy, proxyEgress, leakCheckDNSAAAA, "ip6"),
+	)
+	report.Passed = true
+	for _, c := range report.Checks {
+		if c.Status == leakFail {
+			report.Passed = false
+		}
+	}
+	return report
+}
+
+// checkLeakDNS asks the probe which resolvers queried the name of the host's
+// system resolver lookup. A direct resolver answering a proxied name is a
+// leak; so is any AAAA query leaving the device when the policy only
+// resolves IPv4.
+func checkLeakDNS(ctx context.Context, probe leakProbe, lookup leakLookup, policy leakPolicy, proxyEgress []string, name, network string) leakCheck {
+	check := leakCheck{Name: name, Expected: append([]string{}, policy.ProxyResolvers...), Observed: []string{}}
+	if !policy.Tunnel {
+		check.Status, check.Message = leakSkip, "proxy mode: the system resolver is not captured"
+		return check
+	}
+	host, answers, lookupErr := lookup.Name, lookup.Answers, lookup.Error
+	if host == "" {
+		check.Status, check.Message = leakWarn, "the host did not report a lookup of a probe name"
+		return check
+	}
+	seen, err := probe.Resolvers(ctx, host)
+	if err != nil {
+		check.Status, check.Message = leakWarn, "probe could not report resolvers: "+err.Error()
+		return check
+	}
+	check.Observed = append(check.Observed, seen...)
+
+	ipv4Only := network == "ip6" && policy.QueryStrategy == "UseIPv4"
+	if ipv4Only {
+		check.Expected = []string{}
+	}
+	var direct, unknown []string
+	for _, ip := range seen {
+		switch {
+		case ipv4Only:
+			unknown = append(unknown, ip)
+		case containsString(policy.ProxyResolvers, ip), containsString(proxyEgress, ip):
+		case containsString(policy.DirectResolvers, ip):
+			direct = append(direct, ip)
+		default:
+			unknown = append(unknown, ip)
+		}
+	}
+	switch {
+	case ipv4Only && len(seen) > 0:
+		check.Status, check.Message = leakFail, fmt.Sprintf("AAAA query for %s reached %s although the policy resolves IPv4 only", host, strings.Join(seen, ", "))
+	case ipv4Only && len(answers) > 0:
+		check.Status, check.Message = leakFail, fmt.Sprintf("AAAA query for %s was answered although the policy resolves IPv4 only", host)
+	case ipv4Only:
+		check.Status, check.Message = leakPass, "no AAAA query left the device"
+	case len(direct) > 0:
+		check.Status, check.Message = leakFail, fmt.Sprintf("%s was resolved by direct resolver %s", host, strings.Join(direct, ", "))
+	case len(seen) == 0 && lookupErr != "":
+		check.Status, check.Message = leakWarn, "lookup failed before reaching a resolver: "+lookupErr
+	case len(seen) == 0:
+		check.Status, check.Message = leakWarn, "the probe saw no query for "+host
+	case len(unknown) > 0:
+		check.Status, check.Message = leakWarn, fmt.Sprintf("%s was resolved by %s, which is not in the DNS policy", host, strings.Join(unknown, ", "))
+	default:
+		check.Status, check.Message = leakPass, host+" was resolved by the proxy resolvers"
+	}
+	return check
+}
+
+func nonEmpty(values ...string) []string {
+	out := []string{}
+	for _, v := range values {
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// prepareLeakTest checks that the host supplied a probe and that its
+// observations belong to it.
+func prepareLeakTest(req leakTestRequest) error {
+	probe := req.Probe
+	for _, target := range []string{probe.IPv4URL, probe.IPv6URL, probe.ResolversURL} {
+		if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return newCoreError(codeInvalidArgument, "leak probe endpoints must be http or https URLs", false, map[string]interface{}{"url": target})
+		}
+	}
+	if strings.Trim(probe.Zone, ".") == "" {
+		return newCoreError(codeInvalidArgument, "leak probe zone is required", false, nil)
+	}
+	system := req.System
+	for family, ip := range map[string]string{"4": system.IPv4, "6": system.IPv6} {
+		if parsed := net.ParseIP(ip); ip != "" && (parsed == nil || (parsed.To4() == nil) != (family == "6")) {
+			return newCoreError(codeInvalidArgument, fmt.Sprintf("system egress %q is not an IPv%s address", ip, family), false, nil)
+		}
+	}
+	for _, lookup := range []leakLookup{system.A, system.AAAA} {
+		if lookup.Name != "" && !probe.inZone(lookup.Name) {
+			return newCoreError(codeInvalidArgument, "system lookups must use names under the probe zone", false, map[string]interface{}{
+				"name": lookup.Name,
+				"zone": probe.Zone,
+			})
+		}
+	}
+	return nil
+}
+
+// leakTest runs the self-test against the running core with the host's
+// system path observations.
+func leakTest(req leakTestRequest) (leakReport, error) {
+	if err := prepareLeakTest(req); err != nil {
+		return leakReport{}, err
+	}
+	node, cfgData := engine.current()
+	if !engine.running() {
+		return leakReport{}, newCoreError(codeNotRunning, "connect before running the leak test", false, nil)
+	}
+	var proxy *http.Client
+	if proxyURL, err := activeProxyURL(); err == nil {
+		proxy = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}}
+	}
+	report := runLeakTest(context.Background(), req.Probe, proxy, req.System, leakPolicyFromConfig(cfgData))
+	report.Node = node
+	return report, nil
+}
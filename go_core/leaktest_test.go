@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeResolver is a UDP DNS server that stands in for one upstream
+// resolver. It records the names it is asked for under its public identity
+// and answers A, and AAAA unless ipv4Only is set, in which case AAAA
+// queries are answered empty without leaving the "device".
+type fakeResolver struct {
+	identity string
+	ipv4Only bool
+	conn     net.PacketConn
+	mu       sync.Mutex
+	seen     map[string]bool
+}
+
+func startFakeResolver(t *testing.T, identity string, ipv4Only bool) *fakeResolver {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeResolver{identity: identity, ipv4Only: ipv4Only, conn: conn, seen: map[string]bool{}}
+	t.Cleanup(func() { conn.Close() })
+	go r.serve()
+	return r
+}
+
+func (r *fakeResolver) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := buf[:n]
+		if n < 12 {
+			continue
+		}
+		off := 12
+		var labels []string
+		for off < n && query[off] != 0 {
+			size := int(query[off])
+			if off+1+size > n {
+				break
+			}
+			labels = append(labels, string(query[off+1:off+1+size]))
+			off += 1 + size
+		}
+		off++
+		if off+4 > n {
+			continue
+		}
+		qtype := binary.BigEndian.Uint16(query[off:])
+		off += 4
+
+		var rdata []byte
+		switch {
+		case qtype == 1:
+			rdata = net.ParseIP("192.0.2.10").To4()
+		case qtype == 28 && !r.ipv4Only:
+			rdata = net.ParseIP("2001:db8::10").To16()
+		}
+		if rdata != nil {
+			r.mu.Lock()
+			r.seen[strings.ToLower(strings.Join(labels, "."))] = true
+			r.mu.Unlock()
+		}
+		resp := append([]byte{}, query[:2]...)
+		answers := byte(0)
+		if rdata != nil {
+			answers = 1
+		}
+		resp = append(resp, 0x81, 0x80, 0, 1, 0, answers, 0, 0, 0, 0)
+		resp = append(resp, query[12:off]...)
+		if rdata != nil {
+			resp = append(resp, 0xc0, 0x0c, byte(qtype>>8), byte(qtype), 0, 1, 0, 0, 0, 60, 0, byte(len(rdata)))
+			resp = append(resp, rdata...)
+		}
+		_, _ = r.conn.WriteTo(resp, addr)
+	}
+}
+
+func (r *fakeResolver) saw(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.seen[strings.ToLower(name)]
+}
+
+// resolver returns a system resolver whose queries all reach r.
+func (r *fakeResolver) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "udp", r.conn.LocalAddr().String())
+		},
+	}
+}
+
+// hostLookup resolves a fresh name under the probe zone through r the way
+// the host app resolves it through the system resolver.
+func hostLookup(r *fakeResolver, probe httpLeakProbe, network string) leakLookup {
+	token := make([]byte, 8)
+	_, _ = rand.Read(token)
+	lookup := leakLookup{Name: "xs-" + hex.EncodeToString(token) + "." + probe.Zone, Answers: []string{}}
+	ips, err := r.resolver().LookupIP(context.Background(), network, lookup.Name)
+	for _, ip := range ips {
+		lookup.Answers = append(lookup.Answers, ip.String())
+	}
+	if err != nil {
+		lookup.Error = err.Error()
+	}
+	return lookup
+}
+
+// egressTransport marks requests with the public addresses a path would
+// leave from, which the probe server echoes back like a real one would.
+type egressTransport struct {
+	ipv4, ipv6 string
+}
+
+func (e egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Test-Egress4", e.ipv4)
+	req.Header.Set("X-Test-Egress6", e.ipv6)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// startLeakProbe serves the httpLeakProbe protocol, reporting which fake
+// resolvers saw a name.
+func startLeakProbe(t *testing.T, resolvers ...*fakeResolver) httpLeakProbe {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ip4", "/ip6":
+			ip := r.Header.Get("X-Test-Egress" + r.URL.Path[3:])
+			if ip == "" {
+				http.Error(w, "no route", http.StatusBadGateway)
+				return
+			}
+			_, _ = w.Write([]byte(ip + "\n"))
+		case "/resolvers":
+			seen := []string{}
+			for _, resolver := range resolvers {
+				if resolver.saw(r.URL.Query().Get("name")) {
+					seen = append(seen, resolver.identity)
+				}
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"resolvers": seen})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return httpLeakProbe{
+		IPv4URL:      srv.URL + "/ip4",
+		IPv6URL:      srv.URL + "/ip6",
+		ResolversURL: srv.URL + "/resolvers",
+		Zone:         "leak.test",
+	}
+}
+
+var tunnelLeakPolicy = leakPolicy{
+	Tunnel:          true,
+	ProxyResolvers:  []string{"1.1.1.1", "8.8.8.8"},
+	DirectResolvers: []string{"223.5.5.5"},
+	QueryStrategy:   "UseIPv4",
+}
+
+func leakStatuses(report leakReport) map[string]string {
+	out := map[string]string{}
+	for _, check := range report.Checks {
+		out[check.Name] = check.Status
+	}
+	return out
+}
+
+func TestLeakTestPassesWhenTunneled(t *testing.T) {
+	tunnelDNS := startFakeResolver(t, "1.1.1.1", true)
+	probe := startLeakProbe(t, tunnelDNS)
+	node := &http.Client{Transport: egressTransport{ipv4: "203.0.113.7"}}
+	system := leakHostReport{
+		IPv4:      "203.0.113.7",
+		IPv6Error: "network is unreachable",
+		A:         hostLookup(tunnelDNS, probe, "ip4"),
+		AAAA:      hostLookup(tunnelDNS, probe, "ip6"),
+	}
+
+	report := runLeakTest(context.Background(), probe, node, system, tunnelLeakPolicy)
+	want := map[string]string{
+		leakCheckIPv4:    leakPass,
+		leakCheckIPv6:    leakPass,
+		leakCheckDNSA:    leakPass,
+		leakCheckDNSAAAA: leakPass,
+	}
+	if got := leakStatuses(report); !report.Passed || !reflect.DeepEqual(got, want) {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestLeakTestReportsLeaks(t *testing.T) {
+	ispDNS := startFakeResolver(t, "223.5.5.5", false)
+	probe := startLeakProbe(t, ispDNS)
+	system := leakHostReport{
+		IPv4: "198.51.100.20",
+		IPv6: "2001:db8::20",
+		A:    hostLookup(ispDNS, probe, "ip4"),
+		AAAA: hostLookup(ispDNS, probe, "ip6"),
+	}
+	node := &http.Client{Transport: egressTransport{ipv4: "203.0.113.7"}}
+
+	report := runLeakTest(context.Background(), probe, node, system, tunnelLeakPolicy)
+	if report.Passed {
+		t.Fatal("leaky setup passed")
+	}
+	for _, check := range report.Checks {
+		if check.Status != leakFail {
+			t.Errorf("%s = %s (%s), want fail", check.Name, check.Status, check.Message)
+		}
+	}
+	if v4 := report.Checks[0]; !reflect.DeepEqual(v4.Observed, []string{"198.51.100.20"}) || !reflect.DeepEqual(v4.Expected, []string{"203.0.113.7"}) {
+		t.Errorf("ipv4 check = %+v", v4)
+	}
+	if dns := report.Checks[2]; !reflect.DeepEqual(dns.Observed, []string{"223.5.5.5"}) || !strings.Contains(dns.Message, "direct resolver 223.5.5.5") {
+		t.Errorf("dns check = %+v", dns)
+	}
+}
+
+func TestLeakTestUnknownResolverWarns(t *testing.T) {
+	otherDNS := startFakeResolver(t, "192.0.2.53", false)
+	probe := startLeakProbe(t, otherDNS)
+	node := &http.Client{Transport: egressTransport{ipv4: "203.0.113.7"}}
+	system := leakHostReport{
+		IPv4:      "203.0.113.7",
+		IPv6Error: "network is unreachable",
+		A:         hostLookup(otherDNS, probe, "ip4"),
+		AAAA:      hostLookup(otherDNS, probe, "ip6"),
+	}
+	policy := tunnelLeakPolicy
+	policy.QueryStrategy = "UseIP"
+
+	report := runLeakTest(context.Background(), probe, node, system, policy)
+	if got := leakStatuses(report); !report.Passed || got[leakCheckDNSA] != leakWarn || got[leakCheckDNSAAAA] != leakWarn {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestLeakTestWarnsWithoutHostReport(t *testing.T) {
+	probe := startLeakProbe(t)
+	node := &http.Client{Transport: egressTransport{ipv4: "203.0.113.7"}}
+
+	// Without the host's observations nothing is known about the system
+	// path; the core does not stand in for it with its own sockets.
+	report := runLeakTest(context.Background(), probe, node, leakHostReport{}, tunnelLeakPolicy)
+	for _, check := range report.Checks {
+		if check.Status != leakWarn || !strings.Contains(check.Message, "host did not report") {
+			t.Errorf("%s = %s (%s), want a warning", check.Name, check.Status, check.Message)
+		}
+	}
+	if !report.Passed {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestLeakTestSkipsProxyMode(t *testing.T) {
+	dns := startFakeResolver(t, "223.5.5.5", false)
+	probe := startLeakProbe(t, dns)
+	system := leakHostReport{IPv4: "198.51.100.20", A: hostLookup(dns, probe, "ip4")}
+	policy := tunnelLeakPolicy
+	policy.Tunnel = false
+
+	report := runLeakTest(context.Background(), probe, nil, system, policy)
+	for _, check := range report.Checks {
+		if check.Status != leakSkip {
+			t.Errorf("%s = %s, want skip", check.Name, check.Status)
+		}
+	}
+	if !report.Passed || report.Mode != renderModeProxy {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestPrepareLeakTest(t *testing.T) {
+	probe := httpLeakProbe{
+		IPv4URL:      "https://ipv4.probe.example/ip",
+		IPv6URL:      "https://ipv6.probe.example/ip",
+		ResolversURL: "https://probe.example/resolvers",
+		Zone:         "leak.probe.example.",
+	}
+	valid := leakTestRequest{Probe: probe, System: leakHostReport{
+		IPv4: "198.51.100.20",
+		IPv6: "2001:db8::20",
+		A:    leakLookup{Name: "xs-1.Leak.Probe.Example."},
+	}}
+	if err := prepareLeakTest(valid); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]func(*leakTestRequest){
+		"no probe":          func(r *leakTestRequest) { r.Probe = httpLeakProbe{} },
+		"no zone":           func(r *leakTestRequest) { r.Probe.Zone = "." },
+		"relative url":      func(r *leakTestRequest) { r.Probe.ResolversURL = "/resolvers" },
+		"ipv6 as ipv4":      func(r *leakTestRequest) { r.System.IPv4 = "2001:db8::20" },
+		"not an address":    func(r *leakTestRequest) { r.System.IPv6 = "unknown" },
+		"name outside zone": func(r *leakTestRequest) { r.System.AAAA.Name = "xs-1.example.com" },
+		"the zone itself":   func(r *leakTestRequest) { r.System.A.Name = "leak.probe.example" },
+	}
+	for name, mutate := range cases {
+		req := valid
+		mutate(&req)
+		if err := prepareLeakTest(req); err == nil {
+			t.Errorf("%s: accepted", name)
+		} else {
+			assertCoreErrorCode(t, err, codeInvalidArgument)
+		}
+	}
+}
+
+func TestLeakPolicyFromRenderedConfig(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "render", "tunnel_dns_policy.golden.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := leakPolicyFromConfig(data)
+	want := leakPolicy{
+		Tunnel:          true,
+		ProxyResolvers:  []string{"1.1.1.1", "8.8.8.8"},
+		DirectResolvers: []string{"1.1.1.1", "8.8.8.8"},
+		QueryStrategy:   "UseIPv4",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("policy = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	xnet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/core"
+)
+
+// Measurement modes accepted by MeasureNodes.
+const (
+	measureModeTCP  = "tcp"
+	measureModeReal = "real"
+	measureModeAll  = "all"
+)
+
+// Error classes reported with a measurement, so hosts can tell a dead server
+// from a broken config without parsing messages.
+const (
+	measureErrTimeout     = "timeout"
+	measureErrRefused     = "refused"
+	measureErrReset       = "reset"
+	measureErrUnreachable = "unreachable"
+	measureErrDNS         = "dns"
+	measureErrTLS         = "tls"
+	measureErrHTTP        = "http_status"
+	measureErrConfig      = "config"
+	measureErrOther       = "other"
+)
+
+var (
+	measureSamples     = 3
+	measureTimeout     = 5 * time.Second
+	measureConcurrency = 8
+	// measureURL answers 204 through any working proxy; it is the same probe
+	// the Dart side used for manual tests.
+	measureURL = "https://www.gstatic.com/generate_204"
+)
+
+// measureDialFunc dials through a node; for real-delay tests it goes through
+// a throwaway xray instance built from the node's outbound.
+type measureDialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// measureDialerFactory builds the real-delay dialer. Tests swap it for a
+// plain dialer so the HTTP path can run against local listeners.
+var measureDialerFactory = newXrayMeasureDialer
+
+// nodeMeasurement is one node's result, published as a node_measured event
+// as soon as the node finishes.
+type nodeMeasurement struct {
+	RunID      string  `json:"runId"`
+	Node       string  `json:"node"`
+	Mode       string  `json:"mode"`
+	Samples    []int64 `json:"samplesMs"`
+	Sent       int     `json:"sent"`
+	MedianMs   int64   `json:"medianMs"`
+	JitterMs   int64   `json:"jitterMs"`
+	Loss       float64 `json:"loss"`
+	ErrorClass string  `json:"errorClass,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type measureRun struct {
+	RunID string   `json:"runId"`
+	Mode  string   `json:"mode"`
+	Nodes []string `json:"nodes"`
+}
+
+var measureRunSeq atomic.Int64
+
+// startMeasureNodes validates the request and measures in the background.
+// Each result is published as node_measured; measure_finished carries the
+// full list once every node is done. An empty name list measures every
+// registered node.
+func startMeasureNodes(names []string, mode string) (measureRun, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode == "" {
+		mode = measureModeTCP
+	}
+	if mode != measureModeTCP && mode != measureModeReal && mode != measureModeAll {
+		return measureRun{}, newCoreError(codeInvalidArgument, "mode must be tcp, real or all", false, map[string]interface{}{"mode": mode})
+	}
+	if len(names) == 0 {
+		records, err := nodes.list()
+		if err != nil {
+			return measureRun{}, err
+		}
+		for _, rec := range records {
+			names = append(names, rec.Name)
+		}
+	}
+	if len(names) == 0 {
+		return measureRun{}, newCoreError(codeInvalidArgument, "no nodes to measure", false, nil)
+	}
+	run := measureRun{
+		RunID: "measure-" + strconv.FormatInt(measureRunSeq.Add(1), 10),
+		Mode:  mode,
+		Nodes: names,
+	}
+	go func() {
+		results := measureNodes(context.Background(), run, func(m nodeMeasurement) {
+			publishEvent(eventNodeMeasured, m.Node, m.Mode, m)
+		})
+		publishEvent(eventMeasureFinished, "", run.RunID, results)
+	}()
+	return run, nil
+}
+
+// measureNodes runs up to measureConcurrency nodes at once and calls report
+// for every result as it completes.
+func measureNodes(ctx context.Context, run measureRun, report func(nodeMeasurement)) []nodeMeasurement {
+	modes := []string{run.Mode}
+	if run.Mode == measureModeAll {
+		modes = []string{measureModeTCP, measureModeReal}
+	}
+	var (
+		mu      sync.Mutex
+		results []nodeMeasurement
+		wg      sync.WaitGroup
+	)
+	slots := make(chan struct{}, measureConcurrency)
+	for _, name := range run.Nodes {
+		for _, mode := range modes {
+			wg.Add(1)
+			go func(name, mode string) {
+				defer wg.Done()
+				slots <- struct{}{}
+				defer func() { <-slots }()
+				m := measureNode(ctx, name, mode)
+				m.RunID = run.RunID
+				report(m)
+				mu.Lock()
+				results = append(results, m)
+				mu.Unlock()
+			}(name, mode)
+		}
+	}
+	wg.Wait()
+	return results
+}
+
+func measureNode(ctx context.Context, name, mode string) nodeMeasurement {
+	m := nodeMeasurement{Node: name, Mode: mode, Samples: []int64{}}
+	outbound, err := measureOutbound(name)
+	if err != nil {
+		return m.fail(err)
+	}
+	var sample func(context.Context) error
+	switch mode {
+	case measureModeTCP:
+		addr, err := outboundEndpoint(outbound)
+		if err != nil {
+			return m.fail(err)
+		}
+		sample = func(ctx context.Context) error {
+			conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}
+	case measureModeReal:
+		dial, closeDialer, err := measureDialerFactory(outbound)
+		if err != nil {
+			return m.fail(err)
+		}
+		defer closeDialer()
+		sample = realDelaySample(dial)
+	}
+
+	var lastErr error
+	for i := 0; i < measureSamples; i++ {
+		m.Sent++
+		sampleCtx, cancel := context.WithTimeout(ctx, measureTimeout)
+		start := time.Now()
+		err := sample(sampleCtx)
+		elapsed := time.Since(start)
+		cancel()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		m.Samples = append(m.Samples, elapsed.Milliseconds())
+	}
+	m.summarize()
+	if lastErr != nil {
+		m.ErrorClass = classifyMeasureError(lastErr)
+		m.Error = lastErr.Error()
+	}
+	return m
+}
+
+// realDelaySample issues one GET for measureURL over a fresh connection, so
+// every sample includes the proxy handshake like a real first request.
+func realDelaySample(dial measureDialFunc) func(context.Context) error {
+	return func(ctx context.Context) error {
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext:       dial,
+				DisableKeepAlives: true,
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		defer client.CloseIdleConnections()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, measureURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return measureStatusError(resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+type measureStatusError int
+
+func (e measureStatusError) Error() string {
+	return fmt.Sprintf("probe returned HTTP %d", int(e))
+}
+
+func (m nodeMeasurement) fail(err error) nodeMeasurement {
+	m.Loss = 1
+	m.ErrorClass = classifyMeasureError(err)
+	m.Error = err.Error()
+	return m
+}
+
+// summarize fills median, jitter (mean difference between consecutive
+// samples) and loss from the collected samples.
+func (m *nodeMeasurement) summarize() {
+	if m.Sent > 0 {
+		m.Loss = float64(m.Sent-len(m.Samples)) / float64(m.Sent)
+	}
+	if len(m.Samples) == 0 {
+		return
+	}
+	sorted := append([]int64(nil), m.Samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 1 {
+		m.MedianMs = sorted[mid]
+	} else {
+		m.MedianMs = (sorted[mid-1] + sorted[mid]) / 2
+	}
+	if len(m.Samples) > 1 {
+		var total int64
+		for i := 1; i < len(m.Samples); i++ {
+			d := m.Samples[i] - m.Samples[i-1]
+			if d < 0 {
+				d = -d
+			}
+			total += d
+		}
+		m.JitterMs = total / int64(len(m.Samples)-1)
+	}
+}
+
+func classifyMeasureError(err error) string {
+	var ce *coreError
+	if errors.As(err, &ce) {
+		switch ce.Code {
+		case codeNotFound, codeConfigInvalid, codeUnsupported, codeInvalidArgument:
+			return measureErrConfig
+		}
+	}
+	var status measureStatusError
+	if errors.As(err, &status) {
+		return measureErrHTTP
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return measureErrDNS
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return measureErrTimeout
+	}
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &certErr) || errors.As(err, &unknownAuthority) || errors.As(err, &hostnameErr) {
+		return measureErrTLS
+	}
+	msg := strings.ToLower(err.Error())
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED), strings.Contains(msg, "connection refused"), strings.Contains(msg, "actively refused"):
+		return measureErrRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), strings.Contains(msg, "connection reset"):
+		return measureErrReset
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH), strings.Contains(msg, "unreachable"):
+		return measureErrUnreachable
+	case strings.Contains(msg, "tls:"), strings.Contains(msg, "x509:"):
+		return measureErrTLS
+	}
+	return measureErrOther
+}
+
+func measureOutbound(name string) (map[string]interface{}, error) {
+	rec, err := nodes.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return proxyOutbound(rec.Config)
+}
+
+// outboundEndpoint returns host:port of the first server of an outbound, in
+// either the vnext/servers list or the flat single-server form.
+func outboundEndpoint(outbound map[string]interface{}) (string, error) {
+	protocol := stringField(outbound, "protocol")
+	if protocol == "hysteria" || protocol == "wireguard" {
+		return "", newCoreError(codeUnsupported, protocol+" runs over UDP; use the real delay test", false, map[string]interface{}{"protocol": protocol})
+	}
+	settings, _ := outbound["settings"].(map[string]interface{})
+	server := settings
+	for _, key := range []string{"vnext", "servers"} {
+		if list, ok := settings[key].([]interface{}); ok && len(list) > 0 {
+			server, _ = list[0].(map[string]interface{})
+			break
+		}
+	}
+	address, port := stringField(server, "address"), fixedPort(server["port"])
+	if address == "" || port <= 0 {
+		return "", newCoreError(codeConfigInvalid, "outbound has no server address or port", false, nil)
+	}
+	return net.JoinHostPort(address, strconv.Itoa(port)), nil
+}
+
+// newXrayMeasureDialer starts a side instance holding only the node's
+// outbound and dials through it with core.Dial. Like StartNodeInstance it
+// leaves the primary core's log handler and dialer hooks in place. The
+// instance lives until the returned close func is called.
+func newXrayMeasureDialer(outbound map[string]interface{}) (measureDialFunc, func() error, error) {
+	cfg, err := json.Marshal(map[string]interface{}{"outbounds": []interface{}{outbound}})
+	if err != nil {
+		return nil, nil, err
+	}
+	server, err := newSideInstance(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dest, err := xnet.ParseDestination(network + ":" + addr)
+		if err != nil {
+			return nil, err
+		}
+		return core.Dial(ctx, server, dest)
+	}
+	return dial, server.Close, nil
+}
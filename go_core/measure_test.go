@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// addMeasureNode registers a trojan node whose server is addr.
+func addMeasureNode(t *testing.T, name, addr string) {
+	t.Helper()
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+	cfg, err := json.Marshal(map[string]interface{}{"outbounds": []interface{}{
+		map[string]interface{}{
+			"protocol": "trojan",
+			"tag":      "proxy",
+			"settings": map[string]interface{}{"servers": []interface{}{
+				map[string]interface{}{"address": host, "port": port, "password": "secret"},
+			}},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes.upsert(nodeRecord{Name: name, Config: cfg}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// closedAddr returns a loopback address nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func collectMeasurements(t *testing.T, names []string, mode string) map[string]nodeMeasurement {
+	t.Helper()
+	var mu sync.Mutex
+	streamed := map[string]nodeMeasurement{}
+	results := measureNodes(context.Background(), measureRun{RunID: "test", Mode: mode, Nodes: names}, func(m nodeMeasurement) {
+		mu.Lock()
+		streamed[m.Node+"/"+m.Mode] = m
+		mu.Unlock()
+	})
+	if len(results) != len(streamed) {
+		t.Fatalf("streamed %d results, returned %d", len(streamed), len(results))
+	}
+	return streamed
+}
+
+func TestMeasureNodesTCP(t *testing.T) {
+	setTestDataDir(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	addMeasureNode(t, "up", ln.Addr().String())
+	addMeasureNode(t, "down", closedAddr(t))
+
+	got := collectMeasurements(t, []string{"up", "down", "missing"}, measureModeTCP)
+	up := got["up/tcp"]
+	if up.Sent != measureSamples || len(up.Samples) != measureSamples || up.Loss != 0 || up.ErrorClass != "" {
+		t.Fatalf("up = %+v", up)
+	}
+	if down := got["down/tcp"]; down.Loss != 1 || down.ErrorClass != measureErrRefused {
+		t.Fatalf("down = %+v", down)
+	}
+	if missing := got["missing/tcp"]; missing.Loss != 1 || missing.ErrorClass != measureErrConfig {
+		t.Fatalf("missing = %+v", missing)
+	}
+	for key, m := range got {
+		if m.RunID != "test" {
+			t.Errorf("%s has run id %q", key, m.RunID)
+		}
+	}
+}
+
+func TestMeasureNodesRealDelay(t *testing.T) {
+	setTestDataDir(t)
+	var failing atomic.Bool
+	probe := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer probe.Close()
+
+	// Stand in for the throwaway xray instance: "ok" reaches the probe
+	// directly, "broken" cannot be built, "blocked" reaches a closed port.
+	blocked := closedAddr(t)
+	oldURL, oldFactory := measureURL, measureDialerFactory
+	t.Cleanup(func() { measureURL, measureDialerFactory = oldURL, oldFactory })
+	measureURL = probe.URL
+	measureDialerFactory = func(outbound map[string]interface{}) (measureDialFunc, func() error, error) {
+		addr, err := outboundEndpoint(outbound)
+		if err != nil {
+			return nil, nil, err
+		}
+		if addr == blocked {
+			return func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, blocked)
+			}, func() error { return nil }, nil
+		}
+		if addr == "127.0.0.1:1" {
+			return nil, nil, newCoreError(codeConfigInvalid, "bad outbound", false, nil)
+		}
+		return (&net.Dialer{}).DialContext, func() error { return nil }, nil
+	}
+	addMeasureNode(t, "ok", probe.Listener.Addr().String())
+	addMeasureNode(t, "broken", "127.0.0.1:1")
+	addMeasureNode(t, "blocked", blocked)
+
+	got := collectMeasurements(t, []string{"ok", "broken", "blocked"}, measureModeAll)
+	if len(got) != 6 {
+		t.Fatalf("got %d results, want tcp and real for 3 nodes", len(got))
+	}
+	if ok := got["ok/real"]; ok.Loss != 0 || len(ok.Samples) != measureSamples {
+		t.Fatalf("ok = %+v", ok)
+	}
+	if broken := got["broken/real"]; broken.ErrorClass != measureErrConfig || broken.Sent != 0 {
+		t.Fatalf("broken = %+v", broken)
+	}
+	if b := got["blocked/real"]; b.Loss != 1 || b.ErrorClass != measureErrRefused {
+		t.Fatalf("blocked = %+v", b)
+	}
+
+	failing.Store(true)
+	got = collectMeasurements(t, []string{"ok"}, measureModeReal)
+	if ok := got["ok/real"]; ok.ErrorClass != measureErrHTTP || ok.Loss != 1 {
+		t.Fatalf("status = %+v", ok)
+	}
+}
+
+func TestRealMeasureKeepsPrimaryHooks(t *testing.T) {
+	setTestDataDir(t)
+	primary := startPrimaryForTest(t)
+	probe := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer probe.Close()
+	oldURL := measureURL
+	t.Cleanup(func() { measureURL = oldURL })
+	measureURL = probe.URL
+
+	// The node proxies through the primary's socks inbound, so the sample
+	// runs in a real side instance.
+	host, port, _ := net.SplitHostPort(primary)
+	portNum, _ := strconv.Atoi(port)
+	cfg, err := json.Marshal(map[string]interface{}{"outbounds": []interface{}{
+		map[string]interface{}{
+			"protocol": "socks",
+			"tag":      "proxy",
+			"settings": map[string]interface{}{"servers": []interface{}{
+				map[string]interface{}{"address": host, "port": portNum},
+			}},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes.upsert(nodeRecord{Name: "via-primary", Config: cfg}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := collectMeasurements(t, []string{"via-primary"}, measureModeReal)
+	if m := got["via-primary/real"]; m.Loss != 0 || len(m.Samples) != measureSamples {
+		t.Fatalf("measurement = %+v", m)
+	}
+	assertPrimaryHooks(t, primary)
+}
+
+func TestMeasureSummary(t *testing.T) {
+	m := nodeMeasurement{Sent: 5, Samples: []int64{40, 10, 30, 20}}
+	m.summarize()
+	if m.MedianMs != 25 || m.JitterMs != 20 || m.Loss != 0.2 {
+		t.Fatalf("summary = %+v", m)
+	}
+}
+
+func TestClassifyMeasureError(t *testing.T) {
+	cases := map[string]error{
+		measureErrTimeout: context.DeadlineExceeded,
+		measureErrRefused: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED},
+		measureErrDNS:     &net.DNSError{Err: "no such host", Name: "example.invalid"},
+		measureErrHTTP:    measureStatusError(502),
+		measureErrConfig:  newCoreError(codeNotFound, "node not found", false, nil),
+		measureErrOther:   errors.New("boom"),
+	}
+	for want, err := range cases {
+		if got := classifyMeasureError(err); got != want {
+			t.Errorf("classify(%v) = %q, want %q", err, got, want)
+		}
+	}
+}
+
+func TestStartMeasureNodesRejectsMode(t *testing.T) {
+	_, err := startMeasureNodes([]string{"a"}, "icmp")
+	var ce *coreError
+	if !errors.As(err, &ce) || ce.Code != codeInvalidArgument {
+		t.Fatalf("err = %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	dataDirMu       sync.RWMutex
+	dataDirOverride string
+)
+
+// coreDataDir is the directory the core keeps its persistent state in. Hosts
+// can override it with SetCoreDataDir; mobile hosts should always do so since
+// the sandbox directory is only known to the app.
+func coreDataDir() string {
+	dataDirMu.RLock()
+	override := dataDirOverride
+	dataDirMu.RUnlock()
+	if override != "" {
+		return override
+	}
+	return platformConfigDir()
+}
+
+func setCoreDataDir(dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	dataDirMu.Lock()
+	dataDirOverride = dir
+	dataDirMu.Unlock()
+	applyGeodataAssetDir()
+	return nil
+}
+
+// userConfigSubdir returns <user config dir>/<name>, falling back to the temp
+// directory when the platform has no user config dir (e.g. HOME unset).
+func userConfigSubdir(name string) string {
+	if dir, err := os.UserConfigDir(); err == nil && dir != "" {
+		return filepath.Join(dir, name)
+	}
+	return filepath.Join(os.TempDir(), name)
+}
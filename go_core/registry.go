@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nodeRecord is one entry of the persistent node registry. Config holds the
+// full xray JSON used to start the node.
+type nodeRecord struct {
+	Name      string          `json:"name"`
+	Protocol  string          `json:"protocol,omitempty"`
+	Transport string          `json:"transport,omitempty"`
+	Security  string          `json:"security,omitempty"`
+	UpdatedAt int64           `json:"updatedAt"`
+	Config    json.RawMessage `json:"config,omitempty"`
+}
+
+// nodeRegistry stores one file per node under <data dir>/nodes. File names
+// are derived from the node name so lookups never need an index.
+type nodeRegistry struct {
+	mu sync.Mutex
+}
+
+var nodes = &nodeRegistry{}
+
+func nodesDir() string {
+	return filepath.Join(coreDataDir(), "nodes")
+}
+
+// nodeFileName keeps a readable prefix for debugging and a hash suffix so
+// names that differ only in punctuation or case do not collide.
+func nodeFileName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+		if b.Len() >= 32 {
+			break
+		}
+	}
+	sum := sha256.Sum256([]byte(name))
+	return b.String() + "-" + hex.EncodeToString(sum[:4]) + ".json"
+}
+
+func (r *nodeRegistry) path(name string) string {
+	return filepath.Join(nodesDir(), nodeFileName(name))
+}
+
+func (r *nodeRegistry) readLocked(name string) (nodeRecord, error) {
+	var rec nodeRecord
+	data, err := readVaultFile(r.path(name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return rec, newCoreError(codeNotFound, "node not found", false, map[string]interface{}{"name": name})
+		}
+		return rec, err
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, err
+	}
+	return rec, nil
+}
+
+func (r *nodeRegistry) get(name string) (nodeRecord, error) {
+	if name == "" {
+		return nodeRecord{}, newCoreError(codeInvalidArgument, "node name is required", false, nil)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.readLocked(name)
+}
+
+// list returns every node without its config, sorted by name. Records that
+// are not valid JSON, lack a name or fail vault authentication are skipped;
+// a locked vault or a read error fails the whole listing rather than
+// reporting fewer nodes.
+func (r *nodeRegistry) list() ([]nodeRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries, err := os.ReadDir(nodesDir())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []nodeRecord{}, nil
+		}
+		return nil, err
+	}
+	records := make([]nodeRecord, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		data, err := readVaultFile(filepath.Join(nodesDir(), entry.Name()))
+		if err != nil {
+			var ce *coreError
+			if errors.As(err, &ce) && ce.Code == codeConfigInvalid {
+				continue
+			}
+			return nil, err
+		}
+		var rec nodeRecord
+		if err := json.Unmarshal(data, &rec); err != nil || rec.Name == "" {
+			continue
+		}
+		rec.Config = nil
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records, nil
+}
+
+// upsert validates the record's config and stores it, replacing any node
+// with the same name. Protocol, transport and security are filled from the
+// config when the caller leaves them empty.
+func (r *nodeRegistry) upsert(rec nodeRecord) (nodeRecord, error) {
+	rec.Name = strings.TrimSpace(rec.Name)
+	if rec.Name == "" {
+		return rec, newCoreError(codeInvalidArgument, "node name is required", false, nil)
+	}
+	if len(rec.Config) == 0 {
+		return rec, newCoreError(codeInvalidArgument, "node config is required", false, map[string]interface{}{"name": rec.Name})
+	}
+	if err := preflightConfig(rec.Config); err != nil {
+		return rec, err
+	}
+	protocol, transport, security := describeNodeConfig(rec.Config)
+	if rec.Protocol == "" {
+		rec.Protocol = protocol
+	}
+	if rec.Transport == "" {
+		rec.Transport = transport
+	}
+	if rec.Security == "" {
+		rec.Security = security
+	}
+	rec.UpdatedAt = time.Now().UnixMilli()
+
+	payload, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return rec, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := writeVaultFile(r.path(rec.Name), payload, 0o600); err != nil {
+		return rec, err
+	}
+	rec.Config = nil
+	return rec, nil
+}
+
+func (r *nodeRegistry) remove(name string) error {
+	if name == "" {
+		return newCoreError(codeInvalidArgument, "node name is required", false, nil)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := os.Remove(r.path(name)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return newCoreError(codeNotFound, "node not found", false, map[string]interface{}{"name": name})
+		}
+		return err
+	}
+	return nil
+}
+
+// describeNodeConfig extracts protocol, transport and security of the first
+// proxy outbound for registry listings.
+func describeNodeConfig(cfgData []byte) (protocol, transport, security string) {
+	var doc struct {
+		Outbounds []struct {
+			Protocol       string `json:"protocol"`
+			StreamSettings struct {
+				Network  string `json:"network"`
+				Security string `json:"security"`
+			} `json:"streamSettings"`
+		} `json:"outbounds"`
+	}
+	if err := json.Unmarshal(cfgData, &doc); err != nil {
+		return "", "", ""
+	}
+	for _, outbound := range doc.Outbounds {
+		switch outbound.Protocol {
+		case "freedom", "blackhole", "dns", "":
+			continue
+		}
+		transport = outbound.StreamSettings.Network
+		if transport == "" {
+			transport = "tcp"
+		}
+		security = outbound.StreamSettings.Security
+		if security == "" {
+			security = "none"
+		}
+		return outbound.Protocol, transport, security
+	}
+	return "", "", ""
+}
+
+// legacyNodeConfigPath is where hosts wrote node configs before the
+// registry existed.
+func legacyNodeConfigPath(node string) string {
+	return filepath.Join(os.TempDir(), node+".json")
+}
+
+// readNodeConfig resolves a node through the registry. Configs still sitting
+// at the legacy temp path are imported on first use so existing installs keep
+// working.
+func readNodeConfig(node string) ([]byte, error) {
+	rec, err := nodes.get(node)
+	if err == nil {
+		return rec.Config, nil
+	}
+	var ce *coreError
+	if !errors.As(err, &ce) || ce.Code != codeNotFound {
+		return nil, err
+	}
+	legacy, legacyErr := os.ReadFile(legacyNodeConfigPath(node))
+	if legacyErr != nil {
+		return nil, err
+	}
+	if json.Valid(legacy) {
+		if _, err := nodes.upsert(nodeRecord{Name: node, Config: legacy}); err == nil {
+			// With the vault on, the imported copy is encrypted; do not leave
+			// the plaintext behind.
+			if status, _ := vault.status(); status.Enabled {
+				_ = os.Remove(legacyNodeConfigPath(node))
+			}
+		}
+	}
+	return legacy, nil
+}
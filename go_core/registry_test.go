@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func sameJSON(a, b []byte) bool {
+	var ca, cb bytes.Buffer
+	return json.Compact(&ca, a) == nil && json.Compact(&cb, b) == nil && bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+func TestNodeRegistryUpsertGetDelete(t *testing.T) {
+	setTestDataDir(t)
+	cfg := `{"outbounds":[{"protocol":"vless","settings":{"vnext":[{"address":"jp.example.com","port":443,"users":[{"id":"` + testVlessID + `","encryption":"none"}]}]},"streamSettings":{"network":"grpc","security":"tls"}},{"protocol":"freedom"}]}`
+
+	rec, err := nodes.upsert(nodeRecord{Name: " jp ", Config: json.RawMessage(cfg)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Name != "jp" || rec.Protocol != "vless" || rec.Transport != "grpc" || rec.Security != "tls" || rec.Config != nil || rec.UpdatedAt == 0 {
+		t.Fatalf("upsert = %+v", rec)
+	}
+	if info, err := os.Stat(nodes.path("jp")); err != nil || (runtime.GOOS != "windows" && info.Mode().Perm() != 0o600) {
+		t.Fatalf("record file = %v, %v", info, err)
+	}
+	got, err := nodes.get("jp")
+	if err != nil || got.Protocol != "vless" || !sameJSON(got.Config, []byte(cfg)) {
+		t.Fatalf("get = %+v, %v", got, err)
+	}
+
+	// Upserting the same name replaces the record and keeps caller fields.
+	if _, err := nodes.upsert(nodeRecord{Name: "jp", Protocol: "custom", Config: socksNodeConfig(1080)}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = nodes.get("jp")
+	if err != nil || got.Protocol != "custom" || !sameJSON(got.Config, socksNodeConfig(1080)) {
+		t.Fatalf("get after replace = %+v, %v", got, err)
+	}
+
+	if err := nodes.remove("jp"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = nodes.get("jp")
+	assertCoreErrorCode(t, err, codeNotFound)
+	assertCoreErrorCode(t, nodes.remove("jp"), codeNotFound)
+	_, err = nodes.upsert(nodeRecord{Name: "bad", Config: json.RawMessage(`{"outbounds":`)})
+	assertCoreErrorCode(t, err, codeConfigInvalid)
+	_, err = nodes.upsert(nodeRecord{Name: "  ", Config: socksNodeConfig(1080)})
+	assertCoreErrorCode(t, err, codeInvalidArgument)
+}
+
+func TestNodeRegistryListSortsAndSkipsMalformed(t *testing.T) {
+	setTestDataDir(t)
+	if list, err := nodes.list(); err != nil || len(list) != 0 {
+		t.Fatalf("empty list = %+v, %v", list, err)
+	}
+	for _, name := range []string{"us", "de", "jp"} {
+		if _, err := nodes.upsert(nodeRecord{Name: name, Config: socksNodeConfig(1080)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, content := range map[string]string{
+		"broken.json":   `{"name":`,
+		"nameless.json": `{"config":{}}`,
+		".tmp.json":     `{"name":"hidden"}`,
+		"notes.txt":     `{"name":"notes"}`,
+	} {
+		if err := os.WriteFile(filepath.Join(nodesDir(), file), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := nodes.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, rec := range list {
+		if rec.Config != nil {
+			t.Fatalf("list returned the config of %s", rec.Name)
+		}
+		names = append(names, rec.Name)
+	}
+	if len(names) != 3 || names[0] != "de" || names[1] != "jp" || names[2] != "us" {
+		t.Fatalf("names = %v", names)
+	}
+}
+
+func TestNodeRegistryReportsLockedVault(t *testing.T) {
+	setTestDataDir(t)
+	enableTestVault(t, "correct horse")
+	if _, err := nodes.upsert(nodeRecord{Name: "jp", Config: socksNodeConfig(1080)}); err != nil {
+		t.Fatal(err)
+	}
+	vault.lock()
+
+	_, err := nodes.list()
+	assertCoreErrorCode(t, err, codeVaultLocked)
+	_, err = startMeasureNodes(nil, measureModeTCP)
+	assertCoreErrorCode(t, err, codeVaultLocked)
+	_, err = nodes.upsert(nodeRecord{Name: "us", Config: socksNodeConfig(1081)})
+	assertCoreErrorCode(t, err, codeVaultLocked)
+
+	if _, err := vault.unlock("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := nodes.list(); err != nil || len(list) != 1 || list[0].Name != "jp" {
+		t.Fatalf("list = %+v, %v", list, err)
+	}
+}
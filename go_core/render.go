@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Render modes. Tunnel mode adds the tun inbound on top of the local proxies,
+// as the Dart template did with enableTunnelMode.
+const (
+	renderModeProxy  = "proxy"
+	renderModeTunnel = "tunnel"
+)
+
+// Inbound tags shared with lib/services/vpn_config_service.dart.
+const (
+	tunInboundTag   = "tun-in"
+	socksInboundTag = "socks-in"
+	httpInboundTag  = "http-in"
+)
+
+const (
+	defaultSocksPort = 1080
+	defaultHTTPPort  = 1081
+	defaultTunMTU    = 1500
+)
+
+// renderOptions is the JSON accepted by RenderXrayConfig. Either Node (a
+// registry name) or Outbound must be given.
+type renderOptions struct {
+	Node     string                 `json:"node,omitempty"`
+	Outbound map[string]interface{} `json:"outbound,omitempty"`
+	Mode     string                 `json:"mode"`
+	LogLevel string                 `json:"logLevel"`
+	Inbounds renderInbounds         `json:"inbounds"`
+	// Sniffing toggles sniffing on the tun inbound; the local proxies always
+	// sniff. Defaults to true.
+	Sniffing *bool `json:"sniffing,omitempty"`
+	// DNS and FakeDNS are copied into the config as given. DNSPolicy instead
+	// compiles the DNS control plane into dns, fakeDns and the leading
+	// routing rules; it cannot be combined with DNS or FakeDNS.
+	DNS       map[string]interface{} `json:"dns,omitempty"`
+	FakeDNS   []interface{}          `json:"fakeDns,omitempty"`
+	DNSPolicy *dnsControlPlane       `json:"dnsPolicy,omitempty"`
+	Routing   renderRouting          `json:"routing"`
+}
+
+// renderInbounds configures the local inbounds. A nil port uses the default
+// and 0 disables that inbound.
+type renderInbounds struct {
+	Listen    string `json:"listen,omitempty"`
+	SocksPort *int   `json:"socksPort,omitempty"`
+	HTTPPort  *int   `json:"httpPort,omitempty"`
+	TunMTU    int    `json:"tunMtu,omitempty"`
+}
+
+type renderRouting struct {
+	DomainStrategy string        `json:"domainStrategy,omitempty"`
+	Rules          []interface{} `json:"rules,omitempty"`
+}
+
+var renderLogLevels = map[string]bool{"debug": true, "info": true, "warning": true, "error": true, "none": true}
+
+// renderXrayConfig builds the complete runtime config: log, dns, the local
+// inbounds, the proxy outbound followed by direct/block/dns, and routing.
+// Output depends only on the options so every platform runs the same config.
+func renderXrayConfig(opts renderOptions) (map[string]interface{}, error) {
+	mode := strings.ToLower(strings.TrimSpace(opts.Mode))
+	if mode == "" {
+		mode = renderModeProxy
+	}
+	if mode != renderModeProxy && mode != renderModeTunnel {
+		return nil, newCoreError(codeInvalidArgument, "mode must be proxy or tunnel", false, map[string]interface{}{"mode": opts.Mode})
+	}
+	logLevel := strings.ToLower(strings.TrimSpace(opts.LogLevel))
+	if logLevel == "" {
+		logLevel = "info"
+	}
+	if !renderLogLevels[logLevel] {
+		return nil, newCoreError(codeInvalidArgument, "unknown log level", false, map[string]interface{}{"logLevel": opts.LogLevel})
+	}
+
+	proxy, err := renderProxyOutbound(opts)
+	if err != nil {
+		return nil, err
+	}
+	rules := opts.Routing.Rules
+	if opts.DNSPolicy != nil {
+		if opts.DNS != nil || opts.FakeDNS != nil {
+			return nil, newCoreError(codeInvalidArgument, "dnsPolicy cannot be combined with dns or fakeDns", false, nil)
+		}
+		compiled, err := compileDNSPolicy(*opts.DNSPolicy, mode == renderModeTunnel)
+		if err != nil {
+			return nil, err
+		}
+		opts.DNS = compiled.DNS
+		opts.FakeDNS = compiled.FakeDNS
+		rules = append(compiled.Rules, rules...)
+	}
+	inbounds, err := renderInboundList(opts.Inbounds, mode == renderModeTunnel, opts.Sniffing == nil || *opts.Sniffing, len(opts.FakeDNS) > 0)
+	if err != nil {
+		return nil, err
+	}
+
+	dns := opts.DNS
+	if dns == nil {
+		dns = map[string]interface{}{
+			"servers":                []interface{}{},
+			"queryStrategy":          "UseIPv4",
+			"disableFallbackIfMatch": true,
+		}
+	}
+	if rules == nil {
+		rules = []interface{}{}
+	}
+	cfg := map[string]interface{}{
+		"log":      map[string]interface{}{"loglevel": logLevel},
+		"dns":      dns,
+		"inbounds": inbounds,
+		"outbounds": []interface{}{
+			proxy,
+			map[string]interface{}{"protocol": "freedom", "tag": "direct"},
+			map[string]interface{}{"protocol": "blackhole", "tag": "block"},
+			map[string]interface{}{"protocol": "dns", "tag": "dns"},
+		},
+		"routing": map[string]interface{}{
+			"domainStrategy": firstNonEmpty(opts.Routing.DomainStrategy, "AsIs"),
+			"rules":          rules,
+		},
+	}
+	if len(opts.FakeDNS) > 0 {
+		cfg["fakeDns"] = opts.FakeDNS
+	}
+	return cfg, nil
+}
+
+// renderProxyOutbound copies the node outbound and tags it "proxy", the tag
+// routing rules refer to.
+func renderProxyOutbound(opts renderOptions) (map[string]interface{}, error) {
+	outbound := opts.Outbound
+	if outbound == nil {
+		if opts.Node == "" {
+			return nil, newCoreError(codeInvalidArgument, "node or outbound is required", false, nil)
+		}
+		rec, err := nodes.get(opts.Node)
+		if err != nil {
+			return nil, err
+		}
+		if outbound, err = proxyOutbound(rec.Config); err != nil {
+			return nil, err
+		}
+	}
+	switch stringField(outbound, "protocol") {
+	case "":
+		return nil, newCoreError(codeInvalidArgument, "outbound has no protocol", false, nil)
+	case "freedom", "blackhole", "dns":
+		return nil, newCoreError(codeInvalidArgument, "outbound is not a proxy", false, map[string]interface{}{"protocol": stringField(outbound, "protocol")})
+	}
+	encoded, err := json.Marshal(outbound)
+	if err != nil {
+		return nil, err
+	}
+	var proxy map[string]interface{}
+	if err := json.Unmarshal(encoded, &proxy); err != nil {
+		return nil, err
+	}
+	proxy["tag"] = shareLinkOutboundTag
+	return proxy, nil
+}
+
+func renderInboundList(opts renderInbounds, tunnel, sniffTun, fakeDNS bool) ([]interface{}, error) {
+	listen := firstNonEmpty(opts.Listen, "127.0.0.1")
+	socksPort, err := renderPort(opts.SocksPort, defaultSocksPort, "socksPort")
+	if err != nil {
+		return nil, err
+	}
+	httpPort, err := renderPort(opts.HTTPPort, defaultHTTPPort, "httpPort")
+	if err != nil {
+		return nil, err
+	}
+	if socksPort != 0 && socksPort == httpPort {
+		return nil, newCoreError(codeInvalidArgument, "socks and http inbounds need different ports", false, map[string]interface{}{"port": socksPort})
+	}
+	sniffing := map[string]interface{}{
+		"enabled":      true,
+		"destOverride": []interface{}{"http", "tls", "quic"},
+	}
+
+	inbounds := []interface{}{}
+	if socksPort != 0 {
+		inbounds = append(inbounds, map[string]interface{}{
+			"listen":   listen,
+			"port":     socksPort,
+			"tag":      socksInboundTag,
+			"protocol": "socks",
+			"settings": map[string]interface{}{"udp": true},
+			"sniffing": sniffing,
+		})
+	}
+	if httpPort != 0 {
+		inbounds = append(inbounds, map[string]interface{}{
+			"listen":   listen,
+			"port":     httpPort,
+			"tag":      httpInboundTag,
+			"protocol": "http",
+			"sniffing": sniffing,
+		})
+	}
+	if tunnel {
+		mtu := opts.TunMTU
+		if mtu == 0 {
+			mtu = defaultTunMTU
+		}
+		if mtu < 576 || mtu > 65535 {
+			return nil, newCoreError(codeInvalidArgument, "tun MTU is out of range", false, map[string]interface{}{"tunMtu": mtu})
+		}
+		destOverride := []interface{}{"http", "tls", "quic"}
+		if fakeDNS {
+			destOverride = append(destOverride, "fakedns")
+		}
+		inbounds = append(inbounds, map[string]interface{}{
+			"tag":      tunInboundTag,
+			"protocol": "tun",
+			"settings": map[string]interface{}{"mtu": mtu},
+			"sniffing": map[string]interface{}{
+				"enabled":      sniffTun,
+				"routeOnly":    true,
+				"destOverride": destOverride,
+			},
+		})
+	}
+	if len(inbounds) == 0 {
+		return nil, newCoreError(codeInvalidArgument, "proxy mode needs the socks or http inbound", false, nil)
+	}
+	return inbounds, nil
+}
+
+func renderPort(port *int, fallback int, field string) (int, error) {
+	if port == nil {
+		return fallback, nil
+	}
+	if *port < 0 || *port > 65535 {
+		return 0, newCoreError(codeInvalidArgument, "port is out of range", false, map[string]interface{}{field: *port})
+	}
+	return *port, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// TestRenderXrayConfigGolden renders every testdata/render/*.input.json and
+// compares the result with the matching .golden.json. Run with -update after
+// an intended change to the output.
+func TestRenderXrayConfigGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "render", "*.input.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no render inputs in testdata/render")
+	}
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".input.json")
+		t.Run(name, func(t *testing.T) {
+			raw, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var opts renderOptions
+			if err := json.Unmarshal(raw, &opts); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := renderXrayConfig(opts)
+			if err != nil {
+				t.Fatalf("render: %v", err)
+			}
+			got, err := json.MarshalIndent(cfg, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			golden := filepath.Join("testdata", "render", name+".golden.json")
+			if *updateGolden {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test -run TestRenderXrayConfigGolden -update)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("rendered config differs from %s:\n%s", golden, got)
+			}
+		})
+	}
+}
+
+func TestRenderXrayConfigFromRegistry(t *testing.T) {
+	setTestDataDir(t)
+	link := "trojan://secret@jp.example.com:8443?type=ws&path=%2Fws#jp"
+	node, err := parseShareLink(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := json.Marshal(map[string]interface{}{"outbounds": []interface{}{node.Outbound}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes.upsert(nodeRecord{Name: "jp", Config: cfg}); err != nil {
+		t.Fatal(err)
+	}
+
+	rendered, err := renderXrayConfig(renderOptions{Node: "jp", Mode: renderModeTunnel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbounds := rendered["outbounds"].([]interface{})
+	proxy := outbounds[0].(map[string]interface{})
+	if proxy["protocol"] != "trojan" || proxy["tag"] != "proxy" {
+		t.Fatalf("proxy outbound = %v", proxy)
+	}
+	inbounds := rendered["inbounds"].([]interface{})
+	if len(inbounds) != 3 || inbounds[2].(map[string]interface{})["tag"] != tunInboundTag {
+		t.Fatalf("tunnel inbounds = %v", inbounds)
+	}
+}
+
+func TestRenderXrayConfigRejects(t *testing.T) {
+	outbound := map[string]interface{}{"protocol": "vless"}
+	zero, same := 0, 1080
+	cases := map[string]renderOptions{
+		"no outbound":     {},
+		"bad mode":        {Outbound: outbound, Mode: "gateway"},
+		"bad log level":   {Outbound: outbound, LogLevel: "verbose"},
+		"direct outbound": {Outbound: map[string]interface{}{"protocol": "freedom"}},
+		"no inbounds":     {Outbound: outbound, Inbounds: renderInbounds{SocksPort: &zero, HTTPPort: &zero}},
+		"port clash":      {Outbound: outbound, Inbounds: renderInbounds{SocksPort: &same, HTTPPort: &same}},
+	}
+	for name, opts := range cases {
+		_, err := renderXrayConfig(opts)
+		var ce *coreError
+		if !errors.As(err, &ce) || ce.Code != codeInvalidArgument {
+			t.Errorf("%s: err = %v, want INVALID_ARGUMENT", name, err)
+		}
+	}
+}
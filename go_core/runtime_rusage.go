@@ -0,0 +1,24 @@
+//go:build android || darwin
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// processMemoryBytes is nil on mobile: the sandboxes do not expose the
+// resident size portably. goSysBytes, the memory the Go runtime obtained
+// from the OS, is the figure to watch there.
+func processMemoryBytes() *int64 {
+	return nil
+}
+
+// processCPUTime returns user plus system time from getrusage.
+func processCPUTime() (time.Duration, bool) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, false
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano()), true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// desktopRuntimeSnapshot is returned by GetDesktopRuntimeSnapshot on every
+// platform. Process memory and CPU come from the platform hooks
+// processMemoryBytes and processCPUTime; MemoryBytes is the resident size
+// and is omitted where it cannot be read. The Go heap figures are included
+// because they are what runs an iOS network extension out of memory.
+type desktopRuntimeSnapshot struct {
+	Running                bool              `json:"running"`
+	DownloadBytesPerSecond *int              `json:"downloadBytesPerSecond,omitempty"`
+	UploadBytesPerSecond   *int              `json:"uploadBytesPerSecond,omitempty"`
+	TotalDownloadBytes     *int64            `json:"totalDownloadBytes,omitempty"`
+	TotalUploadBytes       *int64            `json:"totalUploadBytes,omitempty"`
+	Outbounds              []trafficCounters `json:"outbounds,omitempty"`
+	MemoryBytes            *int64            `json:"memoryBytes,omitempty"`
+	CPUPercent             *float64          `json:"cpuPercent,omitempty"`
+	HeapAllocBytes         uint64            `json:"heapAllocBytes"`
+	HeapInuseBytes         uint64            `json:"heapInuseBytes"`
+	HeapSysBytes           uint64            `json:"heapSysBytes"`
+	HeapObjects            uint64            `json:"heapObjects"`
+	GoSysBytes             uint64            `json:"goSysBytes"`
+	NumGC                  uint32            `json:"numGC"`
+	Goroutines             int               `json:"goroutines"`
+	UpdatedAt              int64             `json:"updatedAt"`
+}
+
+var (
+	runtimeStatsMu  sync.Mutex
+	lastCPUTime     time.Duration
+	lastCPUWallTime time.Time
+)
+
+func collectRuntimeSnapshot() desktopRuntimeSnapshot {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	snapshot := desktopRuntimeSnapshot{
+		Running:        engine.running(),
+		MemoryBytes:    processMemoryBytes(),
+		CPUPercent:     currentCPUPercent(),
+		HeapAllocBytes: mem.HeapAlloc,
+		HeapInuseBytes: mem.HeapInuse,
+		HeapSysBytes:   mem.HeapSys,
+		HeapObjects:    mem.HeapObjects,
+		GoSysBytes:     mem.Sys,
+		NumGC:          mem.NumGC,
+		Goroutines:     runtime.NumGoroutine(),
+		UpdatedAt:      time.Now().UnixMilli(),
+	}
+	if stats := traffic.snapshot(); stats.Available {
+		down := int(stats.DownloadBytesPerSecond)
+		up := int(stats.UploadBytesPerSecond)
+		snapshot.DownloadBytesPerSecond = &down
+		snapshot.UploadBytesPerSecond = &up
+		snapshot.TotalDownloadBytes = &stats.TotalDownloadBytes
+		snapshot.TotalUploadBytes = &stats.TotalUploadBytes
+		snapshot.Outbounds = stats.Outbounds
+	}
+	return snapshot
+}
+
+// currentCPUPercent returns process CPU usage since the previous call,
+// normalised to all cores. The first call only records a baseline.
+func currentCPUPercent() *float64 {
+	processTime, ok := processCPUTime()
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+
+	runtimeStatsMu.Lock()
+	defer runtimeStatsMu.Unlock()
+
+	if lastCPUWallTime.IsZero() {
+		lastCPUWallTime = now
+		lastCPUTime = processTime
+		return nil
+	}
+
+	wallDelta := now.Sub(lastCPUWallTime)
+	processDelta := processTime - lastCPUTime
+	lastCPUWallTime = now
+	lastCPUTime = processTime
+	if wallDelta <= 0 {
+		return nil
+	}
+
+	percent := (float64(processDelta) / float64(wallDelta)) * 100
+	if runtime.NumCPU() > 0 {
+		percent /= float64(runtime.NumCPU())
+	}
+	if percent < 0 {
+		percent = 0
+	}
+	return &percent
+}
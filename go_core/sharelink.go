@@ -0,0 +1,602 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// shareLinkOutboundTag matches the proxy outbound tag of the config template.
+const shareLinkOutboundTag = "proxy"
+
+// shareLinkNode is a parsed share link: node metadata plus the xray outbound.
+type shareLinkNode struct {
+	Name      string                 `json:"name"`
+	Protocol  string                 `json:"protocol"`
+	Transport string                 `json:"transport"`
+	Security  string                 `json:"security"`
+	Address   string                 `json:"address"`
+	Port      int                    `json:"port"`
+	Outbound  map[string]interface{} `json:"outbound"`
+}
+
+// parseShareLink turns a vless://, vmess://, trojan://, ss:// or
+// hysteria2:// link into an xray outbound.
+func parseShareLink(raw string) (shareLinkNode, error) {
+	link := strings.TrimSpace(raw)
+	if link == "" {
+		return shareLinkNode{}, newCoreError(codeInvalidArgument, "share link is empty", false, nil)
+	}
+	scheme := ""
+	if i := strings.Index(link, "://"); i > 0 {
+		scheme = strings.ToLower(link[:i])
+	}
+	switch scheme {
+	case "vless":
+		return parseVlessLink(link)
+	case "vmess":
+		return parseVmessLink(link)
+	case "trojan":
+		return parseTrojanLink(link)
+	case "ss":
+		return parseShadowsocksLink(link)
+	case "hysteria2", "hy2":
+		return parseHysteria2Link(link)
+	}
+	return shareLinkNode{}, newCoreError(codeUnsupported, "unsupported share link scheme", false, map[string]interface{}{"scheme": scheme})
+}
+
+func invalidShareLink(message string) error {
+	return newCoreError(codeInvalidArgument, message, false, nil)
+}
+
+// parseLinkURL parses scheme://userinfo@host:port?query#name and lowercases
+// the query keys.
+func parseLinkURL(link string) (*url.URL, string, int, url.Values, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, "", 0, nil, invalidShareLink("invalid share link: " + err.Error())
+	}
+	host := u.Hostname()
+	if host == "" {
+		return nil, "", 0, nil, invalidShareLink("share link has no server address")
+	}
+	port := 443
+	if p := u.Port(); p != "" {
+		port, err = strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, "", 0, nil, invalidShareLink("share link has an invalid port")
+		}
+	}
+	query := url.Values{}
+	for key, values := range u.Query() {
+		query[strings.ToLower(key)] = values
+	}
+	return u, host, port, query, nil
+}
+
+// proxySpec is the protocol-neutral description every importer (share
+// links, Clash and sing-box subscriptions) produces; node() turns it into
+// the xray outbound so all sources map fields the same way.
+type proxySpec struct {
+	Name     string
+	Protocol string
+	Address  string
+	Port     int
+
+	ID         string
+	Password   string
+	Method     string
+	Flow       string
+	Encryption string
+	Cipher     string
+	AlterID    int
+	Obfs       string
+	Plugin     string
+	PinSHA256  string
+
+	Stream linkStreamParams
+}
+
+func (s proxySpec) node() (shareLinkNode, error) {
+	if s.Address == "" {
+		return shareLinkNode{}, invalidShareLink(s.Protocol + " proxy has no server address")
+	}
+	if s.Port <= 0 || s.Port > 65535 {
+		return shareLinkNode{}, invalidShareLink(s.Protocol + " proxy has an invalid port")
+	}
+	name := strings.TrimSpace(s.Name)
+	if name == "" {
+		name = net.JoinHostPort(s.Address, strconv.Itoa(s.Port))
+	}
+	s.Stream.address = s.Address
+
+	node := shareLinkNode{
+		Name:     name,
+		Protocol: s.Protocol,
+		Address:  s.Address,
+		Port:     s.Port,
+	}
+	var settings map[string]interface{}
+	switch s.Protocol {
+	case "vless":
+		if s.ID == "" {
+			return shareLinkNode{}, invalidShareLink("vless proxy has no user id")
+		}
+		user := map[string]interface{}{
+			"id":         s.ID,
+			"encryption": firstNonEmpty(s.Encryption, "none"),
+		}
+		if s.Flow != "" {
+			user["flow"] = s.Flow
+		}
+		settings = vnextSettings(s.Address, s.Port, user)
+	case "vmess":
+		if s.ID == "" {
+			return shareLinkNode{}, invalidShareLink("vmess proxy has no user id")
+		}
+		settings = vnextSettings(s.Address, s.Port, map[string]interface{}{
+			"id":       s.ID,
+			"alterId":  s.AlterID,
+			"security": firstNonEmpty(s.Cipher, "auto"),
+		})
+	case "trojan":
+		if s.Password == "" {
+			return shareLinkNode{}, invalidShareLink("trojan proxy has no password")
+		}
+		server := map[string]interface{}{
+			"address":  s.Address,
+			"port":     s.Port,
+			"password": s.Password,
+		}
+		if s.Flow != "" {
+			server["flow"] = s.Flow
+		}
+		settings = map[string]interface{}{"servers": []interface{}{server}}
+	case "shadowsocks":
+		if s.Method == "" || s.Password == "" {
+			return shareLinkNode{}, invalidShareLink("shadowsocks proxy needs a method and password")
+		}
+		if s.Plugin != "" && s.Plugin != "none" {
+			return shareLinkNode{}, newCoreError(codeUnsupported, "shadowsocks plugins are not supported", false, map[string]interface{}{"plugin": s.Plugin})
+		}
+		node.Transport, node.Security = "tcp", "none"
+		node.Outbound = map[string]interface{}{
+			"tag":      shareLinkOutboundTag,
+			"protocol": "shadowsocks",
+			"settings": map[string]interface{}{
+				"servers": []interface{}{map[string]interface{}{
+					"address":  s.Address,
+					"port":     s.Port,
+					"method":   s.Method,
+					"password": s.Password,
+				}},
+			},
+		}
+		return node, nil
+	case "hysteria2":
+		stream, err := s.hysteriaStream()
+		if err != nil {
+			return shareLinkNode{}, err
+		}
+		node.Transport, node.Security = "hysteria", "tls"
+		node.Outbound = map[string]interface{}{
+			"tag":      shareLinkOutboundTag,
+			"protocol": "hysteria",
+			"settings": map[string]interface{}{
+				"version": 2,
+				"address": s.Address,
+				"port":    s.Port,
+			},
+			"streamSettings": stream,
+		}
+		return node, nil
+	default:
+		return shareLinkNode{}, newCoreError(codeUnsupported, "unsupported proxy protocol", false, map[string]interface{}{"protocol": s.Protocol})
+	}
+
+	stream, network, security, err := buildLinkStream(s.Stream)
+	if err != nil {
+		return shareLinkNode{}, err
+	}
+	node.Transport, node.Security = network, security
+	node.Outbound = map[string]interface{}{
+		"tag":            shareLinkOutboundTag,
+		"protocol":       s.Protocol,
+		"settings":       settings,
+		"streamSettings": stream,
+	}
+	return node, nil
+}
+
+func vnextSettings(address string, port int, user map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"vnext": []interface{}{map[string]interface{}{
+			"address": address,
+			"port":    port,
+			"users":   []interface{}{user},
+		}},
+	}
+}
+
+func (s proxySpec) hysteriaStream() (map[string]interface{}, error) {
+	if s.Password == "" {
+		return nil, invalidShareLink("hysteria2 proxy has no auth")
+	}
+	if s.Obfs != "" && s.Obfs != "none" {
+		return nil, newCoreError(codeUnsupported, "hysteria2 obfs is not supported", false, map[string]interface{}{"obfs": s.Obfs})
+	}
+	tlsSettings := map[string]interface{}{
+		"serverName": firstNonEmpty(s.Stream.sni, s.Address),
+		"alpn":       []interface{}{"h3"},
+	}
+	if isTruthy(s.Stream.insecure) {
+		tlsSettings["allowInsecure"] = true
+	}
+	if s.PinSHA256 != "" {
+		tlsSettings["pinnedPeerCertificateChainSha256"] = []interface{}{s.PinSHA256}
+	}
+	return map[string]interface{}{
+		"network":     "hysteria",
+		"security":    "tls",
+		"tlsSettings": tlsSettings,
+		"hysteriaSettings": map[string]interface{}{
+			"version": 2,
+			"auth":    s.Password,
+		},
+	}, nil
+}
+
+// linkStreamFromQuery reads the transport and security parameters shared by
+// vless:// and trojan:// links.
+func linkStreamFromQuery(query url.Values, defaultSec string) linkStreamParams {
+	return linkStreamParams{
+		network:     query.Get("type"),
+		security:    query.Get("security"),
+		defaultSec:  defaultSec,
+		host:        query.Get("host"),
+		path:        query.Get("path"),
+		headerType:  query.Get("headertype"),
+		serviceName: query.Get("servicename"),
+		authority:   query.Get("authority"),
+		mode:        query.Get("mode"),
+		extra:       query.Get("extra"),
+		sni:         firstNonEmpty(query.Get("sni"), query.Get("peer")),
+		fingerprint: query.Get("fp"),
+		alpn:        query.Get("alpn"),
+		insecure:    firstNonEmpty(query.Get("allowinsecure"), query.Get("insecure")),
+		publicKey:   query.Get("pbk"),
+		shortID:     query.Get("sid"),
+		spiderX:     query.Get("spx"),
+		mldsa65:     query.Get("pqv"),
+	}
+}
+
+func parseVlessLink(link string) (shareLinkNode, error) {
+	u, host, port, query, err := parseLinkURL(link)
+	if err != nil {
+		return shareLinkNode{}, err
+	}
+	return proxySpec{
+		Name:       u.Fragment,
+		Protocol:   "vless",
+		Address:    host,
+		Port:       port,
+		ID:         u.User.Username(),
+		Flow:       query.Get("flow"),
+		Encryption: query.Get("encryption"),
+		Stream:     linkStreamFromQuery(query, "none"),
+	}.node()
+}
+
+func parseTrojanLink(link string) (shareLinkNode, error) {
+	u, host, port, query, err := parseLinkURL(link)
+	if err != nil {
+		return shareLinkNode{}, err
+	}
+	return proxySpec{
+		Name:     u.Fragment,
+		Protocol: "trojan",
+		Address:  host,
+		Port:     port,
+		Password: u.User.Username(),
+		Flow:     query.Get("flow"),
+		Stream:   linkStreamFromQuery(query, "tls"),
+	}.node()
+}
+
+// vmessLink is the base64 JSON payload of a v2rayN style vmess:// link.
+// Several fields are emitted as either strings or numbers.
+type vmessLink struct {
+	V    interface{} `json:"v,omitempty"`
+	PS   string      `json:"ps"`
+	Add  string      `json:"add"`
+	Port interface{} `json:"port"`
+	ID   string      `json:"id"`
+	Aid  interface{} `json:"aid"`
+	Scy  string      `json:"scy"`
+	Net  string      `json:"net"`
+	Type string      `json:"type"`
+	Host string      `json:"host"`
+	Path string      `json:"path"`
+	TLS  string      `json:"tls"`
+	SNI  string      `json:"sni"`
+	ALPN string      `json:"alpn"`
+	FP   string      `json:"fp"`
+}
+
+func parseVmessLink(link string) (shareLinkNode, error) {
+	payload, err := decodeBase64Loose(link[len("vmess://"):])
+	if err != nil {
+		return shareLinkNode{}, invalidShareLink("vmess link is not valid base64")
+	}
+	var v vmessLink
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return shareLinkNode{}, invalidShareLink("vmess link payload is not valid JSON")
+	}
+	port, _ := strconv.Atoi(portString(v.Port))
+	alterID, _ := strconv.Atoi(portString(v.Aid))
+
+	stream := linkStreamParams{
+		network:     v.Net,
+		security:    v.TLS,
+		defaultSec:  "none",
+		host:        v.Host,
+		path:        v.Path,
+		sni:         v.SNI,
+		fingerprint: v.FP,
+		alpn:        v.ALPN,
+	}
+	switch strings.ToLower(v.Net) {
+	case "grpc":
+		// v2rayN stores the service name in path and gun/multi in type.
+		stream.serviceName = v.Path
+		stream.mode = v.Type
+	case "xhttp":
+		stream.mode = v.Type
+	default:
+		stream.headerType = v.Type
+	}
+	return proxySpec{
+		Name:     v.PS,
+		Protocol: "vmess",
+		Address:  v.Add,
+		Port:     port,
+		ID:       v.ID,
+		AlterID:  alterID,
+		Cipher:   v.Scy,
+		Stream:   stream,
+	}.node()
+}
+
+// parseShadowsocksLink accepts SIP002 links (ss://base64(method:password)@host:port)
+// as well as the legacy form with the whole authority base64 encoded.
+func parseShadowsocksLink(link string) (shareLinkNode, error) {
+	body := link[len("ss://"):]
+	fragment := ""
+	if i := strings.IndexByte(body, '#'); i >= 0 {
+		body, fragment = body[:i], body[i+1:]
+	}
+	if !strings.Contains(body, "@") {
+		query := ""
+		if i := strings.IndexByte(body, '?'); i >= 0 {
+			body, query = body[:i], body[i:]
+		}
+		decoded, err := decodeBase64Loose(strings.TrimSuffix(body, "/"))
+		if err != nil {
+			return shareLinkNode{}, invalidShareLink("ss link is not valid base64")
+		}
+		body = string(decoded) + query
+	}
+	u, host, port, query, err := parseLinkURL("ss://" + body)
+	if err != nil {
+		return shareLinkNode{}, err
+	}
+	name, err := url.PathUnescape(fragment)
+	if err != nil {
+		name = fragment
+	}
+
+	method, password := u.User.Username(), ""
+	if p, ok := u.User.Password(); ok {
+		password = p
+	} else if decoded, err := decodeBase64Loose(method); err == nil {
+		method, password, _ = strings.Cut(string(decoded), ":")
+	}
+	plugin, _, _ := strings.Cut(query.Get("plugin"), ";")
+	return proxySpec{
+		Name:     name,
+		Protocol: "shadowsocks",
+		Address:  host,
+		Port:     port,
+		Method:   method,
+		Password: password,
+		Plugin:   plugin,
+	}.node()
+}
+
+func parseHysteria2Link(link string) (shareLinkNode, error) {
+	u, host, port, query, err := parseLinkURL(link)
+	if err != nil {
+		return shareLinkNode{}, err
+	}
+	auth := u.User.Username()
+	if p, ok := u.User.Password(); ok {
+		// Some clients split user:password; hysteria treats both as the auth.
+		auth += ":" + p
+	}
+	return proxySpec{
+		Name:      u.Fragment,
+		Protocol:  "hysteria2",
+		Address:   host,
+		Port:      port,
+		Password:  auth,
+		Obfs:      query.Get("obfs"),
+		PinSHA256: query.Get("pinsha256"),
+		Stream: linkStreamParams{
+			sni:      query.Get("sni"),
+			insecure: query.Get("insecure"),
+		},
+	}.node()
+}
+
+type linkStreamParams struct {
+	network     string
+	security    string
+	defaultSec  string
+	host        string
+	path        string
+	headerType  string
+	serviceName string
+	authority   string
+	mode        string
+	extra       string
+	sni         string
+	fingerprint string
+	alpn        string
+	insecure    string
+	publicKey   string
+	shortID     string
+	spiderX     string
+	mldsa65     string
+	address     string
+}
+
+// buildLinkStream builds streamSettings for the transports and security
+// layers share links can describe. It returns the normalised network and
+// security names alongside.
+func buildLinkStream(p linkStreamParams) (map[string]interface{}, string, string, error) {
+	network := strings.ToLower(firstNonEmpty(p.network, "tcp"))
+	if network == "raw" {
+		network = "tcp"
+	}
+	security := strings.ToLower(firstNonEmpty(p.security, p.defaultSec))
+	stream := map[string]interface{}{"network": network}
+
+	switch network {
+	case "tcp":
+		if strings.EqualFold(p.headerType, "http") {
+			request := map[string]interface{}{"path": []interface{}{firstNonEmpty(p.path, "/")}}
+			if p.host != "" {
+				request["headers"] = map[string]interface{}{"Host": splitList(p.host)}
+			}
+			stream["tcpSettings"] = map[string]interface{}{
+				"header": map[string]interface{}{"type": "http", "request": request},
+			}
+		}
+	case "ws", "httpupgrade":
+		settings := map[string]interface{}{"path": firstNonEmpty(p.path, "/")}
+		if p.host != "" {
+			settings["host"] = p.host
+		}
+		stream[network+"Settings"] = settings
+	case "grpc":
+		settings := map[string]interface{}{"serviceName": p.serviceName}
+		if p.authority != "" {
+			settings["authority"] = p.authority
+		}
+		if strings.EqualFold(p.mode, "multi") {
+			settings["multiMode"] = true
+		}
+		stream["grpcSettings"] = settings
+	case "xhttp", "splithttp":
+		network = "xhttp"
+		stream["network"] = network
+		settings := map[string]interface{}{"path": firstNonEmpty(p.path, "/")}
+		if p.host != "" {
+			settings["host"] = p.host
+		}
+		if p.mode != "" {
+			settings["mode"] = p.mode
+		}
+		if p.extra != "" {
+			var extra interface{}
+			if err := json.Unmarshal([]byte(p.extra), &extra); err != nil {
+				return nil, "", "", invalidShareLink("xhttp extra is not valid JSON")
+			}
+			settings["extra"] = extra
+		}
+		stream["xhttpSettings"] = settings
+	default:
+		return nil, "", "", newCoreError(codeUnsupported, "unsupported transport", false, map[string]interface{}{"transport": network})
+	}
+
+	switch security {
+	case "none", "":
+		security = "none"
+	case "tls":
+		settings := map[string]interface{}{"serverName": firstNonEmpty(p.sni, p.host, p.address)}
+		if p.fingerprint != "" {
+			settings["fingerprint"] = p.fingerprint
+		}
+		if alpn := splitList(p.alpn); len(alpn) > 0 {
+			settings["alpn"] = alpn
+		}
+		if isTruthy(p.insecure) {
+			settings["allowInsecure"] = true
+		}
+		stream["tlsSettings"] = settings
+	case "reality":
+		if p.publicKey == "" {
+			return nil, "", "", invalidShareLink("reality link has no public key (pbk)")
+		}
+		settings := map[string]interface{}{
+			"serverName":  firstNonEmpty(p.sni, p.address),
+			"fingerprint": firstNonEmpty(p.fingerprint, "chrome"),
+			"publicKey":   p.publicKey,
+			"shortId":     p.shortID,
+		}
+		if p.spiderX != "" {
+			settings["spiderX"] = p.spiderX
+		}
+		if p.mldsa65 != "" {
+			settings["mldsa65Verify"] = p.mldsa65
+		}
+		stream["realitySettings"] = settings
+	default:
+		return nil, "", "", newCoreError(codeUnsupported, "unsupported security", false, map[string]interface{}{"security": security})
+	}
+	stream["security"] = security
+	return stream, network, security, nil
+}
+
+// decodeBase64Loose accepts standard and URL-safe alphabets with or without
+// padding, ignoring surrounding whitespace and line breaks.
+func decodeBase64Loose(s string) ([]byte, error) {
+	s = strings.Join(strings.Fields(s), "")
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if v := strings.TrimSpace(value); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func splitList(value string) []interface{} {
+	var items []interface{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func isTruthy(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Speed test phases and states reported in speedtest_progress events.
+const (
+	speedTestPhaseDownload = "download"
+	speedTestPhaseUpload   = "upload"
+
+	speedTestRunning  = "running"
+	speedTestDone     = "done"
+	speedTestFailed   = "failed"
+	speedTestCanceled = "canceled"
+)
+
+const (
+	defaultSpeedTestDuration    = 10 * time.Second
+	defaultSpeedTestUploadBytes = 25 << 20
+	speedTestProgressInterval   = 250 * time.Millisecond
+)
+
+var (
+	// speedTestDownloadURL serves a large static file; speedTestUploadURL
+	// accepts and discards a POST body.
+	speedTestDownloadURL = artifactBaseURL + "/xstream/speedtest/100MB.bin"
+	speedTestUploadURL   = artifactBaseURL + "/xstream/speedtest/upload"
+)
+
+// speedTestProxy returns the local inbound the test goes through. Tests
+// replace it to run against local servers.
+var speedTestProxy = activeProxyURL
+
+// speedTestOptions are the RunSpeedTest parameters; zero values take the
+// defaults. Each phase stops after DurationMs even if the transfer is not
+// finished, and the throughput so far is reported.
+type speedTestOptions struct {
+	URL         string `json:"url"`
+	UploadURL   string `json:"uploadUrl"`
+	DurationMs  int64  `json:"durationMs"`
+	UploadBytes int64  `json:"uploadBytes"`
+	SkipUpload  bool   `json:"skipUpload"`
+}
+
+type speedTestStatus struct {
+	RunID         string  `json:"runId"`
+	Node          string  `json:"node,omitempty"`
+	Proxy         string  `json:"proxy,omitempty"`
+	State         string  `json:"state"`
+	Phase         string  `json:"phase"`
+	TTFBMs        int64   `json:"ttfbMs"`
+	DownloadBytes int64   `json:"downloadBytes"`
+	DownloadMs    int64   `json:"downloadMs"`
+	DownloadMbps  float64 `json:"downloadMbps"`
+	UploadBytes   int64   `json:"uploadBytes"`
+	UploadMs      int64   `json:"uploadMs"`
+	UploadMbps    float64 `json:"uploadMbps"`
+	StartedAt     int64   `json:"startedAt"`
+	UpdatedAt     int64   `json:"updatedAt"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// speedTester runs one speed test at a time.
+type speedTester struct {
+	mu        sync.Mutex
+	status    speedTestStatus
+	cancel    context.CancelFunc
+	published time.Time
+	seq       atomic.Int64
+}
+
+var speedTests = &speedTester{}
+
+func (s *speedTester) snapshot() speedTestStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// start validates opts and runs the test in the background. Progress and the
+// final result are published as speedtest_progress events.
+func (s *speedTester) start(opts speedTestOptions) (speedTestStatus, error) {
+	opts, err := prepareSpeedTest(opts)
+	if err != nil {
+		return speedTestStatus{}, err
+	}
+	proxyURL, err := speedTestProxy()
+	if err != nil {
+		return speedTestStatus{}, err
+	}
+	node, _ := engine.current()
+
+	s.mu.Lock()
+	if s.status.State == speedTestRunning {
+		s.mu.Unlock()
+		return speedTestStatus{}, newCoreError(codeAlreadyRunning, "speed test already in progress", true, map[string]interface{}{"runId": s.status.RunID})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now().UnixMilli()
+	s.cancel = cancel
+	s.status = speedTestStatus{
+		RunID:     "speedtest-" + strconv.FormatInt(s.seq.Add(1), 10),
+		Node:      node,
+		State:     speedTestRunning,
+		Phase:     speedTestPhaseDownload,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	if proxyURL != nil {
+		s.status.Proxy = proxyURL.String()
+	}
+	status := s.status
+	s.mu.Unlock()
+
+	go s.run(ctx, opts, proxyURL)
+	return status, nil
+}
+
+func (s *speedTester) cancelRun() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status.State != speedTestRunning {
+		return newCoreError(codeNotFound, "no speed test is running", false, nil)
+	}
+	s.cancel()
+	return nil
+}
+
+// update applies fn and publishes a speedtest_progress event, throttled
+// while the test is running.
+func (s *speedTester) update(fn func(*speedTestStatus)) {
+	s.mu.Lock()
+	fn(&s.status)
+	now := time.Now()
+	s.status.UpdatedAt = now.UnixMilli()
+	publish := s.status.State != speedTestRunning || now.Sub(s.published) >= speedTestProgressInterval
+	if publish {
+		s.published = now
+	}
+	status := s.status
+	s.mu.Unlock()
+	if publish {
+		publishEvent(eventSpeedTestProgress, status.Node, status.Phase, status)
+	}
+}
+
+func (s *speedTester) run(ctx context.Context, opts speedTestOptions, proxyURL *url.URL) {
+	transport := &http.Transport{
+		Proxy:              http.ProxyURL(proxyURL),
+		DisableCompression: true,
+		ForceAttemptHTTP2:  true,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	duration := time.Duration(opts.DurationMs) * time.Millisecond
+
+	err := s.download(ctx, client, opts.URL, duration)
+	if err == nil && !opts.SkipUpload {
+		s.update(func(st *speedTestStatus) { st.Phase = speedTestPhaseUpload })
+		err = s.upload(ctx, client, opts.UploadURL, opts.UploadBytes, duration)
+	}
+
+	canceled := ctx.Err() != nil
+	s.mu.Lock()
+	s.cancel()
+	s.mu.Unlock()
+	switch {
+	case err == nil:
+		s.update(func(st *speedTestStatus) { st.State = speedTestDone })
+	case canceled:
+		s.update(func(st *speedTestStatus) { st.State = speedTestCanceled; st.Error = "speed test canceled" })
+	default:
+		msg := err.Error()
+		s.update(func(st *speedTestStatus) { st.State = speedTestFailed; st.Error = msg })
+	}
+}
+
+// download reads rawURL until EOF or the phase deadline. Throughput is
+// measured from the first response byte, so TTFB does not skew it.
+func (s *speedTester) download(ctx context.Context, client *http.Client, rawURL string, duration time.Duration) error {
+	phaseCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	var (
+		sent      time.Time
+		firstByte time.Time
+	)
+	trace := &httptrace.ClientTrace{
+		WroteRequest:         func(httptrace.WroteRequestInfo) { sent = time.Now() },
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(phaseCtx, trace), http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", subscriptionUserAgent)
+	req.Header.Set("Cache-Control", "no-cache")
+	resp, err := client.Do(req)
+	if err != nil {
+		return speedTestError(ctx, err, rawURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newCoreError(codeIO, fmt.Sprintf("speed test server returned %d", resp.StatusCode), resp.StatusCode >= 500, map[string]interface{}{
+			"url":    rawURL,
+			"status": resp.StatusCode,
+		})
+	}
+	if firstByte.IsZero() {
+		firstByte = time.Now()
+	}
+	ttfb := firstByte.Sub(sent).Milliseconds()
+	s.update(func(st *speedTestStatus) { st.TTFBMs = ttfb })
+
+	buf := make([]byte, 64<<10)
+	var received int64
+	for {
+		n, readErr := resp.Body.Read(buf)
+		received += int64(n)
+		elapsed := time.Since(firstByte)
+		s.update(func(st *speedTestStatus) {
+			st.DownloadBytes, st.DownloadMs, st.DownloadMbps = received, elapsed.Milliseconds(), mbps(received, elapsed)
+		})
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			if ctx.Err() == nil && phaseCtx.Err() != nil {
+				return nil
+			}
+			return speedTestError(ctx, readErr, rawURL)
+		}
+	}
+}
+
+// upload POSTs size random bytes, stopping at the phase deadline.
+func (s *speedTester) upload(ctx context.Context, client *http.Client, rawURL string, size int64, duration time.Duration) error {
+	phaseCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	body := &speedTestBody{remaining: size, chunk: make([]byte, 64<<10)}
+	rand.Read(body.chunk)
+	body.onRead = func(sent int64) {
+		elapsed := time.Since(body.started)
+		s.update(func(st *speedTestStatus) {
+			st.UploadBytes, st.UploadMs, st.UploadMbps = sent, elapsed.Milliseconds(), mbps(sent, elapsed)
+		})
+	}
+	req, err := http.NewRequestWithContext(phaseCtx, http.MethodPost, rawURL, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("User-Agent", subscriptionUserAgent)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() == nil && phaseCtx.Err() != nil && body.sent.Load() > 0 {
+			return nil
+		}
+		return speedTestError(ctx, err, rawURL)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newCoreError(codeIO, fmt.Sprintf("speed test server returned %d", resp.StatusCode), resp.StatusCode >= 500, map[string]interface{}{
+			"url":    rawURL,
+			"status": resp.StatusCode,
+		})
+	}
+	return nil
+}
+
+// speedTestBody is an upload body of repeated random bytes that reports how
+// much the transport has consumed.
+type speedTestBody struct {
+	remaining int64
+	chunk     []byte
+	started   time.Time
+	sent      atomic.Int64
+	onRead    func(sent int64)
+}
+
+func (b *speedTestBody) Read(p []byte) (int, error) {
+	if b.started.IsZero() {
+		b.started = time.Now()
+	}
+	if b.remaining <= 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, b.chunk)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+	}
+	b.remaining -= int64(n)
+	b.onRead(b.sent.Add(int64(n)))
+	return n, nil
+}
+
+func mbps(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / elapsed.Seconds() / 1e6
+}
+
+func speedTestError(parent context.Context, err error, rawURL string) error {
+	if parent.Err() != nil {
+		return context.Canceled
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return newCoreError(codeIO, "speed test server did not respond in time", true, map[string]interface{}{"url": rawURL})
+	}
+	return wrapCoreError(codeIO, err, true, map[string]interface{}{"url": rawURL})
+}
+
+func prepareSpeedTest(opts speedTestOptions) (speedTestOptions, error) {
+	if opts.URL == "" {
+		opts.URL = speedTestDownloadURL
+	}
+	if opts.UploadURL == "" {
+		opts.UploadURL = speedTestUploadURL
+	}
+	for _, raw := range []string{opts.URL, opts.UploadURL} {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return opts, newCoreError(codeInvalidArgument, "speed test endpoints must be http or https URLs", false, map[string]interface{}{"url": raw})
+		}
+	}
+	if opts.DurationMs < 0 || opts.UploadBytes < 0 {
+		return opts, newCoreError(codeInvalidArgument, "durationMs and uploadBytes must not be negative", false, nil)
+	}
+	if opts.DurationMs == 0 {
+		opts.DurationMs = defaultSpeedTestDuration.Milliseconds()
+	}
+	if opts.UploadBytes == 0 {
+		opts.UploadBytes = defaultSpeedTestUploadBytes
+	}
+	return opts, nil
+}
+
+// activeProxyURL returns the local socks or http inbound of the running
+// config, preferring socks so the proxy sees the real destination.
+func activeProxyURL() (*url.URL, error) {
+	_, cfgData := engine.current()
+	if !engine.running() {
+		return nil, newCoreError(codeNotRunning, "start a node before running a speed test", false, nil)
+	}
+	var httpProxy *url.URL
+	for _, inbound := range localProxyInbounds(cfgData) {
+		switch inbound.Protocol {
+		case "socks", "mixed":
+			return &url.URL{Scheme: "socks5", Host: inbound.Addr}, nil
+		case "http":
+			if httpProxy == nil {
+				httpProxy = &url.URL{Scheme: "http", Host: inbound.Addr}
+			}
+		}
+	}
+	if httpProxy == nil {
+		return nil, newCoreError(codeUnsupported, "the running config has no local socks or http inbound", false, nil)
+	}
+	return httpProxy, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// speedTestServer stands in for the local http inbound: the tester sends
+// absolute-form requests to it and it answers them itself, recording the
+// host each one was meant for.
+type speedTestServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	hosts    []string
+	uploaded atomic.Int64
+}
+
+func newSpeedTestServer(t *testing.T, download, upload http.HandlerFunc) *speedTestServer {
+	t.Helper()
+	s := &speedTestServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.hosts = append(s.hosts, r.URL.Host)
+		s.mu.Unlock()
+		switch r.URL.Path {
+		case "/download":
+			download(w, r)
+		case "/upload":
+			upload(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	proxyURL, _ := url.Parse(s.URL)
+	old := speedTestProxy
+	t.Cleanup(func() { speedTestProxy = old })
+	speedTestProxy = func() (*url.URL, error) { return proxyURL, nil }
+	return s
+}
+
+func (s *speedTestServer) requestedHosts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.hosts...)
+}
+
+// countUpload reads and counts the request body.
+func (s *speedTestServer) countUpload(w http.ResponseWriter, r *http.Request) {
+	n, _ := io.Copy(io.Discard, r.Body)
+	s.uploaded.Add(n)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// trickle sends chunk every few milliseconds until the client goes away.
+func trickle(chunk []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}
+}
+
+func speedTestOpts(durationMs, uploadBytes int64) speedTestOptions {
+	return speedTestOptions{
+		URL:         "http://speedtest.test/download",
+		UploadURL:   "http://speedtest.test/upload",
+		DurationMs:  durationMs,
+		UploadBytes: uploadBytes,
+	}
+}
+
+func waitSpeedTest(t *testing.T, s *speedTester) speedTestStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if status := s.snapshot(); status.State != speedTestRunning {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("speed test still running: %+v", s.snapshot())
+	return speedTestStatus{}
+}
+
+func TestSpeedTestMeasuresThroughProxy(t *testing.T) {
+	content := bytes.Repeat([]byte("speed"), 200<<10)
+	var server *speedTestServer
+	server = newSpeedTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write(content)
+	}, func(w http.ResponseWriter, r *http.Request) { server.countUpload(w, r) })
+	s := &speedTester{}
+
+	started, err := s.start(speedTestOpts(5000, 3<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started.State != speedTestRunning || started.Proxy != server.URL {
+		t.Fatalf("start = %+v", started)
+	}
+	status := waitSpeedTest(t, s)
+
+	if status.State != speedTestDone || status.Error != "" {
+		t.Fatalf("status = %+v", status)
+	}
+	if status.TTFBMs < 100 {
+		t.Fatalf("ttfb = %dms, want the server's 100ms delay", status.TTFBMs)
+	}
+	if status.DownloadBytes != int64(len(content)) || status.DownloadMbps <= 0 {
+		t.Fatalf("download = %d bytes at %.2f Mbps", status.DownloadBytes, status.DownloadMbps)
+	}
+	if status.UploadBytes != 3<<20 || server.uploaded.Load() != 3<<20 || status.UploadMbps <= 0 {
+		t.Fatalf("upload = %d bytes sent, %d received", status.UploadBytes, server.uploaded.Load())
+	}
+	for _, host := range server.requestedHosts() {
+		if host != "speedtest.test" {
+			t.Fatalf("request for %q did not go through the proxy", host)
+		}
+	}
+}
+
+func TestSpeedTestStopsAtPhaseDeadline(t *testing.T) {
+	// Neither phase can finish: the download trickles forever and the upload
+	// is read slowly, so both end at the deadline with what got through.
+	newSpeedTestServer(t, trickle(make([]byte, 1024)), func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 32<<10)
+		for {
+			if _, err := r.Body.Read(buf); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+	s := &speedTester{}
+
+	begin := time.Now()
+	if _, err := s.start(speedTestOpts(300, 1<<30)); err != nil {
+		t.Fatal(err)
+	}
+	status := waitSpeedTest(t, s)
+
+	if status.State != speedTestDone {
+		t.Fatalf("status = %+v", status)
+	}
+	if status.DownloadBytes == 0 || status.UploadBytes == 0 || status.UploadBytes >= 1<<30 {
+		t.Fatalf("download %d bytes, upload %d bytes", status.DownloadBytes, status.UploadBytes)
+	}
+	if elapsed := time.Since(begin); elapsed < 600*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("two 300ms phases took %v", elapsed)
+	}
+}
+
+func TestSpeedTestCancel(t *testing.T) {
+	newSpeedTestServer(t, trickle(make([]byte, 1024)), func(w http.ResponseWriter, r *http.Request) {
+		t.Error("upload ran after cancel")
+	})
+	s := &speedTester{}
+	if err := s.cancelRun(); err == nil {
+		t.Fatal("canceled with nothing running")
+	}
+
+	if _, err := s.start(speedTestOpts(10000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.start(speedTestOpts(10000, 0))
+	assertCoreErrorCode(t, err, codeAlreadyRunning)
+	deadline := time.Now().Add(5 * time.Second)
+	for s.snapshot().DownloadBytes == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.cancelRun(); err != nil {
+		t.Fatal(err)
+	}
+	status := waitSpeedTest(t, s)
+
+	if status.State != speedTestCanceled || status.Phase != speedTestPhaseDownload || status.DownloadBytes == 0 {
+		t.Fatalf("status = %+v", status)
+	}
+	err = s.cancelRun()
+	assertCoreErrorCode(t, err, codeNotFound)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	subscriptionTimeout   = 30 * time.Second
+	subscriptionMaxBytes  = 16 << 20
+	subscriptionUserAgent = "Xstream"
+)
+
+// Subscription formats recognised by parseSubscription.
+const (
+	subscriptionFormatLinks   = "links"
+	subscriptionFormatClash   = "clash"
+	subscriptionFormatSingBox = "sing-box"
+)
+
+type subscriptionUserInfo struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+	Total    int64 `json:"total"`
+	Expire   int64 `json:"expire,omitempty"`
+}
+
+// subscriptionIssue records an entry that could not be imported.
+type subscriptionIssue struct {
+	Index   int    `json:"index"`
+	Name    string `json:"name,omitempty"`
+	Message string `json:"message"`
+}
+
+// subscriptionState is the cached result of the last refresh, stored as
+// <data dir>/subscriptions/<hash>.json.
+type subscriptionState struct {
+	URL          string                `json:"url"`
+	Format       string                `json:"format"`
+	ETag         string                `json:"etag,omitempty"`
+	LastModified string                `json:"lastModified,omitempty"`
+	UserInfo     *subscriptionUserInfo `json:"userInfo,omitempty"`
+	FetchedAt    int64                 `json:"fetchedAt"`
+	CheckedAt    int64                 `json:"checkedAt"`
+	NotModified  bool                  `json:"notModified"`
+	Nodes        []shareLinkNode       `json:"nodes"`
+	Skipped      []subscriptionIssue   `json:"skipped,omitempty"`
+}
+
+var (
+	subscriptionMu     sync.Mutex
+	subscriptionClient = &http.Client{Timeout: subscriptionTimeout}
+)
+
+func subscriptionPath(rawURL string) string {
+	sum := sha256.Sum256([]byte(rawURL))
+	return filepath.Join(coreDataDir(), "subscriptions", hex.EncodeToString(sum[:8])+".json")
+}
+
+func loadSubscription(rawURL string) (subscriptionState, error) {
+	var state subscriptionState
+	data, err := readVaultFile(subscriptionPath(rawURL))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return state, newCoreError(codeNotFound, "subscription has not been fetched", false, map[string]interface{}{"url": rawURL})
+		}
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, err
+	}
+	return state, nil
+}
+
+func saveSubscription(state subscriptionState) error {
+	payload, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeVaultFile(subscriptionPath(state.URL), payload, 0o600)
+}
+
+// refreshSubscription fetches a subscription URL, revalidating the cached
+// copy with ETag/Last-Modified. A 304 returns the cached nodes with
+// notModified set.
+func refreshSubscription(ctx context.Context, rawURL string) (subscriptionState, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return subscriptionState{}, newCoreError(codeInvalidArgument, "subscription URL must be http or https", false, map[string]interface{}{"url": rawURL})
+	}
+
+	subscriptionMu.Lock()
+	defer subscriptionMu.Unlock()
+
+	cached, cacheErr := loadSubscription(rawURL)
+	hasCache := cacheErr == nil
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return subscriptionState{}, err
+	}
+	req.Header.Set("User-Agent", subscriptionUserAgent)
+	if hasCache {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := subscriptionClient.Do(req)
+	if err != nil {
+		return subscriptionState{}, wrapCoreError(codeIO, err, true, map[string]interface{}{"url": rawURL})
+	}
+	defer resp.Body.Close()
+
+	now := time.Now().UnixMilli()
+	if resp.StatusCode == http.StatusNotModified && hasCache {
+		cached.CheckedAt = now
+		cached.NotModified = true
+		if info := parseSubscriptionUserInfo(resp.Header.Get("Subscription-Userinfo")); info != nil {
+			cached.UserInfo = info
+		}
+		return cached, saveSubscription(cached)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return subscriptionState{}, newCoreError(codeIO, fmt.Sprintf("subscription server returned %d", resp.StatusCode), resp.StatusCode >= 500, map[string]interface{}{
+			"url":    rawURL,
+			"status": resp.StatusCode,
+		})
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, subscriptionMaxBytes+1))
+	if err != nil {
+		return subscriptionState{}, wrapCoreError(codeIO, err, true, map[string]interface{}{"url": rawURL})
+	}
+	if len(body) > subscriptionMaxBytes {
+		return subscriptionState{}, newCoreError(codeInvalidArgument, "subscription is too large", false, map[string]interface{}{"url": rawURL})
+	}
+	format, nodes, skipped, err := parseSubscription(body)
+	if err != nil {
+		return subscriptionState{}, err
+	}
+	state := subscriptionState{
+		URL:          rawURL,
+		Format:       format,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		UserInfo:     parseSubscriptionUserInfo(resp.Header.Get("Subscription-Userinfo")),
+		FetchedAt:    now,
+		CheckedAt:    now,
+		Nodes:        nodes,
+		Skipped:      skipped,
+	}
+	return state, saveSubscription(state)
+}
+
+// parseSubscriptionUserInfo reads "upload=1; download=2; total=3; expire=4".
+func parseSubscriptionUserInfo(header string) *subscriptionUserInfo {
+	if strings.TrimSpace(header) == "" {
+		return nil
+	}
+	info := &subscriptionUserInfo{}
+	found := false
+	for _, part := range strings.Split(header, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "upload":
+			info.Upload = n
+		case "download":
+			info.Download = n
+		case "total":
+			info.Total = n
+		case "expire":
+			info.Expire = n
+		default:
+			continue
+		}
+		found = true
+	}
+	if !found {
+		return nil
+	}
+	return info
+}
+
+var clashProxiesPattern = regexp.MustCompile(`(?m)^proxies:\s*$`)
+
+// parseSubscription detects the document format and imports every entry
+// through the same importer as ImportShareLink. Entries that fail are
+// reported in skipped instead of failing the whole subscription.
+func parseSubscription(body []byte) (string, []shareLinkNode, []subscriptionIssue, error) {
+	body = bytes.TrimSpace(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")))
+	nodes := []shareLinkNode{}
+	var issues []subscriptionIssue
+
+	if bytes.HasPrefix(body, []byte("{")) || clashProxiesPattern.Match(body) {
+		format, parse := subscriptionFormatClash, parseClashProxies
+		if bytes.HasPrefix(body, []byte("{")) {
+			format, parse = subscriptionFormatSingBox, parseSingBoxOutbounds
+		}
+		specs, err := parse(body)
+		if err != nil {
+			return "", nil, nil, newCoreError(codeInvalidArgument, "invalid "+format+" subscription: "+err.Error(), false, nil)
+		}
+		for i, spec := range specs {
+			node, err := spec.node()
+			if err != nil {
+				issues = append(issues, subscriptionIssue{Index: i, Name: spec.Name, Message: err.Error()})
+				continue
+			}
+			nodes = append(nodes, node)
+		}
+		return format, nodes, issues, nil
+	}
+
+	// Line lists are usually base64 encoded as a whole, but plain lists are
+	// common enough to accept as well.
+	if decoded, err := decodeBase64Loose(string(body)); err == nil && bytes.Contains(decoded, []byte("://")) {
+		body = decoded
+	}
+	index := 0
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		node, err := parseShareLink(line)
+		if err != nil {
+			issues = append(issues, subscriptionIssue{Index: index, Message: err.Error()})
+		} else {
+			nodes = append(nodes, node)
+		}
+		index++
+	}
+	if index == 0 {
+		return "", nil, nil, newCoreError(codeInvalidArgument, "subscription contains no nodes", false, nil)
+	}
+	return subscriptionFormatLinks, nodes, issues, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// clashProxy covers the Clash / mihomo proxy fields that map onto xray.
+type clashProxy struct {
+	Name              string      `yaml:"name"`
+	Type              string      `yaml:"type"`
+	Server            string      `yaml:"server"`
+	Port              interface{} `yaml:"port"`
+	UUID              string      `yaml:"uuid"`
+	AlterID           interface{} `yaml:"alterId"`
+	Cipher            string      `yaml:"cipher"`
+	Password          string      `yaml:"password"`
+	Flow              string      `yaml:"flow"`
+	Network           string      `yaml:"network"`
+	TLS               bool        `yaml:"tls"`
+	ServerName        string      `yaml:"servername"`
+	SNI               string      `yaml:"sni"`
+	SkipCertVerify    bool        `yaml:"skip-cert-verify"`
+	ClientFingerprint string      `yaml:"client-fingerprint"`
+	ALPN              []string    `yaml:"alpn"`
+	Plugin            string      `yaml:"plugin"`
+	Obfs              string      `yaml:"obfs"`
+	RealityOpts       struct {
+		PublicKey string `yaml:"public-key"`
+		ShortID   string `yaml:"short-id"`
+	} `yaml:"reality-opts"`
+	WSOpts struct {
+		Path    string            `yaml:"path"`
+		Headers map[string]string `yaml:"headers"`
+	} `yaml:"ws-opts"`
+	GRPCOpts struct {
+		ServiceName string `yaml:"grpc-service-name"`
+	} `yaml:"grpc-opts"`
+	XHTTPOpts struct {
+		Path string `yaml:"path"`
+		Host string `yaml:"host"`
+		Mode string `yaml:"mode"`
+	} `yaml:"xhttp-opts"`
+}
+
+func parseClashProxies(body []byte) ([]proxySpec, error) {
+	var doc struct {
+		Proxies []clashProxy `yaml:"proxies"`
+	}
+	if err := yaml.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	specs := make([]proxySpec, 0, len(doc.Proxies))
+	for _, p := range doc.Proxies {
+		specs = append(specs, p.spec())
+	}
+	return specs, nil
+}
+
+func (p clashProxy) spec() proxySpec {
+	spec := proxySpec{
+		Name:     p.Name,
+		Protocol: strings.ToLower(p.Type),
+		Address:  p.Server,
+		Port:     anyInt(p.Port),
+		ID:       p.UUID,
+		Password: p.Password,
+		Flow:     p.Flow,
+		Cipher:   p.Cipher,
+		AlterID:  anyInt(p.AlterID),
+		Obfs:     p.Obfs,
+		Plugin:   p.Plugin,
+	}
+	security := ""
+	switch {
+	case p.RealityOpts.PublicKey != "":
+		security = "reality"
+	case p.TLS:
+		security = "tls"
+	}
+	stream := linkStreamParams{
+		network:     p.Network,
+		security:    security,
+		defaultSec:  "none",
+		sni:         firstNonEmpty(p.ServerName, p.SNI),
+		fingerprint: p.ClientFingerprint,
+		alpn:        strings.Join(p.ALPN, ","),
+		publicKey:   p.RealityOpts.PublicKey,
+		shortID:     p.RealityOpts.ShortID,
+	}
+	if p.SkipCertVerify {
+		stream.insecure = "1"
+	}
+	switch strings.ToLower(p.Network) {
+	case "ws":
+		stream.path = p.WSOpts.Path
+		stream.host = headerValue(p.WSOpts.Headers, "Host")
+	case "grpc":
+		stream.serviceName = p.GRPCOpts.ServiceName
+	case "xhttp":
+		stream.path = p.XHTTPOpts.Path
+		stream.host = p.XHTTPOpts.Host
+		stream.mode = p.XHTTPOpts.Mode
+	}
+
+	switch spec.Protocol {
+	case "ss":
+		spec.Protocol = "shadowsocks"
+		spec.Method = p.Cipher
+	case "trojan":
+		// Trojan always runs over TLS in Clash.
+		stream.defaultSec = "tls"
+	case "hysteria2":
+		stream.sni = firstNonEmpty(p.SNI, p.ServerName)
+	}
+	spec.Stream = stream
+	return spec
+}
+
+// singBoxOutbound covers the sing-box outbound fields that map onto xray.
+type singBoxOutbound struct {
+	Type       string      `json:"type"`
+	Tag        string      `json:"tag"`
+	Server     string      `json:"server"`
+	ServerPort interface{} `json:"server_port"`
+	UUID       string      `json:"uuid"`
+	Flow       string      `json:"flow"`
+	Password   string      `json:"password"`
+	Method     string      `json:"method"`
+	Security   string      `json:"security"`
+	AlterID    interface{} `json:"alter_id"`
+	Plugin     string      `json:"plugin"`
+	Obfs       *struct {
+		Type string `json:"type"`
+	} `json:"obfs"`
+	TLS *struct {
+		Enabled    bool        `json:"enabled"`
+		ServerName string      `json:"server_name"`
+		Insecure   bool        `json:"insecure"`
+		ALPN       interface{} `json:"alpn"`
+		UTLS       struct {
+			Enabled     bool   `json:"enabled"`
+			Fingerprint string `json:"fingerprint"`
+		} `json:"utls"`
+		Reality struct {
+			Enabled   bool   `json:"enabled"`
+			PublicKey string `json:"public_key"`
+			ShortID   string `json:"short_id"`
+		} `json:"reality"`
+	} `json:"tls"`
+	Transport *struct {
+		Type        string            `json:"type"`
+		Path        string            `json:"path"`
+		Host        interface{}       `json:"host"`
+		Headers     map[string]string `json:"headers"`
+		ServiceName string            `json:"service_name"`
+	} `json:"transport"`
+}
+
+// singBoxNonProxyTypes are outbounds that carry no server to import.
+var singBoxNonProxyTypes = map[string]bool{
+	"direct": true, "block": true, "dns": true, "selector": true, "urltest": true,
+}
+
+func parseSingBoxOutbounds(body []byte) ([]proxySpec, error) {
+	var doc struct {
+		Outbounds []singBoxOutbound `json:"outbounds"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	specs := make([]proxySpec, 0, len(doc.Outbounds))
+	for _, o := range doc.Outbounds {
+		if singBoxNonProxyTypes[o.Type] {
+			continue
+		}
+		specs = append(specs, o.spec())
+	}
+	return specs, nil
+}
+
+func (o singBoxOutbound) spec() proxySpec {
+	spec := proxySpec{
+		Name:     o.Tag,
+		Protocol: o.Type,
+		Address:  o.Server,
+		Port:     anyInt(o.ServerPort),
+		ID:       o.UUID,
+		Password: o.Password,
+		Method:   o.Method,
+		Flow:     o.Flow,
+		Cipher:   o.Security,
+		AlterID:  anyInt(o.AlterID),
+		Plugin:   o.Plugin,
+	}
+	if o.Obfs != nil {
+		spec.Obfs = o.Obfs.Type
+	}
+	stream := linkStreamParams{defaultSec: "none"}
+	if tls := o.TLS; tls != nil && tls.Enabled {
+		stream.security = "tls"
+		stream.sni = tls.ServerName
+		stream.alpn = strings.Join(anyStrings(tls.ALPN), ",")
+		if tls.Insecure {
+			stream.insecure = "1"
+		}
+		if tls.UTLS.Enabled {
+			stream.fingerprint = tls.UTLS.Fingerprint
+		}
+		if tls.Reality.Enabled {
+			stream.security = "reality"
+			stream.publicKey = tls.Reality.PublicKey
+			stream.shortID = tls.Reality.ShortID
+		}
+	}
+	if t := o.Transport; t != nil {
+		stream.network = t.Type
+		stream.path = t.Path
+		stream.serviceName = t.ServiceName
+		stream.host = firstNonEmpty(strings.Join(anyStrings(t.Host), ","), headerValue(t.Headers, "Host"))
+		if t.Type == "http" {
+			// sing-box "http" without TLS is the HTTP/1.1 header obfuscation.
+			stream.network = "tcp"
+			stream.headerType = "http"
+		}
+	}
+	spec.Stream = stream
+	return spec
+}
+
+func headerValue(headers map[string]string, name string) string {
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// anyInt accepts the numbers and numeric strings YAML and JSON documents
+// use interchangeably for ports and ids.
+func anyInt(value interface{}) int {
+	switch v := value.(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(strings.TrimSpace(v))
+		return n
+	}
+	return 0
+}
+
+// anyStrings accepts a string or a list of strings.
+func anyStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			out = append(out, fmt.Sprint(item))
+		}
+		return out
+	}
+	return nil
+}
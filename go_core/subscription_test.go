@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const testClashSubscription = `
+port: 7890
+proxies:
+  - name: hk-reality
+    type: vless
+    server: hk.example.com
+    port: 443
+    uuid: 27848739-7e62-4138-9fd3-098a63964b6b
+    network: grpc
+    tls: true
+    servername: www.example.com
+    client-fingerprint: chrome
+    flow: xtls-rprx-vision
+    reality-opts:
+      public-key: Z84J2IelR9ch3k8VtlVhhs5ycBUlXA7wHBWcBrjqnAw
+      short-id: 6ba85179e30d4fc2
+    grpc-opts:
+      grpc-service-name: grpc
+  - name: jp-trojan
+    type: trojan
+    server: jp.example.com
+    port: "8443"
+    password: secret
+    network: ws
+    ws-opts:
+      path: /ws
+      headers:
+        Host: cdn.example.com
+  - name: us-ss
+    type: ss
+    server: 203.0.113.1
+    port: 8388
+    cipher: aes-256-gcm
+    password: pw
+    plugin: obfs
+proxy-groups: []
+`
+
+const testSingBoxSubscription = `{
+  "outbounds": [
+    {"type": "selector", "tag": "select", "outbounds": ["sg"]},
+    {
+      "type": "vmess",
+      "tag": "sg",
+      "server": "sg.example.com",
+      "server_port": 443,
+      "uuid": "27848739-7e62-4138-9fd3-098a63964b6b",
+      "security": "auto",
+      "tls": {"enabled": true, "server_name": "sg.example.com", "alpn": ["h2"]},
+      "transport": {"type": "ws", "path": "/v", "headers": {"Host": "cdn.example.com"}}
+    },
+    {"type": "hysteria2", "tag": "hy", "server": "hy.example.com", "server_port": 443, "password": "pw", "tls": {"enabled": true}},
+    {"type": "direct", "tag": "direct"}
+  ]
+}`
+
+func TestParseSubscriptionLinks(t *testing.T) {
+	list := strings.Join([]string{
+		"vless://27848739-7e62-4138-9fd3-098a63964b6b@a.example.com:443?type=xhttp&security=tls&path=%2Fx&mode=auto#A",
+		"trojan://pw@b.example.com:443#B",
+		"unknown://c",
+	}, "\n")
+	body := base64.StdEncoding.EncodeToString([]byte(list))
+
+	format, nodes, skipped, err := parseSubscription([]byte(body))
+	if err != nil {
+		t.Fatalf("parseSubscription: %v", err)
+	}
+	if format != subscriptionFormatLinks {
+		t.Fatalf("format = %q, want %q", format, subscriptionFormatLinks)
+	}
+	if len(nodes) != 2 || nodes[0].Name != "A" || nodes[0].Transport != "xhttp" || nodes[1].Security != "tls" {
+		t.Fatalf("unexpected nodes: %+v", nodes)
+	}
+	if len(skipped) != 1 || skipped[0].Index != 2 {
+		t.Fatalf("unexpected skipped: %+v", skipped)
+	}
+}
+
+func TestParseSubscriptionClash(t *testing.T) {
+	format, nodes, skipped, err := parseSubscription([]byte(testClashSubscription))
+	if err != nil {
+		t.Fatalf("parseSubscription: %v", err)
+	}
+	if format != subscriptionFormatClash {
+		t.Fatalf("format = %q, want %q", format, subscriptionFormatClash)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("got %d nodes, want 2: %+v", len(nodes), nodes)
+	}
+	hk := nodes[0]
+	if hk.Protocol != "vless" || hk.Transport != "grpc" || hk.Security != "reality" {
+		t.Fatalf("unexpected hk node: %+v", hk)
+	}
+	reality := hk.Outbound["streamSettings"].(map[string]interface{})["realitySettings"].(map[string]interface{})
+	if reality["serverName"] != "www.example.com" || reality["shortId"] != "6ba85179e30d4fc2" {
+		t.Fatalf("unexpected reality settings: %v", reality)
+	}
+	jp := nodes[1]
+	if jp.Port != 8443 || jp.Security != "tls" || jp.Transport != "ws" {
+		t.Fatalf("unexpected jp node: %+v", jp)
+	}
+	ws := jp.Outbound["streamSettings"].(map[string]interface{})["wsSettings"].(map[string]interface{})
+	if ws["host"] != "cdn.example.com" || ws["path"] != "/ws" {
+		t.Fatalf("unexpected ws settings: %v", ws)
+	}
+	if len(skipped) != 1 || skipped[0].Name != "us-ss" {
+		t.Fatalf("unexpected skipped: %+v", skipped)
+	}
+}
+
+func TestParseSubscriptionSingBox(t *testing.T) {
+	format, nodes, skipped, err := parseSubscription([]byte(testSingBoxSubscription))
+	if err != nil {
+		t.Fatalf("parseSubscription: %v", err)
+	}
+	if format != subscriptionFormatSingBox {
+		t.Fatalf("format = %q, want %q", format, subscriptionFormatSingBox)
+	}
+	if len(skipped) != 0 || len(nodes) != 2 {
+		t.Fatalf("unexpected result: nodes=%+v skipped=%+v", nodes, skipped)
+	}
+	if nodes[0].Name != "sg" || nodes[0].Protocol != "vmess" || nodes[0].Transport != "ws" || nodes[0].Security != "tls" {
+		t.Fatalf("unexpected sg node: %+v", nodes[0])
+	}
+	if nodes[1].Protocol != "hysteria2" || nodes[1].Outbound["protocol"] != "hysteria" {
+		t.Fatalf("unexpected hy node: %+v", nodes[1])
+	}
+}
+
+func TestParseSubscriptionUserInfo(t *testing.T) {
+	info := parseSubscriptionUserInfo("upload=1024; download=2048;total=10737418240; expire=1893456000")
+	if info == nil || info.Upload != 1024 || info.Download != 2048 || info.Total != 10737418240 || info.Expire != 1893456000 {
+		t.Fatalf("unexpected user info: %+v", info)
+	}
+	if parseSubscriptionUserInfo("garbage") != nil {
+		t.Fatal("expected nil for a header without known keys")
+	}
+}
+
+func TestRefreshSubscriptionCaching(t *testing.T) {
+	setTestDataDir(t)
+
+	const etag = `"v1"`
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Subscription-Userinfo", "upload=1; download=2; total=3")
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		_, _ = w.Write([]byte(testClashSubscription))
+	}))
+	defer server.Close()
+
+	first, err := refreshSubscription(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("first refresh: %v", err)
+	}
+	if first.NotModified || first.ETag != etag || len(first.Nodes) != 2 || first.UserInfo == nil || first.UserInfo.Total != 3 {
+		t.Fatalf("unexpected first refresh: %+v", first)
+	}
+	info, err := os.Stat(subscriptionPath(server.URL))
+	if err != nil {
+		t.Fatalf("cache file: %v", err)
+	}
+	if perm := info.Mode().Perm(); runtime.GOOS != "windows" && perm&0o077 != 0 {
+		t.Fatalf("cache file permissions = %o, want owner only", perm)
+	}
+
+	second, err := refreshSubscription(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("second refresh: %v", err)
+	}
+	if !second.NotModified || len(second.Nodes) != 2 || second.FetchedAt != first.FetchedAt {
+		t.Fatalf("expected cached nodes on 304, got %+v", second)
+	}
+	if requests != 2 {
+		t.Fatalf("server saw %d requests, want 2", requests)
+	}
+
+	cached, err := loadSubscription(server.URL)
+	if err != nil || !cached.NotModified {
+		t.Fatalf("loadSubscription = %+v, %v", cached, err)
+	}
+}
+
+func TestRefreshSubscriptionHTTPError(t *testing.T) {
+	setTestDataDir(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	_, err := refreshSubscription(context.Background(), server.URL)
+	ce := classifyError(err)
+	if ce == nil || ce.Code != codeIO || !ce.Retryable || ce.Details["status"] != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected error: %+v", ce)
+	}
+}
+
+// setTestDataDir points the core data dir at a temporary directory for the
+// duration of the test.
+func setTestDataDir(t *testing.T) {
+	t.Helper()
+	if err := setCoreDataDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = setCoreDataDir("") })
+}
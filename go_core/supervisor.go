@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// supervisorPollInterval is how often the supervisor checks the core.
+const supervisorPollInterval = time.Second
+
+// supervisorConfig controls automatic restarts after the core stops on its
+// own. A run that lasts StableAfterMs resets the restart budget.
+type supervisorConfig struct {
+	Enabled          bool  `json:"enabled"`
+	MaxRestarts      int   `json:"maxRestarts"`
+	InitialBackoffMs int64 `json:"initialBackoffMs"`
+	MaxBackoffMs     int64 `json:"maxBackoffMs"`
+	StableAfterMs    int64 `json:"stableAfterMs"`
+}
+
+var defaultSupervisorConfig = supervisorConfig{
+	Enabled:          true,
+	MaxRestarts:      5,
+	InitialBackoffMs: 1000,
+	MaxBackoffMs:     30000,
+	StableAfterMs:    60000,
+}
+
+type supervisor struct {
+	mu   sync.Mutex
+	cfg  supervisorConfig
+	poll time.Duration
+}
+
+var coreSupervisor = &supervisor{cfg: defaultSupervisorConfig, poll: supervisorPollInterval}
+
+func (s *supervisor) config() supervisorConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// configure applies cfg, filling zero durations from the defaults.
+func (s *supervisor) configure(cfg supervisorConfig) (supervisorConfig, error) {
+	if cfg.MaxRestarts < 0 || cfg.InitialBackoffMs < 0 || cfg.MaxBackoffMs < 0 || cfg.StableAfterMs < 0 {
+		return supervisorConfig{}, newCoreError(codeInvalidArgument, "supervisor limits must not be negative", false, nil)
+	}
+	if cfg.InitialBackoffMs == 0 {
+		cfg.InitialBackoffMs = defaultSupervisorConfig.InitialBackoffMs
+	}
+	if cfg.MaxBackoffMs == 0 {
+		cfg.MaxBackoffMs = defaultSupervisorConfig.MaxBackoffMs
+	}
+	if cfg.MaxBackoffMs < cfg.InitialBackoffMs {
+		cfg.MaxBackoffMs = cfg.InitialBackoffMs
+	}
+	if cfg.StableAfterMs == 0 {
+		cfg.StableAfterMs = defaultSupervisorConfig.StableAfterMs
+	}
+	s.mu.Lock()
+	s.cfg = cfg
+	s.mu.Unlock()
+	return cfg, nil
+}
+
+// backoff returns the delay before the given restart attempt (1-based).
+func (c supervisorConfig) backoff(attempt int) time.Duration {
+	delay := time.Duration(c.InitialBackoffMs) * time.Millisecond
+	limit := time.Duration(c.MaxBackoffMs) * time.Millisecond
+	for i := 1; i < attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	return delay
+}
+
+// watch follows the core started as generation gen until it is stopped on
+// purpose, replaced by another start, or crashes. A crash is restarted with
+// exponential backoff; once the budget is spent the engine stays failed.
+func (s *supervisor) watch(gen uint64) {
+	s.mu.Lock()
+	poll := s.poll
+	s.mu.Unlock()
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		engine.mu.Lock()
+		if engine.gen != gen {
+			engine.mu.Unlock()
+			return
+		}
+		engine.reconcileLocked()
+		state, crashed, since := engine.state, engine.crashed, engine.since
+		engine.mu.Unlock()
+
+		cfg := s.config()
+		switch {
+		case state == engineRunning:
+			if time.Since(since) >= time.Duration(cfg.StableAfterMs)*time.Millisecond {
+				engine.mu.Lock()
+				if engine.gen == gen {
+					engine.restarts = 0
+				}
+				engine.mu.Unlock()
+			}
+			continue
+		case state == engineFailed && crashed:
+			if cfg.Enabled {
+				s.restart(gen)
+			}
+			return
+		default:
+			return
+		}
+	}
+}
+
+// restart brings back the crashed generation gen. It gives up as soon as a
+// host starts, stops or switches the core in the meantime.
+func (s *supervisor) restart(gen uint64) {
+	engine.mu.Lock()
+	reason := engine.lastExit
+	engine.mu.Unlock()
+
+	for {
+		cfg := s.config()
+		engine.mu.Lock()
+		if engine.gen != gen || engine.state != engineFailed || !engine.crashed {
+			engine.mu.Unlock()
+			return
+		}
+		attempt := engine.restarts + 1
+		node, lastExit := engine.node, engine.lastExit
+		if attempt > cfg.MaxRestarts {
+			engine.crashed = false
+			engine.transitionLocked(engineFailed, fmt.Sprintf("gave up after %d restarts: %s", cfg.MaxRestarts, lastExit))
+			engine.mu.Unlock()
+			return
+		}
+		engine.restarts = attempt
+		engine.mu.Unlock()
+
+		delay := cfg.backoff(attempt)
+		publishEvent(eventCoreRestart, node, lastExit, map[string]interface{}{
+			"attempt":     attempt,
+			"maxRestarts": cfg.MaxRestarts,
+			"delayMs":     delay.Milliseconds(),
+		})
+		time.Sleep(delay)
+
+		instMu.Lock()
+		engine.mu.Lock()
+		current := engine.gen == gen && engine.state == engineFailed && engine.crashed
+		cfgData := engine.cfg
+		engine.mu.Unlock()
+		if !current {
+			instMu.Unlock()
+			return
+		}
+		err := engine.launch(node, cfgData, fmt.Sprintf("restart %d/%d after crash", attempt, cfg.MaxRestarts), true)
+		instMu.Unlock()
+		if err == nil {
+			return
+		}
+
+		engine.mu.Lock()
+		if engine.gen == gen && engine.state == engineFailed {
+			engine.crashed = true
+			engine.lastExit = reason + " (restart failed: " + err.Error() + ")"
+		}
+		engine.mu.Unlock()
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// useFastSupervisor polls and backs off in milliseconds for the test.
+func useFastSupervisor(t *testing.T, cfg supervisorConfig) {
+	t.Helper()
+	coreSupervisor.mu.Lock()
+	prevCfg, prevPoll := coreSupervisor.cfg, coreSupervisor.poll
+	coreSupervisor.poll = 5 * time.Millisecond
+	coreSupervisor.mu.Unlock()
+	if _, err := coreSupervisor.configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		coreSupervisor.mu.Lock()
+		coreSupervisor.cfg, coreSupervisor.poll = prevCfg, prevPoll
+		coreSupervisor.mu.Unlock()
+	})
+}
+
+// waitEngine polls the engine until ok accepts its snapshot.
+func waitEngine(t *testing.T, ok func(engineSnapshot) bool) engineSnapshot {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		snap := engine.snapshot()
+		if ok(snap) {
+			return snap
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("engine = %+v", snap)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// restartEvents returns the core_restart events published after cursor.
+func restartEvents(cursor int64) []coreEvent {
+	var events []coreEvent
+	for _, event := range coreEvents.poll(cursor, 0).Events {
+		if event.Kind == eventCoreRestart {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	cfg, err := coreSupervisor.configure(supervisorConfig{InitialBackoffMs: 100, MaxBackoffMs: 1000})
+	t.Cleanup(func() { _, _ = coreSupervisor.configure(defaultSupervisorConfig) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, ms := range want {
+		if got := cfg.backoff(i + 1); got != ms*time.Millisecond {
+			t.Fatalf("backoff(%d) = %v, want %v", i+1, got, ms*time.Millisecond)
+		}
+	}
+
+	if cfg, _ := coreSupervisor.configure(supervisorConfig{InitialBackoffMs: 500, MaxBackoffMs: 100}); cfg.MaxBackoffMs != 500 || cfg.StableAfterMs != defaultSupervisorConfig.StableAfterMs {
+		t.Fatalf("configure = %+v", cfg)
+	}
+	_, err = coreSupervisor.configure(supervisorConfig{MaxRestarts: -1})
+	assertCoreErrorCode(t, err, codeInvalidArgument)
+}
+
+func TestSupervisorRestartsCrashedCore(t *testing.T) {
+	setTestDataDir(t)
+	core := useFakeCore(t)
+	useFastSupervisor(t, supervisorConfig{Enabled: true, MaxRestarts: 2, InitialBackoffMs: 10, MaxBackoffMs: 15, StableAfterMs: 3600000})
+
+	cursor := coreEvents.poll(0, 0).Cursor
+	if err := engine.start("jp", socksNodeConfig(freeTCPPort(t))); err != nil {
+		t.Fatal(err)
+	}
+
+	core.crash(false)
+	snap := waitEngine(t, func(s engineSnapshot) bool { return s.State == engineRunning && s.Restarts == 1 })
+	restarted := snap.History[len(snap.History)-2]
+	if snap.Node != "jp" || restarted.Cause != "restart 1/2 after crash" || !strings.HasPrefix(snap.LastExit, "core stopped unexpectedly") {
+		t.Fatalf("after first crash = %+v", snap)
+	}
+
+	// The second restart fails, which spends the budget.
+	core.crash(true)
+	snap = waitEngine(t, func(s engineSnapshot) bool { return s.State == engineFailed && strings.HasPrefix(s.Cause, "gave up") })
+	if snap.Restarts != 2 || !strings.Contains(snap.Cause, "gave up after 2 restarts") || !strings.Contains(snap.Cause, "restart failed") {
+		t.Fatalf("after second crash = %+v", snap)
+	}
+
+	events := restartEvents(cursor)
+	if len(events) != 2 {
+		t.Fatalf("core_restart events = %+v", events)
+	}
+	for i, delayMs := range []int64{10, 15} {
+		data := events[i].Data.(map[string]interface{})
+		if events[i].Node != "jp" || data["attempt"] != i+1 || data["maxRestarts"] != 2 || data["delayMs"] != delayMs {
+			t.Fatalf("event %d = %+v", i, events[i])
+		}
+	}
+
+	// Nothing is watching the failed core any more.
+	time.Sleep(50 * time.Millisecond)
+	if starts := len(core.startFds()); starts != 3 {
+		t.Fatalf("core started %d times, want 3", starts)
+	}
+}
+
+func TestSupervisorSkipsReplacedGeneration(t *testing.T) {
+	setTestDataDir(t)
+	core := useFakeCore(t)
+	useFastSupervisor(t, supervisorConfig{Enabled: true, MaxRestarts: 3, InitialBackoffMs: 200, MaxBackoffMs: 200, StableAfterMs: 3600000})
+
+	cursor := coreEvents.poll(0, 0).Cursor
+	if err := engine.start("jp", socksNodeConfig(freeTCPPort(t))); err != nil {
+		t.Fatal(err)
+	}
+	core.crash(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(restartEvents(cursor)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("supervisor never scheduled a restart")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// A host start during the backoff is a new generation; the pending
+	// restart of jp must not replace it.
+	if err := engine.start("us", socksNodeConfig(freeTCPPort(t))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	snap := engine.snapshot()
+	if snap.State != engineRunning || snap.Node != "us" || snap.Restarts != 0 {
+		t.Fatalf("engine = %+v", snap)
+	}
+	if starts := len(core.startFds()); starts != 2 {
+		t.Fatalf("core started %d times, want 2", starts)
+	}
+}
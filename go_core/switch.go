@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// defaultSwitchTimeout is how long a freshly started config has to open its
+// local inbounds before the switch is rolled back.
+const defaultSwitchTimeout = 8 * time.Second
+
+type switchResult struct {
+	Active     string `json:"active"`
+	Previous   string `json:"previous,omitempty"`
+	RolledBack bool   `json:"rolledBack"`
+}
+
+// preflightConfig rejects configs that can never start, before the running
+// instance is touched.
+func preflightConfig(cfgData []byte) error {
+	return configReportError(validateXrayConfig(cfgData))
+}
+
+// localInbound is a socks, http or mixed inbound of a config.
+type localInbound struct {
+	Protocol string
+	Addr     string
+}
+
+// localProxyInbounds lists the local proxy inbounds of a config with the
+// address a client on this host should connect to.
+func localProxyInbounds(cfgData []byte) []localInbound {
+	var doc struct {
+		Inbounds []struct {
+			Protocol string      `json:"protocol"`
+			Listen   string      `json:"listen"`
+			Port     interface{} `json:"port"`
+		} `json:"inbounds"`
+	}
+	if err := json.Unmarshal(cfgData, &doc); err != nil {
+		return nil
+	}
+	var inbounds []localInbound
+	for _, inbound := range doc.Inbounds {
+		switch inbound.Protocol {
+		case "socks", "http", "mixed":
+		default:
+			continue
+		}
+		var port int
+		switch v := inbound.Port.(type) {
+		case float64:
+			port = int(v)
+		case string:
+			port, _ = strconv.Atoi(v)
+		}
+		if port <= 0 {
+			continue
+		}
+		host := inbound.Listen
+		switch host {
+		case "", "0.0.0.0":
+			host = "127.0.0.1"
+		case "::":
+			host = "::1"
+		}
+		inbounds = append(inbounds, localInbound{Protocol: inbound.Protocol, Addr: net.JoinHostPort(host, strconv.Itoa(port))})
+	}
+	return inbounds
+}
+
+// probeAddresses lists the local proxy inbounds that should accept TCP
+// connections once the core is up.
+func probeAddresses(cfgData []byte) []string {
+	var addrs []string
+	for _, inbound := range localProxyInbounds(cfgData) {
+		addrs = append(addrs, inbound.Addr)
+	}
+	return addrs
+}
+
+// waitEngineReady waits until the core is running and every probe address
+// accepts connections.
+func waitEngineReady(cfgData []byte, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	pending := probeAddresses(cfgData)
+	for {
+		if !engine.running() {
+			return newCoreError(codeStartFailed, "core stopped during startup", true, nil)
+		}
+		for len(pending) > 0 {
+			conn, err := net.DialTimeout("tcp", pending[0], 500*time.Millisecond)
+			if err != nil {
+				break
+			}
+			_ = conn.Close()
+			pending = pending[1:]
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return newCoreError(codeStartFailed, "inbound did not become ready in time", true, map[string]interface{}{
+				"address": pending[0],
+				"timeout": timeout.String(),
+			})
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// switchConfig replaces the running config with cfgData. If the new config
+// fails to start or become ready, the previous config is restarted.
+func switchConfig(node string, cfgData []byte, timeout time.Duration) (switchResult, error) {
+	if err := preflightConfig(cfgData); err != nil {
+		return switchResult{}, err
+	}
+
+	instMu.Lock()
+	defer instMu.Unlock()
+
+	prevNode, prevCfg := engine.current()
+	wasRunning := engine.running()
+	// A tunnel session keeps its TUN fd across the switch and a rollback.
+	tunEnv := saveTunFdEnv()
+	result := switchResult{Active: node}
+	if wasRunning {
+		result.Previous = prevNode
+		if err := stopXrayInternal("switching to " + displayNode(node)); err != nil && !errors.Is(err, errNotRunning) {
+			return switchResult{Active: prevNode}, err
+		}
+	}
+
+	tunEnv.restore()
+	startErr := startXrayInternal(node, cfgData)
+	if startErr == nil {
+		startErr = waitEngineReady(cfgData, timeout)
+		if startErr != nil {
+			_ = stopXrayInternal("switch rolled back")
+		}
+	}
+	if startErr == nil {
+		publishEvent(eventNodeSwitched, node, "switched", result)
+		return result, nil
+	}
+
+	if !wasRunning {
+		return switchResult{}, startErr
+	}
+	result.Active = prevNode
+	result.RolledBack = true
+	tunEnv.restore()
+	if err := startXrayInternal(prevNode, prevCfg); err != nil {
+		clearTunFdEnv()
+		result.Active = ""
+		ce := classifyError(startErr)
+		return result, newCoreError(ce.Code, ce.Message, ce.Retryable, map[string]interface{}{
+			"rolledBack":    false,
+			"rollbackError": err.Error(),
+		})
+	}
+	publishEvent(eventNodeSwitched, prevNode, "switch rolled back", result)
+	ce := classifyError(startErr)
+	details := map[string]interface{}{"rolledBack": true, "active": prevNode}
+	for k, v := range ce.Details {
+		details[k] = v
+	}
+	return result, newCoreError(ce.Code, ce.Message, ce.Retryable, details)
+}
+
+func switchNode(node string, timeout time.Duration) (switchResult, error) {
+	data, err := readNodeConfig(node)
+	if err != nil {
+		return switchResult{}, err
+	}
+	return switchConfig(node, data, timeout)
+}
+
+func displayNode(node string) string {
+	if node == "" {
+		return "custom config"
+	}
+	return node
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCore stands in for the libXray singleton. It records the TUN fd each
+// start saw and fails starts whose config contains failMarker.
+type fakeCore struct {
+	mu      sync.Mutex
+	running bool
+	refuse  bool
+	fds     []string
+}
+
+const failMarker = "fake-core-fail"
+
+func useFakeCore(t *testing.T) *fakeCore {
+	t.Helper()
+	core := &fakeCore{}
+	run, stop, running := xrayRun, xrayStop, xrayRunning
+	xrayRun = func(cfg string) error {
+		core.mu.Lock()
+		defer core.mu.Unlock()
+		core.fds = append(core.fds, os.Getenv(tunFdEnvKey))
+		if core.refuse || strings.Contains(cfg, failMarker) {
+			return errors.New("fake core refused config")
+		}
+		core.running = true
+		return nil
+	}
+	xrayStop = func() error {
+		core.mu.Lock()
+		defer core.mu.Unlock()
+		core.running = false
+		return nil
+	}
+	xrayRunning = func() bool {
+		core.mu.Lock()
+		defer core.mu.Unlock()
+		return core.running
+	}
+	t.Cleanup(func() {
+		_ = stopXrayInternal("test cleanup")
+		xrayRun, xrayStop, xrayRunning = run, stop, running
+	})
+	return core
+}
+
+// crash stops the fake core behind the engine's back. With refuse set,
+// every later start fails as well.
+func (c *fakeCore) crash(refuse bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running = false
+	c.refuse = refuse
+}
+
+func (c *fakeCore) startFds() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.fds...)
+}
+
+func tunConfig(outboundTag string) []byte {
+	return []byte(`{
+  "inbounds": [{"tag": "tun-in", "protocol": "tun", "settings": {"name": "xray0", "MTU": 1500}}],
+  "outbounds": [{"tag": "` + outboundTag + `", "protocol": "freedom"}]
+}`)
+}
+
+// startTunnelForTest starts cfg the way the tunnel bridges do: with the TUN
+// fd in the environment.
+func startTunnelForTest(t *testing.T, fd string, cfg []byte) {
+	t.Helper()
+	for _, key := range tunFdEnvKeys {
+		t.Setenv(key, fd)
+	}
+	if err := startXrayInternal("", cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSwitchConfigKeepsTunFd(t *testing.T) {
+	core := useFakeCore(t)
+	startTunnelForTest(t, "42", tunConfig("direct"))
+
+	result, err := switchConfig("next", tunConfig("next-direct"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Active != "next" || result.RolledBack {
+		t.Fatalf("result = %+v", result)
+	}
+	if fds := core.startFds(); len(fds) != 2 || fds[1] != "42" {
+		t.Fatalf("start fds = %q, want the switched config started with fd 42", fds)
+	}
+	for _, key := range tunFdEnvKeys {
+		if got := os.Getenv(key); got != "42" {
+			t.Errorf("%s = %q after switch, want 42", key, got)
+		}
+	}
+}
+
+func TestSwitchConfigRollbackKeepsTunFd(t *testing.T) {
+	core := useFakeCore(t)
+	startTunnelForTest(t, "42", tunConfig("direct"))
+
+	result, err := switchConfig("broken", tunConfig(failMarker), time.Second)
+	if err == nil {
+		t.Fatal("switch to a failing config succeeded")
+	}
+	if result.Active != "" || !result.RolledBack {
+		t.Fatalf("result = %+v", result)
+	}
+	if fds := core.startFds(); len(fds) != 3 || fds[1] != "42" || fds[2] != "42" {
+		t.Fatalf("start fds = %q, want the new and the rollback config started with fd 42", fds)
+	}
+	if !engine.running() || os.Getenv(tunFdEnvKey) != "42" {
+		t.Fatalf("rolled back core running = %v, fd = %q", engine.running(), os.Getenv(tunFdEnvKey))
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/app/stats/command"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	// trafficAPITag is the api tag injected when a config has no api section.
+	trafficAPITag = "xstream-api"
+	// trafficSampleInterval is how often the stats counters are read.
+	trafficSampleInterval = time.Second
+	// trafficSmoothing is the EWMA weight given to the newest sample.
+	trafficSmoothing = 0.3
+)
+
+type trafficCounters struct {
+	Tag                    string `json:"tag,omitempty"`
+	UploadBytesPerSecond   int64  `json:"uploadBytesPerSecond"`
+	DownloadBytesPerSecond int64  `json:"downloadBytesPerSecond"`
+	TotalUploadBytes       int64  `json:"totalUploadBytes"`
+	TotalDownloadBytes     int64  `json:"totalDownloadBytes"`
+
+	upRate   float64
+	downRate float64
+}
+
+type trafficSnapshot struct {
+	Available bool `json:"available"`
+	trafficCounters
+	Outbounds []trafficCounters `json:"outbounds"`
+}
+
+// trafficMonitor samples the xray stats service of the primary core and
+// keeps smoothed rates and totals, overall and per outbound tag. Overall
+// numbers come from the inbound counters so traffic routed to several
+// outbounds is not counted twice.
+type trafficMonitor struct {
+	mu        sync.Mutex
+	conn      *grpc.ClientConn
+	client    command.StatsServiceClient
+	apiTag    string
+	done      chan struct{}
+	last      map[string]int64
+	lastAt    time.Time
+	total     trafficCounters
+	outbounds map[string]*trafficCounters
+}
+
+var traffic = &trafficMonitor{}
+
+// attach starts sampling the stats service at addr. Totals survive restarts
+// of the same session; a fresh start resets them.
+func (m *trafficMonitor) attach(addr, apiTag string, keepTotals bool) {
+	m.detach()
+	if addr == "" {
+		return
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.conn = conn
+	m.client = command.NewStatsServiceClient(conn)
+	m.apiTag = apiTag
+	m.done = make(chan struct{})
+	m.last = map[string]int64{}
+	m.lastAt = time.Time{}
+	if !keepTotals || m.outbounds == nil {
+		m.total = trafficCounters{}
+		m.outbounds = map[string]*trafficCounters{}
+	}
+	done := m.done
+	m.mu.Unlock()
+
+	go m.run(done)
+}
+
+func (m *trafficMonitor) detach() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done != nil {
+		close(m.done)
+		m.done = nil
+	}
+	if m.conn != nil {
+		_ = m.conn.Close()
+		m.conn = nil
+		m.client = nil
+	}
+	m.resetRatesLocked()
+}
+
+// resetRatesLocked zeroes the rates while keeping the totals, for a core
+// that stopped or cannot be queried.
+func (m *trafficMonitor) resetRatesLocked() {
+	m.total.resetRates()
+	for _, counters := range m.outbounds {
+		counters.resetRates()
+	}
+}
+
+func (m *trafficMonitor) run(done chan struct{}) {
+	ticker := time.NewTicker(trafficSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			m.sample()
+		}
+	}
+}
+
+func (m *trafficMonitor) sample() {
+	m.mu.Lock()
+	client := m.client
+	m.mu.Unlock()
+	if client == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), trafficSampleInterval)
+	resp, err := client.QueryStats(ctx, &command.QueryStatsRequest{Pattern: ">>>traffic>>>"})
+	cancel()
+	if err != nil {
+		m.mu.Lock()
+		if m.client == client {
+			m.resetRatesLocked()
+		}
+		m.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client != client {
+		return
+	}
+
+	var inUp, inDown int64
+	outUp := map[string]int64{}
+	outDown := map[string]int64{}
+	for _, stat := range resp.GetStat() {
+		parts := strings.Split(stat.GetName(), ">>>")
+		if len(parts) != 4 || parts[2] != "traffic" {
+			continue
+		}
+		delta := stat.GetValue() - m.last[stat.GetName()]
+		if delta < 0 {
+			// Counters restart from zero when the core is restarted.
+			delta = stat.GetValue()
+		}
+		m.last[stat.GetName()] = stat.GetValue()
+
+		kind, tag, direction := parts[0], parts[1], parts[3]
+		switch {
+		case kind == "inbound" && tag != m.apiTag && direction == "uplink":
+			inUp += delta
+		case kind == "inbound" && tag != m.apiTag && direction == "downlink":
+			inDown += delta
+		case kind == "outbound" && direction == "uplink":
+			outUp[tag] += delta
+		case kind == "outbound" && direction == "downlink":
+			outDown[tag] += delta
+		}
+	}
+
+	first := m.lastAt.IsZero()
+	elapsed := now.Sub(m.lastAt).Seconds()
+	m.lastAt = now
+	if first || elapsed <= 0 {
+		// The first read only establishes the baseline.
+		return
+	}
+	m.total.add(inUp, inDown, elapsed)
+	for tag := range outUp {
+		if _, ok := m.outbounds[tag]; !ok {
+			m.outbounds[tag] = &trafficCounters{Tag: tag}
+		}
+	}
+	for tag := range outDown {
+		if _, ok := m.outbounds[tag]; !ok {
+			m.outbounds[tag] = &trafficCounters{Tag: tag}
+		}
+	}
+	for tag, counters := range m.outbounds {
+		counters.add(outUp[tag], outDown[tag], elapsed)
+	}
+}
+
+func (c *trafficCounters) add(up, down int64, elapsed float64) {
+	c.TotalUploadBytes += up
+	c.TotalDownloadBytes += down
+	c.upRate = trafficSmoothing*(float64(up)/elapsed) + (1-trafficSmoothing)*c.upRate
+	c.downRate = trafficSmoothing*(float64(down)/elapsed) + (1-trafficSmoothing)*c.downRate
+	c.UploadBytesPerSecond = int64(c.upRate + 0.5)
+	c.DownloadBytesPerSecond = int64(c.downRate + 0.5)
+}
+
+func (c *trafficCounters) resetRates() {
+	c.upRate, c.downRate = 0, 0
+	c.UploadBytesPerSecond, c.DownloadBytesPerSecond = 0, 0
+}
+
+func (m *trafficMonitor) snapshot() trafficSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snap := trafficSnapshot{
+		Available:       m.client != nil && !m.lastAt.IsZero(),
+		trafficCounters: m.total,
+		Outbounds:       make([]trafficCounters, 0, len(m.outbounds)),
+	}
+	for _, counters := range m.outbounds {
+		snap.Outbounds = append(snap.Outbounds, *counters)
+	}
+	sort.Slice(snap.Outbounds, func(i, j int) bool { return snap.Outbounds[i].Tag < snap.Outbounds[j].Tag })
+	return snap
+}
+
+// prepareTrafficStats enables the stats service and traffic counters in a
+// config and returns the address of its api listener. An existing api
+// section is reused; otherwise one is injected on a free loopback port.
+// Configs that cannot be rewritten are returned unchanged with no address.
+func prepareTrafficStats(cfgData []byte) ([]byte, string, string) {
+	if isJSONWithComments(cfgData) {
+		return cfgData, "", ""
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(cfgData, &doc); err != nil {
+		return cfgData, "", ""
+	}
+
+	if _, ok := doc["stats"].(map[string]interface{}); !ok {
+		doc["stats"] = map[string]interface{}{}
+	}
+	policy, _ := doc["policy"].(map[string]interface{})
+	if policy == nil {
+		policy = map[string]interface{}{}
+		doc["policy"] = policy
+	}
+	system, _ := policy["system"].(map[string]interface{})
+	if system == nil {
+		system = map[string]interface{}{}
+		policy["system"] = system
+	}
+	for _, key := range []string{"statsInboundUplink", "statsInboundDownlink", "statsOutboundUplink", "statsOutboundDownlink"} {
+		system[key] = true
+	}
+
+	api, _ := doc["api"].(map[string]interface{})
+	if api == nil {
+		api = map[string]interface{}{"tag": trafficAPITag}
+		doc["api"] = api
+	}
+	apiTag := stringField(api, "tag")
+	if apiTag == "" {
+		apiTag = trafficAPITag
+		api["tag"] = apiTag
+	}
+	services, _ := api["services"].([]interface{})
+	hasStats := false
+	for _, service := range services {
+		if service == "StatsService" {
+			hasStats = true
+		}
+	}
+	if !hasStats {
+		api["services"] = append(services, "StatsService")
+	}
+
+	addr := stringField(api, "listen")
+	if addr == "" {
+		addr = apiInboundAddress(doc, apiTag)
+	}
+	if addr == "" {
+		port, err := freePort("127.0.0.1")
+		if err != nil {
+			return cfgData, "", ""
+		}
+		addr = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+		api["listen"] = addr
+	}
+
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return cfgData, "", ""
+	}
+	return out, addr, apiTag
+}
+
+// apiInboundAddress finds the dokodemo-door inbound that older configs use
+// to expose the api.
+func apiInboundAddress(doc map[string]interface{}, apiTag string) string {
+	inbounds, _ := doc["inbounds"].([]interface{})
+	for _, raw := range inbounds {
+		inbound, _ := raw.(map[string]interface{})
+		if stringField(inbound, "tag") != apiTag {
+			continue
+		}
+		port := fixedPort(inbound["port"])
+		if port <= 0 {
+			return ""
+		}
+		host := stringField(inbound, "listen")
+		if host == "" || host == "0.0.0.0" {
+			host = "127.0.0.1"
+		}
+		return net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	return ""
+}
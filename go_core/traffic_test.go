@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/app/stats/command"
+	"google.golang.org/grpc"
+)
+
+// statsStub serves QueryStats from a settable set of counters, standing in
+// for the stats service of a running core.
+type statsStub struct {
+	command.UnimplementedStatsServiceServer
+	mu       sync.Mutex
+	counters map[string]int64
+}
+
+func (s *statsStub) QueryStats(context.Context, *command.QueryStatsRequest) (*command.QueryStatsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := &command.QueryStatsResponse{}
+	for name, value := range s.counters {
+		resp.Stat = append(resp.Stat, &command.Stat{Name: name, Value: value})
+	}
+	return resp, nil
+}
+
+func (s *statsStub) set(counters map[string]int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, value := range counters {
+		s.counters[name] = value
+	}
+}
+
+func startStatsStub(t *testing.T) (*statsStub, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &statsStub{counters: map[string]int64{}}
+	server := grpc.NewServer()
+	command.RegisterStatsServiceServer(server, stub)
+	go func() { _ = server.Serve(ln) }()
+	t.Cleanup(server.Stop)
+	return stub, ln.Addr().String()
+}
+
+// sampleAfter samples as if the previous read was elapsed ago, so rates
+// do not depend on how fast the test runs.
+func sampleAfter(m *trafficMonitor, elapsed time.Duration) {
+	m.mu.Lock()
+	if !m.lastAt.IsZero() {
+		m.lastAt = time.Now().Add(-elapsed)
+	}
+	m.mu.Unlock()
+	m.sample()
+}
+
+func assertTraffic(t *testing.T, got trafficCounters, tag string, upRate, downRate, up, down int64) {
+	t.Helper()
+	near := func(a, b int64) bool { return a-b <= 2 && b-a <= 2 }
+	if got.Tag != tag || !near(got.UploadBytesPerSecond, upRate) || !near(got.DownloadBytesPerSecond, downRate) || got.TotalUploadBytes != up || got.TotalDownloadBytes != down {
+		t.Fatalf("counters = %+v, want %s up %d/s down %d/s totals %d/%d", got, tag, upRate, downRate, up, down)
+	}
+}
+
+func TestTrafficMonitorRates(t *testing.T) {
+	stub, addr := startStatsStub(t)
+	m := &trafficMonitor{}
+	t.Cleanup(m.detach)
+
+	stub.set(map[string]int64{
+		"inbound>>>socks-in>>>traffic>>>uplink":   1000,
+		"inbound>>>socks-in>>>traffic>>>downlink": 5000,
+		"inbound>>>api>>>traffic>>>uplink":        999,
+		"outbound>>>proxy>>>traffic>>>uplink":     600,
+		"outbound>>>proxy>>>traffic>>>downlink":   4000,
+		"outbound>>>direct>>>traffic>>>downlink":  1000,
+		"user>>>a@b>>>traffic>>>uplink":           77,
+		"inbound>>>socks-in>>>online":             3,
+	})
+	m.attach(addr, "api", false)
+	sampleAfter(m, 0)
+	snap := m.snapshot()
+	if !snap.Available || snap.TotalUploadBytes != 0 || len(snap.Outbounds) != 0 {
+		t.Fatalf("baseline = %+v", snap)
+	}
+
+	// Only the growth since the baseline counts; api traffic is ignored.
+	stub.set(map[string]int64{
+		"inbound>>>socks-in>>>traffic>>>uplink":   3000,
+		"inbound>>>socks-in>>>traffic>>>downlink": 15000,
+		"inbound>>>api>>>traffic>>>uplink":        5999,
+		"outbound>>>proxy>>>traffic>>>uplink":     2100,
+		"outbound>>>proxy>>>traffic>>>downlink":   13000,
+		"outbound>>>direct>>>traffic>>>uplink":    500,
+		"outbound>>>direct>>>traffic>>>downlink":  2000,
+	})
+	sampleAfter(m, 2*time.Second)
+	snap = m.snapshot()
+	assertTraffic(t, snap.trafficCounters, "", 300, 1500, 2000, 10000)
+	if len(snap.Outbounds) != 2 {
+		t.Fatalf("outbounds = %+v", snap.Outbounds)
+	}
+	assertTraffic(t, snap.Outbounds[0], "direct", 75, 150, 500, 1000)
+	assertTraffic(t, snap.Outbounds[1], "proxy", 225, 1350, 1500, 9000)
+
+	// An idle second decays the rate and leaves the totals alone.
+	sampleAfter(m, time.Second)
+	assertTraffic(t, m.snapshot().trafficCounters, "", 210, 1050, 2000, 10000)
+}
+
+func TestTrafficMonitorKeepsTotalsAcrossRestart(t *testing.T) {
+	stub, addr := startStatsStub(t)
+	m := &trafficMonitor{}
+	t.Cleanup(m.detach)
+
+	stub.set(map[string]int64{
+		"inbound>>>socks-in>>>traffic>>>uplink": 100,
+		"outbound>>>proxy>>>traffic>>>uplink":   100,
+	})
+	m.attach(addr, "api", false)
+	sampleAfter(m, 0)
+	stub.set(map[string]int64{
+		"inbound>>>socks-in>>>traffic>>>uplink": 1100,
+		"outbound>>>proxy>>>traffic>>>uplink":   1100,
+	})
+	sampleAfter(m, time.Second)
+	assertTraffic(t, m.snapshot().trafficCounters, "", 300, 0, 1000, 0)
+
+	// The supervisor restarted the core: its counters start again from
+	// zero, the totals carry over and the rates start again.
+	stub.set(map[string]int64{
+		"inbound>>>socks-in>>>traffic>>>uplink": 40,
+		"outbound>>>proxy>>>traffic>>>uplink":   40,
+	})
+	m.attach(addr, "api", true)
+	assertTraffic(t, m.snapshot().trafficCounters, "", 0, 0, 1000, 0)
+	sampleAfter(m, 0)
+	stub.set(map[string]int64{
+		"inbound>>>socks-in>>>traffic>>>uplink": 240,
+		"outbound>>>proxy>>>traffic>>>uplink":   240,
+	})
+	sampleAfter(m, time.Second)
+	snap := m.snapshot()
+	assertTraffic(t, snap.trafficCounters, "", 60, 0, 1200, 0)
+	assertTraffic(t, snap.Outbounds[0], "proxy", 60, 0, 1200, 0)
+
+	// A counter that goes backwards without a new attach also means the
+	// core restarted; its new value is all traffic since then.
+	stub.set(map[string]int64{"inbound>>>socks-in>>>traffic>>>uplink": 30})
+	sampleAfter(m, time.Second)
+	if total := m.snapshot().TotalUploadBytes; total != 1230 {
+		t.Fatalf("total after counter reset = %d, want 1230", total)
+	}
+
+	// A fresh start resets the totals.
+	m.attach(addr, "api", false)
+	snap = m.snapshot()
+	if snap.Available || snap.TotalUploadBytes != 0 || len(snap.Outbounds) != 0 {
+		t.Fatalf("after fresh start = %+v", snap)
+	}
+}
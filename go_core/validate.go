@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/xtls/xray-core/infra/conf/serial"
+)
+
+type configDiagnostic struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+type configReport struct {
+	Valid    bool               `json:"valid"`
+	Errors   []configDiagnostic `json:"errors"`
+	Warnings []configDiagnostic `json:"warnings"`
+}
+
+func (r *configReport) errorf(path, format string, args ...interface{}) {
+	r.Errors = append(r.Errors, configDiagnostic{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *configReport) warnf(path, format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, configDiagnostic{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// validateXrayConfig checks a config with the xray-core loader without
+// starting it, then walks the document to attach JSON paths to the most
+// common mistakes and flag suspicious but legal settings. Only the loader
+// decides validity: when it accepts the config, the walk's findings are
+// reported as warnings; when it rejects it, they come first so the error
+// points at a path.
+func validateXrayConfig(cfgData []byte) configReport {
+	report := configReport{Errors: []configDiagnostic{}, Warnings: []configDiagnostic{}}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(cfgData, &doc); err != nil {
+		if !isJSONWithComments(cfgData) {
+			report.errorf("", "%s", describeJSONError(cfgData, err))
+			return report
+		}
+		report.warnf("", "config contains comments; path diagnostics are limited to the xray loader")
+	} else {
+		checkConfigDocument(doc, &report)
+	}
+
+	findings := report.Errors
+	report.Errors = []configDiagnostic{}
+	cfg, err := serial.DecodeJSONConfig(bytes.NewReader(cfgData))
+	if err == nil {
+		_, err = cfg.Build()
+	}
+	if err != nil {
+		report.Errors = append(findings, configDiagnostic{Message: err.Error()})
+	} else {
+		report.Warnings = append(findings, report.Warnings...)
+	}
+	report.Valid = len(report.Errors) == 0
+	return report
+}
+
+func checkConfigDocument(doc map[string]interface{}, r *configReport) {
+	outboundTags := map[string]bool{}
+	inboundTags := map[string]bool{}
+	ports := map[string]string{}
+
+	inbounds, _ := doc["inbounds"].([]interface{})
+	for i, raw := range inbounds {
+		path := fmt.Sprintf("inbounds[%d]", i)
+		inbound, ok := raw.(map[string]interface{})
+		if !ok {
+			r.errorf(path, "inbound must be an object")
+			continue
+		}
+		protocol := stringField(inbound, "protocol")
+		if protocol == "" {
+			r.errorf(path+".protocol", "protocol is required")
+		}
+		if tag := stringField(inbound, "tag"); tag != "" {
+			if inboundTags[tag] {
+				r.errorf(path+".tag", "duplicate inbound tag %q", tag)
+			}
+			inboundTags[tag] = true
+		}
+		if protocol != "tun" {
+			port := portString(inbound["port"])
+			key := stringField(inbound, "listen") + "|" + port
+			if port == "" {
+				r.errorf(path+".port", "port is required")
+			} else if prev, dup := ports[key]; dup {
+				r.errorf(path+".port", "port %s is already used by %s", port, prev)
+			} else {
+				ports[key] = path
+			}
+		}
+		if listen := stringField(inbound, "listen"); listen == "0.0.0.0" || listen == "::" {
+			r.warnf(path+".listen", "inbound listens on all interfaces and is reachable from the local network")
+		}
+	}
+
+	outbounds, _ := doc["outbounds"].([]interface{})
+	if len(outbounds) == 0 {
+		r.errorf("outbounds", "at least one outbound is required")
+	}
+	for i, raw := range outbounds {
+		path := fmt.Sprintf("outbounds[%d]", i)
+		outbound, ok := raw.(map[string]interface{})
+		if !ok {
+			r.errorf(path, "outbound must be an object")
+			continue
+		}
+		if tag := stringField(outbound, "tag"); tag != "" {
+			if outboundTags[tag] {
+				r.errorf(path+".tag", "duplicate outbound tag %q", tag)
+			}
+			outboundTags[tag] = true
+		}
+		checkOutbound(path, outbound, r)
+	}
+
+	balancerTags := map[string]bool{}
+	routing, _ := doc["routing"].(map[string]interface{})
+	balancers, _ := routing["balancers"].([]interface{})
+	for _, raw := range balancers {
+		if balancer, ok := raw.(map[string]interface{}); ok {
+			balancerTags[stringField(balancer, "tag")] = true
+		}
+	}
+	rules, _ := routing["rules"].([]interface{})
+	for i, raw := range rules {
+		path := fmt.Sprintf("routing.rules[%d]", i)
+		rule, ok := raw.(map[string]interface{})
+		if !ok {
+			r.errorf(path, "rule must be an object")
+			continue
+		}
+		outboundTag := stringField(rule, "outboundTag")
+		balancerTag := stringField(rule, "balancerTag")
+		switch {
+		case outboundTag == "" && balancerTag == "":
+			r.errorf(path, "rule needs an outboundTag or balancerTag")
+		case outboundTag != "" && !outboundTags[outboundTag]:
+			r.errorf(path+".outboundTag", "unknown outbound tag %q", outboundTag)
+		case balancerTag != "" && !balancerTags[balancerTag]:
+			r.errorf(path+".balancerTag", "unknown balancer tag %q", balancerTag)
+		}
+		if tags, ok := rule["inboundTag"].([]interface{}); ok {
+			for j, tag := range tags {
+				if name, _ := tag.(string); name != "" && !inboundTags[name] {
+					r.warnf(fmt.Sprintf("%s.inboundTag[%d]", path, j), "unknown inbound tag %q", name)
+				}
+			}
+		}
+	}
+
+	if logCfg, ok := doc["log"].(map[string]interface{}); ok && stringField(logCfg, "loglevel") == "debug" {
+		r.warnf("log.loglevel", "debug logging is verbose and may expose destinations in logs")
+	}
+}
+
+func checkOutbound(path string, outbound map[string]interface{}, r *configReport) {
+	protocol := stringField(outbound, "protocol")
+	settings, _ := outbound["settings"].(map[string]interface{})
+	switch protocol {
+	case "":
+		r.errorf(path+".protocol", "protocol is required")
+	case "vless", "vmess":
+		server, serverPath := settings, path+".settings"
+		if vnext, ok := settings["vnext"].([]interface{}); ok || stringField(settings, "address") == "" {
+			if len(vnext) == 0 {
+				r.errorf(path+".settings.vnext", "at least one server is required")
+				break
+			}
+			server, _ = vnext[0].(map[string]interface{})
+			serverPath = path + ".settings.vnext[0]"
+		}
+		checkServerAddress(serverPath, server, r)
+		user, userPath := server, serverPath
+		if _, flat := server["id"]; !flat {
+			users, _ := server["users"].([]interface{})
+			if len(users) == 0 {
+				r.errorf(serverPath+".users", "at least one user is required")
+				break
+			}
+			user, _ = users[0].(map[string]interface{})
+			userPath = serverPath + ".users[0]"
+		}
+		id := stringField(user, "id")
+		switch {
+		case id == "":
+			r.errorf(userPath+".id", "user id is required")
+		case !uuidPattern.MatchString(id) && len(id) > 30:
+			r.errorf(userPath+".id", "user id is neither a UUID nor a short mapping string")
+		}
+		if encryption := stringField(user, "encryption"); protocol == "vless" && encryption != "" && encryption != "none" {
+			r.warnf(userPath+".encryption", "vless encryption %q requires a matching server", encryption)
+		}
+	case "trojan", "shadowsocks":
+		server, serverPath := settings, path+".settings"
+		if servers, ok := settings["servers"].([]interface{}); ok || stringField(settings, "address") == "" {
+			if len(servers) == 0 {
+				r.errorf(path+".settings.servers", "at least one server is required")
+				break
+			}
+			server, _ = servers[0].(map[string]interface{})
+			serverPath = path + ".settings.servers[0]"
+		}
+		checkServerAddress(serverPath, server, r)
+		if stringField(server, "password") == "" {
+			r.errorf(serverPath+".password", "password is required")
+		}
+		if protocol == "shadowsocks" && stringField(server, "method") == "" {
+			r.errorf(serverPath+".method", "method is required")
+		}
+	}
+
+	stream, _ := outbound["streamSettings"].(map[string]interface{})
+	if stream == nil {
+		return
+	}
+	streamPath := path + ".streamSettings"
+	switch stringField(stream, "security") {
+	case "reality":
+		reality, _ := stream["realitySettings"].(map[string]interface{})
+		realityPath := streamPath + ".realitySettings"
+		if reality == nil {
+			r.errorf(realityPath, "realitySettings are required when security is reality")
+			break
+		}
+		publicKey := stringField(reality, "publicKey")
+		if publicKey == "" {
+			publicKey = stringField(reality, "password")
+		}
+		if publicKey == "" {
+			r.errorf(realityPath+".publicKey", "publicKey is required")
+		} else if key, err := base64.RawURLEncoding.DecodeString(publicKey); err != nil || len(key) != 32 {
+			r.errorf(realityPath+".publicKey", "publicKey must be a 32-byte base64url (no padding) value")
+		}
+		if stringField(reality, "serverName") == "" {
+			r.errorf(realityPath+".serverName", "serverName is required")
+		}
+		if shortID := stringField(reality, "shortId"); shortID != "" {
+			if _, err := hex.DecodeString(shortID); err != nil || len(shortID) > 16 {
+				r.errorf(realityPath+".shortId", "shortId must be up to 16 hex characters of even length")
+			}
+		}
+		if stringField(reality, "fingerprint") == "" {
+			r.warnf(realityPath+".fingerprint", "no uTLS fingerprint set; REALITY requires one")
+		}
+	case "tls":
+		tlsSettings, _ := stream["tlsSettings"].(map[string]interface{})
+		tlsPath := streamPath + ".tlsSettings"
+		if insecure, _ := tlsSettings["allowInsecure"].(bool); insecure {
+			r.warnf(tlsPath+".allowInsecure", "certificate verification is disabled")
+		}
+		if stringField(tlsSettings, "serverName") == "" {
+			r.warnf(tlsPath+".serverName", "no serverName set; the server address is used for SNI")
+		}
+	case "", "none":
+		if protocol == "vless" || protocol == "trojan" {
+			r.warnf(streamPath+".security", "%s without TLS or REALITY sends traffic unencrypted", protocol)
+		}
+	}
+
+	switch stringField(stream, "network") {
+	case "xhttp", "splithttp":
+		xhttp, _ := stream["xhttpSettings"].(map[string]interface{})
+		if stringField(xhttp, "path") == "" {
+			r.warnf(streamPath+".xhttpSettings.path", "no path set; the server default \"/\" is assumed")
+		}
+	case "ws":
+		ws, _ := stream["wsSettings"].(map[string]interface{})
+		if stringField(ws, "path") == "" {
+			r.warnf(streamPath+".wsSettings.path", "no path set; the server default \"/\" is assumed")
+		}
+	case "grpc":
+		grpc, _ := stream["grpcSettings"].(map[string]interface{})
+		if stringField(grpc, "serviceName") == "" {
+			r.warnf(streamPath+".grpcSettings.serviceName", "no serviceName set; the server must also use an empty one")
+		}
+	}
+}
+
+func checkServerAddress(path string, server map[string]interface{}, r *configReport) {
+	if stringField(server, "address") == "" {
+		r.errorf(path+".address", "address is required")
+	}
+	port := portString(server["port"])
+	if port == "" {
+		r.errorf(path+".port", "port is required")
+	} else if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		r.errorf(path+".port", "port %s is out of range", port)
+	}
+}
+
+func stringField(m map[string]interface{}, key string) string {
+	if m == nil {
+		return ""
+	}
+	value, _ := m[key].(string)
+	return strings.TrimSpace(value)
+}
+
+func portString(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.Itoa(int(v))
+	case string:
+		return strings.TrimSpace(v)
+	}
+	return ""
+}
+
+func isJSONWithComments(data []byte) bool {
+	return bytes.Contains(data, []byte("//")) || bytes.Contains(data, []byte("/*"))
+}
+
+// describeJSONError turns a decoding error into a message with line and column.
+func describeJSONError(data []byte, err error) string {
+	se, ok := err.(*json.SyntaxError)
+	if !ok {
+		return err.Error()
+	}
+	line, col := 1, 1
+	for i := int64(0); i < se.Offset-1 && i < int64(len(data)); i++ {
+		if data[i] == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return fmt.Sprintf("%s (line %d, column %d)", se.Error(), line, col)
+}
+
+// configReportError converts a failing report into a CONFIG_INVALID error.
+func configReportError(report configReport) error {
+	if report.Valid {
+		return nil
+	}
+	first := report.Errors[0]
+	message := first.Message
+	if first.Path != "" {
+		message = first.Path + ": " + message
+	}
+	return newCoreError(codeConfigInvalid, message, false, map[string]interface{}{
+		"errors":   report.Errors,
+		"warnings": report.Warnings,
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func diagnosticAt(diags []configDiagnostic, path string) (configDiagnostic, bool) {
+	for _, d := range diags {
+		if d.Path == path {
+			return d, true
+		}
+	}
+	return configDiagnostic{}, false
+}
+
+const validateRealityOutbound = `{
+  "tag": "proxy",
+  "protocol": "vless",
+  "settings": {"vnext": [{"address": "example.com", "port": 443, "users": [{"id": "0f0a8a4e-4f2e-4c9b-9f00-3c3a1e4d5b6a", "encryption": "none", "flow": "xtls-rprx-vision"}]}]},
+  "streamSettings": {
+    "network": "tcp",
+    "security": "reality",
+    "realitySettings": {"serverName": "example.com", "fingerprint": "chrome", "publicKey": %q, "shortId": "6ba85179e30d4fc2"}
+  }
+}`
+
+func validateConfigWith(outbound string) []byte {
+	return []byte(`{
+  "inbounds": [{"tag": "socks-in", "listen": "127.0.0.1", "port": 1080, "protocol": "socks"}],
+  "outbounds": [
+    {"tag": "direct", "protocol": "freedom"},
+    {"tag": "block", "protocol": "blackhole"},
+    ` + outbound + `
+  ]
+}`)
+}
+
+func realityOutbound(publicKey string) string {
+	return fmt.Sprintf(validateRealityOutbound, publicKey)
+}
+
+func TestValidateAcceptsRealityConfig(t *testing.T) {
+	report := validateXrayConfig(validateConfigWith(realityOutbound("Z84J2IelR9ch3k8VtlVhhs5ycBUlXA7wHBWcBrjqnAw")))
+	if !report.Valid || len(report.Errors) != 0 {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestValidateReportsPathForBrokenRealityKey(t *testing.T) {
+	report := validateXrayConfig(validateConfigWith(realityOutbound("not-a-key")))
+	if report.Valid {
+		t.Fatalf("config with a broken publicKey is valid: %+v", report)
+	}
+	path := "outbounds[2].streamSettings.realitySettings.publicKey"
+	if _, ok := diagnosticAt(report.Errors, path); !ok || report.Errors[0].Path != path {
+		t.Fatalf("errors = %+v, want %s first", report.Errors, path)
+	}
+	if last := report.Errors[len(report.Errors)-1]; last.Path != "" || last.Message == "" {
+		t.Fatalf("last error = %+v, want the loader's message", last)
+	}
+}
+
+func TestValidateGrpcWithoutServiceNameIsWarning(t *testing.T) {
+	outbound := `{
+    "tag": "proxy",
+    "protocol": "trojan",
+    "settings": {"servers": [{"address": "example.com", "port": 443, "password": "secret"}]},
+    "streamSettings": {"network": "grpc", "security": "tls", "tlsSettings": {"serverName": "example.com"}, "grpcSettings": {}}
+  }`
+	report := validateXrayConfig(validateConfigWith(outbound))
+	if !report.Valid {
+		t.Fatalf("grpc without serviceName rejected: %+v", report)
+	}
+	if _, ok := diagnosticAt(report.Warnings, "outbounds[2].streamSettings.grpcSettings.serviceName"); !ok {
+		t.Fatalf("warnings = %+v", report.Warnings)
+	}
+	if err := preflightConfig(validateConfigWith(outbound)); err != nil {
+		t.Fatalf("preflight rejected a config xray accepts: %v", err)
+	}
+}
+
+func TestValidateDemotesFindingsTheLoaderAccepts(t *testing.T) {
+	cfg := []byte(`{
+  "inbounds": [
+    {"tag": "socks-in", "listen": "0.0.0.0", "port": 1080, "protocol": "socks"},
+    {"tag": "http-in", "listen": "0.0.0.0", "port": 1080, "protocol": "http"}
+  ],
+  "outbounds": [{"tag": "direct", "protocol": "freedom"}],
+  "routing": {"rules": [{"inboundTag": ["missing-in"], "outboundTag": "direct"}]}
+}`)
+	report := validateXrayConfig(cfg)
+	if !report.Valid {
+		t.Fatalf("report = %+v", report)
+	}
+	for _, path := range []string{"inbounds[1].port", "inbounds[0].listen", "routing.rules[0].inboundTag[0]"} {
+		if _, ok := diagnosticAt(report.Warnings, path); !ok {
+			t.Errorf("no warning at %s: %+v", path, report.Warnings)
+		}
+	}
+}
+
+func TestValidateReportsSyntaxErrorPosition(t *testing.T) {
+	report := validateXrayConfig([]byte("{\n  \"outbounds\": [\n    {\"protocol\": \"freedom\",}\n  ]\n}"))
+	if report.Valid || len(report.Errors) != 1 || !strings.Contains(report.Errors[0].Message, "line 3") {
+		t.Fatalf("report = %+v", report)
+	}
+}
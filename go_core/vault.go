@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Vault key sources.
+const (
+	vaultKeyKeyring    = "keyring"
+	vaultKeyPassphrase = "passphrase"
+)
+
+const (
+	vaultKeyringService = "plus.svc.xstream"
+	vaultKeyringUser    = "vault-key"
+	vaultCheckPlaintext = "xstream-vault"
+)
+
+// vaultMagic prefixes every sealed file. It is followed by the 24 byte nonce
+// and ciphertext||tag, the same framing SyncCrypto uses, so the Dart side can
+// decrypt a vault file with SyncCrypto.decrypt once it has the key.
+var vaultMagic = []byte("XSV1")
+
+// vaultKDF records the argon2id parameters of a passphrase key.
+type vaultKDF struct {
+	Salt    string `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+// vaultMeta is stored unencrypted as <data dir>/vault.json.
+type vaultMeta struct {
+	Version   int       `json:"version"`
+	KeySource string    `json:"keySource"`
+	KDF       *vaultKDF `json:"kdf,omitempty"`
+	// Check is a sealed known value used to verify a passphrase.
+	Check string `json:"check"`
+	// Files lists sealed files outside the data dir, such as
+	// vpn_nodes.json, so disabling the vault can decrypt them again.
+	Files []string `json:"files,omitempty"`
+}
+
+type vaultStatus struct {
+	Enabled   bool   `json:"enabled"`
+	KeySource string `json:"keySource,omitempty"`
+	Unlocked  bool   `json:"unlocked"`
+}
+
+// vaultOptions is the JSON accepted by ConfigureVault.
+type vaultOptions struct {
+	Enabled    bool   `json:"enabled"`
+	KeySource  string `json:"keySource"`
+	Passphrase string `json:"passphrase"`
+}
+
+// nodeVault encrypts node configs, the subscription cache and vpn_nodes.json
+// at rest with XChaCha20-Poly1305. It is off unless vault.json exists in the
+// data dir. The key only lives in memory; plaintext files found while the
+// vault is unlocked are sealed in place.
+type nodeVault struct {
+	mu   sync.Mutex
+	dir  string
+	meta *vaultMeta
+	key  []byte
+}
+
+var vault = &nodeVault{}
+
+func vaultMetaPath(dir string) string {
+	return filepath.Join(dir, "vault.json")
+}
+
+// syncLocked reloads the metadata when the data dir changed since the last
+// call, dropping any key that belonged to the previous dir.
+func (v *nodeVault) syncLocked() error {
+	dir := coreDataDir()
+	if dir == v.dir && v.dir != "" {
+		return nil
+	}
+	v.dir, v.meta, v.key = dir, nil, nil
+	data, err := readFileIfExists(vaultMetaPath(dir))
+	if err != nil || data == nil {
+		return err
+	}
+	var meta vaultMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return newCoreError(codeConfigInvalid, "vault.json is not valid JSON: "+err.Error(), false, nil)
+	}
+	v.meta = &meta
+	return nil
+}
+
+func (v *nodeVault) saveMetaLocked() error {
+	payload, err := json.MarshalIndent(v.meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(vaultMetaPath(v.dir), payload, 0o600)
+}
+
+// unlockedKeyLocked returns the key, fetching it from the OS keyring on first
+// use. Passphrase vaults must be unlocked explicitly.
+func (v *nodeVault) unlockedKeyLocked() ([]byte, error) {
+	if v.key != nil {
+		return v.key, nil
+	}
+	if v.meta.KeySource != vaultKeyKeyring {
+		return nil, newCoreError(codeVaultLocked, "vault is locked", false, nil)
+	}
+	key, err := keyringKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := v.verifyLocked(key); err != nil {
+		return nil, err
+	}
+	v.key = key
+	return key, nil
+}
+
+func (v *nodeVault) verifyLocked(key []byte) error {
+	check, err := base64.StdEncoding.DecodeString(v.meta.Check)
+	if err != nil {
+		return newCoreError(codeConfigInvalid, "vault.json has an invalid check value", false, nil)
+	}
+	plain, err := openSealed(key, check)
+	if err != nil || string(plain) != vaultCheckPlaintext {
+		return newCoreError(codePermissionDenied, "vault key does not match", false, nil)
+	}
+	return nil
+}
+
+func (v *nodeVault) status() (vaultStatus, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := v.syncLocked(); err != nil {
+		return vaultStatus{}, err
+	}
+	if v.meta == nil {
+		return vaultStatus{}, nil
+	}
+	return vaultStatus{Enabled: true, KeySource: v.meta.KeySource, Unlocked: v.key != nil}, nil
+}
+
+// unlock derives the key of a passphrase vault, or loads it from the keyring
+// when passphrase is empty.
+func (v *nodeVault) unlock(passphrase string) (vaultStatus, error) {
+	v.mu.Lock()
+	if err := v.syncLocked(); err != nil {
+		v.mu.Unlock()
+		return vaultStatus{}, err
+	}
+	if v.meta == nil {
+		v.mu.Unlock()
+		return vaultStatus{}, newCoreError(codeNotFound, "vault is not enabled", false, nil)
+	}
+	var err error
+	if v.meta.KeySource == vaultKeyPassphrase {
+		err = v.unlockPassphraseLocked(passphrase)
+	} else {
+		_, err = v.unlockedKeyLocked()
+	}
+	v.mu.Unlock()
+	if err != nil {
+		return vaultStatus{}, err
+	}
+	return v.status()
+}
+
+func (v *nodeVault) unlockPassphraseLocked(passphrase string) error {
+	if passphrase == "" {
+		return newCoreError(codeInvalidArgument, "passphrase is required", false, nil)
+	}
+	if v.meta.KDF == nil {
+		return newCoreError(codeConfigInvalid, "vault.json has no key derivation parameters", false, nil)
+	}
+	key, err := v.meta.KDF.derive(passphrase)
+	if err != nil {
+		return err
+	}
+	if err := v.verifyLocked(key); err != nil {
+		return err
+	}
+	v.key = key
+	return nil
+}
+
+func (v *nodeVault) lock() {
+	v.mu.Lock()
+	v.key = nil
+	v.mu.Unlock()
+}
+
+// configure enables or disables the vault. Enabling creates the key and seals
+// every known plaintext file; disabling needs the vault unlocked (or the
+// passphrase) and writes the files back in plaintext.
+func (v *nodeVault) configure(opts vaultOptions) (vaultStatus, error) {
+	v.mu.Lock()
+	if err := v.syncLocked(); err != nil {
+		v.mu.Unlock()
+		return vaultStatus{}, err
+	}
+	var err error
+	if opts.Enabled {
+		err = v.enableLocked(opts)
+	} else {
+		err = v.disableLocked(opts)
+	}
+	v.mu.Unlock()
+	if err != nil {
+		return vaultStatus{}, err
+	}
+	return v.status()
+}
+
+func (v *nodeVault) enableLocked(opts vaultOptions) error {
+	if v.meta != nil {
+		return newCoreError(codeAlreadyRunning, "vault is already enabled", false, map[string]interface{}{"keySource": v.meta.KeySource})
+	}
+	source := strings.ToLower(strings.TrimSpace(opts.KeySource))
+	if source == "" {
+		source = vaultKeyKeyring
+		if opts.Passphrase != "" {
+			source = vaultKeyPassphrase
+		}
+	}
+	meta := &vaultMeta{Version: 1, KeySource: source}
+	var key []byte
+	switch source {
+	case vaultKeyKeyring:
+		key = make([]byte, chacha20poly1305.KeySize)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		if err := keyring.Set(vaultKeyringService, vaultKeyringUser, base64.StdEncoding.EncodeToString(key)); err != nil {
+			return newCoreError(codeUnsupported, "OS keyring is not available: "+err.Error(), false, nil)
+		}
+	case vaultKeyPassphrase:
+		if opts.Passphrase == "" {
+			return newCoreError(codeInvalidArgument, "passphrase is required", false, nil)
+		}
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		meta.KDF = &vaultKDF{Salt: base64.StdEncoding.EncodeToString(salt), Time: 3, Memory: 64 * 1024, Threads: 2}
+		var err error
+		if key, err = meta.KDF.derive(opts.Passphrase); err != nil {
+			return err
+		}
+	default:
+		return newCoreError(codeInvalidArgument, "unknown vault key source", false, map[string]interface{}{"keySource": source})
+	}
+	check, err := sealWithKey(key, []byte(vaultCheckPlaintext))
+	if err != nil {
+		return err
+	}
+	meta.Check = base64.StdEncoding.EncodeToString(check)
+
+	v.meta, v.key = meta, key
+	if err := v.saveMetaLocked(); err != nil {
+		v.meta, v.key = nil, nil
+		return err
+	}
+	return v.migrateLocked()
+}
+
+func (v *nodeVault) disableLocked(opts vaultOptions) error {
+	if v.meta == nil {
+		return nil
+	}
+	if v.key == nil && v.meta.KeySource == vaultKeyPassphrase {
+		if err := v.unlockPassphraseLocked(opts.Passphrase); err != nil {
+			return err
+		}
+	}
+	if _, err := v.unlockedKeyLocked(); err != nil {
+		return err
+	}
+	key, files := v.key, v.vaultFilesLocked()
+	for _, path := range files {
+		data, err := readFileIfExists(path)
+		if err != nil || !isSealed(data) {
+			continue
+		}
+		plain, err := openSealed(key, data)
+		if err != nil {
+			return wrapCoreError(codeIO, err, false, map[string]interface{}{"path": path})
+		}
+		if err := writeFileAtomic(path, plain, 0o600); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(vaultMetaPath(v.dir)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if v.meta.KeySource == vaultKeyKeyring {
+		_ = keyring.Delete(vaultKeyringService, vaultKeyringUser)
+	}
+	v.meta, v.key = nil, nil
+	return nil
+}
+
+// migrateLocked seals every plaintext file the vault covers.
+func (v *nodeVault) migrateLocked() error {
+	for _, path := range v.vaultFilesLocked() {
+		data, err := readFileIfExists(path)
+		if err != nil || data == nil || isSealed(data) {
+			continue
+		}
+		sealed, err := sealWithKey(v.key, data)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, sealed, 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vaultFilesLocked lists the registry, the subscription cache and tracked
+// external files.
+func (v *nodeVault) vaultFilesLocked() []string {
+	var files []string
+	for _, sub := range []string{"nodes", "subscriptions"} {
+		entries, _ := os.ReadDir(filepath.Join(v.dir, sub))
+		for _, entry := range entries {
+			if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			files = append(files, filepath.Join(v.dir, sub, entry.Name()))
+		}
+	}
+	return append(files, v.meta.Files...)
+}
+
+// seal encrypts data when the vault is enabled and returns it unchanged
+// otherwise. path is recorded when it lies outside the data dir.
+func (v *nodeVault) seal(path string, data []byte) ([]byte, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := v.syncLocked(); err != nil {
+		return nil, err
+	}
+	if v.meta == nil {
+		return data, nil
+	}
+	key, err := v.unlockedKeyLocked()
+	if err != nil {
+		return nil, err
+	}
+	dir, _ := filepath.Abs(v.dir)
+	if abs, err := filepath.Abs(path); err == nil && !strings.HasPrefix(abs, dir+string(filepath.Separator)) {
+		tracked := false
+		for _, f := range v.meta.Files {
+			tracked = tracked || f == abs
+		}
+		if !tracked {
+			v.meta.Files = append(v.meta.Files, abs)
+			if err := v.saveMetaLocked(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return sealWithKey(key, data)
+}
+
+// open decrypts sealed data. Plaintext is returned as is, with migrate set
+// when the vault is enabled so the caller can seal the file in place.
+func (v *nodeVault) open(data []byte) (plain []byte, migrate bool, err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := v.syncLocked(); err != nil {
+		return nil, false, err
+	}
+	if !isSealed(data) {
+		return data, v.meta != nil, nil
+	}
+	if v.meta == nil {
+		return nil, false, newCoreError(codeVaultLocked, "file is encrypted but no vault is configured", false, nil)
+	}
+	key, err := v.unlockedKeyLocked()
+	if err != nil {
+		return nil, false, err
+	}
+	plain, err = openSealed(key, data)
+	if err != nil {
+		return nil, false, newCoreError(codeConfigInvalid, "vault file failed authentication", false, nil)
+	}
+	return plain, false, nil
+}
+
+// readVaultFile reads a file that may be sealed and returns its plaintext.
+// Plaintext files are sealed in place when the vault is enabled; failures to
+// do so leave the file readable and are not reported.
+func readVaultFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plain, migrate, err := vault.open(data)
+	if err != nil {
+		return nil, err
+	}
+	if migrate {
+		if sealed, err := vault.seal(path, plain); err == nil {
+			_ = writeFileAtomic(path, sealed, 0o600)
+		}
+	}
+	return plain, nil
+}
+
+func readVaultFileIfExists(path string) ([]byte, error) {
+	data, err := readVaultFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// openVaultFile is readVaultFile for files that other readers expect in
+// plaintext: plaintext is returned as is and never sealed in place. sealed
+// reports whether the file was encrypted.
+func openVaultFile(path string) (plain []byte, sealed bool, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	plain, _, err = vault.open(data)
+	return plain, isSealed(data), err
+}
+
+func openVaultFileIfExists(path string) ([]byte, bool, error) {
+	plain, sealed, err := openVaultFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	return plain, sealed, err
+}
+
+// writeVaultFile is writeFileAtomic with the data sealed when the vault is
+// enabled.
+func writeVaultFile(path string, data []byte, perm os.FileMode) error {
+	sealed, err := vault.seal(path, data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, sealed, perm)
+}
+
+func (k vaultKDF) derive(passphrase string) ([]byte, error) {
+	salt, err := base64.StdEncoding.DecodeString(k.Salt)
+	if err != nil || len(salt) == 0 || k.Time == 0 || k.Memory == 0 || k.Threads == 0 {
+		return nil, newCoreError(codeConfigInvalid, "vault.json has invalid key derivation parameters", false, nil)
+	}
+	return argon2.IDKey([]byte(passphrase), salt, k.Time, k.Memory, k.Threads, chacha20poly1305.KeySize), nil
+}
+
+func keyringKey() ([]byte, error) {
+	encoded, err := keyring.Get(vaultKeyringService, vaultKeyringUser)
+	if err != nil {
+		if errors.Is(err, keyring.ErrNotFound) {
+			return nil, newCoreError(codeVaultLocked, "vault key is missing from the OS keyring", false, nil)
+		}
+		return nil, newCoreError(codeUnsupported, "OS keyring is not available: "+err.Error(), false, nil)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != chacha20poly1305.KeySize {
+		return nil, newCoreError(codeConfigInvalid, "vault key in the OS keyring is malformed", false, nil)
+	}
+	return key, nil
+}
+
+func isSealed(data []byte) bool {
+	return len(data) >= len(vaultMagic)+chacha20poly1305.NonceSizeX+chacha20poly1305.Overhead &&
+		bytes.HasPrefix(data, vaultMagic)
+}
+
+func sealWithKey(key, plain []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(vaultMagic)+chacha20poly1305.NonceSizeX, len(vaultMagic)+chacha20poly1305.NonceSizeX+len(plain)+aead.Overhead())
+	copy(out, vaultMagic)
+	nonce := out[len(vaultMagic):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, plain, nil), nil
+}
+
+func openSealed(key, data []byte) ([]byte, error) {
+	if !isSealed(data) {
+		return nil, errors.New("not a vault file")
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	body := data[len(vaultMagic):]
+	return aead.Open(nil, body[:chacha20poly1305.NonceSizeX], body[chacha20poly1305.NonceSizeX:], nil)
+}
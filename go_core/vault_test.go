@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func enableTestVault(t *testing.T, passphrase string) {
+	t.Helper()
+	if _, err := vault.configure(vaultOptions{Enabled: true, KeySource: vaultKeyPassphrase, Passphrase: passphrase}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(vault.lock)
+}
+
+func assertCoreErrorCode(t *testing.T, err error, code string) {
+	t.Helper()
+	var ce *coreError
+	if !errors.As(err, &ce) || ce.Code != code {
+		t.Fatalf("err = %v, want %s", err, code)
+	}
+}
+
+func readRaw(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestVaultSealOpenRoundTrip(t *testing.T) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte(`{"outbounds":[{"protocol":"vless"}]}`)
+	sealed, err := sealWithKey(key, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(sealed) || bytes.Contains(sealed, []byte("vless")) {
+		t.Fatalf("sealed = %q", sealed)
+	}
+	opened, err := openSealed(key, sealed)
+	if err != nil || !bytes.Equal(opened, plain) {
+		t.Fatalf("open = %q, %v", opened, err)
+	}
+
+	setTestDataDir(t)
+	enableTestVault(t, "correct horse")
+	path := filepath.Join(t.TempDir(), "node-jp-config.json")
+	if err := writeVaultFile(path, plain, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(readRaw(t, path)) {
+		t.Fatal("writeVaultFile left the file in plaintext")
+	}
+	got, sealedOnDisk, err := openVaultFile(path)
+	if err != nil || !sealedOnDisk || !bytes.Equal(got, plain) {
+		t.Fatalf("openVaultFile = %q, %v, %v", got, sealedOnDisk, err)
+	}
+}
+
+func TestVaultWrongPassphrase(t *testing.T) {
+	setTestDataDir(t)
+	enableTestVault(t, "correct horse")
+	if _, err := nodes.upsert(nodeRecord{Name: "jp", Config: socksNodeConfig(1080)}); err != nil {
+		t.Fatal(err)
+	}
+	vault.lock()
+
+	_, err := nodes.get("jp")
+	assertCoreErrorCode(t, err, codeVaultLocked)
+	_, err = vault.unlock("battery staple")
+	assertCoreErrorCode(t, err, codePermissionDenied)
+	if status, _ := vault.status(); status.Unlocked {
+		t.Fatal("a wrong passphrase unlocked the vault")
+	}
+	_, err = vault.configure(vaultOptions{Enabled: false, Passphrase: "battery staple"})
+	assertCoreErrorCode(t, err, codePermissionDenied)
+
+	if _, err := vault.unlock("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes.get("jp"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVaultRejectsWrongMagic(t *testing.T) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	sealed, err := sealWithKey(key, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := append([]byte("XSV2"), sealed[len(vaultMagic):]...)
+	if isSealed(other) {
+		t.Fatal("XSV2 data treated as sealed")
+	}
+	if _, err := openSealed(key, other); err == nil {
+		t.Fatal("openSealed accepted the wrong magic")
+	}
+
+	setTestDataDir(t)
+	enableTestVault(t, "correct horse")
+	// A file with the right magic that was not sealed with this key fails
+	// authentication instead of being returned as plaintext.
+	path := filepath.Join(t.TempDir(), "forged.json")
+	if err := os.WriteFile(path, sealed, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = readVaultFile(path)
+	assertCoreErrorCode(t, err, codeConfigInvalid)
+}
+
+func TestVaultMigratesPlaintextFiles(t *testing.T) {
+	setTestDataDir(t)
+	if _, err := nodes.upsert(nodeRecord{Name: "jp", Config: socksNodeConfig(1080)}); err != nil {
+		t.Fatal(err)
+	}
+	state := subscriptionState{URL: "https://sub.example.com/a"}
+	if err := saveSubscription(state); err != nil {
+		t.Fatal(err)
+	}
+	regPath, subPath := nodes.path("jp"), subscriptionPath(state.URL)
+	if isSealed(readRaw(t, regPath)) || isSealed(readRaw(t, subPath)) {
+		t.Fatal("files sealed before the vault was enabled")
+	}
+
+	enableTestVault(t, "correct horse")
+	for _, path := range []string{regPath, subPath} {
+		if !isSealed(readRaw(t, path)) {
+			t.Fatalf("%s was not sealed when the vault was enabled", path)
+		}
+	}
+
+	// A plaintext node written afterwards, e.g. by an older build, is sealed
+	// on first read.
+	late := filepath.Join(nodesDir(), nodeFileName("us"))
+	payload, _ := json.Marshal(nodeRecord{Name: "us", Config: socksNodeConfig(1081)})
+	if err := os.WriteFile(late, payload, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := nodes.get("us"); err != nil || rec.Name != "us" {
+		t.Fatalf("get = %+v, %v", rec, err)
+	}
+	if !isSealed(readRaw(t, late)) {
+		t.Fatal("plaintext node was not sealed on read")
+	}
+
+	if _, err := vault.configure(vaultOptions{Enabled: false}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{regPath, subPath, late} {
+		if isSealed(readRaw(t, path)) {
+			t.Fatalf("%s still sealed after disabling the vault", path)
+		}
+	}
+}
+
+func TestWriteConfigFilesSealsNodeList(t *testing.T) {
+	setTestDataDir(t)
+	enableTestVault(t, "correct horse")
+	dir := t.TempDir()
+	xrayPath := filepath.Join(dir, "node-jp-config.json")
+	servicePath := filepath.Join(dir, "xstream.jp.plist")
+	vpnPath := filepath.Join(dir, "vpn_nodes.json")
+
+	// A plaintext list from before the vault was enabled is sealed on load.
+	if err := os.WriteFile(vpnPath, []byte(`[{"name":"us","countryCode":"us","configPath":"/x/us.json","serviceName":"xstream.us"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	list, err := loadVpnNodes(vpnPath)
+	if err != nil || len(list.Nodes) != 1 {
+		t.Fatalf("load = %+v, %v", list, err)
+	}
+	if !isSealed(readRaw(t, vpnPath)) {
+		t.Fatal("loadVpnNodes left vpn_nodes.json in plaintext")
+	}
+
+	xray := string(socksNodeConfig(1080))
+	node := `[{"name":"jp","countryCode":"jp","configPath":"` + xrayPath + `","serviceName":"xstream.jp"}]`
+	if err := writeConfigFilesInternal(xrayPath, xray, servicePath, "<plist/>", vpnPath, node); err != nil {
+		t.Fatal(err)
+	}
+	// The services run the xray binary on the config directly.
+	if string(readRaw(t, xrayPath)) != xray {
+		t.Fatal("xray config was encrypted")
+	}
+	if string(readRaw(t, servicePath)) != "<plist/>" {
+		t.Fatal("service definition was encrypted")
+	}
+	if !isSealed(readRaw(t, vpnPath)) {
+		t.Fatal("vpn_nodes.json written in plaintext with the vault on")
+	}
+	got, _, err := openVaultFile(vpnPath)
+	var written []map[string]interface{}
+	if err != nil || json.Unmarshal(got, &written) != nil || len(written) != 2 {
+		t.Fatalf("ReadVaultFile = %q, %v", got, err)
+	}
+
+	// Quarantined records can carry secrets, so the sidecar is sealed too.
+	if err := writeVaultFile(vpnPath, []byte(`[{"countryCode":"de"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := loadVpnNodes(vpnPath); err != nil || len(list.Quarantined) != 1 {
+		t.Fatalf("load = %+v, %v", list, err)
+	}
+	if !isSealed(readRaw(t, list.QuarantinePath)) {
+		t.Fatal("quarantine sidecar written in plaintext with the vault on")
+	}
+
+	vault.lock()
+	_, err = loadVpnNodes(vpnPath)
+	assertCoreErrorCode(t, err, codeVaultLocked)
+	if _, err := vault.unlock("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := vault.configure(vaultOptions{Enabled: false}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{vpnPath, list.QuarantinePath} {
+		if isSealed(readRaw(t, path)) {
+			t.Fatalf("%s still sealed after disabling the vault", path)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// vpnNodeSchemaVersion is the record version written to vpn_nodes.json.
+// Records without schemaVersion predate it and are version 0.
+const vpnNodeSchemaVersion = 1
+
+// vpnNodeMigrations[v] upgrades a record from version v to v+1. Records are
+// migrated in place on load; append a step when the schema changes.
+var vpnNodeMigrations = []func(rec map[string]interface{}){
+	// 0 -> 1: early macOS builds stored the service as plistName, and
+	// enabled was optional with true as the default.
+	func(rec map[string]interface{}) {
+		if strings.TrimSpace(stringField(rec, "serviceName")) == "" && stringField(rec, "plistName") != "" {
+			rec["serviceName"] = rec["plistName"]
+		}
+		delete(rec, "plistName")
+		if _, ok := rec["enabled"]; !ok {
+			rec["enabled"] = true
+		}
+	},
+}
+
+// vpnNode is one vpn_nodes.json record, matching VpnNode in
+// docs/VpnConfigStruct.md. Fields this version does not know about are kept
+// in extra and written back unchanged.
+type vpnNode struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Name          string `json:"name"`
+	CountryCode   string `json:"countryCode"`
+	ConfigPath    string `json:"configPath"`
+	ServiceName   string `json:"serviceName"`
+	Protocol      string `json:"protocol"`
+	Transport     string `json:"transport"`
+	Security      string `json:"security"`
+	Enabled       bool   `json:"enabled"`
+
+	extra map[string]json.RawMessage
+	// raw holds a record from a newer schema, written back byte for byte.
+	raw json.RawMessage
+}
+
+// vpnNodeFields are the keys owned by vpnNode; everything else is extra.
+var vpnNodeFields = map[string]bool{
+	"schemaVersion": true, "name": true, "countryCode": true, "configPath": true,
+	"serviceName": true, "protocol": true, "transport": true, "security": true, "enabled": true,
+}
+
+// vpnNodeJSON is vpnNode without its methods, for plain (un)marshalling
+// inside the custom codecs.
+type vpnNodeJSON vpnNode
+
+func (n *vpnNode) UnmarshalJSON(data []byte) error {
+	var typed vpnNodeJSON
+	if err := json.Unmarshal(data, &typed); err != nil {
+		return err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	*n = vpnNode(typed)
+	for key, value := range all {
+		if vpnNodeFields[key] {
+			continue
+		}
+		if n.extra == nil {
+			n.extra = map[string]json.RawMessage{}
+		}
+		n.extra[key] = value
+	}
+	return nil
+}
+
+// MarshalJSON writes known and extra fields together in sorted key order, so
+// records look the same whether or not they carry extra fields.
+func (n vpnNode) MarshalJSON() ([]byte, error) {
+	if n.raw != nil {
+		return n.raw, nil
+	}
+	known, err := json.Marshal(vpnNodeJSON(n))
+	if err != nil {
+		return nil, err
+	}
+	all := map[string]json.RawMessage{}
+	if err := json.Unmarshal(known, &all); err != nil {
+		return nil, err
+	}
+	for key, value := range n.extra {
+		all[key] = value
+	}
+	return json.Marshal(all)
+}
+
+// validate applies the same required fields as VpnNode.fromJson in Dart.
+func (n vpnNode) validate() error {
+	for field, value := range map[string]string{
+		"name":        n.Name,
+		"countryCode": n.CountryCode,
+		"configPath":  n.ConfigPath,
+		"serviceName": n.ServiceName,
+	} {
+		if strings.TrimSpace(value) == "" {
+			return fmt.Errorf("%s is required", field)
+		}
+	}
+	return nil
+}
+
+// vpnNodeQuarantine is one record that could not be loaded, kept verbatim in
+// the sidecar file so nothing is lost.
+type vpnNodeQuarantine struct {
+	Record        json.RawMessage `json:"record"`
+	Reason        string          `json:"reason"`
+	QuarantinedAt int64           `json:"quarantinedAt"`
+}
+
+// vpnNodeList is the result of loading vpn_nodes.json.
+type vpnNodeList struct {
+	SchemaVersion  int                 `json:"schemaVersion"`
+	Nodes          []vpnNode           `json:"nodes"`
+	Migrated       int                 `json:"migrated"`
+	Quarantined    []vpnNodeQuarantine `json:"quarantined,omitempty"`
+	QuarantinePath string              `json:"quarantinePath"`
+}
+
+// vpnNodesQuarantinePath is the sidecar next to the node list, e.g.
+// vpn_nodes.quarantine.json.
+func vpnNodesQuarantinePath(vpnPath string) string {
+	return strings.TrimSuffix(vpnPath, ".json") + ".quarantine.json"
+}
+
+// parseVpnNodes migrates every record to the current schema. Records that are
+// not objects, fail to decode or miss required fields are returned as
+// quarantined instead of nodes. Records from a newer schema are kept as they
+// are.
+func parseVpnNodes(data []byte) (vpnNodeList, error) {
+	list := vpnNodeList{SchemaVersion: vpnNodeSchemaVersion, Nodes: []vpnNode{}}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return list, nil
+	}
+	var records []json.RawMessage
+	if err := json.Unmarshal(data, &records); err != nil {
+		return list, newCoreError(codeConfigInvalid, "vpn node list is not a JSON array: "+err.Error(), false, nil)
+	}
+	now := time.Now().UnixMilli()
+	for _, raw := range records {
+		node, migrated, err := migrateVpnNode(raw)
+		if err != nil {
+			list.Quarantined = append(list.Quarantined, vpnNodeQuarantine{Record: raw, Reason: err.Error(), QuarantinedAt: now})
+			continue
+		}
+		if migrated {
+			list.Migrated++
+		}
+		list.Nodes = append(list.Nodes, node)
+	}
+	return list, nil
+}
+
+func migrateVpnNode(raw json.RawMessage) (vpnNode, bool, error) {
+	var node vpnNode
+	var rec map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&rec); err != nil || rec == nil {
+		return node, false, fmt.Errorf("record is not a JSON object")
+	}
+	version := 0
+	if value, ok := rec["schemaVersion"]; ok {
+		number, isNumber := value.(json.Number)
+		v, err := number.Int64()
+		if !isNumber || err != nil || v < 0 {
+			return node, false, fmt.Errorf("schemaVersion must be a non-negative integer")
+		}
+		version = int(v)
+	}
+	if version > vpnNodeSchemaVersion {
+		// Written by a newer build: keep it untouched for that build.
+		if err := json.Unmarshal(raw, &node); err != nil {
+			return node, false, fmt.Errorf("decode schema %d record: %v", version, err)
+		}
+		node.raw = raw
+		return node, false, nil
+	}
+	for v := version; v < vpnNodeSchemaVersion; v++ {
+		vpnNodeMigrations[v](rec)
+	}
+	rec["schemaVersion"] = vpnNodeSchemaVersion
+	migrated, err := json.Marshal(rec)
+	if err != nil {
+		return node, false, err
+	}
+	if err := json.Unmarshal(migrated, &node); err != nil {
+		return node, false, fmt.Errorf("decode record: %v", err)
+	}
+	if err := node.validate(); err != nil {
+		return node, false, err
+	}
+	return node, version != vpnNodeSchemaVersion, nil
+}
+
+// loadVpnNodes reads the node list, rewriting it when records were migrated,
+// quarantined or merged as duplicates so the file on disk is always current.
+// A plaintext list is sealed in place when the vault is enabled.
+func loadVpnNodes(vpnPath string) (vpnNodeList, error) {
+	configFilesMu.Lock()
+	defer configFilesMu.Unlock()
+	var list vpnNodeList
+	err := withFileLock(vpnPath, func() error {
+		data, err := readVaultFileIfExists(vpnPath)
+		if err != nil {
+			return err
+		}
+		if list, err = parseVpnNodes(data); err != nil {
+			return err
+		}
+		loaded := len(list.Nodes)
+		list.Nodes = upsertVpnNodes(nil, list.Nodes)
+		if list.Migrated == 0 && len(list.Quarantined) == 0 && len(list.Nodes) == loaded {
+			return nil
+		}
+		return saveVpnNodesLocked(vpnPath, list)
+	})
+	list.QuarantinePath = vpnNodesQuarantinePath(vpnPath)
+	return list, err
+}
+
+// saveVpnNodesLocked appends quarantined records to the sidecar before
+// rewriting the list, so a record is never removed from the list without
+// first landing in the quarantine file. Callers hold the vpnPath lock.
+func saveVpnNodesLocked(vpnPath string, list vpnNodeList) error {
+	if len(list.Quarantined) > 0 {
+		quarantinePath := vpnNodesQuarantinePath(vpnPath)
+		var existing []vpnNodeQuarantine
+		if data, _, err := openVaultFileIfExists(quarantinePath); err != nil {
+			return err
+		} else if len(bytes.TrimSpace(data)) > 0 {
+			if err := json.Unmarshal(data, &existing); err != nil {
+				return newCoreError(codeConfigInvalid, "vpn node quarantine file is not valid JSON: "+err.Error(), false, map[string]interface{}{"path": quarantinePath})
+			}
+		}
+		encoded, err := json.MarshalIndent(append(existing, list.Quarantined...), "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeVaultFile(quarantinePath, encoded, 0o600); err != nil {
+			return err
+		}
+	}
+	encoded, err := encodeVpnNodes(list.Nodes)
+	if err != nil {
+		return err
+	}
+	return writeVaultFile(vpnPath, encoded, 0o600)
+}
+
+// encodeVpnNodes indents the list like json.MarshalIndent, except that
+// records from a newer schema are copied verbatim rather than reindented.
+func encodeVpnNodes(nodes []vpnNode) ([]byte, error) {
+	if len(nodes) == 0 {
+		return []byte("[]"), nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, node := range nodes {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString("\n  ")
+		if node.raw != nil {
+			buf.Write(node.raw)
+			continue
+		}
+		encoded, err := json.MarshalIndent(node, "  ", "  ")
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(encoded)
+	}
+	buf.WriteString("\n]")
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateVpnNode(t *testing.T) {
+	cases := []struct {
+		name     string
+		record   string
+		migrated bool
+		want     vpnNode
+		err      string
+	}{
+		{
+			name:     "plistName becomes serviceName",
+			record:   `{"name":"jp","countryCode":"jp","configPath":"/c/jp.json","plistName":"xstream.jp"}`,
+			migrated: true,
+			want:     vpnNode{SchemaVersion: 1, Name: "jp", CountryCode: "jp", ConfigPath: "/c/jp.json", ServiceName: "xstream.jp", Enabled: true},
+		},
+		{
+			name:     "serviceName wins over plistName",
+			record:   `{"name":"jp","countryCode":"jp","configPath":"/c/jp.json","serviceName":"svc.jp","plistName":"old.jp","enabled":false}`,
+			migrated: true,
+			want:     vpnNode{SchemaVersion: 1, Name: "jp", CountryCode: "jp", ConfigPath: "/c/jp.json", ServiceName: "svc.jp"},
+		},
+		{
+			name:   "current version",
+			record: `{"schemaVersion":1,"name":"us","countryCode":"us","configPath":"/c/us.json","serviceName":"svc.us","protocol":"vless","enabled":false}`,
+			want:   vpnNode{SchemaVersion: 1, Name: "us", CountryCode: "us", ConfigPath: "/c/us.json", ServiceName: "svc.us", Protocol: "vless"},
+		},
+		{
+			name:   "not an object",
+			record: `["jp"]`,
+			err:    "record is not a JSON object",
+		},
+		{
+			name:   "negative schemaVersion",
+			record: `{"schemaVersion":-1,"name":"jp"}`,
+			err:    "schemaVersion must be a non-negative integer",
+		},
+		{
+			name:   "string schemaVersion",
+			record: `{"schemaVersion":"1","name":"jp"}`,
+			err:    "schemaVersion must be a non-negative integer",
+		},
+		{
+			name:   "missing countryCode",
+			record: `{"schemaVersion":1,"name":"jp","configPath":"/c/jp.json","serviceName":"svc.jp"}`,
+			err:    "countryCode is required",
+		},
+		{
+			name:   "wrong field type",
+			record: `{"schemaVersion":1,"name":7}`,
+			err:    "decode record",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			node, migrated, err := migrateVpnNode(json.RawMessage(tc.record))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("err = %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			node.extra = nil
+			if migrated != tc.migrated || node.raw != nil || !sameVpnNode(node, tc.want) {
+				t.Fatalf("migrate = %+v, %v", node, migrated)
+			}
+		})
+	}
+}
+
+func sameVpnNode(a, b vpnNode) bool {
+	ea, _ := json.Marshal(a)
+	eb, _ := json.Marshal(b)
+	return bytes.Equal(ea, eb)
+}
+
+func TestMigrateVpnNodeKeepsUnknownFields(t *testing.T) {
+	node, _, err := migrateVpnNode(json.RawMessage(`{"name":"jp","countryCode":"jp","configPath":"/c/jp.json","serviceName":"svc.jp","latencyMs":42,"tags":["fast"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(node.extra["latencyMs"]) != "42" || string(node.extra["tags"]) != `["fast"]` {
+		t.Fatalf("extra = %v", node.extra)
+	}
+	encoded, err := json.Marshal(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(encoded, []byte(`"latencyMs":42`)) || !bytes.Contains(encoded, []byte(`"tags":["fast"]`)) || bytes.Contains(encoded, []byte("plistName")) {
+		t.Fatalf("encoded = %s", encoded)
+	}
+
+	// A newer build's record keeps fields this version has never heard of.
+	newer := `{"schemaVersion": 2,  "name":"de", "region": {"city":"Berlin"}}`
+	node, migrated, err := migrateVpnNode(json.RawMessage(newer))
+	if err != nil || migrated || node.Name != "de" {
+		t.Fatalf("migrate = %+v, %v, %v", node, migrated, err)
+	}
+	if encoded, _ := json.Marshal([]vpnNode{node}); !bytes.Contains(encoded, []byte(`"region":{"city":"Berlin"}`)) {
+		t.Fatalf("encoded = %s", encoded)
+	}
+}
+
+func TestParseVpnNodes(t *testing.T) {
+	list, err := parseVpnNodes([]byte("  "))
+	if err != nil || len(list.Nodes) != 0 || list.SchemaVersion != vpnNodeSchemaVersion {
+		t.Fatalf("empty = %+v, %v", list, err)
+	}
+	_, err = parseVpnNodes([]byte(`{"name":"jp"}`))
+	assertCoreErrorCode(t, err, codeConfigInvalid)
+
+	list, err = parseVpnNodes([]byte(`[
+  {"name":"jp","countryCode":"jp","configPath":"/c/jp.json","plistName":"xstream.jp"},
+  {"schemaVersion":1,"name":"us","countryCode":"us","configPath":"/c/us.json","serviceName":"svc.us","enabled":true},
+  {"schemaVersion":3,"name":"de"},
+  "garbage",
+  {"schemaVersion":1,"name":"fr"}
+]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Nodes) != 3 || list.Nodes[0].Name != "jp" || list.Nodes[1].Name != "us" || list.Nodes[2].raw == nil {
+		t.Fatalf("nodes = %+v", list.Nodes)
+	}
+	if list.Migrated != 1 || len(list.Quarantined) != 2 {
+		t.Fatalf("migrated = %d, quarantined = %+v", list.Migrated, list.Quarantined)
+	}
+	if string(list.Quarantined[0].Record) != `"garbage"` || string(list.Quarantined[1].Record) != `{"schemaVersion":1,"name":"fr"}` {
+		t.Fatalf("quarantined records = %s, %s", list.Quarantined[0].Record, list.Quarantined[1].Record)
+	}
+	if !strings.HasSuffix(list.Quarantined[1].Reason, " is required") {
+		t.Fatalf("reason = %q", list.Quarantined[1].Reason)
+	}
+}
+
+func TestLoadVpnNodesRoundTrip(t *testing.T) {
+	setTestDataDir(t)
+	vpnPath := filepath.Join(t.TempDir(), "vpn_nodes.json")
+	newer := `{"schemaVersion": 2, "name": "de",  "region": {"city": "Berlin"}}`
+	if err := os.WriteFile(vpnPath, []byte(`[
+  {"name":"jp","countryCode":"jp","configPath":"/c/jp.json","plistName":"xstream.jp","latencyMs":42},
+  `+newer+`,
+  {"name":"bad"}
+]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := loadVpnNodes(vpnPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Nodes) != 2 || list.Migrated != 1 || len(list.Quarantined) != 1 || list.QuarantinePath != filepath.Join(filepath.Dir(vpnPath), "vpn_nodes.quarantine.json") {
+		t.Fatalf("load = %+v", list)
+	}
+	written := readRaw(t, vpnPath)
+	if !bytes.Contains(written, []byte(newer)) {
+		t.Fatalf("newer record not kept byte for byte:\n%s", written)
+	}
+	var records []map[string]interface{}
+	if err := json.Unmarshal(written, &records); err != nil || len(records) != 2 {
+		t.Fatalf("written = %s, %v", written, err)
+	}
+	jp := records[0]
+	if jp["serviceName"] != "xstream.jp" || jp["enabled"] != true || jp["schemaVersion"] != float64(1) || jp["latencyMs"] != float64(42) || jp["plistName"] != nil {
+		t.Fatalf("migrated record = %v", jp)
+	}
+
+	// The sidecar only ever grows: a second bad record is appended.
+	if err := os.WriteFile(vpnPath, append(bytes.TrimSuffix(written, []byte("\n]")), []byte(`,
+  {"name":"worse","countryCode":7}
+]`)...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if list, err = loadVpnNodes(vpnPath); err != nil || len(list.Nodes) != 2 || len(list.Quarantined) != 1 {
+		t.Fatalf("second load = %+v, %v", list, err)
+	}
+	var sidecar []vpnNodeQuarantine
+	if err := json.Unmarshal(readRaw(t, list.QuarantinePath), &sidecar); err != nil {
+		t.Fatal(err)
+	}
+	if len(sidecar) != 2 || !sameJSON(sidecar[0].Record, []byte(`{"name":"bad"}`)) || !strings.Contains(string(sidecar[1].Record), `"worse"`) {
+		t.Fatalf("sidecar = %+v", sidecar)
+	}
+	for _, q := range sidecar {
+		if q.Reason == "" || q.QuarantinedAt == 0 {
+			t.Fatalf("sidecar entry = %+v", q)
+		}
+	}
+	if !bytes.Contains(readRaw(t, vpnPath), []byte(newer)) {
+		t.Fatal("newer record changed on the second rewrite")
+	}
+}
@@ -75,6 +75,20 @@ typedef InitTrayNative = ffi.Void Function();
 typedef InitTrayDart = void Function();
 typedef GetDesktopRuntimeSnapshotNative = ffi.Pointer<ffi.Char> Function();
 typedef GetDesktopRuntimeSnapshotDart = ffi.Pointer<ffi.Char> Function();
+typedef ReadVaultFileNative =
+    ffi.Pointer<ffi.Char> Function(ffi.Pointer<ffi.Char>);
+typedef ReadVaultFileDart =
+    ffi.Pointer<ffi.Char> Function(ffi.Pointer<ffi.Char>);
+typedef WriteVaultFileNative =
+    ffi.Pointer<ffi.Char> Function(
+      ffi.Pointer<ffi.Char>,
+      ffi.Pointer<ffi.Char>,
+    );
+typedef WriteVaultFileDart =
+    ffi.Pointer<ffi.Char> Function(
+      ffi.Pointer<ffi.Char>,
+      ffi.Pointer<ffi.Char>,
+    );
 
 GetDesktopRuntimeSnapshotDart? _lookupGetDesktopRuntimeSnapshot(
   ffi.DynamicLibrary lib,
@@ -89,6 +103,26 @@ GetDesktopRuntimeSnapshotDart? _lookupGetDesktopRuntimeSnapshot(
   }
 }
 
+ReadVaultFileDart? _lookupReadVaultFile(ffi.DynamicLibrary lib) {
+  try {
+    return lib.lookupFunction<ReadVaultFileNative, ReadVaultFileDart>(
+      'ReadVaultFile',
+    );
+  } catch (_) {
+    return null;
+  }
+}
+
+WriteVaultFileDart? _lookupWriteVaultFile(ffi.DynamicLibrary lib) {
+  try {
+    return lib.lookupFunction<WriteVaultFileNative, WriteVaultFileDart>(
+      'WriteVaultFile',
+    );
+  } catch (_) {
+    return null;
+  }
+}
+
 class BridgeBindings {
   BridgeBindings(ffi.DynamicLibrary lib)
     : startNodeService = lib
@@ -131,7 +165,9 @@ class BridgeBindings {
         DesktopIntegrationCommandDart
       >('DesktopIntegrationCommand'),
       initTray = lib.lookupFunction<InitTrayNative, InitTrayDart>('InitTray'),
-      getDesktopRuntimeSnapshot = _lookupGetDesktopRuntimeSnapshot(lib);
+      getDesktopRuntimeSnapshot = _lookupGetDesktopRuntimeSnapshot(lib),
+      readVaultFile = _lookupReadVaultFile(lib),
+      writeVaultFile = _lookupWriteVaultFile(lib);
 
   final StartNodeServiceDart startNodeService;
   final CreateWindowsServiceDart createWindowsService;
@@ -146,4 +182,6 @@ class BridgeBindings {
   final DesktopIntegrationCommandDart desktopIntegrationCommand;
   final InitTrayDart initTray;
   final GetDesktopRuntimeSnapshotDart? getDesktopRuntimeSnapshot;
+  final ReadVaultFileDart? readVaultFile;
+  final WriteVaultFileDart? writeVaultFile;
 }
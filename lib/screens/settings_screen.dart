@@ -270,6 +270,13 @@ class _SettingsScreenState extends State<SettingsScreen> {
         }
         final out = File(dest);
         await out.create(recursive: true);
+        if (name == 'vpn_nodes.json') {
+          await NativeBridge.writeVaultFile(
+            dest,
+            utf8.decode(entry.content as List<int>),
+          );
+          continue;
+        }
         await out.writeAsBytes(entry.content as List<int>);
       }
       await VpnConfig.load();
@@ -303,7 +310,14 @@ class _SettingsScreenState extends State<SettingsScreen> {
 
       final encoder = ZipFileEncoder();
       encoder.create(backupPath);
-      encoder.addFile(File(configPath), 'vpn_nodes.json');
+      // The backup is restored on other machines, so the node list goes in
+      // as plaintext even when the vault encrypts it locally.
+      final nodesJson = utf8.encode(
+        await NativeBridge.readVaultFile(configPath),
+      );
+      encoder.addArchiveFile(
+        ArchiveFile('vpn_nodes.json', nodesJson.length, nodesJson),
+      );
       for (final node in VpnConfig.nodes) {
         final cfg = File(node.configPath);
         if (await cfg.exists()) {
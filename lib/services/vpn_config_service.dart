@@ -158,7 +158,7 @@ class VpnConfig {
       final path = await GlobalApplicationConfig.getLocalConfigPath();
       final file = File(path);
       if (await file.exists()) {
-        final jsonStr = await file.readAsString();
+        final jsonStr = await NativeBridge.readVaultFile(path);
         final List<dynamic> jsonList = json.decode(jsonStr);
         fromLocal = jsonList.map((e) => VpnNode.fromJson(e)).toList();
       }
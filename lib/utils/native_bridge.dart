@@ -217,6 +217,83 @@ class NativeBridge {
     throw UnsupportedError('Unsupported platform');
   }
 
+  /// Reads a file the Go vault may have encrypted, such as vpn_nodes.json.
+  /// Plaintext files are read directly.
+  static Future<String> readVaultFile(String path) async {
+    if (!await isVaultSealed(path)) {
+      return File(path).readAsString();
+    }
+    final read = _useFfi ? _ffi.readVaultFile : null;
+    if (read == null) {
+      throw FileSystemException('encrypted file needs ReadVaultFile', path);
+    }
+    final pathPtr = path.toNativeUtf8();
+    try {
+      final resPtr = read(pathPtr.cast());
+      final raw = resPtr.cast<Utf8>().toDartString();
+      _ffi.freeCString(resPtr);
+      final response = jsonDecode(raw) as Map<String, dynamic>;
+      if (response['ok'] == true && response['data'] is String) {
+        return response['data'] as String;
+      }
+      final error = response['error'];
+      final message = error is Map ? error['message'] : null;
+      throw FileSystemException(
+        (message as String?) ?? 'failed to open encrypted file',
+        path,
+      );
+    } finally {
+      malloc.free(pathPtr);
+    }
+  }
+
+  /// Writes [content] to [path] through the Go core, which encrypts it when
+  /// the vault is enabled. Without the export the file is written in
+  /// plaintext, unless it is already encrypted.
+  static Future<void> writeVaultFile(String path, String content) async {
+    final write = _useFfi ? _ffi.writeVaultFile : null;
+    if (write == null) {
+      if (await isVaultSealed(path)) {
+        throw FileSystemException('encrypted file needs WriteVaultFile', path);
+      }
+      await File(path).writeAsString(content);
+      return;
+    }
+    final pathPtr = path.toNativeUtf8();
+    final contentPtr = content.toNativeUtf8();
+    try {
+      final resPtr = write(pathPtr.cast(), contentPtr.cast());
+      final raw = resPtr.cast<Utf8>().toDartString();
+      _ffi.freeCString(resPtr);
+      final response = jsonDecode(raw) as Map<String, dynamic>;
+      if (response['ok'] != true) {
+        final error = response['error'];
+        final message = error is Map ? error['message'] : null;
+        throw FileSystemException(
+          (message as String?) ?? 'failed to write encrypted file',
+          path,
+        );
+      }
+    } finally {
+      malloc.free(pathPtr);
+      malloc.free(contentPtr);
+    }
+  }
+
+  /// Whether [path] starts with the vault's "XSV1" magic.
+  static Future<bool> isVaultSealed(String path) async {
+    RandomAccessFile? file;
+    try {
+      file = await File(path).open();
+      final head = await file.read(4);
+      return ascii.decode(head, allowInvalid: true) == 'XSV1';
+    } on FileSystemException {
+      return false;
+    } finally {
+      await file?.close();
+    }
+  }
+
   static Future<String> writeConfigFiles({
     required String xrayConfigPath,
     required String xrayConfigContent,
@@ -233,7 +310,7 @@ class NativeBridge {
         await File(vpnNodesConfigPath).parent.create(recursive: true);
         await File(xrayConfigPath).writeAsString(xrayConfigContent);
         await File(servicePath).writeAsString(serviceContent);
-        await File(vpnNodesConfigPath).writeAsString(vpnNodesConfigContent);
+        await writeVaultFile(vpnNodesConfigPath, vpnNodesConfigContent);
         return 'success';
       } catch (e) {
         return '写入失败: $e';
@@ -823,9 +900,6 @@ class NativeBridge {
   }
 
   static Future<DesktopRuntimeSnapshot> getDesktopRuntimeSnapshot() async {
-    if (!(Platform.isWindows || Platform.isLinux)) {
-      return _desktopRuntimeSnapshotFallback;
-    }
     if (!_useFfi) {
       return _desktopRuntimeSnapshotFallback;
     }